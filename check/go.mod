@@ -0,0 +1,10 @@
+module github.com/nmoutschen/gossip/check
+
+go 1.13
+
+replace github.com/nmoutschen/gossip/gossip => ../gossip
+
+require (
+	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/nmoutschen/gossip/gossip v0.0.0-00010101000000-000000000000
+)
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/nmoutschen/gossip/gossip"
+)
+
+/*check polls all nodes known to a controller until interrupted, then prints a
+convergence report.
+*/
+func main() {
+	config := getConfig()
+	ctrlAddr := gossip.Addr{IP: config.Controller.IP, Port: config.Controller.Port}
+	checker := gossip.NewChecker(gossip.ControllerNodes(ctrlAddr, config), config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	log.Printf("Polling nodes known to controller %s, press Ctrl+C to stop", ctrlAddr)
+	checker.Run(ctx)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(checker.Report())
+}
+
+func getConfig() *gossip.Config {
+	config := new(gossip.Config)
+
+	err := envconfig.Process("gossip", config)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return config
+}
@@ -1,11 +1,16 @@
 package gossip
 
 import (
-	"fmt"
+	"errors"
+	"net"
+	"strconv"
 )
 
 /*Addr stores the address of a node, which is also a uniquely identifiable
 representation of that node.
+
+IP can also be a hostname, which is resolved every time a connection to the
+node is opened.
 */
 type Addr struct {
 	IP   string `json:"ip"`
@@ -14,5 +19,32 @@ type Addr struct {
 
 //String returns a string representation of the address
 func (a Addr) String() string {
-	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+	return net.JoinHostPort(a.IP, strconv.Itoa(a.Port))
+}
+
+//ParseAddr parses an address in the 'ip:port' format
+func ParseAddr(s string) (Addr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return Addr{}, err
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum <= 0 || portNum > 65535 {
+		return Addr{}, errors.New("Invalid port in address " + s)
+	}
+	return Addr{IP: host, Port: portNum}, nil
+}
+
+//parseAddrs parses a list of addresses in the 'ip:port' format
+func parseAddrs(list []string) ([]Addr, error) {
+	addrs := make([]Addr, 0, len(list))
+	for _, s := range list {
+		addr, err := ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
 }
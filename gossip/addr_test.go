@@ -0,0 +1,49 @@
+package gossip
+
+import (
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	testCases := []struct {
+		Input    string
+		Expected Addr
+		Error    bool
+	}{
+		{"127.0.0.1:8080", Addr{"127.0.0.1", 8080}, false},
+		{"node0:8080", Addr{"node0", 8080}, false},
+		{"[::1]:8080", Addr{"::1", 8080}, false},
+		{":8080", Addr{"", 8080}, false},
+		{"127.0.0.1", Addr{}, true},
+		{"127.0.0.1:http", Addr{}, true},
+		{"127.0.0.1:0", Addr{}, true},
+		{"127.0.0.1:65536", Addr{}, true},
+	}
+
+	for _, testCase := range testCases {
+		addr, err := ParseAddr(testCase.Input)
+		if (err != nil) != testCase.Error {
+			t.Errorf("ParseAddr(%q) returned error %v; want error %t", testCase.Input, err, testCase.Error)
+		}
+		if addr != testCase.Expected {
+			t.Errorf("ParseAddr(%q) == %v; want %v", testCase.Input, addr, testCase.Expected)
+		}
+	}
+}
+
+func TestAddrString(t *testing.T) {
+	testCases := []struct {
+		Addr     Addr
+		Expected string
+	}{
+		{Addr{"127.0.0.1", 8080}, "127.0.0.1:8080"},
+		{Addr{"::1", 8080}, "[::1]:8080"},
+		{Addr{"node-1.local", 8080}, "node-1.local:8080"},
+	}
+
+	for _, testCase := range testCases {
+		if s := testCase.Addr.String(); s != testCase.Expected {
+			t.Errorf("%#v.String() == %q; want %q", testCase.Addr, s, testCase.Expected)
+		}
+	}
+}
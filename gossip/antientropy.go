@@ -0,0 +1,172 @@
+package gossip
+
+import (
+	"context"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*AntiEntropy runs an anti-entropy session with up to
+n.config.Node.AntiEntropyPartners peers chosen randomly, and returns once all
+sessions are finished. Unreachable peers are skipped.
+
+This repairs states that were missed by the node or its peers, for example
+after a network partition, without waiting for newer states of the same keys.
+*/
+func (n *Node) AntiEntropy(ctx context.Context) {
+	if n.Draining() {
+		return
+	}
+
+	var peers []*Peer
+	for _, peer := range n.PeerList() {
+		if !peer.IsUnreachable() {
+			peers = append(peers, peer)
+		}
+	}
+	n.config.shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > n.config.Node.AntiEntropyPartners {
+		peers = peers[:n.config.Node.AntiEntropyPartners]
+	}
+
+	tasks := n.config.newTaskGroup()
+	for _, peer := range peers {
+		peer := peer
+		tasks.Go(func() {
+			pushed, pulled := n.syncPeer(ctx, peer)
+			log.WithFields(log.Fields{"node": n, "peer": peer, "func": "AntiEntropy"}).Infof("Pushed %d states and pulled %d states", pushed, pulled)
+		})
+	}
+	tasks.Wait()
+}
+
+/*antiEntropyWorker runs anti-entropy sessions at regular interval.
+ */
+func (n *Node) antiEntropyWorker() {
+	for n.config.sleep(n.ctx, n.config.Node.AntiEntropyInterval) {
+		n.AntiEntropy(n.ctx)
+	}
+}
+
+/*diffLeaves walks down the Merkle trees of the node and a peer, only following
+the branches that differ, and returns the leaves that differ.
+
+This takes one round trip per level of the tree, or a single one if both trees
+are the same.
+*/
+func (n *Node) diffLeaves(ctx context.Context, peer *Peer) ([]int, error) {
+	nodes := []int{0}
+	for level := 0; ; level++ {
+		res, err := peer.GetTree(ctx, TreeRequest{Level: level, Nodes: nodes})
+		if err != nil {
+			return nil, err
+		}
+		local, err := n.tree.Hashes(level, nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		var differing []int
+		for i, node := range nodes {
+			if res.Hashes[i] != local[i] {
+				differing = append(differing, node)
+			}
+		}
+		if level == merkleDepth || len(differing) == 0 {
+			return differing, nil
+		}
+		nodes = merkleChildren(differing)
+	}
+}
+
+//leafStatus returns the status of the keys of the node in the given leaves of its Merkle tree
+func (n *Node) leafStatus(leaves []int) (map[string]KeyStatus, error) {
+	keys, err := n.tree.Keys(leaves)
+	if err != nil {
+		return nil, err
+	}
+
+	status := make(map[string]KeyStatus, len(keys))
+	for _, key := range keys {
+		if state, ok := n.GetState(key); ok {
+			status[key] = n.keyStatus(state)
+		}
+	}
+	return status, nil
+}
+
+/*syncPeer runs an anti-entropy session with a peer, and returns the number of
+states pushed to and pulled from the peer.
+
+The node walks down the Merkle trees of both nodes to find the leaves that
+differ, then retrieves the status of the keys of the peer in those leaves. The
+node then pulls the states that are newer on the peer and pushes the states
+that are newer locally or missing on the peer. If both states have the same
+timestamp but different data, the state is both pulled and pushed, so that the
+Resolver of each node repairs the divergence.
+
+Once the data of the states pushed and pulled reaches
+n.config.Node.AntiEntropyMaxBytes, the remaining keys are left for the next
+session.
+*/
+func (n *Node) syncPeer(ctx context.Context, peer *Peer) (int, int) {
+	leaves, err := n.diffLeaves(ctx, peer)
+	if err != nil || len(leaves) == 0 {
+		return 0, 0
+	}
+	res, err := peer.Sync(ctx, leaves)
+	if err != nil {
+		return 0, 0
+	}
+	local, err := n.leafStatus(leaves)
+	if err != nil {
+		return 0, 0
+	}
+
+	var keys []string
+	for key := range local {
+		keys = append(keys, key)
+	}
+	for key := range res.Keys {
+		if _, ok := local[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pushed, pulled, size := 0, 0, 0
+	maxBytes := n.config.Node.AntiEntropyMaxBytes
+	for _, key := range keys {
+		if ctx.Err() != nil || (maxBytes > 0 && size >= maxBytes) {
+			break
+		}
+
+		remote, onPeer := res.Keys[key]
+		if onPeer && n.needsFetch(key, remote) {
+			if state, err := n.fetchState(ctx, peer, key, remote); err == nil {
+				size += len(state.Data)
+				state.Hops++
+				if n.stateInbox.sendState(ctx, n.stateChan, state) {
+					pulled++
+				}
+			}
+		}
+
+		state, ok := n.GetState(key)
+		if !ok {
+			continue
+		}
+		if !onPeer || state.Timestamp.After(remote.Timestamp) || (state.Timestamp == remote.Timestamp && state.Digest != remote.Digest) {
+			//The peer receives the state one hop further from its writer
+			state.Hops++
+			if n.sendState(ctx, peer, state) {
+				size += len(state.Data)
+				pushed++
+			}
+		}
+	}
+	return pushed, pulled
+}
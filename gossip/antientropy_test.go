@@ -0,0 +1,123 @@
+package gossip
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNodeSyncPeer(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.AntiEntropyInterval = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewNode(&config)
+	b := NewNode(&config)
+	a.StartWorkers(ctx)
+	b.StartWorkers(ctx)
+	testServer := httptest.NewServer(b.Handler())
+	defer testServer.Close()
+	peer := NewPeer(parseURL(testServer.URL), &config)
+
+	a.UpdateState(State{Key: "shared", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncPeer"})
+	b.UpdateState(State{Key: "shared", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncPeer"})
+	a.UpdateState(State{Key: "a", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncPeer"})
+	b.UpdateState(State{Key: "b", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncPeer"})
+	a.UpdateState(State{Key: "newer-on-a", Timestamp: Timestamp{Physical: 2}, Data: "TestNodeSyncPeer"})
+	b.UpdateState(State{Key: "newer-on-a", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncPeer"})
+	a.UpdateState(State{Key: "newer-on-b", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncPeer"})
+	b.UpdateState(State{Key: "newer-on-b", Timestamp: Timestamp{Physical: 2}, Data: "TestNodeSyncPeer"})
+
+	if pushed, pulled := a.syncPeer(ctx, peer); pushed != 2 || pulled != 2 {
+		t.Errorf("a.syncPeer() == %d, %d; want %d, %d", pushed, pulled, 2, 2)
+	}
+	a.flush(ctx)
+	if leaves, err := a.diffLeaves(ctx, peer); err != nil || len(leaves) != 0 {
+		t.Errorf("a.diffLeaves() == %v, %v after a session; want no leaves", leaves, err)
+	}
+
+	//Nodes holding the same states have nothing to exchange
+	if pushed, pulled := a.syncPeer(ctx, peer); pushed != 0 || pulled != 0 {
+		t.Errorf("a.syncPeer() == %d, %d with the same states; want %d, %d", pushed, pulled, 0, 0)
+	}
+}
+
+func TestNodeSyncPeerMaxBytes(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.AntiEntropyInterval = 0
+	config.Node.AntiEntropyMaxBytes = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewNode(&config)
+	b := NewNode(&config)
+	a.StartWorkers(ctx)
+	b.StartWorkers(ctx)
+	testServer := httptest.NewServer(b.Handler())
+	defer testServer.Close()
+	peer := NewPeer(parseURL(testServer.URL), &config)
+
+	a.UpdateState(State{Key: "a", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncPeerMaxBytes"})
+	a.UpdateState(State{Key: "b", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncPeerMaxBytes"})
+
+	//The session stops once the cap is reached, and the next one resumes
+	for i := 0; i < 2; i++ {
+		if pushed, pulled := a.syncPeer(ctx, peer); pushed != 1 || pulled != 0 {
+			t.Errorf("a.syncPeer() == %d, %d in session %d; want %d, %d", pushed, pulled, i, 1, 0)
+		}
+	}
+	if leaves, err := a.diffLeaves(ctx, peer); err != nil || len(leaves) != 0 {
+		t.Errorf("a.diffLeaves() == %v, %v after two sessions; want no leaves", leaves, err)
+	}
+}
+
+func TestNodeSyncPeerLargeKeyspace(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.AntiEntropyInterval = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewNode(&config)
+	b := NewNode(&config)
+	a.StartWorkers(ctx)
+	b.StartWorkers(ctx)
+	var requests int32
+	handler := b.Handler()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler.ServeHTTP(w, r)
+	}))
+	defer testServer.Close()
+	peer := NewPeer(parseURL(testServer.URL), &config)
+
+	for i := 0; i < 10000; i++ {
+		state := State{Key: fmt.Sprintf("key-%d", i), Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncPeerLargeKeyspace"}
+		a.UpdateState(state)
+		b.UpdateState(state)
+	}
+	for i := 0; i < 3; i++ {
+		b.UpdateState(State{Key: fmt.Sprintf("key-%d", i*1000), Timestamp: Timestamp{Physical: 2}, Data: "TestNodeSyncPeerLargeKeyspace"})
+	}
+
+	//Only the branches leading to the three keys are walked down
+	leaves, err := a.diffLeaves(ctx, peer)
+	if err != nil || len(leaves) != 3 {
+		t.Fatalf("a.diffLeaves() == %v, %v; want 3 leaves", leaves, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != merkleDepth+1 {
+		t.Errorf("a.diffLeaves() sent %d requests; want %d", n, merkleDepth+1)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	if pushed, pulled := a.syncPeer(ctx, peer); pushed != 0 || pulled != 3 {
+		t.Errorf("a.syncPeer() == %d, %d; want %d, %d", pushed, pulled, 0, 3)
+	}
+	//Walking down the tree, retrieving the status of the keys, and pulling the 3 states
+	if n := atomic.LoadInt32(&requests); n != merkleDepth+1+1+3 {
+		t.Errorf("a.syncPeer() sent %d requests; want %d", n, merkleDepth+1+1+3)
+	}
+}
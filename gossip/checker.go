@@ -0,0 +1,371 @@
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//NodeLister returns the addresses of the nodes of a cluster
+type NodeLister func(ctx context.Context) ([]Addr, error)
+
+//StaticNodes returns a NodeLister for a fixed list of nodes
+func StaticNodes(addrs ...Addr) NodeLister {
+	return func(ctx context.Context) ([]Addr, error) {
+		return addrs, nil
+	}
+}
+
+/*ControllerNodes returns a NodeLister retrieving the nodes known to a
+controller through its '/peers' endpoint.
+*/
+func ControllerNodes(addr Addr, config *Config) NodeLister {
+	if config == nil {
+		config = DefaultConfig
+	}
+
+	client, clientErr := config.HTTPClient()
+	return func(ctx context.Context) ([]Addr, error) {
+		if clientErr != nil {
+			return nil, clientErr
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/peers", config.Protocol, addr), nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer closeBody(res)
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.New("Controller responded with status " + res.Status)
+		}
+
+		cpr := CtrlPeersResponse{}
+		if err := json.NewDecoder(res.Body).Decode(&cpr); err != nil {
+			return nil, err
+		}
+		addrs := make([]Addr, 0, len(cpr.Nodes))
+		for _, node := range cpr.Nodes {
+			addrs = append(addrs, node.Addr)
+		}
+		return addrs, nil
+	}
+}
+
+/*Checker measures how long states take to reach all nodes of a cluster.
+
+The checker regularly polls the '/status' endpoint of all nodes. Every state
+reported by a node is tracked as a write, starting at the physical time of its
+timestamp. A write converges once all nodes that responded to a poll report
+its timestamp, or a newer one for the same key.
+
+As writes are only discovered through polls, the precision of the
+measurements is bounded by the interval between polls.
+*/
+type Checker struct {
+	//Nodes lists the nodes to poll
+	Nodes NodeLister
+
+	//writes is the list of writes, in the order they were discovered
+	writes []*writeRecord
+	//keys maps keys to their writes
+	keys map[string][]*writeRecord
+	//latest is the latest timestamp reported by each node for each key
+	latest map[Addr]map[string]Timestamp
+	//responded is the list of nodes that responded to the last poll
+	responded []Addr
+	//regressions is the list of nodes that reported an older state than before
+	regressions []Regression
+	//mu protects access to the records
+	mu sync.Mutex
+
+	//config stores the configuration parameters
+	config *Config
+}
+
+//writeRecord tracks the propagation of a single write
+type writeRecord struct {
+	//key is the key of the state
+	key string
+	//timestamp is the timestamp of the state
+	timestamp Timestamp
+	//written is the time the state was written
+	written time.Time
+	//reached is the time and number of hops when each node first reported the state
+	reached map[Addr]reach
+	//converged is the time the state reached all nodes, or zero
+	converged time.Time
+}
+
+//reach is the time and number of hops when a node first reported a state
+type reach struct {
+	//time is the time of the poll
+	time time.Time
+	//hops is the number of hops, or -1 if the node reported a newer state
+	hops int
+}
+
+//Regression is a node reporting an older state for a key than in a previous poll
+type Regression struct {
+	Addr Addr      `json:"addr"`
+	Key  string    `json:"key"`
+	From Timestamp `json:"from"`
+	To   Timestamp `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+//WriteReport summarizes the propagation of a single write
+type WriteReport struct {
+	Key       string    `json:"key"`
+	Timestamp Timestamp `json:"time"`
+	Written   time.Time `json:"written"`
+	//Converged is true if the write reached all nodes
+	Converged bool `json:"converged"`
+	//Duration is the time for the write to reach all nodes, if it converged
+	Duration time.Duration `json:"duration"`
+	//Reached is the number of nodes that reported the write
+	Reached int `json:"reached"`
+	//MaxHops is the highest number of hops reported for the write
+	MaxHops int `json:"maxHops"`
+	//Unreached are the nodes that responded to the last poll without reporting the write
+	Unreached []Addr `json:"unreached"`
+}
+
+/*ConvergenceReport summarizes the propagation of all writes seen by a
+Checker.
+
+Percentiles are computed over writes that converged.
+*/
+type ConvergenceReport struct {
+	Writes    []WriteReport `json:"writes"`
+	Converged int           `json:"converged"`
+	P50       time.Duration `json:"p50"`
+	P99       time.Duration `json:"p99"`
+	//Unreached are the nodes that did not report at least one write
+	Unreached   []Addr       `json:"unreached"`
+	Regressions []Regression `json:"regressions"`
+}
+
+//NewChecker creates a new Checker polling the given nodes
+func NewChecker(nodes NodeLister, config *Config) *Checker {
+	if config == nil {
+		config = DefaultConfig
+	}
+
+	//All nodes are polled with the same HTTP client
+	if transportConfig, err := config.withTransport(); err == nil {
+		config = transportConfig
+	} else {
+		log.WithFields(log.Fields{"func": "NewChecker"}).Errorf("Failed to configure TLS: %s", err.Error())
+	}
+
+	return &Checker{
+		Nodes: nodes,
+
+		keys:   make(map[string][]*writeRecord),
+		latest: make(map[Addr]map[string]Timestamp),
+
+		config: config,
+	}
+}
+
+//Poll retrieves the status of all nodes and updates the records
+func (c *Checker) Poll(ctx context.Context) error {
+	addrs, err := c.Nodes(ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"func": "Poll"}).Warnf("Failed to list nodes: %s", err.Error())
+		return err
+	}
+
+	//Retrieve the status of all nodes
+	statuses := make(map[Addr]StatusResponse)
+	statusesMu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr Addr) {
+			defer wg.Done()
+			status, err := c.config.transport().GetStatus(ctx, addr)
+			if err != nil {
+				log.WithFields(log.Fields{"func": "Poll", "addr": addr}).Infof("Failed to retrieve status: %s", err.Error())
+				return
+			}
+			statusesMu.Lock()
+			statuses[addr] = status
+			statusesMu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	c.record(c.config.clock().Now(), statuses)
+	return nil
+}
+
+//Report returns a report on all writes seen so far
+func (c *Checker) Report() ConvergenceReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	report := ConvergenceReport{
+		Writes:      []WriteReport{},
+		Unreached:   []Addr{},
+		Regressions: append([]Regression{}, c.regressions...),
+	}
+	var durations []time.Duration
+	unreached := make(map[Addr]bool)
+	for _, w := range c.writes {
+		wr := WriteReport{
+			Key:       w.key,
+			Timestamp: w.timestamp,
+			Written:   w.written,
+			Converged: !w.converged.IsZero(),
+			Reached:   len(w.reached),
+			Unreached: []Addr{},
+		}
+		if wr.Converged {
+			wr.Duration = w.converged.Sub(w.written)
+			durations = append(durations, wr.Duration)
+		}
+		for _, r := range w.reached {
+			if r.hops > wr.MaxHops {
+				wr.MaxHops = r.hops
+			}
+		}
+		for _, addr := range c.responded {
+			if _, ok := w.reached[addr]; !ok {
+				wr.Unreached = append(wr.Unreached, addr)
+				unreached[addr] = true
+			}
+		}
+		report.Writes = append(report.Writes, wr)
+	}
+
+	report.Converged = len(durations)
+	report.P50 = percentile(durations, 0.5)
+	report.P99 = percentile(durations, 0.99)
+	for addr := range unreached {
+		report.Unreached = append(report.Unreached, addr)
+	}
+	sort.Slice(report.Unreached, func(i, j int) bool {
+		return report.Unreached[i].String() < report.Unreached[j].String()
+	})
+
+	return report
+}
+
+//Run polls all nodes at regular interval until the context is cancelled
+func (c *Checker) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.config.clock().After(c.config.Checker.Interval):
+			c.Poll(ctx)
+		}
+	}
+}
+
+//record updates the records with the statuses retrieved during a poll
+func (c *Checker) record(now time.Time, statuses map[Addr]StatusResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.responded = c.responded[:0]
+	for addr, status := range statuses {
+		c.responded = append(c.responded, addr)
+
+		latest, ok := c.latest[addr]
+		if !ok {
+			latest = make(map[string]Timestamp)
+			c.latest[addr] = latest
+		}
+
+		for key, ks := range status.Keys {
+			//Detect nodes going back to an older state
+			if prev, ok := latest[key]; ok && ks.Timestamp.Before(prev) {
+				log.WithFields(log.Fields{"func": "record", "addr": addr, "key": key}).Warnf("Node regressed from %v to %v", prev, ks.Timestamp)
+				c.regressions = append(c.regressions, Regression{addr, key, prev, ks.Timestamp, now})
+			}
+			latest[key] = ks.Timestamp
+
+			//Track new writes
+			found := false
+			for _, w := range c.keys[key] {
+				if w.timestamp == ks.Timestamp {
+					found = true
+					break
+				}
+			}
+			if !found {
+				w := &writeRecord{
+					key:       key,
+					timestamp: ks.Timestamp,
+					written:   time.Unix(0, ks.Timestamp.Physical),
+					reached:   make(map[Addr]reach),
+				}
+				c.writes = append(c.writes, w)
+				c.keys[key] = append(c.keys[key], w)
+			}
+
+			//The node reached this write and all older writes for the key
+			for _, w := range c.keys[key] {
+				if _, ok := w.reached[addr]; ok || w.timestamp.After(ks.Timestamp) {
+					continue
+				}
+				r := reach{now, -1}
+				if w.timestamp == ks.Timestamp {
+					r.hops = ks.Hops
+				}
+				w.reached[addr] = r
+			}
+		}
+	}
+
+	//Check which writes reached all nodes
+	if len(c.responded) == 0 {
+		return
+	}
+	for _, w := range c.writes {
+		if !w.converged.IsZero() {
+			continue
+		}
+		converged := true
+		for _, addr := range c.responded {
+			if _, ok := w.reached[addr]; !ok {
+				converged = false
+				break
+			}
+		}
+		if converged {
+			w.converged = now
+		}
+	}
+}
+
+//percentile returns the nearest-rank percentile of a list of durations
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,130 @@
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//statusTransport is a Transport returning a different status for each address
+type statusTransport struct {
+	stubTransport
+	statuses map[Addr]StatusResponse
+	mu       sync.Mutex
+}
+
+func (t *statusTransport) GetStatus(ctx context.Context, addr Addr) (StatusResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	status, ok := t.statuses[addr]
+	if !ok {
+		return status, ErrMessageDropped
+	}
+	return status, nil
+}
+
+func (t *statusTransport) set(addr Addr, key string, ks KeyStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.statuses[addr] = StatusResponse{Keys: map[string]KeyStatus{key: ks}}
+}
+
+func TestChecker(t *testing.T) {
+	a, b, c := Addr{"127.0.0.1", 8080}, Addr{"127.0.0.1", 8081}, Addr{"127.0.0.1", 8082}
+	written := time.Now().Add(-time.Second)
+	t1 := Timestamp{Physical: written.UnixNano()}
+	t2 := Timestamp{Physical: written.Add(time.Millisecond).UnixNano()}
+
+	transport := &statusTransport{statuses: make(map[Addr]StatusResponse)}
+	config := *DefaultConfig
+	config.Transport = transport
+	checker := NewChecker(StaticNodes(a, b, c), &config)
+	ctx := context.Background()
+
+	//c is unreachable and b does not know the key yet
+	transport.set(a, "key", KeyStatus{Timestamp: t1})
+	transport.statuses[b] = StatusResponse{}
+	checker.Poll(ctx)
+	report := checker.Report()
+	if len(report.Writes) != 1 || report.Converged != 0 {
+		t.Fatalf("report == %+v; want 1 write that did not converge", report)
+	}
+	if len(report.Unreached) != 1 || report.Unreached[0] != b {
+		t.Errorf("report.Unreached == %v; want [%v]", report.Unreached, b)
+	}
+
+	//b reaches a newer write, which also counts for the first one
+	transport.set(b, "key", KeyStatus{Timestamp: t2, Hops: 2})
+	checker.Poll(ctx)
+	report = checker.Report()
+	if len(report.Writes) != 2 || report.Converged != 1 {
+		t.Fatalf("report == %+v; want 2 writes with 1 converged", report)
+	}
+	if !report.Writes[0].Converged || report.Writes[0].Duration < time.Second {
+		t.Errorf("report.Writes[0] == %+v; want converged after at least 1s", report.Writes[0])
+	}
+	if report.Writes[1].MaxHops != 2 {
+		t.Errorf("report.Writes[1].MaxHops == %d; want 2", report.Writes[1].MaxHops)
+	}
+	if len(report.Unreached) != 1 || report.Unreached[0] != a {
+		t.Errorf("report.Unreached == %v; want [%v]", report.Unreached, a)
+	}
+
+	//b goes back to the first write
+	transport.set(b, "key", KeyStatus{Timestamp: t1})
+	checker.Poll(ctx)
+	report = checker.Report()
+	if len(report.Regressions) != 1 || report.Regressions[0].Addr != b || report.Regressions[0].From != t2 {
+		t.Errorf("report.Regressions == %+v; want 1 regression for %v", report.Regressions, b)
+	}
+}
+
+func TestControllerNodes(t *testing.T) {
+	addrs := []Addr{{"127.0.0.1", 8080}, {"127.0.0.1", 8081}}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/peers" {
+			t.Errorf("r.URL.Path == %s; want /peers", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(CtrlPeersResponse{Nodes: []CtrlPeerResponse{
+			{Addr: addrs[0], Peers: []Addr{addrs[1]}},
+			{Addr: addrs[1], Peers: []Addr{addrs[0]}},
+		}})
+	}))
+	defer testServer.Close()
+
+	nodes, err := ControllerNodes(parseURL(testServer.URL), nil)(context.Background())
+	if err != nil {
+		t.Fatalf("ControllerNodes() returned an error: %s", err.Error())
+	}
+	if len(nodes) != 2 || nodes[0] != addrs[0] || nodes[1] != addrs[1] {
+		t.Errorf("nodes == %v; want %v", nodes, addrs)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	durations := []time.Duration{5, 1, 4, 2, 3, 6, 7, 8, 9, 10}
+
+	testCases := []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{0.5, 5},
+		{0.99, 10},
+		{0, 1},
+	}
+
+	for i, tc := range testCases {
+		if d := percentile(durations, tc.p); d != tc.expected {
+			t.Errorf("[%d] percentile(%v) == %v; want %v", i, tc.p, d, tc.expected)
+		}
+	}
+	if d := percentile(nil, 0.5); d != 0 {
+		t.Errorf("percentile(nil) == %v; want 0", d)
+	}
+}
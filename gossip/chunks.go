@@ -0,0 +1,262 @@
+package gossip
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//chunkList is the list of chunk digests of the data of a state
+type chunkList struct {
+	//digest is the digest of the data of the state
+	digest string
+	//hashes are the hex-encoded SHA-256 digests of the chunks
+	hashes []string
+}
+
+//partialChunks are the chunks downloaded while fetching the state of a key
+type partialChunks struct {
+	//chunks are the chunks downloaded, by digest
+	chunks map[string]string
+	//size is the number of bytes of chunks
+	size int
+	//updated is the last time a chunk was downloaded
+	updated time.Time
+}
+
+//chunkHash returns the hex-encoded SHA-256 digest of a chunk
+func chunkHash(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:])
+}
+
+/*splitChunks splits data in chunks of size bytes, the last chunk being
+shorter. If size is 0, the data is returned as a single chunk.
+
+Chunks are split on bytes, not on characters: a chunk is not necessarily a
+valid UTF-8 string.
+*/
+func splitChunks(data string, size int) []string {
+	if size <= 0 || len(data) <= size {
+		return []string{data}
+	}
+
+	chunks := make([]string, 0, (len(data)+size-1)/size)
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	return append(chunks, data)
+}
+
+/*chunked returns true if the data of a state is larger than
+n.config.Node.ChunkSize, in which case it is transferred in chunks.
+*/
+func (n *Node) chunked(state State) bool {
+	return n.config.Node.ChunkSize > 0 && len(state.Data) > n.config.Node.ChunkSize
+}
+
+/*chunkHashes returns the digests of the chunks of the data of a state, or nil
+if the state is not chunked.
+
+Digests are cached for the latest state of each key, as they are advertised in
+every status.
+*/
+func (n *Node) chunkHashes(state State) []string {
+	if !n.chunked(state) {
+		return nil
+	}
+	if value, ok := n.chunkCache.Load(state.Key); ok {
+		if list, ok := value.(chunkList); ok && list.digest == state.Digest {
+			return list.hashes
+		}
+	}
+
+	chunks := splitChunks(state.Data, n.config.Node.ChunkSize)
+	hashes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		hashes[i] = chunkHash([]byte(chunk))
+	}
+	n.chunkCache.Store(state.Key, chunkList{state.Digest, hashes})
+	return hashes
+}
+
+//keyStatus returns the status of a state, as advertised to peers
+func (n *Node) keyStatus(state State) KeyStatus {
+	return KeyStatus{
+		Timestamp: state.Timestamp,
+		Digest:    state.Digest,
+		Hops:      state.Hops,
+		Chunks:    n.chunkHashes(state),
+	}
+}
+
+/*fetchState retrieves the latest state for a key from a peer, as advertised in
+status.
+
+If the state is split in chunks, this only downloads the chunks that are not
+part of the current state of the key, or of previous attempts to fetch it. If
+a chunk cannot be retrieved, the chunks already downloaded are kept so that
+the next attempt resumes from there.
+*/
+func (n *Node) fetchState(ctx context.Context, peer *Peer, key string, status KeyStatus) (State, error) {
+	if len(status.Chunks) == 0 {
+		return peer.Get(ctx, key)
+	}
+
+	state, err := peer.GetMetadata(ctx, key)
+	if err != nil {
+		return State{}, err
+	}
+	//The peer applied another state since advertising this one
+	if state.Digest != status.Digest {
+		log.WithFields(log.Fields{"node": n, "peer": peer, "key": key, "func": "fetchState"}).Info("State changed since it was advertised")
+		return peer.Get(ctx, key)
+	}
+
+	available := n.availableChunks(key)
+	data := make([]string, len(status.Chunks))
+	fetched := 0
+	for i, hash := range status.Chunks {
+		if chunk, ok := available[hash]; ok {
+			data[i] = chunk
+			continue
+		}
+
+		chunk, err := peer.GetChunk(ctx, key, status.Digest, i, hash)
+		if err != nil {
+			return State{}, err
+		}
+		n.savePartialChunk(key, hash, string(chunk))
+		available[hash] = string(chunk)
+		data[i] = string(chunk)
+		fetched++
+	}
+	log.WithFields(log.Fields{"node": n, "peer": peer, "key": key, "func": "fetchState"}).Infof("Fetched %d/%d chunks", fetched, len(status.Chunks))
+
+	state.Data = strings.Join(data, "")
+	n.clearPartialChunks(key)
+	if !state.VerifyDigest() {
+		return State{}, errors.New("Assembled state with an invalid digest")
+	}
+	return state, nil
+}
+
+/*availableChunks returns the chunks of the current state of a key and the
+chunks downloaded by previous attempts to fetch it, by digest.
+*/
+func (n *Node) availableChunks(key string) map[string]string {
+	available := make(map[string]string)
+	if state, ok := n.GetState(key); ok && n.chunked(state) {
+		hashes := n.chunkHashes(state)
+		for i, chunk := range splitChunks(state.Data, n.config.Node.ChunkSize) {
+			available[hashes[i]] = chunk
+		}
+	}
+
+	n.partialMu.Lock()
+	defer n.partialMu.Unlock()
+	n.expirePartialChunks()
+	if partial, ok := n.partial[key]; ok {
+		for hash, chunk := range partial.chunks {
+			available[hash] = chunk
+		}
+	}
+	return available
+}
+
+/*savePartialChunk keeps a chunk downloaded while fetching a key.
+
+If the chunks kept would exceed n.config.Node.PartialMaxBytes, the chunks of
+the keys that were not updated for the longest time are forgotten first. The
+chunk is not kept if it does not fit on its own.
+*/
+func (n *Node) savePartialChunk(key, hash, chunk string) {
+	n.partialMu.Lock()
+	defer n.partialMu.Unlock()
+
+	n.expirePartialChunks()
+	if max := n.config.Node.PartialMaxBytes; max > 0 {
+		for n.partialSize+len(chunk) > max {
+			oldest := ""
+			for k, partial := range n.partial {
+				if k != key && (oldest == "" || partial.updated.Before(n.partial[oldest].updated)) {
+					oldest = k
+				}
+			}
+			if oldest == "" {
+				log.WithFields(log.Fields{"node": n, "key": key, "func": "savePartialChunk"}).Warn("Not keeping chunk, too many bytes of chunks kept")
+				return
+			}
+			n.deletePartialChunks(oldest)
+		}
+	}
+
+	partial, ok := n.partial[key]
+	if !ok {
+		partial = &partialChunks{chunks: make(map[string]string)}
+		n.partial[key] = partial
+	}
+	if _, ok := partial.chunks[hash]; !ok {
+		partial.chunks[hash] = chunk
+		partial.size += len(chunk)
+		n.partialSize += len(chunk)
+	}
+	partial.updated = n.config.clock().Now()
+}
+
+//clearPartialChunks forgets the chunks downloaded while fetching a key
+func (n *Node) clearPartialChunks(key string) {
+	n.partialMu.Lock()
+	defer n.partialMu.Unlock()
+
+	n.deletePartialChunks(key)
+}
+
+/*expirePartialChunks forgets the chunks of keys that were not updated for
+n.config.Node.PartialTTL, as their fetch failed and was not retried.
+n.partialMu must be held.
+*/
+func (n *Node) expirePartialChunks() {
+	if n.config.Node.PartialTTL <= 0 {
+		return
+	}
+
+	now := n.config.clock().Now()
+	for key, partial := range n.partial {
+		if now.Sub(partial.updated) >= n.config.Node.PartialTTL {
+			n.deletePartialChunks(key)
+		}
+	}
+}
+
+//deletePartialChunks forgets the chunks of a key. n.partialMu must be held.
+func (n *Node) deletePartialChunks(key string) {
+	if partial, ok := n.partial[key]; ok {
+		n.partialSize -= partial.size
+		delete(n.partial, key)
+	}
+}
+
+/*sendState sends a state to a peer, piggybacking membership events on the
+request, and returns true if the peer acknowledged it.
+
+If the state is split in chunks, the state is announced to the peer instead,
+and the peer downloads the chunks it misses from this node.
+*/
+func (n *Node) sendState(ctx context.Context, peer *Peer, state State) bool {
+	if !n.chunked(state) {
+		return peer.Send(ctx, state, n.members.Piggyback()...)
+	}
+
+	return peer.Announce(ctx, Announcement{
+		Addr:   n.Addr(),
+		Key:    state.Key,
+		Status: n.keyStatus(state),
+	})
+}
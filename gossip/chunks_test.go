@@ -0,0 +1,317 @@
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplitChunks(t *testing.T) {
+	testCases := []struct {
+		Data   string
+		Size   int
+		Chunks []string
+	}{
+		{"", 4, []string{""}},
+		{"abc", 4, []string{"abc"}},
+		{"abcd", 4, []string{"abcd"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"abcdefgh", 4, []string{"abcd", "efgh"}},
+		{"abcdefgh", 0, []string{"abcdefgh"}},
+	}
+
+	for _, testCase := range testCases {
+		chunks := splitChunks(testCase.Data, testCase.Size)
+		if strings.Join(chunks, "|") != strings.Join(testCase.Chunks, "|") {
+			t.Errorf("splitChunks(%q, %d) == %v; want %v", testCase.Data, testCase.Size, chunks, testCase.Chunks)
+		}
+	}
+}
+
+func TestNodeKeyStatusChunks(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.ChunkSize = 4
+	n := NewNode(&config)
+
+	small, _ := n.UpdateState(State{Key: "small", Timestamp: Timestamp{Physical: 1}, Data: "abcd"})
+	if status := n.keyStatus(small); len(status.Chunks) != 0 {
+		t.Errorf("n.keyStatus(%v).Chunks == %v; want no chunks", small, status.Chunks)
+	}
+
+	large, _ := n.UpdateState(State{Key: "large", Timestamp: Timestamp{Physical: 1}, Data: "abcdefghij"})
+	status := n.keyStatus(large)
+	if len(status.Chunks) != 3 || status.Chunks[1] != chunkHash([]byte("efgh")) {
+		t.Errorf("n.keyStatus(%v).Chunks == %v; want the hashes of 3 chunks", large, status.Chunks)
+	}
+
+	//Hashes are recomputed once the state changes
+	large, _ = n.UpdateState(State{Key: "large", Timestamp: Timestamp{Physical: 2}, Data: "abcdXXXXij"})
+	if status := n.keyStatus(large); status.Chunks[1] != chunkHash([]byte("XXXX")) {
+		t.Errorf("n.keyStatus(%v).Chunks[1] == %s; want %s", large, status.Chunks[1], chunkHash([]byte("XXXX")))
+	}
+}
+
+func TestNodeFetchState(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.ChunkSize = 4
+	ctx := context.Background()
+
+	a := NewNode(&config)
+	b := NewNode(&config)
+	var chunks int32
+	handler := b.Handler()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("chunk") != "" {
+			atomic.AddInt32(&chunks, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer testServer.Close()
+	peer := NewPeer(parseURL(testServer.URL), &config)
+
+	a.UpdateState(State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "aaaabbbbccccdd"})
+	state, _ := b.UpdateState(State{Key: "key", Timestamp: Timestamp{Physical: 2}, Data: "aaaaXXXXccccdd"})
+
+	//Only the chunk that changed is downloaded
+	fetched, err := a.fetchState(ctx, peer, "key", b.keyStatus(state))
+	if err != nil || fetched.Data != state.Data || fetched.Digest != state.Digest {
+		t.Fatalf("a.fetchState() == %v, %v; want %v, nil", fetched, err, state)
+	}
+	if n := atomic.LoadInt32(&chunks); n != 1 {
+		t.Errorf("a.fetchState() downloaded %d chunks; want %d", n, 1)
+	}
+
+	//States that are not chunked are retrieved in full
+	small, _ := b.UpdateState(State{Key: "small", Timestamp: Timestamp{Physical: 1}, Data: "abc"})
+	atomic.StoreInt32(&chunks, 0)
+	if fetched, err := a.fetchState(ctx, peer, "small", b.keyStatus(small)); err != nil || fetched.Data != small.Data {
+		t.Errorf("a.fetchState() == %v, %v; want %v, nil", fetched, err, small)
+	}
+	if n := atomic.LoadInt32(&chunks); n != 0 {
+		t.Errorf("a.fetchState() downloaded %d chunks for a small state; want %d", n, 0)
+	}
+}
+
+func TestNodeFetchStateResume(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.ChunkSize = 4
+	config.Peer.MaxRetries = 0
+	ctx := context.Background()
+
+	a := NewNode(&config)
+	b := NewNode(&config)
+	var chunks, failures int32
+	handler := b.Handler()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("chunk") != "" {
+			//The connection drops on the third chunk the first time
+			if r.URL.Query().Get("chunk") == "2" && atomic.AddInt32(&failures, 1) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			atomic.AddInt32(&chunks, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer testServer.Close()
+	peer := NewPeer(parseURL(testServer.URL), &config)
+
+	state, _ := b.UpdateState(State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "aaaabbbbccccdddd"})
+	status := b.keyStatus(state)
+
+	if _, err := a.fetchState(ctx, peer, "key", status); err == nil {
+		t.Fatalf("a.fetchState() == nil with a failing chunk; want an error")
+	}
+	if n := atomic.LoadInt32(&chunks); n != 2 {
+		t.Errorf("a.fetchState() downloaded %d chunks before failing; want %d", n, 2)
+	}
+
+	//The next attempt only downloads the remaining chunks
+	atomic.StoreInt32(&chunks, 0)
+	fetched, err := a.fetchState(ctx, peer, "key", status)
+	if err != nil || fetched.Data != state.Data {
+		t.Fatalf("a.fetchState() == %v, %v; want %v, nil", fetched, err, state)
+	}
+	if n := atomic.LoadInt32(&chunks); n != 2 {
+		t.Errorf("a.fetchState() downloaded %d chunks when resuming; want %d", n, 2)
+	}
+	if len(a.availableChunks("key")) != 0 {
+		t.Errorf("a.availableChunks() == %v after fetching; want no chunks", a.availableChunks("key"))
+	}
+}
+
+func TestNodePartialChunks(t *testing.T) {
+	clock := &fixedClock{time.Unix(0, 0)}
+	config := *DefaultConfig
+	config.Clock = clock
+	config.Node.PartialTTL = time.Minute
+	config.Node.PartialMaxBytes = 8
+	n := NewNode(&config)
+
+	n.savePartialChunk("a", "a1", "aaaa")
+	clock.now = clock.now.Add(time.Second)
+	n.savePartialChunk("b", "b1", "bbbb")
+	if len(n.availableChunks("a")) != 1 || len(n.availableChunks("b")) != 1 {
+		t.Fatalf("n.availableChunks() == %v, %v; want 1 chunk for each key", n.availableChunks("a"), n.availableChunks("b"))
+	}
+
+	//The key that was not updated for the longest time is evicted first
+	clock.now = clock.now.Add(time.Second)
+	n.savePartialChunk("c", "c1", "cccc")
+	if len(n.availableChunks("a")) != 0 || len(n.availableChunks("c")) != 1 {
+		t.Errorf("n.availableChunks() == %v, %v; want no chunk for a and 1 chunk for c", n.availableChunks("a"), n.availableChunks("c"))
+	}
+
+	//Chunks larger than the limit are not kept
+	n.savePartialChunk("d", "d1", "ddddddddd")
+	if len(n.availableChunks("d")) != 0 {
+		t.Errorf("n.availableChunks() == %v for a chunk over the limit; want no chunk", n.availableChunks("d"))
+	}
+
+	//Chunks of fetches that are not retried expire
+	clock.now = clock.now.Add(time.Minute)
+	if len(n.availableChunks("b")) != 0 || len(n.availableChunks("c")) != 0 || n.partialSize != 0 {
+		t.Errorf("n.availableChunks() == %v, %v after the TTL; want no chunk", n.availableChunks("b"), n.availableChunks("c"))
+	}
+}
+
+func TestNodeKeysHandlerGetChunk(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.ChunkSize = 4
+	n := NewNode(&config)
+	state, _ := n.UpdateState(State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "aaaabbbbcc"})
+	testCases := []struct {
+		Query      string
+		StatusCode int
+		Body       string
+	}{
+		{"?chunk=1&digest=" + state.Digest, http.StatusOK, "bbbb"},
+		{"?chunk=2", http.StatusOK, "cc"},
+		{"?chunk=3", http.StatusBadRequest, ""},
+		{"?chunk=-1", http.StatusBadRequest, ""},
+		{"?chunk=a", http.StatusBadRequest, ""},
+		{"?chunk=0&digest=other", http.StatusConflict, ""},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", n.URL()+"/keys/key"+testCase.Query, nil)
+		w := httptest.NewRecorder()
+		n.keysHandler(w, req)
+		res := w.Result()
+
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != testCase.StatusCode {
+			t.Errorf("res.StatusCode == %d for %q; want %d", res.StatusCode, testCase.Query, testCase.StatusCode)
+		}
+		if testCase.StatusCode == http.StatusOK && string(body) != testCase.Body {
+			t.Errorf("Body == %q for %q; want %q", body, testCase.Query, testCase.Body)
+		}
+	}
+}
+
+func TestNodeKeysHandlerGetMetadata(t *testing.T) {
+	n := NewNode(nil)
+	state, _ := n.UpdateState(State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeKeysHandlerGetMetadata"})
+
+	req := httptest.NewRequest("GET", n.URL()+"/keys/key?metadata=true", nil)
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	var rState State
+	json.NewDecoder(res.Body).Decode(&rState)
+	if res.StatusCode != http.StatusOK || rState.Data != "" || rState.Digest != state.Digest {
+		t.Errorf("Response == %d, %v; want %d with the digest %s and no data", res.StatusCode, rState, http.StatusOK, state.Digest)
+	}
+}
+
+func TestNodeAnnounceHandler(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.ChunkSize = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := NewNode(&config)
+	b := NewNode(&config)
+	a.StartWorkers(ctx)
+	b.StartWorkers(ctx)
+	aServer := httptest.NewServer(a.Handler())
+	defer aServer.Close()
+	bServer := httptest.NewServer(b.Handler())
+	defer bServer.Close()
+
+	state, _ := b.UpdateState(State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "aaaabbbbcc"})
+	a.Peers = append(a.Peers, NewPeer(parseURL(bServer.URL), &config))
+	peer := NewPeer(parseURL(aServer.URL), &config)
+	if !peer.Announce(ctx, Announcement{Addr: parseURL(bServer.URL), Key: "key", Status: b.keyStatus(state)}) {
+		t.Fatalf("peer.Announce() == false; want true")
+	}
+
+	//a downloads the chunks from b in the background
+	timeout := time.Now().Add(5 * time.Second)
+	for {
+		if fetched, ok := a.GetState("key"); ok && fetched.Digest == state.Digest {
+			break
+		}
+		if time.Now().After(timeout) {
+			t.Fatalf("a.GetState() did not return the announced state")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodeAnnounceHandlerInvalid(t *testing.T) {
+	n := NewNode(nil)
+	n.Peers = append(n.Peers, NewPeer(Addr{"127.0.0.1", 8080}, nil))
+	testCases := []struct {
+		Announcement Announcement
+		StatusCode   int
+	}{
+		{Announcement{Addr: Addr{"127.0.0.1", 0}, Key: "key"}, http.StatusBadRequest},
+		{Announcement{Addr: Addr{"127.0.0.1", 8080}}, http.StatusBadRequest},
+		//Only peers can announce states
+		{Announcement{Addr: Addr{"127.0.0.1", 8081}, Key: "key"}, http.StatusForbidden},
+	}
+
+	for _, testCase := range testCases {
+		reqBody, _ := json.Marshal(testCase.Announcement)
+		req := httptest.NewRequest("POST", n.URL()+"/announce", bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		n.announceHandler(w, req)
+		res := w.Result()
+
+		if res.StatusCode != testCase.StatusCode {
+			t.Errorf("res.StatusCode == %d for %v; want %d", res.StatusCode, testCase.Announcement, testCase.StatusCode)
+		}
+	}
+}
+
+func TestNodePeerSendStateAnnounce(t *testing.T) {
+	transport := &stubTransport{}
+	config := *DefaultConfig
+	config.Transport = transport
+	config.Node.ChunkSize = 4
+	n := NewNode(&config)
+	peer := NewPeer(Addr{"127.0.0.1", 8080}, &config)
+	ctx := context.Background()
+
+	n.sendState(ctx, peer, State{Key: "small", Timestamp: Timestamp{Physical: 1}, Data: "abc"})
+	n.sendState(ctx, peer, State{Key: "large", Timestamp: Timestamp{Physical: 1}, Data: "abcdefgh"})
+
+	expected := []string{"Send", "Announce"}
+	if len(transport.calls) != len(expected) {
+		t.Fatalf("transport.calls == %v; want %v", transport.calls, expected)
+	}
+	for i := range expected {
+		if transport.calls[i] != expected[i] {
+			t.Errorf("transport.calls[%d] == %s; want %s", i, transport.calls[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package gossip
+
+import (
+	"time"
+)
+
+/*Clock is the source of time used by nodes, controllers and peers to schedule
+their workers and to track the last contact with peers.
+
+This allows simulations to control time instead of relying on the wall clock.
+Implementations must be safe to call from multiple goroutines.
+*/
+type Clock interface {
+	//Now returns the current time
+	Now() time.Time
+	//After waits for the duration to elapse, then sends the current time on the returned channel
+	After(d time.Duration) <-chan time.Time
+}
+
+//systemClock is a Clock using the wall clock
+type systemClock struct{}
+
+//Now returns the current wall-clock time
+func (c systemClock) Now() time.Time {
+	return time.Now()
+}
+
+//After waits for the duration to elapse on the wall clock
+func (c systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
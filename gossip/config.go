@@ -1,9 +1,19 @@
 package gossip
 
 import (
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
 	"time"
 )
 
+//CheckerConfig represents the configuration properties for convergence checkers
+type CheckerConfig struct {
+	//Interval is the delay between two polls of all nodes
+	Interval time.Duration `json:"interval" yaml:"interval" default:"1s"`
+}
+
 //ControllerConfig represents the configuration properties for controllers
 type ControllerConfig struct {
 	/*MaxPingDelay is the time (in ms) before the controller will consider a
@@ -14,6 +24,11 @@ type ControllerConfig struct {
 	/*ScanInterval is the delay (in ms) between two scans from a controller
 	instance*/
 	ScanInterval time.Duration `json:"scanInterval" yaml:"scanInterval" default:"60s"`
+	/*Discovery is the list of DNS names resolved to discover nodes, either as
+	'host:port' for A and AAAA records, or as SRV record names*/
+	Discovery []string `json:"discovery" yaml:"discovery" default:""`
+	//DiscoveryInterval is the delay between two resolutions of the DNS names
+	DiscoveryInterval time.Duration `json:"discoveryInterval" yaml:"discoveryInterval" default:"30s"`
 	//IP address of the controller
 	IP string `json:"ip" yaml:"ip" default:""`
 	//Port for the HTTP server on the controller
@@ -24,7 +39,7 @@ type ControllerConfig struct {
 type CorsConfig struct {
 	/*AllowHeaders is used for the Access-Control-Allow-Headers header for HTTP
 	responses.*/
-	AllowHeaders string `json:"allowHeaders" yaml:"allowHeaders" default:"Accept, Content-Type, Content-Length, Accept-Encoding"`
+	AllowHeaders string `json:"allowHeaders" yaml:"allowHeaders" default:"Accept, Content-Type, Content-Length, Accept-Encoding, X-Gossip-Consistency"`
 	/*AllowOrigin is used for the Access-Control-Allow-Origin header for HTTP
 	responses.*/
 	AllowOrigin string `json:"allowOrigin" yaml:"allowOrigin" default:"*"`
@@ -38,8 +53,81 @@ type NodeConfig struct {
 	/*MaxPingDelay is the time before the node will consider a
 	peer as irrecoverable*/
 	MaxPingDelay time.Duration `json:"maxPingDelay" yaml:"maxPingDelay" default:"5m"`
+	/*PhiIrrecoverable is the suspicion level of the phi-accrual failure
+	detector above which a peer is considered as irrecoverable. If 0, only
+	MaxPingDelay and SuspicionTimeout are used.*/
+	PhiIrrecoverable float64 `json:"phiIrrecoverable" yaml:"phiIrrecoverable" default:"32"`
+	/*IndirectProbes is the number of peers asked to probe a peer that failed
+	to respond to a ping*/
+	IndirectProbes int `json:"indirectProbes" yaml:"indirectProbes" default:"3"`
+	/*SuspicionTimeout is the time a peer can stay suspect before being
+	considered as dead*/
+	SuspicionTimeout time.Duration `json:"suspicionTimeout" yaml:"suspicionTimeout" default:"2m"`
 	//ScanInterval is the delay between two pings from a node instance
 	PingInterval time.Duration `json:"pingInterval" yaml:"pingInterval" default:"30s"`
+	/*MinPeers is the number of peers below which the node picks new peers
+	from its view of the membership, without waiting for the controller. If 0,
+	only the controller assigns peers.*/
+	MinPeers int `json:"minPeers" yaml:"minPeers" default:"3"`
+	/*PiggybackEvents is the maximum number of membership events piggybacked on
+	a single message*/
+	PiggybackEvents int `json:"piggybackEvents" yaml:"piggybackEvents" default:"8"`
+	/*DataDir is the directory where the node persists its states. If empty,
+	states are only kept in memory.*/
+	DataDir string `json:"dataDir" yaml:"dataDir" default:""`
+	//SnapshotInterval is the delay between two snapshots of the states
+	SnapshotInterval time.Duration `json:"snapshotInterval" yaml:"snapshotInterval" default:"5m"`
+	/*WriteTimeout is the maximum time to wait for a write to reach its
+	consistency level before failing*/
+	WriteTimeout time.Duration `json:"writeTimeout" yaml:"writeTimeout" default:"5s"`
+	/*AntiEntropyInterval is the delay between two anti-entropy sessions with
+	random peers. If 0, anti-entropy is disabled.*/
+	AntiEntropyInterval time.Duration `json:"antiEntropyInterval" yaml:"antiEntropyInterval" default:"1m"`
+	/*AntiEntropyPartners is the number of peers the node synchronizes with
+	during each anti-entropy round*/
+	AntiEntropyPartners int `json:"antiEntropyPartners" yaml:"antiEntropyPartners" default:"1"`
+	/*AntiEntropyMaxBytes is the maximum number of bytes of data pushed and
+	pulled during an anti-entropy session. If 0, sessions are not limited.*/
+	AntiEntropyMaxBytes int `json:"antiEntropyMaxBytes" yaml:"antiEntropyMaxBytes" default:"1048576"`
+	/*ChunkSize is the size in bytes of the chunks of data of large states.
+	States with more data than that are announced to peers, which download
+	the chunks they miss. If 0, states are always transferred whole.*/
+	ChunkSize int `json:"chunkSize" yaml:"chunkSize" default:"65536"`
+	/*PartialTTL is the time during which the chunks downloaded by a fetch
+	that failed are kept, so that the next attempt resumes from there. If 0,
+	they are kept until the state is assembled.*/
+	PartialTTL time.Duration `json:"partialTTL" yaml:"partialTTL" default:"10m"`
+	/*PartialMaxBytes is the maximum number of bytes of chunks kept for fetches
+	in progress. If 0, the chunks kept are not limited.*/
+	PartialMaxBytes int `json:"partialMaxBytes" yaml:"partialMaxBytes" default:"67108864"`
+	/*MaxClockDrift is how far ahead of the clock of the node the timestamps
+	received from clients and peers can be. States with a timestamp further
+	ahead are rejected. If 0, timestamps are not limited.*/
+	MaxClockDrift time.Duration `json:"maxClockDrift" yaml:"maxClockDrift" default:"5m"`
+	/*TrustedKeys is the list of base64-encoded Ed25519 public keys allowed to
+	sign states. If empty, states do not need to be signed.*/
+	TrustedKeys []string `json:"trustedKeys" yaml:"trustedKeys" default:""`
+	/*Seeds is the list of addresses of nodes, as 'ip:port', that the node
+	peers with when it starts*/
+	Seeds []string `json:"seeds" yaml:"seeds" default:""`
+	/*Controllers is the list of addresses of controllers, as 'ip:port', that
+	the node registers with when it starts*/
+	Controllers []string `json:"controllers" yaml:"controllers" default:""`
+	/*MaxJoinBackoff is the maximum duration between two attempts to peer with
+	a seed or to register with a controller*/
+	MaxJoinBackoff time.Duration `json:"maxJoinBackoff" yaml:"maxJoinBackoff" default:"30s"`
+	/*Discovery is the list of DNS names resolved to discover other nodes,
+	either as 'host:port' for A and AAAA records, or as SRV record names*/
+	Discovery []string `json:"discovery" yaml:"discovery" default:""`
+	//DiscoveryInterval is the delay between two resolutions of the DNS names
+	DiscoveryInterval time.Duration `json:"discoveryInterval" yaml:"discoveryInterval" default:"30s"`
+	/*Debug enables the '/debug' endpoints, which allow injecting faults in
+	messages sent to peers at runtime. This must not be enabled in production.*/
+	Debug bool `json:"debug" yaml:"debug" default:"false"`
+	/*ID is the unique ID of the node. If empty, the ID is generated on the
+	first start and stored in DataDir, or generated on every start if DataDir
+	is empty.*/
+	ID string `json:"id" yaml:"id" default:""`
 	//IP address of the node
 	IP string `json:"ip" yaml:"ip" default:""`
 	//Port for the HTTP server on the node
@@ -51,49 +139,230 @@ type PeerConfig struct {
 	/*BackoffDuration is the base duration before retrying to send a
 	message to a peer*/
 	BackoffDuration time.Duration `json:"backoffDuration" yaml:"backoffDuration" default:"200ms"`
+	/*ConnectTimeout is the maximum time to establish a connection with a
+	peer, including the TLS handshake*/
+	ConnectTimeout time.Duration `json:"connectTimeout" yaml:"connectTimeout" default:"2s"`
+	/*IdleConnTimeout is the time before closing a connection to a peer that
+	is not used*/
+	IdleConnTimeout time.Duration `json:"idleConnTimeout" yaml:"idleConnTimeout" default:"90s"`
 	/*MaxAttempts is the number of attempts before considering the peer as
 	unreachable*/
 	MaxAttempts int `json:"maxAttempts" yaml:"maxAttempts" default:"5"`
 	/*MaxRetries is the number of retries before giving up on sending a message
 	to a peer*/
 	MaxRetries int `json:"maxRetries" yaml:"maxRetries" default:"3"`
+	/*PhiMinStdDev is the minimum standard deviation of the intervals between
+	heartbeats in the phi-accrual failure detector. Lower values make the
+	detector react faster on networks with stable latency.*/
+	PhiMinStdDev time.Duration `json:"phiMinStdDev" yaml:"phiMinStdDev" default:"15s"`
+	/*PhiUnreachable is the suspicion level of the phi-accrual failure detector
+	above which a peer is considered as unreachable. If 0, only MaxAttempts is
+	used.*/
+	PhiUnreachable float64 `json:"phiUnreachable" yaml:"phiUnreachable" default:"8"`
+	//PhiWindowSize is the number of intervals between heartbeats kept for each peer
+	PhiWindowSize int `json:"phiWindowSize" yaml:"phiWindowSize" default:"100"`
+	//MaxIdleConns is the maximum number of idle connections kept for each peer
+	MaxIdleConns int `json:"maxIdleConns" yaml:"maxIdleConns" default:"4"`
+	/*RequestTimeout is the maximum time for a request to a peer, including
+	reading the response*/
+	RequestTimeout time.Duration `json:"requestTimeout" yaml:"requestTimeout" default:"10s"`
+}
+
+/*TLSConfig represents the configuration properties for TLS, used when the
+protocol is https*/
+type TLSConfig struct {
+	/*CertFile is the path to the PEM-encoded certificate presented by nodes
+	and controllers, both as servers and as clients*/
+	CertFile string `json:"certFile" yaml:"certFile" default:""`
+	//KeyFile is the path to the PEM-encoded private key of the certificate
+	KeyFile string `json:"keyFile" yaml:"keyFile" default:""`
+	/*CAFile is the path to the PEM-encoded certificate authorities used to
+	verify servers and clients. If set, servers require clients to present a
+	certificate signed by one of these authorities.*/
+	CAFile string `json:"caFile" yaml:"caFile" default:""`
 }
 
 //Config represents all configuration properties
 type Config struct {
+	Checker    CheckerConfig    `json:"checker" yaml:"checker"`
 	Controller ControllerConfig `json:"controller" yaml:"controller"`
 	Cors       CorsConfig       `json:"cors" yaml:"cors"`
 	Node       NodeConfig       `json:"node" yaml:"node"`
 	Peer       PeerConfig       `json:"peer" yaml:"peer"`
+	TLS        TLSConfig        `json:"tls" yaml:"tls"`
+	/*Client is the HTTP client used to send requests to peers. If nil, a
+	client is created from the configuration.*/
+	Client *http.Client `json:"-" yaml:"-" ignored:"true"`
+	/*Transport is used to send messages to peers. If nil, messages are sent
+	with an HTTPTransport.*/
+	Transport Transport `json:"-" yaml:"-" ignored:"true"`
+	/*Clock is the source of time used to schedule workers and to track peers.
+	If nil, the wall clock is used.*/
+	Clock Clock `json:"-" yaml:"-" ignored:"true"`
+	/*DNS looks up DNS records to discover nodes. If nil, the default resolver
+	of the system is used.*/
+	DNS DNSResolver `json:"-" yaml:"-" ignored:"true"`
+	/*Faults are injected in all messages sent to peers. If nil, no fault is
+	injected unless the node runs in debug mode.*/
+	Faults *Faults `json:"-" yaml:"-" ignored:"true"`
+	/*Rand is the source of randomness used to pick peers. It is shared by all
+	copies of the configuration and used under a lock. If nil, the default
+	source of the math/rand package is used.*/
+	Rand *rand.Rand `json:"-" yaml:"-" ignored:"true"`
+	/*Tracker counts the tasks in progress, so that simulations can wait until
+	nodes are idle. If nil, tasks are not counted.*/
+	Tracker Tracker `json:"-" yaml:"-" ignored:"true"`
 	/*Protocol is the protocol to use to send messages to other peers, either
 	http or https*/
 	Protocol string `json:"protocol" yaml:"protocol" default:"http"`
 }
 
+//transport returns the Transport used to send messages to peers
+func (c *Config) transport() Transport {
+	if c.Transport != nil {
+		return c.Transport
+	}
+	return NewHTTPTransport(c)
+}
+
+/*withTransport returns a copy of the configuration with an HTTPTransport
+created once, so that all peers share the same pool of connections. If
+c.Transport is already set, this returns c.
+*/
+func (c *Config) withTransport() (*Config, error) {
+	if c.Transport != nil {
+		return c, nil
+	}
+
+	client, err := c.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	config := *c
+	config.Transport = &HTTPTransport{
+		client: client,
+		config: &config,
+	}
+	return &config, nil
+}
+
+//dns returns the DNSResolver used to discover nodes
+func (c *Config) dns() DNSResolver {
+	if c.DNS != nil {
+		return c.DNS
+	}
+	return net.DefaultResolver
+}
+
+//clock returns the Clock used to schedule workers and to track peers
+func (c *Config) clock() Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return systemClock{}
+}
+
+//randMu protects access to Config.Rand, which is not safe for concurrent use
+var randMu sync.Mutex
+
+//perm returns a random permutation of the integers in [0, n)
+func (c *Config) perm(n int) []int {
+	if c.Rand == nil {
+		return rand.Perm(n)
+	}
+
+	randMu.Lock()
+	defer randMu.Unlock()
+	return c.Rand.Perm(n)
+}
+
+//intn returns a random integer in [0, n)
+func (c *Config) intn(n int) int {
+	if c.Rand == nil {
+		return rand.Intn(n)
+	}
+
+	randMu.Lock()
+	defer randMu.Unlock()
+	return c.Rand.Intn(n)
+}
+
+//shuffle randomizes the order of n elements, see rand.Shuffle
+func (c *Config) shuffle(n int, swap func(i, j int)) {
+	if c.Rand == nil {
+		rand.Shuffle(n, swap)
+		return
+	}
+
+	randMu.Lock()
+	defer randMu.Unlock()
+	c.Rand.Shuffle(n, swap)
+}
+
 //DefaultConfig is the default configuration for controllers, nodes and peers.
 var DefaultConfig *Config = &Config{
+	Checker: CheckerConfig{
+		Interval: time.Second,
+	},
 	Controller: ControllerConfig{
-		MaxScanDelay: 3600000, //1 hour (3 600 000 ms)
-		MinPeers:     3,
-		ScanInterval: 60 * time.Second, //1 minute (60 000 ms)
-		IP:           "127.0.0.1",
-		Port:         7080,
+		MaxScanDelay:      time.Hour, //1 hour (3 600 000 ms)
+		MinPeers:          3,
+		ScanInterval:      60 * time.Second, //1 minute (60 000 ms)
+		Discovery:         []string{},
+		DiscoveryInterval: 30 * time.Second, //30 seconds (30 000 ms)
+		IP:                "127.0.0.1",
+		Port:              7080,
 	},
 	Cors: CorsConfig{
-		AllowHeaders: "Accept, Content-Type, Content-Length, Accept-Encoding",
+		AllowHeaders: "Accept, Content-Type, Content-Length, Accept-Encoding, X-Gossip-Consistency",
 		AllowOrigin:  "*",
 	},
 	Node: NodeConfig{
-		MaxRecipients: 4,
-		MaxPingDelay:  300000,           //5 minutes (300 000 ms)
-		PingInterval:  30 * time.Second, //30 seconds (30 000 ms)
-		IP:            "127.0.0.1",
-		Port:          8080,
+		MaxRecipients:       4,
+		MaxPingDelay:        5 * time.Minute, //5 minutes (300 000 ms)
+		PhiIrrecoverable:    32,
+		IndirectProbes:      3,
+		SuspicionTimeout:    2 * time.Minute,  //2 minutes (120 000 ms)
+		PingInterval:        30 * time.Second, //30 seconds (30 000 ms)
+		MinPeers:            3,
+		PiggybackEvents:     8,
+		DataDir:             "",
+		SnapshotInterval:    5 * time.Minute,  //5 minutes (300 000 ms)
+		WriteTimeout:        5 * time.Second,  //5 seconds (5 000 ms)
+		AntiEntropyInterval: 60 * time.Second, //1 minute (60 000 ms)
+		AntiEntropyPartners: 1,
+		AntiEntropyMaxBytes: 1 << 20,          //1 MiB
+		ChunkSize:           64 << 10,         //64 KiB
+		PartialTTL:          10 * time.Minute, //10 minutes (600 000 ms)
+		PartialMaxBytes:     64 << 20,         //64 MiB
+		MaxClockDrift:       5 * time.Minute,  //5 minutes (300 000 ms)
+		TrustedKeys:         []string{},
+		Seeds:               []string{},
+		Controllers:         []string{},
+		MaxJoinBackoff:      30 * time.Second, //30 seconds (30 000 ms)
+		Discovery:           []string{},
+		DiscoveryInterval:   30 * time.Second, //30 seconds (30 000 ms)
+		Debug:               false,
+		ID:                  "",
+		IP:                  "127.0.0.1",
+		Port:                8080,
 	},
 	Peer: PeerConfig{
 		BackoffDuration: 200 * time.Millisecond, //200 ms
+		ConnectTimeout:  2 * time.Second,        //2 seconds (2 000 ms)
+		IdleConnTimeout: 90 * time.Second,       //90 seconds (90 000 ms)
 		MaxAttempts:     5,
 		MaxRetries:      3,
+		PhiMinStdDev:    15 * time.Second, //15 seconds (15 000 ms)
+		PhiUnreachable:  8,
+		PhiWindowSize:   100,
+		MaxIdleConns:    4,
+		RequestTimeout:  10 * time.Second, //10 seconds (10 000 ms)
+	},
+	TLS: TLSConfig{
+		CertFile: "",
+		KeyFile:  "",
+		CAFile:   "",
 	},
 	Protocol: "http",
 }
@@ -0,0 +1,55 @@
+package gossip
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*Consistency is the level of guarantee required by a client before a write is
+acknowledged.
+
+The zero value acknowledges writes as soon as they are received by the node.
+*/
+type Consistency struct {
+	//Durable requires the state to be applied and persisted by the node
+	Durable bool
+	//Peers is the number of peers that must acknowledge the state
+	Peers int
+}
+
+/*ParseConsistency parses a consistency level.
+
+Supported values are:
+
+* "" or "local": acknowledge as soon as the state is received
+* "durable": acknowledge once the state is applied and persisted
+* "peers=N": acknowledge once the state is durable and N peers received it
+*/
+func ParseConsistency(s string) (Consistency, error) {
+	switch {
+	case s == "" || s == "local":
+		return Consistency{}, nil
+	case s == "durable":
+		return Consistency{Durable: true}, nil
+	case strings.HasPrefix(s, "peers="):
+		peers, err := strconv.Atoi(strings.TrimPrefix(s, "peers="))
+		if err != nil || peers < 1 {
+			return Consistency{}, errors.New("Number of peers must be a positive integer")
+		}
+		return Consistency{Durable: true, Peers: peers}, nil
+	}
+
+	return Consistency{}, errors.New("Unknown consistency level")
+}
+
+//String returns a string representation of the consistency level
+func (c Consistency) String() string {
+	switch {
+	case c.Peers > 0:
+		return "peers=" + strconv.Itoa(c.Peers)
+	case c.Durable:
+		return "durable"
+	}
+	return "local"
+}
@@ -0,0 +1,36 @@
+package gossip
+
+import (
+	"testing"
+)
+
+func TestParseConsistency(t *testing.T) {
+	testCases := []struct {
+		Level       string
+		Consistency Consistency
+		Err         bool
+	}{
+		{"", Consistency{}, false},
+		{"local", Consistency{}, false},
+		{"durable", Consistency{Durable: true}, false},
+		{"peers=1", Consistency{Durable: true, Peers: 1}, false},
+		{"peers=3", Consistency{Durable: true, Peers: 3}, false},
+		{"peers=0", Consistency{}, true},
+		{"peers=-1", Consistency{}, true},
+		{"peers=a", Consistency{}, true},
+		{"strong", Consistency{}, true},
+	}
+
+	for _, testCase := range testCases {
+		consistency, err := ParseConsistency(testCase.Level)
+		if (err != nil) != testCase.Err {
+			t.Errorf("ParseConsistency(%q) returned error %v; want error %t", testCase.Level, err, testCase.Err)
+		}
+		if consistency != testCase.Consistency {
+			t.Errorf("ParseConsistency(%q) == %v; want %v", testCase.Level, consistency, testCase.Consistency)
+		}
+		if err == nil && testCase.Level != "" && consistency.String() != testCase.Level {
+			t.Errorf("consistency.String() == %s; want %s", consistency.String(), testCase.Level)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package gossip
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
 	"time"
 
@@ -16,11 +19,29 @@ type Controller struct {
 	IP string
 	//Port is the port for the HTTP server on the controller
 	Port int
-	//Peers is a sync.Map[Addr]*Peer containing all known peers.
+	/*Peers is a sync.Map containing all known peers as *Peer, keyed by their
+	ID, or by their Addr until their ID is known.*/
 	Peers *sync.Map
 
+	//peerAddrs is a sync.Map indexing the peers of Peers as *Peer by their Addr
+	peerAddrs sync.Map
+	//peersMu serializes changes to the keys of Peers and peerAddrs
+	peersMu sync.Mutex
 	//addPeerChan is a channel to receive peering requests
-	addPeerChan chan Addr
+	addPeerChan chan PeeringRequest
+	//addPeerInbox tracks the messages sent to the addPeerWorker
+	addPeerInbox *inbox
+	//discovery discovers nodes through DNS, or is nil
+	discovery *Discovery
+
+	//ctx is cancelled when the controller stops, to stop workers and abort requests to peers
+	ctx context.Context
+	//cancel cancels ctx
+	cancel context.CancelFunc
+	//server is the HTTP server started by Start, or nil
+	server *http.Server
+	//workers tracks running workers
+	workers sync.WaitGroup
 
 	//config stores the configuration parameters
 	config *Config
@@ -32,17 +53,34 @@ func NewController(config *Config) *Controller {
 		config = DefaultConfig
 	}
 
+	//All peers share the same HTTP client
+	config, err := config.withTransport()
+	if err != nil {
+		log.WithFields(log.Fields{"func": "NewController"}).Fatalf("Failed to configure TLS: %s", err.Error())
+	}
+
 	c := &Controller{
 		IP:    config.Controller.IP,
 		Port:  config.Controller.Port,
 		Peers: &sync.Map{},
 
-		addPeerChan: make(chan Addr, 8),
-		config:      config,
+		addPeerChan:  make(chan PeeringRequest, 8),
+		addPeerInbox: config.newInbox(),
+		config:       config,
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
 	log.WithFields(log.Fields{"controller": c, "func": "NewController"}).Info("Initializing controller")
 
+	//Inject faults in messages sent to peers
+	if config.Faults != nil {
+		c.config = config.withFaults(Addr{c.IP, c.Port}, config.Faults)
+	}
+
+	if len(config.Controller.Discovery) > 0 {
+		c.discovery = NewDiscovery(config.Controller.Discovery, c.config)
+	}
+
 	return c
 }
 
@@ -62,13 +100,13 @@ func (c *Controller) ConnectLowPeers() {
 	*/
 	var lcPeers []*Peer
 	for _, peer := range c.FindLowPeers() {
-		for i := len(peer.Peers); i < c.config.Controller.MinPeers; i++ {
+		for i := peer.PeerCount(); i < c.config.Controller.MinPeers; i++ {
 			lcPeers = append(lcPeers, peer)
 		}
 	}
 	log.WithFields(log.Fields{"controller": c, "func": "ConnectLowPeers"}).Infof("Found %d peers with not enough peers", len(lcPeers))
 	//Shuffle peers
-	rand.Shuffle(len(lcPeers), func(i, j int) {
+	c.config.shuffle(len(lcPeers), func(i, j int) {
 		lcPeers[i], lcPeers[j] = lcPeers[j], lcPeers[i]
 	})
 
@@ -90,12 +128,13 @@ func (c *Controller) ConnectLowPeers() {
 		}
 
 		log.WithFields(log.Fields{"controller": c, "func": "ConnectLowPeers"}).Infof("Connecting peers %v and %v", lcPeers[i], lcPeers[i+1])
-		go lcPeers[i].SendPeeringRequest(lcPeers[i+1].Addr)
+		orig, dest := lcPeers[i], lcPeers[i+1]
+		c.config.goTask(func() { orig.SendPeeringRequest(c.ctx, dest.PeeringRequest()) })
 		/*Store peering temporarily, otherwise we would have to wait until the
 		next scan.
 		*/
-		lcPeers[i].Peers = append(lcPeers[i].Peers, lcPeers[i+1])
-		lcPeers[i+1].Peers = append(lcPeers[i+1].Peers, lcPeers[i])
+		lcPeers[i].AddPeer(lcPeers[i+1])
+		lcPeers[i+1].AddPeer(lcPeers[i])
 	}
 
 	/*Matching left-over peers with a random know peer
@@ -118,12 +157,13 @@ func (c *Controller) ConnectLowPeers() {
 
 		//Random matching
 		for _, peer := range loPeers {
-			oPeer := peers[rand.Intn(len(peers))]
+			oPeer := peers[c.config.intn(len(peers))]
 			if peer.CanPeer(oPeer) {
-				go peer.SendPeeringRequest(oPeer.Addr)
+				peer := peer
+				c.config.goTask(func() { peer.SendPeeringRequest(c.ctx, oPeer.PeeringRequest()) })
 				//Pre-emptively add peering in memory.
-				peer.Peers = append(peer.Peers, oPeer)
-				oPeer.Peers = append(oPeer.Peers, peer)
+				peer.AddPeer(oPeer)
+				oPeer.AddPeer(peer)
 			} else {
 				log.WithFields(log.Fields{"controller": c, "func": "ConnectLowPeers", "peer": peer}).Info("Failed to find a random match")
 			}
@@ -131,6 +171,43 @@ func (c *Controller) ConnectLowPeers() {
 	}
 }
 
+/*CheckPeeringRequest returns an error if a peering request claims the address
+of a known node with a different ID, while that node is still reachable.
+
+When the next scan finds another node at that address, the address is free to
+use again.
+*/
+func (c *Controller) CheckPeeringRequest(req PeeringRequest) error {
+	if peer := c.findPeer(req.Addr); peer != nil && differentIDs(peer.ID(), req.ID) && peer.Reachable() {
+		return errors.New("Address is used by another node")
+	}
+	return nil
+}
+
+/*Drain asks a node to drain before it leaves the cluster.
+
+The node asks its controllers to re-home its peers while draining. If it did
+not ask this controller, the controller re-homes the peers the node had before
+draining.
+*/
+func (c *Controller) Drain(ctx context.Context, addr Addr) error {
+	peer := c.findPeer(addr)
+	if peer == nil {
+		peer = NewPeer(addr, c.config)
+	}
+	neighbours := c.neighbours(ctx, peer)
+
+	log.WithFields(log.Fields{"controller": c, "func": "Drain", "peer": peer}).Info("Draining node")
+	if err := peer.Drain(ctx); err != nil {
+		return err
+	}
+
+	if c.findPeer(addr) != nil {
+		c.rehome(peer, neighbours)
+	}
+	return nil
+}
+
 /*FindClusters look at all peers known to the controller and returns the Addr
 of peers in separate slices if they are not connected.
 
@@ -192,7 +269,7 @@ func (c *Controller) FindClusters() [][]*Peer {
 			delete(peers, peer)
 			toVisit = toVisit[1:]
 
-			for _, subPeer := range peer.Peers {
+			for _, subPeer := range peer.PeerList() {
 				if _, ok := visited[subPeer]; !ok {
 					toVisit = append(toVisit, subPeer)
 				}
@@ -224,7 +301,7 @@ func (c *Controller) FindLowPeers() (lcPeers []*Peer) {
 			return true
 		}
 
-		if len(peer.Peers) < c.config.Controller.MinPeers {
+		if peer.PeerCount() < c.config.Controller.MinPeers {
 			lcPeers = append(lcPeers, peer)
 		}
 		return true
@@ -272,7 +349,7 @@ func (c *Controller) MergeClusters(clusters [][]*Peer) {
 		same number more than once.
 		*/
 		var origs []*Peer
-		for i, o := range rand.Perm(len(clusters[oPos])) {
+		for i, o := range c.config.perm(len(clusters[oPos])) {
 			if i >= minPeers {
 				break
 			}
@@ -280,23 +357,35 @@ func (c *Controller) MergeClusters(clusters [][]*Peer) {
 		}
 
 		//Send peering requests to oPos on behalf of dPos.
-		for i, d := range rand.Perm(len(clusters[dPos])) {
+		for i, d := range c.config.perm(len(clusters[dPos])) {
 			if i >= minPeers {
 				break
 			}
 			log.WithFields(log.Fields{"controller": c, "func": "MergeClusters"}).Infof("Connecting peers %v and %v", origs[i], clusters[dPos][d])
-			go origs[i].SendPeeringRequest(clusters[dPos][d].Addr)
+			orig, dest := origs[i], clusters[dPos][d]
+			c.config.goTask(func() { orig.SendPeeringRequest(c.ctx, dest.PeeringRequest()) })
 			/*Manually add the peers together, even though there is no proof
 			that the peering was successful at this team. It is necessary to do
 			this for the identification of nodes with less than
 			c.config.Controller.MinPeers peers.
 			*/
-			origs[i].Peers = append(origs[i].Peers, clusters[dPos][d])
-			clusters[dPos][d].Peers = append(clusters[dPos][d].Peers, origs[i])
+			origs[i].AddPeer(clusters[dPos][d])
+			clusters[dPos][d].AddPeer(origs[i])
 		}
 	}
 }
 
+/*RemoveNode re-homes the peers of a node leaving the cluster, then forgets the
+node.
+*/
+func (c *Controller) RemoveNode(ctx context.Context, addr Addr) {
+	peer := c.findPeer(addr)
+	if peer == nil {
+		peer = NewPeer(addr, c.config)
+	}
+	c.rehome(peer, c.neighbours(ctx, peer))
+}
+
 /*ScanPeers retrieve the list of peers from peers
 
 When scanning for peers, it's possible that the scanner will discover new
@@ -305,15 +394,16 @@ scan it as well.
 
 This function also takes care of removing peers that are irrecoverable.
 */
-func (c *Controller) ScanPeers() {
+func (c *Controller) ScanPeers(ctx context.Context) {
 	//Start peer removal temporary worker
-	removePeerChan := make(chan Addr, 8)
-	go c.removePeerWorker(removePeerChan)
+	removePeerChan := make(chan *Peer, 8)
+	removePeerInbox := c.config.newInbox()
+	c.config.goTask(func() { c.removePeerWorker(removePeerChan, removePeerInbox) })
 	//Closing the channel will automatically stop the worker
-	defer close(removePeerChan)
+	defer removePeerInbox.closePeers(removePeerChan)
 
 	//Discovery phase
-	wg := &sync.WaitGroup{}
+	tasks := c.config.newTaskGroup()
 	scanned := &sync.Map{}
 	c.Peers.Range(func(_, value interface{}) bool {
 		peer, ok := value.(*Peer)
@@ -325,30 +415,121 @@ func (c *Controller) ScanPeers() {
 		//Remove irrecoverable peer
 		if peer.IsCtrlIrrecoverable() {
 			log.WithFields(log.Fields{"controller": c, "func": "ScanPeers", "peer": peer}).Info("Removing irrecoverable peer")
-			removePeerChan <- peer.Addr
+			removePeerInbox.sendPeer(context.Background(), removePeerChan, peer)
 			return true
 		}
 
 		//Run scan for the peer
-		wg.Add(1)
-		go c.scanPeer(peer, scanned, wg)
+		tasks.Go(func() { c.scanPeer(ctx, peer, scanned, tasks) })
 		return true
 	})
-	wg.Wait()
+	tasks.Wait()
+}
+
+//Handler returns an http.Handler serving the API of the controller
+func (c *Controller) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", c.peersHandler)
+	mux.HandleFunc("/nodes/", c.nodesHandler)
+	return mux
+}
+
+/*Start starts the workers of the controller and an HTTP server listening on
+the address of the controller.
+
+The workers and the server run until ctx is cancelled or Stop is called. This
+returns an error if the server cannot listen on the address of the controller.
+*/
+func (c *Controller) Start(ctx context.Context) error {
+	server, ln, err := newServer(c.String(), c.Handler(), c.config)
+	if err != nil {
+		return err
+	}
+	c.server = server
+
+	log.WithFields(log.Fields{"controller": c, "func": "Start"}).Info("Starting controller")
+	c.StartWorkers(ctx)
+	c.startWorker(func() {
+		if err := serve(server, ln); err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{"controller": c, "func": "Start"}).Errorf("Fatal error with HTTP server: %s", err.Error())
+		}
+	})
+	c.startWorker(func() {
+		//Close remaining connections if the controller stops without calling Stop
+		c.config.track(-1)
+		<-c.ctx.Done()
+		c.config.track(1)
+		server.Close()
+	})
+
+	return nil
+}
+
+/*StartWorkers starts the workers of the controller without running an HTTP
+server.
+
+The workers run until ctx is cancelled or Stop is called.
+*/
+func (c *Controller) StartWorkers(ctx context.Context) {
+	c.startWorker(func() {
+		c.config.track(-1)
+		select {
+		case <-ctx.Done():
+			c.cancel()
+		case <-c.ctx.Done():
+		}
+		c.config.track(1)
+	})
+	c.startWorker(c.addPeerWorker)
+	c.startWorker(c.scanWorker)
+	if c.discovery != nil {
+		c.startWorker(c.discoveryWorker)
+	}
 }
 
-//Run starts the control instance
+//Run starts the controller and runs until it receives an interrupt signal
 func (c *Controller) Run() {
-	//Start workers
-	go c.addPeerWorker()
-	go c.scanWorker()
+	if err := c.Start(context.Background()); err != nil {
+		log.WithFields(log.Fields{"controller": c, "func": "Run"}).Fatalf("Failed to start controller: %s", err.Error())
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.Stop(ctx); err != nil {
+		log.WithFields(log.Fields{"controller": c, "func": "Run"}).Fatalf("Error shutting down controller: %s", err.Error())
+	}
+}
 
-	//Register handlers
-	http.HandleFunc("/peers", c.peersHandler)
+/*Stop stops the controller
 
-	//Run HTTP server
-	log.WithFields(log.Fields{"controller": c, "func": "NewController"}).Info("Starting controller")
-	log.WithFields(log.Fields{"controller": c, "func": "NewController"}).Fatal(http.ListenAndServe(c.String(), nil))
+This shuts down the HTTP server, cancels all in-flight requests to peers and
+waits for the workers to exit, or for ctx to be cancelled.
+*/
+func (c *Controller) Stop(ctx context.Context) error {
+	log.WithFields(log.Fields{"controller": c, "func": "Stop"}).Info("Stopping controller")
+	if c.server != nil {
+		if err := c.server.Shutdown(ctx); err != nil {
+			log.WithFields(log.Fields{"controller": c, "func": "Stop"}).Warnf("Failed to shut down HTTP server: %s", err.Error())
+		}
+	}
+	c.cancel()
+
+	//Wait for the workers to exit
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 //String returns a string representation of the controller
@@ -364,45 +545,223 @@ func (c *Controller) URL() string {
 //addPeerWorker listens on the addPeerChan channel for new peers
 func (c *Controller) addPeerWorker() {
 	for {
-		addr := <-c.addPeerChan
-		log.WithFields(log.Fields{"controller": c, "func": "addPeerWorker", "addr": addr}).Info("Received peering info")
+		var req PeeringRequest
+		c.addPeerInbox.wait(func() int { return len(c.addPeerChan) })
+		select {
+		case <-c.ctx.Done():
+			c.addPeerInbox.received(nil)
+			return
+		case req = <-c.addPeerChan:
+			c.addPeerInbox.received(c.addPeerChan)
+		}
+		log.WithFields(log.Fields{"controller": c, "func": "addPeerWorker", "addr": req.Addr, "id": req.ID}).Info("Received peering info")
+
+		//Add peers to the list of known peers
+		c.loadPeer(req.Addr, req.ID)
+	}
+}
+
+/*discoveryWorker resolves the DNS names of c.discovery when the controller
+starts, then at regular interval, and adds the nodes found to the known peers.
+*/
+func (c *Controller) discoveryWorker() {
+	for {
+		addrs, _ := c.discovery.Resolve(c.ctx)
+		for _, addr := range addrs {
+			if !c.addPeerInbox.sendPeeringRequest(c.ctx, c.addPeerChan, PeeringRequest{Addr: addr}) {
+				return
+			}
+		}
 
-		//Skip known peers
-		if _, known := c.Peers.Load(addr); known {
-			log.WithFields(log.Fields{"controller": c, "func": "addPeerWorker", "addr": addr}).Debug("Skip known peer")
+		if !c.config.sleep(c.ctx, c.config.Controller.DiscoveryInterval) {
+			return
+		}
+	}
+}
+
+/*findPeer returns the known peer with the given address, or nil if there are
+none.
+*/
+func (c *Controller) findPeer(addr Addr) *Peer {
+	if iPeer, ok := c.peerAddrs.Load(addr); ok {
+		if peer, ok := iPeer.(*Peer); ok {
+			return peer
+		}
+	}
+	return nil
+}
+
+/*identifyPeer records the ID a node responded with, and returns the peer to use
+for that node.
+*/
+func (c *Controller) identifyPeer(peer *Peer, id string) *Peer {
+	if id == "" || peer.ID() == id {
+		return peer
+	}
+
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+
+	c.setPeerID(peer, id)
+	return peer
+}
+
+/*loadPeer returns the known peer for the node with the given address, or adds
+a new peer if there are none.
+
+If id is not empty, the node itself reported it, through a peering request:
+a peer with the same ID at another address is replaced, as the node changed
+address. Addresses reported by other nodes can be stale and must be loaded
+with an empty id, so that only the node itself can move its ID.
+*/
+func (c *Controller) loadPeer(addr Addr, id string) *Peer {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+
+	if peer := c.findPeer(addr); peer != nil {
+		c.setPeerID(peer, id)
+		return peer
+	}
+
+	log.WithFields(log.Fields{"controller": c, "func": "loadPeer", "addr": addr, "id": id}).Info("Adding peer")
+	peer := NewPeer(addr, c.config)
+	peer.SetID(id)
+	c.storePeer(peer)
+	return peer
+}
+
+/*neighbours returns the peers of a node, as reported by the node or as found
+during the last scan if the node cannot be reached.
+*/
+func (c *Controller) neighbours(ctx context.Context, peer *Peer) []*Peer {
+	res, err := peer.GetPeers(ctx)
+	if err != nil {
+		return peer.PeerList()
+	}
+
+	neighbours := make([]*Peer, 0, len(res.Peers))
+	for _, addr := range res.Peers {
+		if addr != peer.Addr {
+			neighbours = append(neighbours, c.loadPeer(addr, ""))
+		}
+	}
+	return neighbours
+}
+
+/*rehome connects the peers of a node leaving the cluster in a ring, then
+forgets the node.
+
+As any path going through the node can go through the ring instead, the graph
+stays connected once the node leaves.
+*/
+func (c *Controller) rehome(peer *Peer, neighbours []*Peer) {
+	log.WithFields(log.Fields{"controller": c, "func": "rehome", "peer": peer}).Infof("Re-homing %d peers", len(neighbours))
+
+	/*A single peer has no one to connect to, and two peers only need to be
+	connected once.
+	*/
+	connections := len(neighbours)
+	if connections <= 2 {
+		connections--
+	}
+	for i := 0; i < connections; i++ {
+		orig, dest := neighbours[i], neighbours[(i+1)%len(neighbours)]
+		if !orig.CanPeer(dest) {
 			continue
 		}
 
-		//Add peers to the list of known peers
-		peer := NewPeer(addr, c.config)
-		c.Peers.Store(addr, peer)
+		log.WithFields(log.Fields{"controller": c, "func": "rehome"}).Infof("Connecting peers %v and %v", orig, dest)
+		c.config.goTask(func() { orig.SendPeeringRequest(c.ctx, dest.PeeringRequest()) })
+		//Pre-emptively add peering in memory.
+		orig.AddPeer(dest)
+		dest.AddPeer(orig)
 	}
+
+	c.removePeer(peer)
+}
+
+/*removePeer forgets a peer, unless another peer replaced it in c.Peers. This
+returns true if the peer was removed.
+*/
+func (c *Controller) removePeer(peer *Peer) bool {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+
+	key := peerKey(peer.Addr, peer.ID())
+	if value, ok := c.Peers.Load(key); !ok || value != peer {
+		return false
+	}
+	log.WithFields(log.Fields{"controller": c, "func": "removePeer", "peer": peer}).Info("Removing peer")
+	c.Peers.Delete(key)
+	if value, ok := c.peerAddrs.Load(peer.Addr); ok && value == peer {
+		c.peerAddrs.Delete(peer.Addr)
+	}
+	return true
 }
 
 //removePeerWorker is a temporary worker to remove irrecoverable peers
-func (c *Controller) removePeerWorker(removePeerChan chan Addr) {
+func (c *Controller) removePeerWorker(removePeerChan chan *Peer, removePeerInbox *inbox) {
 	for {
-		addr, open := <-removePeerChan
+		removePeerInbox.wait(func() int { return len(removePeerChan) })
+		peer, open := <-removePeerChan
+		removePeerInbox.received(removePeerChan)
 		if !open {
 			log.WithFields(log.Fields{"controller": c, "func": "removePeerWorker"}).Debug("Stopping worker")
 			return
-		} else if _, ok := c.Peers.Load(addr); ok {
-			log.WithFields(log.Fields{"controller": c, "func": "removePeerWorker", "addr": addr}).Info("Removing peer")
-			c.Peers.Delete(addr)
-		} else {
-			log.WithFields(log.Fields{"controller": c, "func": "removePeerWorker", "addr": addr}).Debug("Ignore duplicate peer removal message")
 		}
+
+		if !c.removePeer(peer) {
+			log.WithFields(log.Fields{"controller": c, "func": "removePeerWorker", "peer": peer}).Debug("Ignore duplicate peer removal message")
+		}
+	}
+}
+
+/*setPeerID sets the ID of a peer and keys it by that ID in c.Peers.
+
+The address of a peer is authoritative: if the peer was known with another ID,
+another node now uses that address. A peer with the same ID at another address
+is replaced, as the node changed address.
+
+This must be called while holding c.peersMu.
+*/
+func (c *Controller) setPeerID(peer *Peer, id string) {
+	if id == "" || peer.ID() == id {
+		return
 	}
+
+	if peer.ID() != "" {
+		log.WithFields(log.Fields{"controller": c, "func": "setPeerID", "peer": peer, "id": id}).Warnf("Node responded with a different ID than %s", peer.ID())
+	}
+	c.Peers.Delete(peerKey(peer.Addr, peer.ID()))
+	peer.SetID(id)
+	c.storePeer(peer)
+}
+
+/*storePeer stores a peer in c.Peers, replacing any peer with the same ID.
+
+This must be called while holding c.peersMu.
+*/
+func (c *Controller) storePeer(peer *Peer) {
+	key := peerKey(peer.Addr, peer.ID())
+	if iOld, ok := c.Peers.Load(key); ok {
+		if old, ok := iOld.(*Peer); ok && old.Addr != peer.Addr {
+			log.WithFields(log.Fields{"controller": c, "func": "storePeer", "peer": old, "id": peer.ID()}).Infof("Node moved to %v", peer.Addr)
+			if value, ok := c.peerAddrs.Load(old.Addr); ok && value == old {
+				c.peerAddrs.Delete(old.Addr)
+			}
+		}
+	}
+	c.Peers.Store(key, peer)
+	c.peerAddrs.Store(peer.Addr, peer)
 }
 
 //scanWorker periodically scans peers
 func (c *Controller) scanWorker() {
-	for {
-		time.Sleep(c.config.Controller.ScanInterval)
+	for c.config.sleep(c.ctx, c.config.Controller.ScanInterval) {
 		log.WithFields(log.Fields{"controller": c, "func": "scanWorker"}).Info("Start scan")
 
 		//Scan all nodes
-		c.ScanPeers()
+		c.ScanPeers(c.ctx)
 
 		//Find clusters
 		clusters := c.FindClusters()
@@ -420,9 +779,27 @@ func (c *Controller) scanWorker() {
 	}
 }
 
+/*startWorker runs a worker in a new goroutine and tracks it until it
+returns. The worker is counted as a task while it runs.
+*/
+func (c *Controller) startWorker(worker func()) {
+	c.workers.Add(1)
+	c.config.goTask(func() {
+		defer c.workers.Done()
+		worker()
+	})
+}
+
+//peerKey returns the key of a peer in Controller.Peers
+func peerKey(addr Addr, id string) interface{} {
+	if id != "" {
+		return id
+	}
+	return addr
+}
+
 //scanPeer scans a single peer or skip it if it in the scanned map
-func (c *Controller) scanPeer(peer *Peer, scanned *sync.Map, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (c *Controller) scanPeer(ctx context.Context, peer *Peer, scanned *sync.Map, tasks *taskGroup) {
 
 	//This peer is already scanned
 	if _, ok := scanned.Load(peer.Addr); ok {
@@ -432,34 +809,39 @@ func (c *Controller) scanPeer(peer *Peer, scanned *sync.Map, wg *sync.WaitGroup)
 
 	//Retrieve the list of peers of this peer
 	log.WithFields(log.Fields{"controller": c, "func": "scanPeer", "peer": peer}).Info("Scanning peer")
-	peers, err := peer.GetPeers()
+	res, err := peer.GetPeers(ctx)
 	scanned.Store(peer.Addr, peer)
 	if err != nil {
 		log.WithFields(log.Fields{"controller": c, "func": "scanPeer", "peer": peer}).Info("Failed to scan peer")
 		return
 	}
+	peer = c.identifyPeer(peer, res.ID)
 
-	//Reset the list of peers of the peer
-	peer.Peers = nil
+	//Draining nodes are leaving the cluster
+	if res.Draining {
+		log.WithFields(log.Fields{"controller": c, "func": "scanPeer", "peer": peer}).Info("Skipping draining peer")
+		c.removePeer(peer)
+		return
+	}
 
 	//Parse peers of the peer
-	for _, addr := range peers {
-		//Load the peer
-		iSubPeer, _ := c.Peers.LoadOrStore(addr, NewPeer(addr, c.config))
-		subPeer, ok := iSubPeer.(*Peer)
-		if !ok {
-			log.WithFields(log.Fields{"controller": c, "func": "scanPeer", "peer": peer, "subPeer": subPeer}).Warn("Failed to assert subPeer")
-			continue
-		}
+	subPeers := make([]*Peer, 0, len(res.Peers))
+	for _, addr := range res.Peers {
+		/*Load the peer by address only: the peer may list a former address of
+		a node that moved, and the node reports its ID when scanned.
+		*/
+		subPeer := c.loadPeer(addr, "")
 
 		//Add the sub-peer to the list of peers
-		peer.Peers = append(peer.Peers, subPeer)
+		subPeers = append(subPeers, subPeer)
 
 		//Schedule the peer for scanning if it hasn't already been scanned
 		if _, ok := scanned.Load(addr); !ok {
 			log.WithFields(log.Fields{"controller": c, "func": "scanPeer", "peer": peer, "subPeer": subPeer}).Info("Adding subPeer for scanning")
-			wg.Add(1)
-			go c.scanPeer(subPeer, scanned, wg)
+			tasks.Go(func() { c.scanPeer(ctx, subPeer, scanned, tasks) })
 		}
 	}
+
+	//Replace the list of peers of the peer
+	peer.SetPeers(subPeers)
 }
@@ -10,30 +10,59 @@ import (
 
 //peersHandler handles requests to '/peers'
 func (c *Controller) peersHandler(w http.ResponseWriter, r *http.Request) {
-	corsHeadersResponse(&w, r, c.config, "GET, POST")
-	if r.Method == http.MethodGet {
+	corsHeadersResponse(&w, r, c.config, "GET, POST, DELETE")
+	if r.Method == http.MethodDelete {
+		c.peersDeleteHandler(w, r)
+	} else if r.Method == http.MethodGet {
 		c.peersGetHandler(w, r)
 	} else if r.Method == http.MethodPost {
 		c.peersPostHandler(w, r)
 	} else if r.Method == http.MethodOptions {
-		corsOptionsResponse(w, r, c.config, "GET, POST")
+		corsOptionsResponse(w, r, c.config, "GET, POST, DELETE")
 	} else {
 		methodNotAllowedHandler(w, r)
 	}
 }
 
+/*peersDeleteHandler handles 'DELETE /peers' requests
+
+Nodes send this request while draining. The controller responds once the peers
+of the node are re-homed.
+*/
+func (c *Controller) peersDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{"controller": c, "func": "peersDeleteHandler"}).Info("Received DELETE /peers")
+	addr := &Addr{}
+
+	if err := json.NewDecoder(r.Body).Decode(addr); err != nil {
+		log.WithFields(log.Fields{"controller": c, "func": "peersDeleteHandler"}).Warn("Failed to decode request body")
+		response(w, r, http.StatusInternalServerError, "Failed to decode request body")
+		return
+	}
+
+	//Invalid port number
+	if addr.Port == 0 {
+		response(w, r, http.StatusBadRequest, "Required property 'port' is 0 or not present")
+		return
+	}
+
+	/*Infer that the client node does not know its IP address and use the one
+	from the HTTP request instead.
+	*/
+	if addr.IP == "" {
+		log.WithFields(log.Fields{"controller": c, "func": "peersDeleteHandler"}).Infof("Auto-detecting IP address for peer: %s", strings.SplitN(r.RemoteAddr, ":", 2)[0])
+		addr.IP = strings.SplitN(r.RemoteAddr, ":", 2)[0]
+	}
+
+	c.RemoveNode(r.Context(), *addr)
+	response(w, r, http.StatusOK, "Peers re-homed")
+}
+
 //peersGetHandler handles 'GET /peers' requests
 func (c *Controller) peersGetHandler(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(log.Fields{"controller": c, "func": "peersGetHandler"}).Info("Received GET /peers")
 	//Create response
 	cpr := &CtrlPeersResponse{}
-	c.Peers.Range(func(key, value interface{}) bool {
-		addr, ok := key.(Addr)
-		if !ok {
-			log.WithFields(log.Fields{"controller": c, "func": "peersGetHandler", "addr": addr}).Warn("Failed to assert address")
-			return true
-		}
-
+	c.Peers.Range(func(_, value interface{}) bool {
 		peer, ok := value.(*Peer)
 		if !ok {
 			log.WithFields(log.Fields{"controller": c, "func": "peersGetHandler", "peer": peer}).Warn("Failed to assert peer")
@@ -41,9 +70,10 @@ func (c *Controller) peersGetHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		n := &CtrlPeerResponse{
-			Addr: addr,
+			ID:   peer.ID(),
+			Addr: peer.Addr,
 		}
-		for _, p := range peer.Peers {
+		for _, p := range peer.PeerList() {
 			n.Peers = append(n.Peers, p.Addr)
 		}
 
@@ -59,16 +89,16 @@ func (c *Controller) peersGetHandler(w http.ResponseWriter, r *http.Request) {
 //peersPostHandler handles 'POST /peers' requests
 func (c *Controller) peersPostHandler(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(log.Fields{"controller": c, "func": "peersPostHandler"}).Info("Received POST /peers")
-	addr := &Addr{}
+	req := &PeeringRequest{}
 
-	if err := json.NewDecoder(r.Body).Decode(addr); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 		log.WithFields(log.Fields{"controller": c, "func": "peersPostHandler"}).Warn("Failed to decode request body")
 		response(w, r, http.StatusInternalServerError, "Failed to decode request body")
 		return
 	}
 
 	//Invalid port number
-	if (*addr).Port == 0 {
+	if req.Port == 0 {
 		response(w, r, http.StatusBadRequest, "Required property 'port' is 0 or not present")
 		return
 	}
@@ -76,11 +106,57 @@ func (c *Controller) peersPostHandler(w http.ResponseWriter, r *http.Request) {
 	/*Infer that the client node does not know its IP address and use the one
 	from the HTTP request instead.
 	*/
-	if (*addr).IP == "" {
+	if req.IP == "" {
 		log.WithFields(log.Fields{"controller": c, "func": "peersPostHandler"}).Infof("Auto-detecting IP address for peer: %s", strings.SplitN(r.RemoteAddr, ":", 2)[0])
-		(*addr).IP = strings.SplitN(r.RemoteAddr, ":", 2)[0]
+		req.IP = strings.SplitN(r.RemoteAddr, ":", 2)[0]
+	}
+
+	if err := c.CheckPeeringRequest(*req); err != nil {
+		log.WithFields(log.Fields{"controller": c, "func": "peersPostHandler", "addr": req.Addr, "id": req.ID}).Warnf("Rejected peering request: %s", err.Error())
+		response(w, r, http.StatusConflict, err.Error())
+		return
 	}
 
-	c.addPeerChan <- *addr
+	if !c.addPeerInbox.sendPeeringRequest(c.ctx, c.addPeerChan, *req) {
+		response(w, r, http.StatusServiceUnavailable, "Controller is stopping")
+		return
+	}
 	response(w, r, http.StatusOK, "Peer address received")
 }
+
+//nodesHandler handles requests to the '/nodes/{addr}/drain' path
+func (c *Controller) nodesHandler(w http.ResponseWriter, r *http.Request) {
+	corsHeadersResponse(&w, r, c.config, "POST")
+	if r.Method == http.MethodOptions {
+		corsOptionsResponse(w, r, c.config, "POST")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/nodes/")
+	if !strings.HasSuffix(path, "/drain") {
+		response(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	addr, err := ParseAddr(strings.TrimSuffix(path, "/drain"))
+	if err != nil {
+		response(w, r, http.StatusBadRequest, "Invalid node address")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		methodNotAllowedHandler(w, r)
+		return
+	}
+	c.nodesDrainHandler(w, r, addr)
+}
+
+//nodesDrainHandler handles 'POST /nodes/{addr}/drain' requests
+func (c *Controller) nodesDrainHandler(w http.ResponseWriter, r *http.Request, addr Addr) {
+	log.WithFields(log.Fields{"controller": c, "func": "nodesDrainHandler", "addr": addr}).Info("Received POST /nodes/{addr}/drain")
+
+	if err := c.Drain(r.Context(), addr); err != nil {
+		response(w, r, http.StatusBadGateway, "Failed to drain node: "+err.Error())
+		return
+	}
+	response(w, r, http.StatusOK, "Node drained")
+}
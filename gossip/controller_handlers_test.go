@@ -11,8 +11,9 @@ import (
 func TestControllerPeersHandlerGet(t *testing.T) {
 	//Prepare peer and controller
 	peer := NewPeer(Addr{"127.0.0.1", 8080}, nil)
+	peer.SetID("a")
 	c := NewController(nil)
-	c.Peers.Store(peer.Addr, peer)
+	c.Peers.Store(peer.ID(), peer)
 	peer.Peers = []*Peer{peer}
 
 	//Send request
@@ -37,6 +38,9 @@ func TestControllerPeersHandlerGet(t *testing.T) {
 	if cpr.Nodes[0].Addr != peer.Addr {
 		t.Errorf("cpr.Nodes[0].Addr == %v; want %v", cpr.Nodes[0].Addr, peer.Addr)
 	}
+	if cpr.Nodes[0].ID != peer.ID() {
+		t.Errorf("cpr.Nodes[0].ID == %q; want %q", cpr.Nodes[0].ID, peer.ID())
+	}
 
 	if len(cpr.Nodes[0].Peers) != 1 {
 		t.Errorf("len(cpr.Nodes[0].Peers) == %d; want %d", len(cpr.Nodes[0].Peers), 1)
@@ -65,13 +69,34 @@ func TestControllerPeersHandlerPost(t *testing.T) {
 		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusOK)
 	}
 
-	rAddr := <-c.addPeerChan
+	rAddr := (<-c.addPeerChan).Addr
 
 	if rAddr != addr {
 		t.Errorf("rAddr == %v; want %v", rAddr, addr)
 	}
 }
 
+func TestControllerPeersHandlerPostConflict(t *testing.T) {
+	//Prepare peer and controller
+	c := NewController(nil)
+	peer := c.loadPeer(Addr{"127.0.0.1", 8080}, "a")
+	reqBody, _ := json.Marshal(PeeringRequest{Addr: peer.Addr, ID: "b"})
+
+	//Send request
+	req := httptest.NewRequest("POST", "http://127.0.0.1:7080/peers", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	c.peersHandler(w, req)
+	res := w.Result()
+
+	//Parse response
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusConflict)
+	}
+	if len(c.addPeerChan) != 0 {
+		t.Errorf("len(c.addPeerChan) == %d; want %d", len(c.addPeerChan), 0)
+	}
+}
+
 func TestControllerPeersHandlerPostEmpty(t *testing.T) {
 	//Prepare controller
 	c := NewController(nil)
@@ -87,3 +112,57 @@ func TestControllerPeersHandlerPostEmpty(t *testing.T) {
 		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusBadRequest)
 	}
 }
+
+func TestControllerPeersHandlerDelete(t *testing.T) {
+	//Prepare addr and controller
+	addr := Addr{"127.0.0.1", 8080}
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	c := NewController(&config)
+	c.loadPeer(addr, "")
+	reqBody, _ := json.Marshal(addr)
+
+	//Send request
+	req := httptest.NewRequest("DELETE", "http://127.0.0.1:7080/peers", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	c.peersHandler(w, req)
+	res := w.Result()
+
+	//Parse response
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusOK)
+	}
+	if c.findPeer(addr) != nil {
+		t.Errorf("Peer %v found in c.Peers", addr)
+	}
+}
+
+func TestControllerNodesHandlerDrain(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	c := NewController(&config)
+
+	testCases := []struct {
+		method     string
+		path       string
+		statusCode int
+	}{
+		{"POST", "/nodes/127.0.0.1:8080/drain", http.StatusOK},
+		{"GET", "/nodes/127.0.0.1:8080/drain", http.StatusMethodNotAllowed},
+		{"POST", "/nodes/127.0.0.1/drain", http.StatusBadRequest},
+		{"POST", "/nodes/127.0.0.1:8080", http.StatusNotFound},
+	}
+
+	for _, testCase := range testCases {
+		//Send request
+		req := httptest.NewRequest(testCase.method, "http://127.0.0.1:7080"+testCase.path, nil)
+		w := httptest.NewRecorder()
+		c.Handler().ServeHTTP(w, req)
+		res := w.Result()
+
+		//Parse response
+		if res.StatusCode != testCase.statusCode {
+			t.Errorf("res.StatusCode == %d for %s %s; want %d", res.StatusCode, testCase.method, testCase.path, testCase.statusCode)
+		}
+	}
+}
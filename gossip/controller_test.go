@@ -1,9 +1,14 @@
 package gossip
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,7 +19,7 @@ func TestControllerAddPeerWorker(t *testing.T) {
 	go c.addPeerWorker()
 
 	//Add a peer
-	c.addPeerChan <- addr
+	c.addPeerChan <- PeeringRequest{Addr: addr}
 	time.Sleep(100 * time.Millisecond)
 
 	if _, ok := c.Peers.Load(addr); !ok {
@@ -30,7 +35,7 @@ func TestControllerAddPeerWorker(t *testing.T) {
 	}
 
 	//Test idempotence, a peer should not be added twice
-	c.addPeerChan <- addr
+	c.addPeerChan <- PeeringRequest{Addr: addr}
 	time.Sleep(100 * time.Millisecond)
 
 	if _, ok := c.Peers.Load(addr); !ok {
@@ -287,12 +292,13 @@ func TestControllerFindLowPeersFull(t *testing.T) {
 func TestControllerRemovePeerWorker(t *testing.T) {
 	addr := Addr{"127.0.0.1", 8080}
 	c := NewController(nil)
-	removePeerChan := make(chan Addr)
+	removePeerChan := make(chan *Peer)
 	defer close(removePeerChan)
-	c.Peers.Store(addr, NewPeer(addr, nil))
+	peer := NewPeer(addr, nil)
+	c.Peers.Store(addr, peer)
 
-	go c.removePeerWorker(removePeerChan)
-	removePeerChan <- addr
+	go c.removePeerWorker(removePeerChan, c.config.newInbox())
+	removePeerChan <- peer
 	//TODO: Find a better solution to handle asynchronous operations.
 	time.Sleep(100 * time.Millisecond)
 
@@ -309,6 +315,68 @@ func TestControllerRemovePeerWorker(t *testing.T) {
 	}
 }
 
+func TestControllerLoadPeer(t *testing.T) {
+	addr := Addr{"127.0.0.1", 8080}
+	newAddr := Addr{"127.0.0.1", 8081}
+	c := NewController(nil)
+
+	//Peers are keyed by address until their ID is known
+	peer := c.loadPeer(addr, "")
+	if _, ok := c.Peers.Load(addr); !ok {
+		t.Errorf("Peer %v not found in c.Peers", addr)
+	}
+
+	//Learning the ID keys the peer by ID
+	if p := c.loadPeer(addr, "a"); p != peer {
+		t.Errorf("c.loadPeer(%v, %q) == %v; want %v", addr, "a", p, peer)
+	}
+	if _, ok := c.Peers.Load(addr); ok {
+		t.Errorf("Peer %v still keyed by address in c.Peers", addr)
+	}
+	if value, ok := c.Peers.Load("a"); !ok || value != peer {
+		t.Errorf("c.Peers.Load(%q) == %v, %t; want %v, true", "a", value, ok, peer)
+	}
+
+	//A known ID at another address replaces the peer
+	moved := c.loadPeer(newAddr, "a")
+	if moved == peer || moved.Addr != newAddr {
+		t.Errorf("c.loadPeer(%v, %q) == %v; want a new peer at %v", newAddr, "a", moved, newAddr)
+	}
+	var pLength int
+	c.Peers.Range(func(_, _ interface{}) bool {
+		pLength++
+		return true
+	})
+	if pLength != 1 {
+		t.Errorf("pLength == %d; want %d", pLength, 1)
+	}
+
+	//A former address reported by another node does not move the ID back
+	stale := c.loadPeer(addr, "")
+	if stale == moved || c.findPeer(newAddr) != moved {
+		t.Errorf("c.loadPeer(%v, %q) == %v; want a peer other than %v", addr, "", stale, moved)
+	}
+	if value, ok := c.Peers.Load("a"); !ok || value != moved {
+		t.Errorf("c.Peers.Load(%q) == %v, %t; want %v, true", "a", value, ok, moved)
+	}
+}
+
+func TestControllerCheckPeeringRequest(t *testing.T) {
+	addr := Addr{"127.0.0.1", 8080}
+	c := NewController(nil)
+	c.loadPeer(addr, "a")
+
+	if err := c.CheckPeeringRequest(PeeringRequest{Addr: addr, ID: "a"}); err != nil {
+		t.Errorf("c.CheckPeeringRequest() with the same ID == %v; want nil", err)
+	}
+	if err := c.CheckPeeringRequest(PeeringRequest{Addr: addr}); err != nil {
+		t.Errorf("c.CheckPeeringRequest() without ID == %v; want nil", err)
+	}
+	if err := c.CheckPeeringRequest(PeeringRequest{Addr: addr, ID: "b"}); err == nil {
+		t.Errorf("c.CheckPeeringRequest() with another ID == nil; want an error")
+	}
+}
+
 func TestControllerScanPeers(t *testing.T) {
 	//Setup
 	peer := NewPeer(Addr{"127.0.0.1", 80}, nil)
@@ -329,9 +397,9 @@ func TestControllerScanPeers(t *testing.T) {
 	}))
 	defer func() { testServer.Close() }()
 	peer.Addr = parseURL(testServer.URL)
-	c.Peers.Store(peer.Addr, peer)
+	c.storePeer(peer)
 
-	c.ScanPeers()
+	c.ScanPeers(context.Background())
 
 	if !received {
 		t.Errorf("HTTP Server never received a request")
@@ -349,3 +417,130 @@ func TestControllerScanPeers(t *testing.T) {
 		t.Errorf("lenPeers == %d; want %d", lenPeers, 1)
 	}
 }
+
+func TestControllerConcurrentScan(t *testing.T) {
+	addrs := []Addr{{"127.0.0.1", 9000}, {"127.0.0.1", 9001}, {"127.0.0.1", 9002}, {"127.0.0.1", 9003}}
+	config := *DefaultConfig
+	config.Transport = &stubTransport{peers: addrs[:2]}
+	c := NewController(&config)
+	for _, addr := range addrs {
+		c.loadPeer(addr, "")
+	}
+	c.StartWorkers(context.Background())
+	defer c.Stop(context.Background())
+
+	//Hammer the HTTP handlers while the controller scans and connects peers
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				c.ScanPeers(context.Background())
+				c.MergeClusters(c.FindClusters())
+				c.ConnectLowPeers()
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				addr := fmt.Sprintf(`{"ip": "127.0.0.1", "port": %d}`, 9000+(i+j)%4)
+				c.peersHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/peers", nil))
+				c.peersHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/peers", strings.NewReader(addr)))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestControllerStartStop(t *testing.T) {
+	config := *DefaultConfig
+	config.Controller.IP = "127.0.0.1"
+	config.Controller.Port = 0
+	c := NewController(&config)
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("c.Start() == %v; want nil", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Stop(ctx); err != nil {
+		t.Errorf("c.Stop() == %v; want nil", err)
+	}
+}
+
+func TestControllerDiscoveryWorker(t *testing.T) {
+	config := *DefaultConfig
+	config.DNS = newStubResolver()
+	config.Controller.Discovery = []string{"gossip.local:8080"}
+	c := NewController(&config)
+	go c.discoveryWorker()
+	defer c.cancel()
+
+	for _, expected := range []Addr{{"10.0.0.1", 8080}, {"10.0.0.2", 8080}} {
+		select {
+		case req := <-c.addPeerChan:
+			if req.Addr != expected {
+				t.Errorf("Received %v from c.addPeerChan; want %v", req.Addr, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %v", expected)
+		}
+	}
+}
+
+func TestControllerRehome(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	c := NewController(&config)
+	peer := c.loadPeer(Addr{"127.0.0.1", 8080}, "")
+	neighbours := []*Peer{
+		c.loadPeer(Addr{"127.0.0.1", 8081}, ""),
+		c.loadPeer(Addr{"127.0.0.1", 8082}, ""),
+		c.loadPeer(Addr{"127.0.0.1", 8083}, ""),
+	}
+
+	c.rehome(peer, neighbours)
+
+	//Neighbours are connected in a ring
+	for i, neighbour := range neighbours {
+		if neighbour.PeerCount() != 2 {
+			t.Errorf("neighbours[%d].PeerCount() == %d; want %d", i, neighbour.PeerCount(), 2)
+		}
+	}
+	if c.findPeer(peer.Addr) != nil {
+		t.Errorf("Peer %v found in c.Peers after re-homing its peers", peer.Addr)
+	}
+}
+
+func TestControllerDrain(t *testing.T) {
+	addr := Addr{"127.0.0.1", 8080}
+	transport := &stubTransport{peers: []Addr{{"127.0.0.1", 8081}, {"127.0.0.1", 8082}}}
+	config := *DefaultConfig
+	config.Transport = transport
+	c := NewController(&config)
+	c.loadPeer(addr, "")
+
+	if err := c.Drain(context.Background(), addr); err != nil {
+		t.Fatalf("c.Drain() == %v; want nil", err)
+	}
+
+	//The node did not ask the controller to re-home its peers
+	if c.findPeer(addr) != nil {
+		t.Errorf("Peer %v found in c.Peers after draining", addr)
+	}
+	if peer := c.findPeer(transport.peers[0]); peer == nil || peer.PeerCount() != 1 {
+		t.Errorf("c.findPeer(%v) == %v; want a peer with 1 peer", transport.peers[0], peer)
+	}
+
+	//Failing to drain the node keeps it
+	config.Transport = &stubTransport{err: errors.New("TestControllerDrain")}
+	c = NewController(&config)
+	c.loadPeer(addr, "")
+	if err := c.Drain(context.Background(), addr); err == nil {
+		t.Errorf("c.Drain() == nil; want an error")
+	}
+	if c.findPeer(addr) == nil {
+		t.Errorf("Peer %v not found in c.Peers after failing to drain it", addr)
+	}
+}
@@ -0,0 +1,165 @@
+package gossip
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*DNSResolver looks up DNS records to discover nodes. *net.Resolver implements
+this interface.
+*/
+type DNSResolver interface {
+	//LookupHost returns the IP addresses of a host, from its A and AAAA records
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	//LookupSRV returns the SRV records of a service
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+/*Discovery finds the addresses of nodes by resolving DNS names.
+
+Names in the 'host:port' format are resolved through A and AAAA records: each
+IP address becomes a node listening on that port. This suits headless services
+that return one record per node.
+
+Other names, such as '_gossip._tcp.gossip.default.svc.cluster.local', are
+resolved through SRV records: each target becomes a node listening on the port
+of the record. Targets keep their hostname, which is resolved again every time
+a connection is opened, so that nodes are still reachable after their IP
+address changes.
+*/
+type Discovery struct {
+	//Names is the list of DNS names to resolve
+	Names []string
+
+	//resolver looks up DNS records
+	resolver DNSResolver
+}
+
+//NewDiscovery creates a new Discovery resolving the given names
+func NewDiscovery(names []string, config *Config) *Discovery {
+	if config == nil {
+		config = DefaultConfig
+	}
+
+	return &Discovery{
+		Names:    names,
+		resolver: config.dns(),
+	}
+}
+
+/*Resolve resolves all names and returns the addresses found, sorted and
+without duplicates.
+
+Names that fail to resolve are skipped. This returns the last error if no name
+could be resolved.
+*/
+func (d *Discovery) Resolve(ctx context.Context) ([]Addr, error) {
+	found := make(map[Addr]bool)
+	var lastErr error
+	resolved := 0
+	for _, name := range d.Names {
+		addrs, err := d.resolve(ctx, name)
+		if err != nil {
+			log.WithFields(log.Fields{"func": "Resolve", "name": name}).Warnf("Failed to resolve name: %s", err.Error())
+			lastErr = err
+			continue
+		}
+		resolved++
+		for _, addr := range addrs {
+			found[addr] = true
+		}
+	}
+	if resolved == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	addrs := make([]Addr, 0, len(found))
+	for addr := range found {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].String() < addrs[j].String()
+	})
+	return addrs, nil
+}
+
+/*IsSelf returns true if addr points to the node at self, either directly or
+through a hostname resolving to the IP address of the node.
+
+If the node does not know its IP address, any IP address of this host matches.
+*/
+func (d *Discovery) IsSelf(ctx context.Context, addr Addr, self Addr) bool {
+	if addr == self {
+		return true
+	}
+	if addr.Port != self.Port {
+		return false
+	}
+
+	ips := []string{addr.IP}
+	if net.ParseIP(addr.IP) == nil {
+		resolved, err := d.resolver.LookupHost(ctx, addr.IP)
+		if err != nil {
+			return false
+		}
+		ips = resolved
+	}
+
+	if self.IP != "" {
+		for _, ip := range ips {
+			if ip == self.IP {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		for _, ifaceAddr := range ifaceAddrs {
+			if ipNet, ok := ifaceAddr.(*net.IPNet); ok && ipNet.IP.Equal(parsed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//resolve resolves a single name
+func (d *Discovery) resolve(ctx context.Context, name string) ([]Addr, error) {
+	//Names with a port are resolved through A and AAAA records
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		addr, err := ParseAddr(name)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := d.resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]Addr, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, Addr{IP: ip, Port: addr.Port})
+		}
+		return addrs, nil
+	}
+
+	//Other names are resolved through SRV records
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]Addr, 0, len(records))
+	for _, record := range records {
+		addrs = append(addrs, Addr{IP: strings.TrimSuffix(record.Target, "."), Port: int(record.Port)})
+	}
+	return addrs, nil
+}
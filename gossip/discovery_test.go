@@ -0,0 +1,110 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+//stubResolver is a DNSResolver returning records from maps
+type stubResolver struct {
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("No such host")
+	}
+	return ips, nil
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	records, ok := r.srvs[name]
+	if !ok {
+		return "", nil, errors.New("No such host")
+	}
+	return name, records, nil
+}
+
+func newStubResolver() *stubResolver {
+	return &stubResolver{
+		hosts: map[string][]string{
+			"gossip.local":   {"10.0.0.2", "10.0.0.1"},
+			"node-1.local":   {"10.0.0.1"},
+			"node-3.local":   {"10.0.0.3"},
+			"gossip6.local":  {"fd00::1"},
+			"elsewhere.test": {"192.0.2.1"},
+		},
+		srvs: map[string][]*net.SRV{
+			"_gossip._tcp.gossip.local": {
+				{Target: "node-1.local.", Port: 8080},
+				{Target: "node-3.local.", Port: 8080},
+			},
+		},
+	}
+}
+
+func TestDiscoveryResolve(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Names    []string
+		Expected []Addr
+		Err      bool
+	}{
+		{"a", []string{"gossip.local:8080"}, []Addr{{"10.0.0.1", 8080}, {"10.0.0.2", 8080}}, false},
+		{"aaaa", []string{"gossip6.local:8080"}, []Addr{{"fd00::1", 8080}}, false},
+		{"srv", []string{"_gossip._tcp.gossip.local"}, []Addr{{"node-1.local", 8080}, {"node-3.local", 8080}}, false},
+		{"dedupe", []string{"gossip.local:8080", "node-1.local:8080"}, []Addr{{"10.0.0.1", 8080}, {"10.0.0.2", 8080}}, false},
+		{"partial", []string{"unknown.local:8080", "node-3.local:8081"}, []Addr{{"10.0.0.3", 8081}}, false},
+		{"failed", []string{"unknown.local:8080", "_gossip._tcp.unknown.local"}, nil, true},
+		{"invalid-port", []string{"gossip.local:0"}, nil, true},
+		{"empty", []string{}, []Addr{}, false},
+	}
+
+	config := *DefaultConfig
+	config.DNS = newStubResolver()
+	for _, testCase := range testCases {
+		d := NewDiscovery(testCase.Names, &config)
+		addrs, err := d.Resolve(context.Background())
+		if err != nil != testCase.Err {
+			t.Errorf("d.Resolve() returned error %v for test case %q; want error %v", err, testCase.Name, testCase.Err)
+			continue
+		}
+		if !testCase.Err && !reflect.DeepEqual(addrs, testCase.Expected) {
+			t.Errorf("d.Resolve() == %v for test case %q; want %v", addrs, testCase.Name, testCase.Expected)
+		}
+	}
+}
+
+func TestDiscoveryIsSelf(t *testing.T) {
+	config := *DefaultConfig
+	config.DNS = newStubResolver()
+	d := NewDiscovery(nil, &config)
+	self := Addr{"10.0.0.1", 8080}
+
+	testCases := []struct {
+		Addr     Addr
+		Self     Addr
+		Expected bool
+	}{
+		{self, self, true},
+		{Addr{"10.0.0.2", 8080}, self, false},
+		{Addr{"10.0.0.1", 8081}, self, false},
+		{Addr{"node-1.local", 8080}, self, true},
+		{Addr{"node-3.local", 8080}, self, false},
+		{Addr{"unknown.local", 8080}, self, false},
+		//Without an IP address, the addresses of the host are used
+		{Addr{"127.0.0.1", 8080}, Addr{"", 8080}, true},
+		{Addr{"elsewhere.test", 8080}, Addr{"", 8080}, false},
+	}
+
+	for _, testCase := range testCases {
+		if isSelf := d.IsSelf(context.Background(), testCase.Addr, testCase.Self); isSelf != testCase.Expected {
+			t.Errorf("d.IsSelf(%v, %v) == %v; want %v", testCase.Addr, testCase.Self, isSelf, testCase.Expected)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//ErrMessageDropped is returned by a FaultTransport when it drops a message
+var ErrMessageDropped = errors.New("Message dropped by fault injection")
+
+/*Latency is a distribution of delays added to messages.
+
+Samples below zero are rounded up to zero.
+*/
+type Latency struct {
+	/*Distribution is the shape of the distribution: "constant" (default),
+	"uniform", "normal" or "exponential"*/
+	Distribution string `json:"distribution,omitempty"`
+	//Mean is the average delay
+	Mean time.Duration `json:"mean"`
+	/*Jitter is the maximum deviation from the mean for uniform distributions,
+	and the standard deviation for normal distributions*/
+	Jitter time.Duration `json:"jitter,omitempty"`
+}
+
+//sample returns a random delay following the distribution
+func (l Latency) sample(r *rand.Rand) time.Duration {
+	var d time.Duration
+	switch l.Distribution {
+	case "uniform":
+		d = l.Mean - l.Jitter + time.Duration(r.Float64()*float64(2*l.Jitter))
+	case "normal":
+		d = l.Mean + time.Duration(r.NormFloat64()*float64(l.Jitter))
+	case "exponential":
+		d = time.Duration(r.ExpFloat64() * float64(l.Mean))
+	default:
+		d = l.Mean
+	}
+
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+//validate returns an error if the distribution is not supported
+func (l Latency) validate() error {
+	switch l.Distribution {
+	case "", "constant", "uniform", "normal", "exponential":
+	default:
+		return errors.New("Unknown latency distribution '" + l.Distribution + "'")
+	}
+	if l.Mean < 0 || l.Jitter < 0 {
+		return errors.New("Latency cannot be negative")
+	}
+	return nil
+}
+
+/*FaultRule describes faults applied to messages from and to given addresses.
+
+Each message is delivered as a request from the sender to the recipient, then
+as a response from the recipient to the sender, and rules apply to both.
+*/
+type FaultRule struct {
+	//From is the list of senders affected by the rule. If empty, all senders are affected.
+	From []Addr `json:"from,omitempty"`
+	//To is the list of recipients affected by the rule. If empty, all recipients are affected.
+	To []Addr `json:"to,omitempty"`
+
+	//Drop is the probability that a message is dropped
+	Drop float64 `json:"drop,omitempty"`
+	/*Duplicate is the probability that a message is delivered twice. This
+	only applies to states and peering requests, as duplicating reads has no
+	effect on the recipient.*/
+	Duplicate float64 `json:"duplicate,omitempty"`
+	/*Reorder is the probability that a message is delayed by ReorderDelay, so
+	that messages sent after it are delivered first*/
+	Reorder float64 `json:"reorder,omitempty"`
+	//ReorderDelay is the additional delay for reordered messages
+	ReorderDelay time.Duration `json:"reorderDelay,omitempty"`
+	//Latency is the delay added to every message
+	Latency Latency `json:"latency"`
+
+	//Until is the time at which the rule expires. If zero, the rule never expires.
+	Until time.Time `json:"until"`
+}
+
+//matches returns true if the rule applies to a message sent from an address to another
+func (r FaultRule) matches(from, to Addr) bool {
+	return (len(r.From) == 0 || containsAddr(r.From, from)) && (len(r.To) == 0 || containsAddr(r.To, to))
+}
+
+//validate returns an error if the rule is invalid
+func (r FaultRule) validate() error {
+	for _, p := range []float64{r.Drop, r.Duplicate, r.Reorder} {
+		if p < 0 || p > 1 {
+			return errors.New("Probabilities must be between 0 and 1")
+		}
+	}
+	if r.ReorderDelay < 0 {
+		return errors.New("Reorder delay cannot be negative")
+	}
+	return r.Latency.validate()
+}
+
+/*Partition splits addresses in groups that cannot communicate with each
+other.
+
+Addresses that are not part of any group are not affected by the partition.
+*/
+type Partition struct {
+	//Groups is the list of groups of addresses
+	Groups [][]Addr `json:"groups"`
+	//Until is the time at which the partition heals. If zero, the partition never heals.
+	Until time.Time `json:"until"`
+}
+
+//separates returns true if two addresses are in different groups
+func (p Partition) separates(from, to Addr) bool {
+	fromGroup, toGroup := -1, -1
+	for i, group := range p.Groups {
+		if containsAddr(group, from) {
+			fromGroup = i
+		}
+		if containsAddr(group, to) {
+			toGroup = i
+		}
+	}
+	return fromGroup != -1 && toGroup != -1 && fromGroup != toGroup
+}
+
+//FaultSpec is the list of faults injected by a Faults instance
+type FaultSpec struct {
+	Rules      []FaultRule `json:"rules"`
+	Partitions []Partition `json:"partitions"`
+}
+
+/*Faults holds the faults injected in messages between peers.
+
+A single Faults instance can be shared by multiple FaultTransports, for example
+to partition a simulated cluster. Faults can be changed at any time, and rules
+and partitions are removed once they expire.
+*/
+type Faults struct {
+	//spec is the list of active faults
+	spec FaultSpec
+	//rand is the source of randomness for probabilities and latencies
+	rand *rand.Rand
+	//clock is used to expire rules and partitions
+	clock Clock
+	//mu protects access to spec and rand
+	mu sync.Mutex
+}
+
+//faultPlan is the outcome of applying faults to a single message
+type faultPlan struct {
+	//drop is true if the message must be dropped
+	drop bool
+	//duplicate is true if the message must be delivered twice
+	duplicate bool
+	//delay is the time to wait before delivering the message
+	delay time.Duration
+}
+
+//NewFaults creates a new Faults instance without any fault
+func NewFaults(clock Clock) *Faults {
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	return &Faults{
+		spec:  FaultSpec{Rules: []FaultRule{}, Partitions: []Partition{}},
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		clock: clock,
+	}
+}
+
+//AddPartition adds a partition
+func (f *Faults) AddPartition(partition Partition) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.spec.Partitions = append(f.spec.Partitions, partition)
+}
+
+//AddRule adds a rule, or returns an error if the rule is invalid
+func (f *Faults) AddRule(rule FaultRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.spec.Rules = append(f.spec.Rules, rule)
+	return nil
+}
+
+//Reset removes all rules and partitions
+func (f *Faults) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.spec = FaultSpec{Rules: []FaultRule{}, Partitions: []Partition{}}
+}
+
+//Seed makes the faults reproducible by seeding the source of randomness
+func (f *Faults) Seed(seed int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rand = rand.New(rand.NewSource(seed))
+}
+
+//Set replaces all rules and partitions, or returns an error if a rule is invalid
+func (f *Faults) Set(spec FaultSpec) error {
+	for _, rule := range spec.Rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	//Copy the slices as expired faults are removed in place
+	f.spec = FaultSpec{
+		Rules:      append([]FaultRule{}, spec.Rules...),
+		Partitions: append([]Partition{}, spec.Partitions...),
+	}
+	return nil
+}
+
+//Spec returns the rules and partitions that have not expired yet
+func (f *Faults) Spec() FaultSpec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.expire()
+	spec := FaultSpec{
+		Rules:      make([]FaultRule, len(f.spec.Rules)),
+		Partitions: make([]Partition, len(f.spec.Partitions)),
+	}
+	copy(spec.Rules, f.spec.Rules)
+	copy(spec.Partitions, f.spec.Partitions)
+	return spec
+}
+
+/*expire removes the rules and partitions that have expired.
+
+This must be called while holding f.mu.
+*/
+func (f *Faults) expire() {
+	now := f.clock.Now()
+	active := func(until time.Time) bool {
+		return until.IsZero() || now.Before(until)
+	}
+
+	rules := f.spec.Rules[:0]
+	for _, rule := range f.spec.Rules {
+		if active(rule.Until) {
+			rules = append(rules, rule)
+		}
+	}
+	f.spec.Rules = rules
+
+	partitions := f.spec.Partitions[:0]
+	for _, partition := range f.spec.Partitions {
+		if active(partition.Until) {
+			partitions = append(partitions, partition)
+		}
+	}
+	f.spec.Partitions = partitions
+}
+
+//plan decides which faults to apply to a message sent from an address to another
+func (f *Faults) plan(from, to Addr) faultPlan {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.expire()
+	plan := faultPlan{}
+	for _, partition := range f.spec.Partitions {
+		if partition.separates(from, to) {
+			plan.drop = true
+			return plan
+		}
+	}
+
+	for _, rule := range f.spec.Rules {
+		if !rule.matches(from, to) {
+			continue
+		}
+
+		if rule.Drop > 0 && f.rand.Float64() < rule.Drop {
+			plan.drop = true
+		}
+		if rule.Duplicate > 0 && f.rand.Float64() < rule.Duplicate {
+			plan.duplicate = true
+		}
+		if rule.Reorder > 0 && f.rand.Float64() < rule.Reorder {
+			plan.delay += rule.ReorderDelay
+		}
+		plan.delay += rule.Latency.sample(f.rand)
+	}
+	return plan
+}
+
+/*FaultTransport is a Transport injecting faults in the messages sent through
+another Transport.
+*/
+type FaultTransport struct {
+	//Transport is the Transport used to deliver messages
+	Transport Transport
+	//From is the address of the sender of all messages
+	From Addr
+	//Faults is the list of faults to inject
+	Faults *Faults
+	//Tracker counts delayed messages as tasks once their delay elapses
+	Tracker Tracker
+
+	//clock is used to delay messages
+	clock Clock
+}
+
+//NewFaultTransport creates a new FaultTransport
+func NewFaultTransport(transport Transport, from Addr, faults *Faults, clock Clock) *FaultTransport {
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	return &FaultTransport{
+		Transport: transport,
+		From:      from,
+		Faults:    faults,
+		clock:     clock,
+	}
+}
+
+//Announce tells a peer that the sender holds a state whose data is split in chunks
+func (t *FaultTransport) Announce(ctx context.Context, addr Addr, announcement Announcement) error {
+	return t.do(ctx, addr, true, func(ctx context.Context) error {
+		return t.Transport.Announce(ctx, addr, announcement)
+	})
+}
+
+//Drain asks a node to drain before it leaves the cluster
+func (t *FaultTransport) Drain(ctx context.Context, addr Addr) error {
+	return t.do(ctx, addr, false, func(ctx context.Context) error {
+		return t.Transport.Drain(ctx, addr)
+	})
+}
+
+//Get retrieves the latest state for a key from a peer
+func (t *FaultTransport) Get(ctx context.Context, addr Addr, key string) (State, error) {
+	var state State
+	err := t.do(ctx, addr, false, func(ctx context.Context) (err error) {
+		state, err = t.Transport.Get(ctx, addr, key)
+		return err
+	})
+	return state, err
+}
+
+//GetChunk retrieves a chunk of the data of the latest state for a key from a peer
+func (t *FaultTransport) GetChunk(ctx context.Context, addr Addr, key, digest string, index int) ([]byte, error) {
+	var chunk []byte
+	err := t.do(ctx, addr, false, func(ctx context.Context) (err error) {
+		chunk, err = t.Transport.GetChunk(ctx, addr, key, digest, index)
+		return err
+	})
+	return chunk, err
+}
+
+//GetMetadata retrieves the latest state for a key from a peer, without its data
+func (t *FaultTransport) GetMetadata(ctx context.Context, addr Addr, key string) (State, error) {
+	var state State
+	err := t.do(ctx, addr, false, func(ctx context.Context) (err error) {
+		state, err = t.Transport.GetMetadata(ctx, addr, key)
+		return err
+	})
+	return state, err
+}
+
+//GetPeers retrieves the ID and the peers of a peer
+func (t *FaultTransport) GetPeers(ctx context.Context, addr Addr) (PeersResponse, error) {
+	var res PeersResponse
+	err := t.do(ctx, addr, false, func(ctx context.Context) (err error) {
+		res, err = t.Transport.GetPeers(ctx, addr)
+		return err
+	})
+	return res, err
+}
+
+//GetTree retrieves the hashes of nodes at a level of the Merkle tree of a peer
+func (t *FaultTransport) GetTree(ctx context.Context, addr Addr, req TreeRequest) (TreeResponse, error) {
+	var res TreeResponse
+	err := t.do(ctx, addr, false, func(ctx context.Context) (err error) {
+		res, err = t.Transport.GetTree(ctx, addr, req)
+		return err
+	})
+	return res, err
+}
+
+//GetStatus retrieves the status of a peer, including the status of each of its keys
+func (t *FaultTransport) GetStatus(ctx context.Context, addr Addr) (StatusResponse, error) {
+	var status StatusResponse
+	err := t.do(ctx, addr, false, func(ctx context.Context) (err error) {
+		status, err = t.Transport.GetStatus(ctx, addr)
+		return err
+	})
+	return status, err
+}
+
+//Ping retrieves the status of a peer
+func (t *FaultTransport) Ping(ctx context.Context, addr Addr, events []MemberEvent) (StatusResponse, error) {
+	var status StatusResponse
+	err := t.do(ctx, addr, false, func(ctx context.Context) (err error) {
+		status, err = t.Transport.Ping(ctx, addr, events)
+		return err
+	})
+	return status, err
+}
+
+//Probe asks a peer to probe req.Target on behalf of the sender
+func (t *FaultTransport) Probe(ctx context.Context, addr Addr, req ProbeRequest) (ProbeResponse, error) {
+	var res ProbeResponse
+	err := t.do(ctx, addr, false, func(ctx context.Context) (err error) {
+		res, err = t.Transport.Probe(ctx, addr, req)
+		return err
+	})
+	return res, err
+}
+
+//Send sends a state to a peer
+func (t *FaultTransport) Send(ctx context.Context, addr Addr, state State, events []MemberEvent) error {
+	return t.do(ctx, addr, true, func(ctx context.Context) error {
+		return t.Transport.Send(ctx, addr, state, events)
+	})
+}
+
+//SendPeeringRequest asks a peer to peer with the node in req
+func (t *FaultTransport) SendPeeringRequest(ctx context.Context, addr Addr, req PeeringRequest) error {
+	return t.do(ctx, addr, true, func(ctx context.Context) error {
+		return t.Transport.SendPeeringRequest(ctx, addr, req)
+	})
+}
+
+//SendPeerDeletionRequest asks a peer to remove peerAddr from its peers
+func (t *FaultTransport) SendPeerDeletionRequest(ctx context.Context, addr Addr, peerAddr Addr) error {
+	return t.do(ctx, addr, true, func(ctx context.Context) error {
+		return t.Transport.SendPeerDeletionRequest(ctx, addr, peerAddr)
+	})
+}
+
+//Sync retrieves the status of the keys in leaves of the Merkle tree of a peer
+func (t *FaultTransport) Sync(ctx context.Context, addr Addr, req SyncRequest) (SyncResponse, error) {
+	var res SyncResponse
+	err := t.do(ctx, addr, false, func(ctx context.Context) (err error) {
+		res, err = t.Transport.Sync(ctx, addr, req)
+		return err
+	})
+	return res, err
+}
+
+/*do delivers a request to addr and its response back, applying faults in both
+directions.
+
+If duplicate is true, the request can be delivered twice. The outcome of the
+second delivery is ignored.
+*/
+func (t *FaultTransport) do(ctx context.Context, addr Addr, duplicate bool, f func(ctx context.Context) error) error {
+	//Request
+	req := t.Faults.plan(t.From, addr)
+	if err := t.wait(ctx, req.delay); err != nil {
+		return err
+	}
+	if req.drop {
+		return ErrMessageDropped
+	}
+	err := f(ctx)
+	if duplicate && req.duplicate {
+		f(ctx)
+	}
+
+	//Response
+	res := t.Faults.plan(addr, t.From)
+	if err := t.wait(ctx, res.delay); err != nil {
+		return err
+	}
+	if res.drop {
+		return ErrMessageDropped
+	}
+	return err
+}
+
+//wait waits for a delay on the clock, or until the context is cancelled
+func (t *FaultTransport) wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	if !sleep(ctx, t.clock, t.Tracker, d) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+//containsAddr returns true if an address is in a list
+func containsAddr(addrs []Addr, addr Addr) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+/*withFaults returns a copy of the configuration where messages sent from an
+address go through a FaultTransport.
+*/
+func (c *Config) withFaults(from Addr, faults *Faults) *Config {
+	config := *c
+	transport := NewFaultTransport(c.transport(), from, faults, c.clock())
+	transport.Tracker = c.Tracker
+	config.Transport = transport
+	return &config
+}
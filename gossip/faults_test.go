@@ -0,0 +1,148 @@
+package gossip
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFaultsPartition(t *testing.T) {
+	a, b, c := Addr{"127.0.0.1", 8080}, Addr{"127.0.0.1", 8081}, Addr{"127.0.0.1", 8082}
+	f := NewFaults(nil)
+	f.AddPartition(Partition{Groups: [][]Addr{{a}, {b}}})
+
+	testCases := []struct {
+		from, to Addr
+		drop     bool
+	}{
+		{a, b, true},
+		{b, a, true},
+		{a, c, false},
+		{c, b, false},
+	}
+
+	for i, tc := range testCases {
+		if plan := f.plan(tc.from, tc.to); plan.drop != tc.drop {
+			t.Errorf("[%d] plan.drop == %t; want %t", i, plan.drop, tc.drop)
+		}
+	}
+}
+
+func TestFaultsRule(t *testing.T) {
+	a, b := Addr{"127.0.0.1", 8080}, Addr{"127.0.0.1", 8081}
+	f := NewFaults(nil)
+	if err := f.AddRule(FaultRule{From: []Addr{a}, Drop: 1, Latency: Latency{Mean: time.Second}}); err != nil {
+		t.Fatalf("f.AddRule() returned an error: %s", err.Error())
+	}
+
+	if plan := f.plan(a, b); !plan.drop || plan.delay != time.Second {
+		t.Errorf("f.plan(a, b) == %+v; want drop with 1s delay", plan)
+	}
+	if plan := f.plan(b, a); plan.drop || plan.delay != 0 {
+		t.Errorf("f.plan(b, a) == %+v; want no fault", plan)
+	}
+}
+
+func TestFaultsExpire(t *testing.T) {
+	f := NewFaults(nil)
+	f.AddRule(FaultRule{Drop: 1, Until: time.Now().Add(-time.Second)})
+	f.AddRule(FaultRule{Drop: 1, Until: time.Now().Add(time.Hour)})
+	f.AddPartition(Partition{Until: time.Now().Add(-time.Second)})
+
+	spec := f.Spec()
+	if len(spec.Rules) != 1 {
+		t.Errorf("len(spec.Rules) == %d; want 1", len(spec.Rules))
+	}
+	if len(spec.Partitions) != 0 {
+		t.Errorf("len(spec.Partitions) == %d; want 0", len(spec.Partitions))
+	}
+}
+
+func TestFaultsSetInvalid(t *testing.T) {
+	testCases := []FaultRule{
+		{Drop: 2},
+		{Duplicate: -1},
+		{Latency: Latency{Distribution: "pareto"}},
+		{Latency: Latency{Mean: -time.Second}},
+	}
+
+	f := NewFaults(nil)
+	for i, tc := range testCases {
+		if err := f.Set(FaultSpec{Rules: []FaultRule{tc}}); err == nil {
+			t.Errorf("[%d] f.Set() == nil; want error", i)
+		}
+	}
+}
+
+func TestLatencySample(t *testing.T) {
+	f := NewFaults(nil)
+	f.Seed(1)
+
+	testCases := []Latency{
+		{Mean: time.Second},
+		{Distribution: "uniform", Mean: time.Second, Jitter: 100 * time.Millisecond},
+		{Distribution: "normal", Mean: time.Second, Jitter: 100 * time.Millisecond},
+		{Distribution: "exponential", Mean: time.Second},
+	}
+
+	for i, tc := range testCases {
+		var total time.Duration
+		for j := 0; j < 1000; j++ {
+			d := tc.sample(f.rand)
+			if d < 0 {
+				t.Fatalf("[%d] tc.sample() == %v; want >= 0", i, d)
+			}
+			if tc.Distribution == "uniform" && (d < 900*time.Millisecond || d > 1100*time.Millisecond) {
+				t.Errorf("[%d] tc.sample() == %v; want between 900ms and 1.1s", i, d)
+			}
+			total += d
+		}
+		if mean := total / 1000; mean < 800*time.Millisecond || mean > 1200*time.Millisecond {
+			t.Errorf("[%d] mean == %v; want around 1s", i, mean)
+		}
+	}
+}
+
+func TestFaultTransport(t *testing.T) {
+	a, b := Addr{"127.0.0.1", 8080}, Addr{"127.0.0.1", 8081}
+	stub := &stubTransport{}
+	f := NewFaults(nil)
+	transport := NewFaultTransport(stub, a, f, nil)
+	ctx := context.Background()
+
+	//Duplicate states
+	f.Set(FaultSpec{Rules: []FaultRule{{Duplicate: 1}}})
+	if err := transport.Send(ctx, b, State{}, nil); err != nil {
+		t.Errorf("transport.Send() returned an error: %s", err.Error())
+	}
+	if _, err := transport.Ping(ctx, b, nil); err != nil {
+		t.Errorf("transport.Ping() returned an error: %s", err.Error())
+	}
+	if len(stub.calls) != 3 {
+		t.Errorf("stub.calls == %v; want [Send Send Ping]", stub.calls)
+	}
+
+	//Drop responses from b
+	f.Set(FaultSpec{Rules: []FaultRule{{From: []Addr{b}, Drop: 1}}})
+	if err := transport.Send(ctx, b, State{}, nil); err != ErrMessageDropped {
+		t.Errorf("transport.Send() == %v; want %v", err, ErrMessageDropped)
+	}
+	if len(stub.calls) != 4 {
+		t.Errorf("len(stub.calls) == %d; want 4", len(stub.calls))
+	}
+
+	//Latency
+	f.Set(FaultSpec{Rules: []FaultRule{{Latency: Latency{Mean: 20 * time.Millisecond}}}})
+	start := time.Now()
+	transport.Ping(ctx, b, nil)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("transport.Ping() took %v; want at least 40ms", elapsed)
+	}
+
+	//Cancelled context
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := transport.Send(cctx, b, State{}, nil); err != context.Canceled {
+		t.Errorf("transport.Send() == %v; want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,194 @@
+package gossip
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*Timestamp is a hybrid logical clock timestamp.
+
+Timestamps are ordered by physical time, then by logical counter, then by node
+identifier, which gives a total order across all nodes.
+*/
+type Timestamp struct {
+	//Physical is the wall-clock component, in nanoseconds since the Unix epoch
+	Physical int64 `json:"physical"`
+	//Logical orders events that share the same physical component
+	Logical uint32 `json:"logical"`
+	//Node is the identifier of the node that generated the timestamp
+	Node string `json:"node,omitempty"`
+}
+
+//Compare returns -1, 0 or 1 if t is before, equal to or after o
+func (t Timestamp) Compare(o Timestamp) int {
+	switch {
+	case t.Physical < o.Physical:
+		return -1
+	case t.Physical > o.Physical:
+		return 1
+	case t.Logical < o.Logical:
+		return -1
+	case t.Logical > o.Logical:
+		return 1
+	case t.Node < o.Node:
+		return -1
+	case t.Node > o.Node:
+		return 1
+	}
+	return 0
+}
+
+//After returns true if t is after o
+func (t Timestamp) After(o Timestamp) bool {
+	return t.Compare(o) > 0
+}
+
+//Before returns true if t is before o
+func (t Timestamp) Before(o Timestamp) bool {
+	return t.Compare(o) < 0
+}
+
+//IsZero returns true if the timestamp is not set
+func (t Timestamp) IsZero() bool {
+	return t == Timestamp{}
+}
+
+//String returns a string representation of the timestamp
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%x.%x/%s", t.Physical, t.Logical, t.Node)
+}
+
+/*UnmarshalJSON decodes a timestamp from JSON.
+
+For compatibility with clients that send timestamps as integers in
+nanoseconds, a JSON number is decoded as the physical component of the
+timestamp.
+*/
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && (data[0] == '-' || (data[0] >= '0' && data[0] <= '9')) {
+		*t = Timestamp{}
+		return json.Unmarshal(data, &t.Physical)
+	}
+
+	//Use a different type to prevent infinite recursion
+	type timestamp Timestamp
+	return json.Unmarshal(data, (*timestamp)(t))
+}
+
+//ErrClockDrift is returned when a timestamp is too far ahead of the wall clock
+var ErrClockDrift = errors.New("Timestamp is too far ahead of the clock")
+
+/*HLC is a hybrid logical clock.
+
+It generates timestamps that stay close to the wall-clock time, but that
+always move forward and respect causality: a timestamp generated after
+receiving another timestamp is always greater than the received one, even if
+the wall clock of the sender is ahead.
+
+As a single timestamp far in the future would move the clock past the
+wall-clock time for good, timestamps more than maxDrift ahead of the wall
+clock are rejected.
+*/
+type HLC struct {
+	//node is the identifier of the node that owns the clock
+	node string
+	/*maxDrift is how far ahead of the wall clock a received timestamp can be.
+	If 0, received timestamps are not limited.*/
+	maxDrift time.Duration
+	//last is the last timestamp generated by the clock
+	last Timestamp
+	//now returns the wall-clock time in nanoseconds
+	now func() int64
+	//mu protects access to the last timestamp
+	mu sync.Mutex
+}
+
+//NewHLC creates a new hybrid logical clock for a node
+func NewHLC(node string) *HLC {
+	return &HLC{
+		node: node,
+		now: func() int64 {
+			return time.Now().UnixNano()
+		},
+	}
+}
+
+//Last returns the last timestamp generated by the clock
+func (c *HLC) Last() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.last
+}
+
+//Now generates a timestamp for a local event, such as a write
+func (c *HLC) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pt := c.now(); pt > c.last.Physical {
+		c.last = Timestamp{Physical: pt, Node: c.node}
+	} else {
+		c.last = Timestamp{Physical: c.last.Physical, Logical: c.last.Logical + 1, Node: c.node}
+	}
+
+	return c.last
+}
+
+//Check returns ErrClockDrift if t is too far ahead of the wall clock
+func (c *HLC) Check(t Timestamp) error {
+	return c.check(t, c.now())
+}
+
+//check returns ErrClockDrift if t is more than c.maxDrift ahead of now
+func (c *HLC) check(t Timestamp, now int64) error {
+	if c.maxDrift > 0 && t.Physical-now > int64(c.maxDrift) {
+		return ErrClockDrift
+	}
+	return nil
+}
+
+/*Update advances the clock after receiving a timestamp from another node, and
+returns the new timestamp of the clock.
+
+If the timestamp is too far ahead of the wall clock, the clock is left as is
+and this returns ErrClockDrift.
+*/
+func (c *HLC) Update(t Timestamp) (Timestamp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last := c.last
+	physical := c.now()
+	if err := c.check(t, physical); err != nil {
+		return last, err
+	}
+	if last.Physical > physical {
+		physical = last.Physical
+	}
+	if t.Physical > physical {
+		physical = t.Physical
+	}
+
+	var logical uint32
+	switch {
+	case physical == last.Physical && physical == t.Physical:
+		logical = last.Logical
+		if t.Logical > logical {
+			logical = t.Logical
+		}
+		logical++
+	case physical == last.Physical:
+		logical = last.Logical + 1
+	case physical == t.Physical:
+		logical = t.Logical + 1
+	}
+
+	c.last = Timestamp{Physical: physical, Logical: logical, Node: c.node}
+	return c.last, nil
+}
@@ -0,0 +1,156 @@
+package gossip
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTimestampCompare(t *testing.T) {
+	testCases := []struct {
+		A        Timestamp
+		B        Timestamp
+		Expected int
+	}{
+		{Timestamp{}, Timestamp{}, 0},
+		{Timestamp{1, 0, "a"}, Timestamp{1, 0, "a"}, 0},
+		{Timestamp{1, 0, "a"}, Timestamp{2, 0, "a"}, -1},
+		{Timestamp{2, 0, "a"}, Timestamp{1, 5, "a"}, 1},
+		{Timestamp{1, 1, "a"}, Timestamp{1, 2, "a"}, -1},
+		{Timestamp{1, 1, "b"}, Timestamp{1, 1, "a"}, 1},
+	}
+
+	for i, testCase := range testCases {
+		if c := testCase.A.Compare(testCase.B); c != testCase.Expected {
+			t.Errorf("Compare() == %d in test case %d; want %d", c, i, testCase.Expected)
+		}
+		if c := testCase.B.Compare(testCase.A); c != -testCase.Expected {
+			t.Errorf("reverse Compare() == %d in test case %d; want %d", c, i, -testCase.Expected)
+		}
+	}
+}
+
+func TestTimestampUnmarshalJSON(t *testing.T) {
+	testCases := []struct {
+		JSON     string
+		Expected Timestamp
+	}{
+		{`1257894000000000000`, Timestamp{Physical: 1257894000000000000}},
+		{`0`, Timestamp{}},
+		{`{"physical": 5, "logical": 2, "node": "127.0.0.1:8080"}`, Timestamp{5, 2, "127.0.0.1:8080"}},
+		{`{}`, Timestamp{}},
+	}
+
+	for _, testCase := range testCases {
+		var ts Timestamp
+		if err := json.Unmarshal([]byte(testCase.JSON), &ts); err != nil {
+			t.Errorf("json.Unmarshal(%s) returned error %s", testCase.JSON, err.Error())
+		}
+		if ts != testCase.Expected {
+			t.Errorf("json.Unmarshal(%s) == %v; want %v", testCase.JSON, ts, testCase.Expected)
+		}
+	}
+
+	//Legacy states with an integer timestamp
+	var state State
+	json.Unmarshal([]byte(`{"key": "key", "time": 42, "data": "TestTimestampUnmarshalJSON"}`), &state)
+	if state.Timestamp != (Timestamp{Physical: 42}) {
+		t.Errorf("state.Timestamp == %v; want %v", state.Timestamp, Timestamp{Physical: 42})
+	}
+}
+
+func TestHLCNow(t *testing.T) {
+	var pt int64 = 10
+	c := NewHLC("node")
+	c.now = func() int64 { return pt }
+
+	//The physical time does not move, so the logical counter should increase
+	first := c.Now()
+	second := c.Now()
+	if first != (Timestamp{10, 0, "node"}) {
+		t.Errorf("c.Now() == %v; want %v", first, Timestamp{10, 0, "node"})
+	}
+	if !second.After(first) || second.Logical != 1 {
+		t.Errorf("c.Now() == %v; want %v", second, Timestamp{10, 1, "node"})
+	}
+
+	//The physical time moves forward, so the logical counter resets
+	pt = 20
+	if third := c.Now(); third != (Timestamp{20, 0, "node"}) {
+		t.Errorf("c.Now() == %v; want %v", third, Timestamp{20, 0, "node"})
+	}
+
+	//The physical time moves backward, the clock should not
+	pt = 5
+	if fourth := c.Now(); fourth != (Timestamp{20, 1, "node"}) {
+		t.Errorf("c.Now() == %v; want %v", fourth, Timestamp{20, 1, "node"})
+	}
+}
+
+func TestHLCUpdate(t *testing.T) {
+	var pt int64 = 10
+	c := NewHLC("node")
+	c.now = func() int64 { return pt }
+
+	//Remote clock ahead of the local physical time
+	remote := Timestamp{100, 3, "other"}
+	if ts, err := c.Update(remote); err != nil || ts != (Timestamp{100, 4, "node"}) {
+		t.Errorf("c.Update(%v) == %v, %v; want %v, nil", remote, ts, err, Timestamp{100, 4, "node"})
+	}
+
+	//Local events after receiving the remote timestamp are ordered after it
+	if ts := c.Now(); !ts.After(remote) {
+		t.Errorf("c.Now() == %v; want after %v", ts, remote)
+	}
+
+	//Remote clock behind the local clock
+	remote = Timestamp{50, 9, "other"}
+	if ts, err := c.Update(remote); err != nil || ts != (Timestamp{100, 6, "node"}) {
+		t.Errorf("c.Update(%v) == %v, %v; want %v, nil", remote, ts, err, Timestamp{100, 6, "node"})
+	}
+
+	//Physical time ahead of both clocks
+	pt = 200
+	if ts, err := c.Update(remote); err != nil || ts != (Timestamp{200, 0, "node"}) {
+		t.Errorf("c.Update(%v) == %v, %v; want %v, nil", remote, ts, err, Timestamp{200, 0, "node"})
+	}
+}
+
+func TestHLCUpdateMaxDrift(t *testing.T) {
+	var pt int64 = 1000
+	c := NewHLC("node")
+	c.now = func() int64 { return pt }
+	c.maxDrift = 100
+
+	testCases := []struct {
+		Remote   Timestamp
+		Error    error
+		Expected Timestamp
+	}{
+		//Remote clock ahead, but within the maximum drift
+		{Timestamp{1100, 0, "other"}, nil, Timestamp{1100, 1, "node"}},
+		//Remote clock too far ahead, the clock is left as is
+		{Timestamp{1101, 0, "other"}, ErrClockDrift, Timestamp{1100, 1, "node"}},
+		{Timestamp{1 << 62, 0, "other"}, ErrClockDrift, Timestamp{1100, 1, "node"}},
+		//Remote clock behind
+		{Timestamp{10, 0, "other"}, nil, Timestamp{1100, 2, "node"}},
+	}
+
+	for i, testCase := range testCases {
+		if err := c.Check(testCase.Remote); err != testCase.Error {
+			t.Errorf("c.Check(%v) == %v; want %v for test case %d", testCase.Remote, err, testCase.Error, i)
+		}
+		ts, err := c.Update(testCase.Remote)
+		if err != testCase.Error {
+			t.Errorf("c.Update(%v) returned error %v; want %v for test case %d", testCase.Remote, err, testCase.Error, i)
+		}
+		if ts != testCase.Expected {
+			t.Errorf("c.Update(%v) == %v; want %v for test case %d", testCase.Remote, ts, testCase.Expected, i)
+		}
+	}
+
+	//Without a maximum drift, timestamps are not limited
+	c.maxDrift = 0
+	if _, err := c.Update(Timestamp{1 << 62, 0, "other"}); err != nil {
+		t.Errorf("c.Update() returned error %s without a maximum drift", err.Error())
+	}
+}
@@ -0,0 +1,80 @@
+package gossip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//idFileName is the name of the file storing the ID of a node in its data directory
+const idFileName = "node.id"
+
+/*NewNodeID generates a new random node ID.
+
+IDs are 128-bit random numbers encoded in hexadecimal.
+*/
+func NewNodeID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/*loadNodeID returns the ID of a node.
+
+This returns config.Node.ID if it is set. Otherwise, the ID is read from the
+data directory of the node, or generated and stored there on the first start,
+so that the node keeps the same ID across restarts and address changes. Nodes
+without a data directory get a new ID every time they start.
+*/
+func loadNodeID(config *Config) (string, error) {
+	if config.Node.ID != "" {
+		return config.Node.ID, nil
+	}
+	if config.Node.DataDir == "" {
+		return NewNodeID()
+	}
+
+	path := filepath.Join(config.Node.DataDir, idFileName)
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if id == "" {
+			return "", errors.New("Empty node ID in " + path)
+		}
+		return id, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id, err := NewNodeID()
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(log.Fields{"func": "loadNodeID", "id": id}).Info("Generated new node ID")
+
+	//Write the ID to a temporary file first, so that a crash never leaves an empty ID behind
+	if err := os.MkdirAll(config.Node.DataDir, 0755); err != nil {
+		return "", err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+//differentIDs returns true if both IDs are known and different
+func differentIDs(a, b string) bool {
+	return a != "" && b != "" && a != b
+}
@@ -0,0 +1,61 @@
+package gossip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewNodeID(t *testing.T) {
+	a, err := NewNodeID()
+	if err != nil {
+		t.Fatalf("NewNodeID() returned error %s", err.Error())
+	}
+	b, _ := NewNodeID()
+	if len(a) != 32 {
+		t.Errorf("len(NewNodeID()) == %d; want 32", len(a))
+	}
+	if a == b {
+		t.Errorf("NewNodeID() returned %q twice", a)
+	}
+}
+
+func TestLoadNodeID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	//Without a data directory, IDs change on every start
+	config := *DefaultConfig
+	a, _ := loadNodeID(&config)
+	b, _ := loadNodeID(&config)
+	if a == "" || a == b {
+		t.Errorf("loadNodeID() == %q, then %q; want different IDs", a, b)
+	}
+
+	//IDs are stored in the data directory
+	config.Node.DataDir = filepath.Join(dir, "data")
+	a, err = loadNodeID(&config)
+	if err != nil {
+		t.Fatalf("loadNodeID() returned error %s", err.Error())
+	}
+	if b, _ := loadNodeID(&config); a != b {
+		t.Errorf("loadNodeID() == %q after restart; want %q", b, a)
+	}
+
+	//The configured ID takes precedence
+	config.Node.ID = "node-1"
+	if id, _ := loadNodeID(&config); id != "node-1" {
+		t.Errorf("loadNodeID() == %q; want %q", id, "node-1")
+	}
+
+	//Empty ID files are rejected
+	config.Node.ID = ""
+	ioutil.WriteFile(filepath.Join(config.Node.DataDir, idFileName), []byte("\n"), 0644)
+	if _, err := loadNodeID(&config); err == nil {
+		t.Errorf("loadNodeID() returned no error for an empty ID file")
+	}
+}
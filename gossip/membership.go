@@ -0,0 +1,372 @@
+package gossip
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*membersHeader is the HTTP header used to piggyback membership events on
+messages between nodes.
+*/
+const membersHeader = "X-Gossip-Members"
+
+/*retransmitMult is the multiplier of the logarithm of the number of members
+used to compute how many times an event is piggybacked before being dropped.
+*/
+const retransmitMult = 3
+
+/*Membership is an eventually consistent view of all nodes of a cluster,
+including nodes that are not peers of the node owning the view.
+
+Events are applied following the rules of SWIM: an event about a member only
+overrides what is known about that member if it has a greater incarnation
+number, or if it has the same incarnation number and a higher precedence. Leave
+events have precedence over suspect events, which have precedence over join
+events. Applied events are then piggybacked on further messages, a number of
+times that grows logarithmically with the size of the cluster.
+
+Only the node itself can refute a suspicion, by increasing its incarnation
+number.
+
+Members are identified by their node ID, so that a node that moves keeps the
+same entry. An event about a known member at another address only moves it if
+it has a greater incarnation number. A node that hears about itself at another
+address refutes it, which settles the move. Events without an ID, for nodes
+only known by address, apply to the member known at that address.
+*/
+type Membership struct {
+	//self is the address of the node owning the view
+	self Addr
+	//id is the ID of the node owning the view
+	id string
+	//members is the state of each known member, including the node itself, by key
+	members map[string]*member
+	//queue is the list of events waiting to be piggybacked
+	queue []*broadcast
+	//refute is called with the incarnation number of a suspicion about the node itself
+	refute func(incarnation uint64) uint64
+	//mu protects access to members and queue
+	mu sync.Mutex
+
+	//config stores the configuration parameters
+	config *Config
+}
+
+//member is the state of a member in a Membership
+type member struct {
+	//id is the ID of the member, or empty if it is only known by address
+	id string
+	//addr is the last known address of the member
+	addr Addr
+	//liveness is the state of the member
+	liveness Liveness
+	//incarnation is the last known incarnation number of the member
+	incarnation uint64
+	//since is the time when the member reached its current state
+	since time.Time
+}
+
+//broadcast is an event waiting to be piggybacked
+type broadcast struct {
+	//event is the event to piggyback
+	event MemberEvent
+	//key is the key of the member the event is about
+	key string
+	//transmits is the number of times the event was piggybacked
+	transmits int
+}
+
+/*NewMembership creates a new Membership for the node with the given ID at
+self.
+
+refute is called when another node suspects the node itself, and returns the
+new incarnation number of the node.
+*/
+func NewMembership(self Addr, id string, config *Config, refute func(incarnation uint64) uint64) *Membership {
+	if config == nil {
+		config = DefaultConfig
+	}
+
+	m := &Membership{
+		self:    self,
+		id:      id,
+		members: make(map[string]*member),
+		refute:  refute,
+		config:  config,
+	}
+	m.members[id] = &member{
+		id:       id,
+		addr:     self,
+		liveness: PeerAlive,
+		since:    config.clock().Now(),
+	}
+	m.enqueue(id, MemberEvent{MemberJoin, id, self, 0})
+
+	return m
+}
+
+/*Alive returns the addresses of all alive members, except the node itself, in
+no particular order.
+*/
+func (m *Membership) Alive() []Addr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	addrs := make([]Addr, 0, len(m.members))
+	for key, mem := range m.members {
+		if key != m.id && mem.addr != m.self && mem.liveness == PeerAlive {
+			addrs = append(addrs, mem.addr)
+		}
+	}
+	return addrs
+}
+
+/*Apply applies events to the view and queues the ones that changed it for
+piggybacking. This returns the number of events applied.
+*/
+func (m *Membership) Apply(events ...MemberEvent) int {
+	var refutes []uint64
+	applied := 0
+
+	m.mu.Lock()
+	now := m.config.clock().Now()
+	for _, event := range events {
+		/*Only the node itself knows if it is alive and where it is. Events
+		without an ID are about the node if they are about its address.
+		*/
+		if event.ID == m.id || event.ID == "" && event.Addr == m.self {
+			moved := event.ID != "" && event.Addr != m.self
+			if (event.Type != MemberJoin || moved) && event.Incarnation >= m.members[m.id].incarnation {
+				refutes = append(refutes, event.Incarnation)
+			}
+			continue
+		}
+
+		liveness, ok := eventLiveness[event.Type]
+		if !ok {
+			log.WithFields(log.Fields{"func": "Apply", "event": event}).Warn("Ignoring unknown membership event")
+			continue
+		}
+
+		key := m.key(event)
+		mem, known := m.members[key]
+		if known && mem.addr != event.Addr {
+			/*The member is known at another address: only a greater
+			incarnation number moves it. Otherwise, the current state is
+			piggybacked again, so that the member refutes it if it moved.
+			*/
+			if event.Incarnation <= mem.incarnation {
+				m.enqueue(key, mem.event())
+				continue
+			}
+			log.WithFields(log.Fields{"func": "Apply", "event": event}).Infof("Member moved from %v", mem.addr)
+		} else if known && !overrides(event.Incarnation, liveness, mem.incarnation, mem.liveness) {
+			continue
+		}
+		if !known {
+			mem = &member{id: event.ID}
+			m.members[key] = mem
+		}
+		//Forget the entry of the address if it was only known by address
+		if old, ok := m.members[event.Addr.String()]; ok && old != mem && old.id == "" {
+			delete(m.members, event.Addr.String())
+		}
+
+		log.WithFields(log.Fields{"func": "Apply", "event": event}).Debug("Applying membership event")
+		mem.addr = event.Addr
+		mem.liveness = liveness
+		mem.incarnation = event.Incarnation
+		mem.since = now
+		m.enqueue(key, event)
+		applied++
+	}
+	m.mu.Unlock()
+
+	for _, incarnation := range refutes {
+		m.Refuted(m.refute(incarnation))
+	}
+	return applied
+}
+
+/*Expire marks members that stayed suspect for longer than
+m.config.Node.SuspicionTimeout as dead, and forgets members that are dead for
+longer than m.config.Node.MaxPingDelay.
+*/
+func (m *Membership) Expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.config.clock().Now()
+	for key, mem := range m.members {
+		switch {
+		case mem.liveness == PeerSuspect && mem.since.Add(m.config.Node.SuspicionTimeout).Before(now):
+			log.WithFields(log.Fields{"func": "Expire", "addr": mem.addr, "id": mem.id}).Info("Suspect member is dead")
+			mem.liveness = PeerDead
+			mem.since = now
+			m.enqueue(key, mem.event())
+		case mem.liveness == PeerDead && mem.since.Add(m.config.Node.MaxPingDelay).Before(now):
+			log.WithFields(log.Fields{"func": "Expire", "addr": mem.addr, "id": mem.id}).Debug("Forgetting dead member")
+			delete(m.members, key)
+		}
+	}
+}
+
+//Members returns the state of all known members, sorted by address
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, mem := range m.members {
+		members = append(members, Member{
+			ID:          mem.id,
+			Addr:        mem.addr,
+			Liveness:    mem.liveness,
+			Incarnation: mem.incarnation,
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Addr.String() < members[j].Addr.String()
+	})
+	return members
+}
+
+/*Piggyback returns up to m.config.Node.PiggybackEvents events to send with a
+message, starting with the events that were sent the least.
+
+This never returns nil, so that the receiver knows the message comes from a
+node even if there are no events.
+*/
+func (m *Membership) Piggyback() []MemberEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.queue) == 0 {
+		return []MemberEvent{}
+	}
+
+	sort.SliceStable(m.queue, func(i, j int) bool {
+		return m.queue[i].transmits < m.queue[j].transmits
+	})
+	count := m.config.Node.PiggybackEvents
+	if count > len(m.queue) {
+		count = len(m.queue)
+	}
+
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(m.members)+1))))
+	events := make([]MemberEvent, 0, count)
+	queue := m.queue[:0]
+	for i, b := range m.queue {
+		if i < count {
+			events = append(events, b.event)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			queue = append(queue, b)
+		}
+	}
+	m.queue = queue
+
+	return events
+}
+
+/*Refuted records a new incarnation number of the node itself and queues a
+join event to let other nodes know that it is alive.
+*/
+func (m *Membership) Refuted(incarnation uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	self := m.members[m.id]
+	if incarnation <= self.incarnation {
+		return
+	}
+	self.incarnation = incarnation
+	self.since = m.config.clock().Now()
+	m.enqueue(m.id, self.event())
+}
+
+/*key returns the key of the member an event is about: its ID, or the key of
+the member known at its address if the event has no ID. Members only known by
+address are keyed by their address.
+
+This must be called while holding m.mu.
+*/
+func (m *Membership) key(event MemberEvent) string {
+	if event.ID != "" {
+		return event.ID
+	}
+	for key, mem := range m.members {
+		if mem.addr == event.Addr {
+			return key
+		}
+	}
+	return event.Addr.String()
+}
+
+/*enqueue queues an event about the member with the given key for
+piggybacking, replacing any queued event about the same member.
+
+This must be called while holding m.mu.
+*/
+func (m *Membership) enqueue(key string, event MemberEvent) {
+	for i, b := range m.queue {
+		if b.key == key {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			break
+		}
+	}
+	m.queue = append(m.queue, &broadcast{event: event, key: key})
+}
+
+//event returns an event announcing the current state of the member
+func (mem *member) event() MemberEvent {
+	return MemberEvent{livenessEvent[mem.liveness], mem.id, mem.addr, mem.incarnation}
+}
+
+//eventLiveness is the liveness of a member after each type of event
+var eventLiveness = map[MemberEventType]Liveness{
+	MemberJoin:    PeerAlive,
+	MemberSuspect: PeerSuspect,
+	MemberLeave:   PeerDead,
+}
+
+//livenessEvent is the type of event announcing each liveness of a member
+var livenessEvent = map[Liveness]MemberEventType{
+	PeerAlive:   MemberJoin,
+	PeerSuspect: MemberSuspect,
+	PeerDead:    MemberLeave,
+}
+
+/*overrides returns true if a member with the given incarnation and liveness
+overrides what is currently known about that member.
+*/
+func overrides(incarnation uint64, liveness Liveness, curIncarnation uint64, curLiveness Liveness) bool {
+	if incarnation != curIncarnation {
+		return incarnation > curIncarnation
+	}
+	return liveness > curLiveness
+}
+
+/*decodeMembersHeader decodes the membership events piggybacked on a request,
+or returns nil if there are none.
+*/
+func decodeMembersHeader(r *http.Request) []MemberEvent {
+	header := r.Header.Get(membersHeader)
+	if header == "" {
+		return nil
+	}
+
+	var events []MemberEvent
+	if err := json.Unmarshal([]byte(header), &events); err != nil {
+		log.WithFields(log.Fields{"func": "decodeMembersHeader"}).Warnf("Failed to decode membership events: %s", err.Error())
+		return nil
+	}
+	return events
+}
@@ -0,0 +1,251 @@
+package gossip
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//fixedClock is a Clock that only moves when its time is changed
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fixedClock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time)
+}
+
+func TestMembershipApply(t *testing.T) {
+	self, addr := Addr{"127.0.0.1", 8080}, Addr{"127.0.0.1", 8081}
+	testCases := []struct {
+		Name        string
+		Current     *MemberEvent
+		Event       MemberEvent
+		Applied     bool
+		Liveness    Liveness
+		Incarnation uint64
+	}{
+		{"join-unknown", nil, MemberEvent{MemberJoin, "b", addr, 0}, true, PeerAlive, 0},
+		{"suspect-unknown", nil, MemberEvent{MemberSuspect, "b", addr, 2}, true, PeerSuspect, 2},
+		{"join-known", &MemberEvent{MemberJoin, "b", addr, 1}, MemberEvent{MemberJoin, "b", addr, 1}, false, PeerAlive, 1},
+		{"join-older", &MemberEvent{MemberJoin, "b", addr, 1}, MemberEvent{MemberJoin, "b", addr, 0}, false, PeerAlive, 1},
+		{"suspect", &MemberEvent{MemberJoin, "b", addr, 1}, MemberEvent{MemberSuspect, "b", addr, 1}, true, PeerSuspect, 1},
+		{"suspect-older", &MemberEvent{MemberJoin, "b", addr, 1}, MemberEvent{MemberSuspect, "b", addr, 0}, false, PeerAlive, 1},
+		{"join-suspect", &MemberEvent{MemberSuspect, "b", addr, 1}, MemberEvent{MemberJoin, "b", addr, 1}, false, PeerSuspect, 1},
+		{"refuted", &MemberEvent{MemberSuspect, "b", addr, 1}, MemberEvent{MemberJoin, "b", addr, 2}, true, PeerAlive, 2},
+		{"leave", &MemberEvent{MemberSuspect, "b", addr, 1}, MemberEvent{MemberLeave, "b", addr, 1}, true, PeerDead, 1},
+		{"join-left", &MemberEvent{MemberLeave, "b", addr, 1}, MemberEvent{MemberJoin, "b", addr, 1}, false, PeerDead, 1},
+		{"rejoin", &MemberEvent{MemberLeave, "b", addr, 1}, MemberEvent{MemberJoin, "b", addr, 2}, true, PeerAlive, 2},
+		{"unknown-type", nil, MemberEvent{"unknown", "b", addr, 0}, false, PeerAlive, 0},
+	}
+
+	for _, testCase := range testCases {
+		m := NewMembership(self, "a", nil, func(incarnation uint64) uint64 { return incarnation + 1 })
+		if testCase.Current != nil {
+			m.Apply(*testCase.Current)
+		}
+
+		applied := m.Apply(testCase.Event)
+		if applied != 0 != testCase.Applied {
+			t.Errorf("m.Apply() == %d for test case %q; want applied %v", applied, testCase.Name, testCase.Applied)
+		}
+		if !testCase.Applied && testCase.Current == nil {
+			if members := m.Members(); len(members) != 1 {
+				t.Errorf("len(m.Members()) == %d for test case %q; want 1", len(members), testCase.Name)
+			}
+			continue
+		}
+		for _, member := range m.Members() {
+			if member.Addr != addr {
+				continue
+			}
+			if member.Liveness != testCase.Liveness || member.Incarnation != testCase.Incarnation {
+				t.Errorf("Member is %v with incarnation %d for test case %q; want %v with incarnation %d", member.Liveness, member.Incarnation, testCase.Name, testCase.Liveness, testCase.Incarnation)
+			}
+		}
+	}
+}
+
+func TestMembershipRefute(t *testing.T) {
+	self := Addr{"127.0.0.1", 8080}
+	var refuted []uint64
+	m := NewMembership(self, "a", nil, func(incarnation uint64) uint64 {
+		refuted = append(refuted, incarnation)
+		return incarnation + 1
+	})
+
+	//Joins about the node itself are ignored
+	m.Apply(MemberEvent{MemberJoin, "a", self, 3})
+	if len(refuted) != 0 {
+		t.Errorf("refute called %d times after a join; want 0", len(refuted))
+	}
+
+	m.Apply(MemberEvent{MemberSuspect, "a", self, 0})
+	if len(refuted) != 1 || refuted[0] != 0 {
+		t.Fatalf("refute called with %v after a suspicion; want [0]", refuted)
+	}
+	members := m.Members()
+	if len(members) != 1 || members[0].Liveness != PeerAlive || members[0].Incarnation != 1 {
+		t.Errorf("m.Members() == %v; want self alive with incarnation 1", members)
+	}
+
+	found := false
+	for _, event := range m.Piggyback() {
+		if event == (MemberEvent{MemberJoin, "a", self, 1}) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("m.Piggyback() does not contain the refutation")
+	}
+
+	//Suspicions about older incarnations are already refuted
+	m.Apply(MemberEvent{MemberLeave, "a", self, 0})
+	if len(refuted) != 1 {
+		t.Errorf("refute called %d times after an older suspicion; want 1", len(refuted))
+	}
+}
+
+func TestMembershipMove(t *testing.T) {
+	self, addr, moved := Addr{"127.0.0.1", 8080}, Addr{"127.0.0.1", 8081}, Addr{"127.0.0.1", 8082}
+	var refuted []uint64
+	m := NewMembership(self, "a", nil, func(incarnation uint64) uint64 {
+		refuted = append(refuted, incarnation)
+		return incarnation + 1
+	})
+	m.Apply(MemberEvent{MemberJoin, "b", addr, 1})
+	m.Piggyback()
+
+	//The same incarnation number does not move the member
+	if applied := m.Apply(MemberEvent{MemberJoin, "b", moved, 1}); applied != 0 {
+		t.Errorf("m.Apply() == %d for the same incarnation; want 0", applied)
+	}
+	members := m.Members()
+	if len(members) != 2 || members[1].Addr != addr {
+		t.Errorf("m.Members() == %v; want %q at %v", members, "b", addr)
+	}
+	found := false
+	for _, event := range m.Piggyback() {
+		if event == (MemberEvent{MemberJoin, "b", addr, 1}) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("m.Piggyback() does not contain the current state of the member")
+	}
+
+	//A greater incarnation number moves the member
+	if applied := m.Apply(MemberEvent{MemberJoin, "b", moved, 2}); applied != 1 {
+		t.Errorf("m.Apply() == %d for a greater incarnation; want 1", applied)
+	}
+	members = m.Members()
+	if len(members) != 2 || members[1].ID != "b" || members[1].Addr != moved || members[1].Incarnation != 2 {
+		t.Errorf("m.Members() == %v; want %q at %v with incarnation 2", members, "b", moved)
+	}
+
+	//Members only known by address are identified
+	m.Apply(MemberEvent{MemberJoin, "", addr, 0})
+	m.Apply(MemberEvent{MemberSuspect, "", addr, 0})
+	m.Apply(MemberEvent{MemberJoin, "c", addr, 0})
+	members = m.Members()
+	if len(members) != 3 || members[1].ID != "c" || members[1].Liveness != PeerAlive {
+		t.Errorf("m.Members() == %v; want %q alive at %v", members, "c", addr)
+	}
+
+	//The node refutes being at another address
+	m.Apply(MemberEvent{MemberJoin, "a", addr, 0})
+	if len(refuted) != 1 || refuted[0] != 0 {
+		t.Errorf("refute called with %v after a move; want [0]", refuted)
+	}
+}
+
+func TestMembershipPiggyback(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.PiggybackEvents = 2
+	m := NewMembership(Addr{"127.0.0.1", 8080}, "a", &config, nil)
+	m.Apply(
+		MemberEvent{MemberJoin, "b", Addr{"127.0.0.1", 8081}, 0},
+		MemberEvent{MemberJoin, "c", Addr{"127.0.0.1", 8082}, 0},
+	)
+
+	//3 members: each event is sent 3*ceil(log2(4)) = 6 times, 2 events at a time
+	sent := make(map[Addr]int)
+	for i := 0; i < 20; i++ {
+		events := m.Piggyback()
+		if events == nil {
+			t.Fatalf("m.Piggyback() == nil; want non-nil")
+		}
+		if len(events) > config.Node.PiggybackEvents {
+			t.Errorf("len(m.Piggyback()) == %d; want at most %d", len(events), config.Node.PiggybackEvents)
+		}
+		for _, event := range events {
+			sent[event.Addr]++
+		}
+	}
+
+	if len(sent) != 3 {
+		t.Errorf("Piggybacked events about %d members; want 3", len(sent))
+	}
+	for addr, count := range sent {
+		if count != 6 {
+			t.Errorf("Event about %v piggybacked %d times; want 6", addr, count)
+		}
+	}
+}
+
+func TestMembershipExpire(t *testing.T) {
+	clock := &fixedClock{time.Now()}
+	config := *DefaultConfig
+	config.Clock = clock
+	suspect, dead := Addr{"127.0.0.1", 8081}, Addr{"127.0.0.1", 8082}
+	m := NewMembership(Addr{"127.0.0.1", 8080}, "a", &config, nil)
+	m.Apply(
+		MemberEvent{MemberSuspect, "b", suspect, 0},
+		MemberEvent{MemberLeave, "c", dead, 0},
+	)
+
+	clock.now = clock.now.Add(config.Node.SuspicionTimeout + time.Second)
+	m.Expire()
+	for _, member := range m.Members() {
+		if member.Addr == suspect && member.Liveness != PeerDead {
+			t.Errorf("Suspect member is %v after SuspicionTimeout; want %v", member.Liveness, PeerDead)
+		}
+	}
+
+	clock.now = clock.now.Add(config.Node.MaxPingDelay - config.Node.SuspicionTimeout)
+	m.Expire()
+	for _, member := range m.Members() {
+		if member.Addr == dead {
+			t.Errorf("Dead member still known after MaxPingDelay")
+		}
+		if member.Addr == suspect && member.Liveness != PeerDead {
+			t.Errorf("Suspect member is %v; want %v", member.Liveness, PeerDead)
+		}
+	}
+}
+
+func TestDecodeMembersHeader(t *testing.T) {
+	testCases := []struct {
+		Header   string
+		Expected int
+	}{
+		{"", 0},
+		{"[]", 0},
+		{`[{"type":"join","addr":{"ip":"127.0.0.1","port":8081},"incarnation":1}]`, 1},
+		{"not json", 0},
+	}
+
+	for i, testCase := range testCases {
+		r := httptest.NewRequest("GET", "/status", nil)
+		if testCase.Header != "" {
+			r.Header.Set(membersHeader, testCase.Header)
+		}
+		if events := decodeMembersHeader(r); len(events) != testCase.Expected {
+			t.Errorf("len(decodeMembersHeader()) == %d for test case %d; want %d", len(events), i, testCase.Expected)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package gossip
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	//merkleFanout is the number of children of each inner node of a MerkleTree
+	merkleFanout = 16
+	//merkleDepth is the level of the leaves of a MerkleTree, the root being at level 0
+	merkleDepth = 4
+	//merkleLeaves is the number of leaves of a MerkleTree, merkleFanout^merkleDepth
+	merkleLeaves = 65536
+)
+
+/*MerkleTree is a hash tree over the keyspace of a node, used to find the keys
+that differ between two nodes during anti-entropy sessions.
+
+Keys are assigned to a leaf by the hash of their name. Each node of the tree
+holds the XOR of the hashes of the latest state of every key below it, so that
+two nodes holding the same states have the same tree regardless of the order
+in which they applied them. Using XOR instead of hashing the children lets
+UpdateState replace the state of a key by only updating the nodes on the path
+from its leaf to the root.
+
+With merkleFanout children per node and leaves at merkleDepth, the tree has
+merkleLeaves leaves. Two nodes that differ in a handful of keys out of a
+million find them in merkleDepth+1 round trips, each carrying the hashes of the
+children of the branches that differ. Nodes are only allocated once a key is
+assigned below them, as most nodes of small clusters hold few keys.
+*/
+type MerkleTree struct {
+	//levels are the hashes of the nodes at each level, starting with the root
+	levels []map[int]uint64
+	//keys are the keys assigned to each leaf
+	keys map[int][]string
+	//mu protects access to levels and keys
+	mu sync.RWMutex
+}
+
+//NewMerkleTree creates a new MerkleTree without any state
+func NewMerkleTree() *MerkleTree {
+	t := &MerkleTree{
+		levels: make([]map[int]uint64, merkleDepth+1),
+		keys:   make(map[int][]string),
+	}
+	for i := range t.levels {
+		t.levels[i] = make(map[int]uint64)
+	}
+	return t
+}
+
+/*Update replaces the state of a key in the tree.
+
+If found is false, the key was not part of the tree yet and current is
+ignored.
+*/
+func (t *MerkleTree) Update(current State, found bool, state State) {
+	hash := stateHash(state)
+	if found {
+		hash ^= stateHash(current)
+	}
+
+	leaf := merkleLeaf(state.Key)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !found {
+		t.keys[leaf] = append(t.keys[leaf], state.Key)
+	}
+	for level, index := merkleDepth, leaf; level >= 0; level, index = level-1, index/merkleFanout {
+		t.levels[level][index] ^= hash
+	}
+}
+
+//Root returns the hex-encoded hash of the root of the tree
+func (t *MerkleTree) Root() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return fmt.Sprintf("%016x", t.levels[0][0])
+}
+
+/*Hashes returns the hex-encoded hashes of the nodes at the given indexes of a
+level of the tree, or of all nodes of the level if there are no indexes.
+*/
+func (t *MerkleTree) Hashes(level int, indexes []int) ([]string, error) {
+	if level < 0 || level > merkleDepth {
+		return nil, errors.New("Invalid tree level")
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	width := merkleWidth(level)
+	if len(indexes) == 0 {
+		hashes := make([]string, width)
+		for i := range hashes {
+			hashes[i] = fmt.Sprintf("%016x", t.levels[level][i])
+		}
+		return hashes, nil
+	}
+
+	hashes := make([]string, len(indexes))
+	for i, index := range indexes {
+		if index < 0 || index >= width {
+			return nil, errors.New("Invalid tree node")
+		}
+		hashes[i] = fmt.Sprintf("%016x", t.levels[level][index])
+	}
+	return hashes, nil
+}
+
+//Keys returns the keys assigned to the given leaves
+func (t *MerkleTree) Keys(leaves []int) ([]string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var keys []string
+	for _, leaf := range leaves {
+		if leaf < 0 || leaf >= merkleLeaves {
+			return nil, errors.New("Invalid tree leaf")
+		}
+		keys = append(keys, t.keys[leaf]...)
+	}
+	return keys, nil
+}
+
+//merkleChildren returns the indexes of the children of nodes of a MerkleTree
+func merkleChildren(indexes []int) []int {
+	children := make([]int, 0, len(indexes)*merkleFanout)
+	for _, index := range indexes {
+		for i := 0; i < merkleFanout; i++ {
+			children = append(children, index*merkleFanout+i)
+		}
+	}
+	return children
+}
+
+//merkleLeaf returns the index of the leaf of a key in a MerkleTree
+func merkleLeaf(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(binary.BigEndian.Uint32(sum[:4]) % merkleLeaves)
+}
+
+//merkleWidth returns the number of nodes at a level of a MerkleTree
+func merkleWidth(level int) int {
+	width := 1
+	for i := 0; i < level; i++ {
+		width *= merkleFanout
+	}
+	return width
+}
+
+/*stateHash returns the hash of a state for a MerkleTree
+
+This covers the key, timestamp and digest of the state, but not the number of
+hops, which differs between nodes holding the same state.
+*/
+func stateHash(state State) uint64 {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %d %d %q %s", state.Key, state.Timestamp.Physical, state.Timestamp.Logical, state.Timestamp.Node, state.Digest)
+	return binary.BigEndian.Uint64(h.Sum(nil)[:8])
+}
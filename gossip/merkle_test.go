@@ -0,0 +1,97 @@
+package gossip
+
+import (
+	"testing"
+)
+
+func TestMerkleTreeUpdate(t *testing.T) {
+	states := []State{
+		{Key: "a", Timestamp: Timestamp{Physical: 1}, Digest: "a"},
+		{Key: "b", Timestamp: Timestamp{Physical: 2}, Digest: "b"},
+		{Key: "c", Timestamp: Timestamp{Physical: 3}, Digest: "c"},
+	}
+
+	//Trees do not depend on the order states are applied in
+	a := NewMerkleTree()
+	b := NewMerkleTree()
+	for i := range states {
+		a.Update(State{}, false, states[i])
+		b.Update(State{}, false, states[len(states)-1-i])
+	}
+	for level := 0; level <= merkleDepth; level++ {
+		ha, _ := a.Hashes(level, nil)
+		hb, _ := b.Hashes(level, nil)
+		if len(ha) != merkleWidth(level) {
+			t.Errorf("len(a.Hashes(%d)) == %d; want %d", level, len(ha), merkleWidth(level))
+		}
+		for i := range ha {
+			if ha[i] != hb[i] {
+				t.Errorf("a.Hashes(%d)[%d] == %s; want %s", level, i, ha[i], hb[i])
+			}
+		}
+	}
+
+	//Replacing a state only changes the nodes on the path to its leaf
+	state := State{Key: "a", Timestamp: Timestamp{Physical: 4}, Digest: "d"}
+	b.Update(states[0], true, state)
+	leaf := merkleLeaf("a")
+	for level, index := merkleDepth, leaf; level >= 0; level, index = level-1, index/merkleFanout {
+		ha, _ := a.Hashes(level, nil)
+		hb, _ := b.Hashes(level, nil)
+		for i := range ha {
+			if (ha[i] != hb[i]) != (i == index) {
+				t.Errorf("a.Hashes(%d)[%d] == %s, b.Hashes(%d)[%d] == %s", level, i, ha[i], level, i, hb[i])
+			}
+		}
+	}
+
+	//Replacing it back restores the tree
+	b.Update(state, true, states[0])
+	if ra, rb := a.levels[0][0], b.levels[0][0]; ra != rb {
+		t.Errorf("b.levels[0][0] == %x; want %x", rb, ra)
+	}
+	if keys, _ := b.Keys([]int{leaf}); len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("b.Keys([%d]) == %v; want [a]", leaf, keys)
+	}
+}
+
+func TestMerkleTreeHashes(t *testing.T) {
+	tree := NewMerkleTree()
+	testCases := []struct {
+		level int
+		nodes []int
+		ok    bool
+	}{
+		{0, []int{0}, true},
+		{1, []int{0, 15}, true},
+		{merkleDepth, []int{merkleLeaves - 1}, true},
+		{-1, []int{0}, false},
+		{merkleDepth + 1, []int{0}, false},
+		{1, []int{16}, false},
+		{1, []int{-1}, false},
+	}
+
+	for _, testCase := range testCases {
+		hashes, err := tree.Hashes(testCase.level, testCase.nodes)
+		if (err == nil) != testCase.ok {
+			t.Errorf("tree.Hashes(%d, %v) == %v; want ok == %v", testCase.level, testCase.nodes, err, testCase.ok)
+		}
+		if testCase.ok && len(hashes) != len(testCase.nodes) {
+			t.Errorf("len(tree.Hashes(%d, %v)) == %d; want %d", testCase.level, testCase.nodes, len(hashes), len(testCase.nodes))
+		}
+	}
+
+	if _, err := tree.Keys([]int{merkleLeaves}); err == nil {
+		t.Errorf("tree.Keys([%d]) == nil; want an error", merkleLeaves)
+	}
+}
+
+func TestMerkleChildren(t *testing.T) {
+	children := merkleChildren([]int{0, 2})
+	if len(children) != 2*merkleFanout || children[0] != 0 || children[merkleFanout] != 2*merkleFanout {
+		t.Errorf("merkleChildren([0, 2]) == %v", children)
+	}
+	if merkleWidth(merkleDepth) != merkleLeaves {
+		t.Errorf("merkleWidth(%d) == %d; want %d", merkleDepth, merkleWidth(merkleDepth), merkleLeaves)
+	}
+}
@@ -1,7 +1,18 @@
 package gossip
 
+/*Announcement is the body of an /announce request, telling a node that the
+sender holds a state whose data is split in chunks. The node then downloads the
+chunks it misses from the sender.
+*/
+type Announcement struct {
+	Addr   Addr      `json:"addr"`
+	Key    string    `json:"key"`
+	Status KeyStatus `json:"status"`
+}
+
 //CtrlPeerResponse is a single node as part of a CtrlPeersResponse struct.
 type CtrlPeerResponse struct {
+	ID    string `json:"id,omitempty"`
 	Addr  Addr   `json:"addr"`
 	Peers []Addr `json:"peers"`
 }
@@ -11,9 +22,88 @@ type CtrlPeersResponse struct {
 	Nodes []CtrlPeerResponse `json:"nodes"`
 }
 
-//PeersResponse is the response sent for a /peers request.
+/*Member describes a member of the cluster, with its state in the failure
+detectors of a node.
+
+ID is empty for members only known by address. Phi is only known for peers.
+*/
+type Member struct {
+	ID          string   `json:"id,omitempty"`
+	Addr        Addr     `json:"addr"`
+	Liveness    Liveness `json:"liveness"`
+	Incarnation uint64   `json:"incarnation"`
+	Phi         float64  `json:"phi"`
+}
+
+//MemberEventType is the type of a membership event
+type MemberEventType string
+
+const (
+	//MemberJoin announces that a member joined the cluster, or is alive again
+	MemberJoin MemberEventType = "join"
+	//MemberLeave announces that a member left the cluster, or is dead
+	MemberLeave MemberEventType = "leave"
+	//MemberSuspect announces that a member failed direct and indirect probes
+	MemberSuspect MemberEventType = "suspect"
+)
+
+/*MemberEvent is a change in the membership of the cluster, piggybacked on
+pings and states sent to peers.
+
+ID is the ID of the member, or empty if it is only known by address.
+*/
+type MemberEvent struct {
+	Type        MemberEventType `json:"type"`
+	ID          string          `json:"id,omitempty"`
+	Addr        Addr            `json:"addr"`
+	Incarnation uint64          `json:"incarnation"`
+}
+
+//MembersResponse is the response sent for a /members request
+type MembersResponse struct {
+	Members []Member `json:"members"`
+}
+
+/*PeeringRequest is the body of a POST /peers request, asking a node or a
+controller to add a peer.
+
+ID is the ID of the peer, if known. A request claiming an address used by
+another node is rejected.
+*/
+type PeeringRequest struct {
+	Addr
+	ID string `json:"id,omitempty"`
+}
+
+/*PeersResponse is the response sent for a /peers request.
+
+ID is the ID of the node sending the response. Members contains the same peers
+as Peers, with their ID and their state in the failure detectors of the node.
+*/
 type PeersResponse struct {
-	Peers []Addr `json:"peers"`
+	ID      string   `json:"id"`
+	Peers   []Addr   `json:"peers"`
+	Members []Member `json:"members,omitempty"`
+	//Draining is true if the node is leaving the cluster
+	Draining bool `json:"draining,omitempty"`
+}
+
+/*ProbeRequest is the body of a /probe request, asking a node to probe the
+target on behalf of the sender.
+
+If the target is the node receiving the request and Suspect is true, the node
+refutes the suspicion by increasing its incarnation number.
+*/
+type ProbeRequest struct {
+	Target      Addr   `json:"target"`
+	Incarnation uint64 `json:"incarnation"`
+	Suspect     bool   `json:"suspect"`
+}
+
+//ProbeResponse is the response sent for a /probe request.
+type ProbeResponse struct {
+	Ack         bool   `json:"ack"`
+	Incarnation uint64 `json:"incarnation"`
 }
 
 //Response is the response sent to requests when an error occurs.
@@ -21,10 +111,75 @@ type Response struct {
 	Message string `json:"message"`
 }
 
+/*KeyStatus summarizes the latest known state of a key in a StatusResponse.
+
+If the data of the state is split in chunks, this also contains the
+hex-encoded SHA-256 digest of each chunk.
+*/
+type KeyStatus struct {
+	Timestamp Timestamp `json:"time"`
+	Digest    string    `json:"digest"`
+	Hops      int       `json:"hops"`
+	Chunks    []string  `json:"chunks,omitempty"`
+}
+
 /*StatusResponse is the response sent for a /status request.
 
-This contains the timestamp for the latest known state.
+This contains the root hash of the Merkle tree of the node, the current
+timestamp of the node's clock, and the ID and incarnation number of the node.
+If the request asks for it, this also contains the timestamp and digest for the
+latest known state of each key, including deleted keys.
 */
 type StatusResponse struct {
-	LastState int64 `json:"lastState"`
+	ID          string    `json:"id"`
+	Clock       Timestamp `json:"clock"`
+	Incarnation uint64    `json:"incarnation"`
+	//Root is the hash of the root of the Merkle tree of the node
+	Root string `json:"root"`
+	//Keys is the status of each key, only present if the request asks for it
+	Keys map[string]KeyStatus `json:"keys,omitempty"`
+	//Draining is true if the node is leaving the cluster
+	Draining bool `json:"draining,omitempty"`
+	//Members are the membership events piggybacked on the response
+	Members []MemberEvent `json:"members,omitempty"`
+}
+
+/*SyncRequest is the body of a /sync request, asking for the status of the
+keys in leaves of the Merkle tree of a node that differ from the sender.
+*/
+type SyncRequest struct {
+	Leaves []int `json:"leaves"`
+}
+
+//SyncResponse is the response sent for a /sync request.
+type SyncResponse struct {
+	Keys map[string]KeyStatus `json:"keys"`
+}
+
+/*TreeRequest is the body of a /tree request, asking for the hashes of nodes at
+a level of the Merkle tree of a node.
+
+If Nodes is empty, the response contains the hashes of all nodes of the level.
+*/
+type TreeRequest struct {
+	Level int   `json:"level"`
+	Nodes []int `json:"nodes,omitempty"`
+}
+
+//TreeResponse is the response sent for a /tree request.
+type TreeResponse struct {
+	Level  int      `json:"level"`
+	Hashes []string `json:"hashes"`
+}
+
+/*WriteResponse is the response sent for a write request that requires a
+consistency level other than local.
+
+This contains the timestamp of the applied state and the peers that
+acknowledged it.
+*/
+type WriteResponse struct {
+	Message   string    `json:"message"`
+	Timestamp Timestamp `json:"time"`
+	Peers     []Addr    `json:"peers"`
 }
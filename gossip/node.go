@@ -2,12 +2,13 @@ package gossip
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"sort"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -15,77 +16,338 @@ import (
 
 //Node represents the management unit for this node
 type Node struct {
+	//ID is the unique ID of the Node, which does not change with its address
+	ID string
 	//IP is the IP address of the Node
 	IP string
 	//Port is the port for the HTTP server on the Node
 	Port int
 
-	//Peers is the slice of peers known to the node
+	/*Faults are the faults injected in messages sent to peers, or nil if
+	faults are disabled*/
+	Faults *Faults
+	/*Peers is the slice of peers known to the node. Once the workers are
+	started, use PeerList to read it.*/
 	Peers []*Peer
-	//State is the current internal data state of the node
-	State State
+	/*Resolver picks the state to keep when two states share the same key and
+	timestamp. This can be replaced before calling Run.*/
+	Resolver ConflictResolver
+	/*States is a sync.Map[string]State containing the current state of each
+	key. Use UpdateState to change it, so that the Merkle tree of the node stays
+	in sync.*/
+	States *sync.Map
 
+	//peersMu protects access to Peers
+	peersMu sync.RWMutex
+
+	//draining is true once the node started draining
+	draining bool
+	//drainingMu protects access to draining
+	drainingMu sync.RWMutex
+	//writes tracks the writes in progress, which the node waits for before draining
+	writes sync.WaitGroup
+	//incarnation is increased by the node to refute suspicions from peers
+	incarnation uint64
+	//incarnationMu protects access to incarnation
+	incarnationMu sync.Mutex
+	//members is the view of the node on the membership of the cluster
+	members *Membership
+	//seeds are the nodes to peer with when the node starts
+	seeds []Addr
+	//controllers are the controllers to register with when the node starts
+	controllers []Addr
+	//discovery discovers other nodes through DNS, or is nil
+	discovery *Discovery
+
+	//flushChan is a channel to wait until the states received so far are applied
+	flushChan chan chan struct{}
 	//fetchStateChan is a channel to force fetch updates from other peers
-	fetchStateChan chan *Peer
+	fetchStateChan chan fetchRequest
 	//addPeerChan is a channel to receive peering requests
-	addPeerChan chan Addr
+	addPeerChan chan PeeringRequest
 	//deletePeerChan is a channel to receive peer deletion requests
 	deletePeerChan chan Addr
 	//peerStateChan is a channel to receive state updates that need to be propagated to peers
 	peerStateChan chan State
 	//stateChan is a channel to receive state updates
 	stateChan chan State
+	//writeChan is a channel to receive client writes that require a consistency level
+	writeChan chan writeRequest
+	//addPeerInbox tracks the messages sent to the addPeerWorker
+	addPeerInbox *inbox
+	//deletePeerInbox tracks the messages sent to the deletePeerWorker
+	deletePeerInbox *inbox
+	//fetchStateInbox tracks the messages sent to the fetchStateWorker
+	fetchStateInbox *inbox
+	//peerStateInbox tracks the messages sent to the peerSendStateWorker
+	peerStateInbox *inbox
+	//stateInbox tracks the messages sent to the stateWorker
+	stateInbox *inbox
+
+	//clock generates timestamps for new states
+	clock *HLC
+	//tree is the Merkle tree over the states of the node, used for anti-entropy
+	tree *MerkleTree
+	//chunkCache is a sync.Map[string]chunkList caching the chunk digests of large states
+	chunkCache sync.Map
+	//partial are the chunks downloaded while fetching large states, by key
+	partial map[string]*partialChunks
+	//partialSize is the number of bytes of chunks in partial
+	partialSize int
+	//partialMu protects access to partial and partialSize
+	partialMu sync.Mutex
+	//trustedKeys are the keys allowed to sign states
+	trustedKeys TrustedKeys
+	//storage persists the states of the node
+	storage Storage
+	//storageMu serializes state updates with snapshots of the storage
+	storageMu sync.Mutex
+
+	//ctx is cancelled when the node stops, to stop workers and abort requests to peers
+	ctx context.Context
+	//cancel cancels ctx
+	cancel context.CancelFunc
+	//server is the HTTP server started by Start, or nil
+	server *http.Server
+	//workers tracks running workers
+	workers sync.WaitGroup
+	//stopOnce ensures that the node leaves and closes its storage only once
+	stopOnce sync.Once
+	//stopErr is the error returned by the first call to Stop that closed the storage
+	stopErr error
 
 	//config stores the configuration parameters
 	config *Config
 }
 
-//NewNode creates a new Node
+//fetchRequest is a request to fetch the state of a key from a peer
+type fetchRequest struct {
+	//peer is the peer that holds the state
+	peer *Peer
+	//key is the key to fetch
+	key string
+	//status is the status of the state advertised by the peer
+	status KeyStatus
+}
+
+//peerAck is the result of sending a state to a peer
+type peerAck struct {
+	//addr is the address of the peer
+	addr Addr
+	//ok is true if the peer acknowledged the state
+	ok bool
+}
+
+//writeRequest is a client write waiting to be applied by the stateWorker
+type writeRequest struct {
+	//state is the state to write
+	state State
+	//consistency is the consistency level required by the client
+	consistency Consistency
+	//result receives the outcome of the write once it is applied
+	result chan writeResult
+}
+
+//writeResult is the outcome of applying a writeRequest
+type writeResult struct {
+	//state is the state after being applied, with its timestamp
+	state State
+	//applied is true if the state was applied and persisted
+	applied bool
+	//obsolete is true if the state was not applied as it is not newer
+	obsolete bool
+	//recipients is the number of peers the state was sent to
+	recipients int
+	//acks receives the result of sending the state to each recipient
+	acks chan peerAck
+}
+
+/*NewNode creates a new Node
+
+If config.Node.DataDir is set, states are persisted in a FileStorage in that
+directory.
+*/
 func NewNode(config *Config) *Node {
 	if config == nil {
 		config = DefaultConfig
 	}
 
+	var storage Storage = nullStorage{}
+	if config.Node.DataDir != "" {
+		fileStorage, err := NewFileStorage(config.Node.DataDir)
+		if err != nil {
+			log.WithFields(log.Fields{"func": "NewNode"}).Fatalf("Failed to open storage: %s", err.Error())
+		}
+		storage = fileStorage
+	}
+
+	return NewNodeWithStorage(config, storage)
+}
+
+/*NewNodeWithStorage creates a new Node that persists its states in the given
+storage.
+
+The states already present in the storage are loaded before returning.
+*/
+func NewNodeWithStorage(config *Config, storage Storage) *Node {
+	if config == nil {
+		config = DefaultConfig
+	}
+
+	//All peers share the same HTTP client
+	config, err := config.withTransport()
+	if err != nil {
+		log.WithFields(log.Fields{"func": "NewNode"}).Fatalf("Failed to configure TLS: %s", err.Error())
+	}
+
 	n := &Node{
-		IP:   config.Node.IP,
-		Port: config.Node.Port,
+		IP:       config.Node.IP,
+		Port:     config.Node.Port,
+		Resolver: DigestResolver{},
+		States:   &sync.Map{},
 
-		fetchStateChan: make(chan *Peer, 8),
-		addPeerChan:    make(chan Addr, 8),
+		fetchStateChan: make(chan fetchRequest, 8),
+		addPeerChan:    make(chan PeeringRequest, 8),
 		deletePeerChan: make(chan Addr, 8),
 		peerStateChan:  make(chan State, 8),
 		stateChan:      make(chan State, 8),
+		flushChan:      make(chan chan struct{}),
+		writeChan:      make(chan writeRequest, 8),
+
+		addPeerInbox:    config.newInbox(),
+		deletePeerInbox: config.newInbox(),
+		fetchStateInbox: config.newInbox(),
+		peerStateInbox:  config.newInbox(),
+		stateInbox:      config.newInbox(),
+
+		tree:    NewMerkleTree(),
+		partial: make(map[string]*partialChunks),
+		storage: storage,
 
 		config: config,
 	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
 
 	log.WithFields(log.Fields{"node": n, "func": "NewNode"}).Info("Initializing node")
 
+	id, err := loadNodeID(config)
+	if err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "NewNode"}).Fatalf("Failed to load node ID: %s", err.Error())
+	}
+	n.ID = id
+	//Timestamps are told apart by the ID of the node, as nodes can share an address
+	n.clock = NewHLC(n.ID)
+	n.clock.maxDrift = config.Node.MaxClockDrift
+	n.clock.now = func() int64 {
+		return config.clock().Now().UnixNano()
+	}
+
+	trustedKeys, err := NewTrustedKeys(config.Node.TrustedKeys)
+	if err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "NewNode"}).Fatalf("Failed to parse trusted keys: %s", err.Error())
+	}
+	n.trustedKeys = trustedKeys
+
+	if n.seeds, err = parseAddrs(config.Node.Seeds); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "NewNode"}).Fatalf("Failed to parse seeds: %s", err.Error())
+	}
+	if n.controllers, err = parseAddrs(config.Node.Controllers); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "NewNode"}).Fatalf("Failed to parse controllers: %s", err.Error())
+	}
+
+	//Inject faults in messages sent to peers
+	n.Faults = config.Faults
+	if n.Faults == nil && config.Node.Debug {
+		n.Faults = NewFaults(config.clock())
+	}
+	if n.Faults != nil {
+		n.config = config.withFaults(n.Addr(), n.Faults)
+	}
+
+	n.members = NewMembership(n.Addr(), n.ID, n.config, n.refute)
+	if len(config.Node.Discovery) > 0 {
+		n.discovery = NewDiscovery(config.Node.Discovery, n.config)
+	}
+
+	n.loadStates()
+
 	return n
 }
 
 //AddPeer adds a new peer if there are no known peers with the same Addr
 func (n *Node) AddPeer(addr Addr) {
-	log.WithFields(log.Fields{"node": n, "addr": addr, "func": "AddPeer"}).Info("Received peering request")
+	n.addPeer(PeeringRequest{Addr: addr})
+}
+
+/*CheckPeeringRequest returns an error if a peering request claims the address
+of a known peer with a different ID, while that peer is still reachable.
+
+When a peer stops being reachable, or responds to pings with the ID of the
+request, the address is free to use again.
+*/
+func (n *Node) CheckPeeringRequest(req PeeringRequest) error {
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	if n.conflicts(req) {
+		return errors.New("Address is used by another node")
+	}
+	return nil
+}
+
+/*addPeer adds a new peer if there are no known peers with the same Addr and
+ID.
+
+If a peer with the same ID is known at another address, the node changed
+address and the peer at the former address is replaced. If a peer with a
+different ID is known at the same address and is no longer reachable, another
+node now uses that address and the peer is replaced as well.
+*/
+func (n *Node) addPeer(req PeeringRequest) {
+	log.WithFields(log.Fields{"node": n, "addr": req.Addr, "id": req.ID, "func": "addPeer"}).Info("Received peering request")
+
+	//Skip if draining, as the node is leaving its peers.
+	if n.Draining() {
+		log.WithFields(log.Fields{"node": n, "addr": req.Addr, "func": "addPeer"}).Info("Skip peering request while draining")
+		return
+	}
 
 	//Skip if self.
-	if addr == n.Addr() {
-		log.WithFields(log.Fields{"node": n, "addr": addr, "func": "AddPeer"}).Info("Skip self-peering request")
+	if req.Addr == n.Addr() || req.ID == n.ID {
+		log.WithFields(log.Fields{"node": n, "addr": req.Addr, "func": "addPeer"}).Info("Skip self-peering request")
+		return
+	}
+
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	if n.conflicts(req) {
+		log.WithFields(log.Fields{"node": n, "addr": req.Addr, "id": req.ID, "func": "addPeer"}).Warn("Skip peering request for an address used by another node")
 		return
 	}
 
 	//Skip if already known.
-	if _, found := n.FindPeer(addr); found {
-		log.WithFields(log.Fields{"node": n, "addr": addr, "func": "AddPeer"}).Info("Skip known peer")
+	pos, found := n.findPeer(req.Addr)
+	if found && !differentIDs(n.Peers[pos].ID(), req.ID) {
+		log.WithFields(log.Fields{"node": n, "addr": req.Addr, "func": "addPeer"}).Info("Skip known peer")
+		n.Peers[pos].SetID(req.ID)
 		return
 	}
 
 	//Add the peer to the list of known peers.
-	peer := NewPeer(addr, n.config)
-	n.Peers = append(n.Peers, peer)
+	peer := NewPeer(req.Addr, n.config)
+	peer.SetID(req.ID)
+	if found {
+		log.WithFields(log.Fields{"node": n, "addr": req.Addr, "id": req.ID, "func": "addPeer"}).Infof("Replacing unreachable peer with ID %s", n.Peers[pos].ID())
+		n.Peers[pos] = peer
+	} else {
+		n.Peers = append(n.Peers, peer)
+	}
+	n.removeMovedPeers(peer)
+	n.members.Apply(MemberEvent{MemberJoin, req.ID, req.Addr, 0})
 
 	//Send a peering request.
-	go peer.SendPeeringRequest(n.Addr())
+	n.config.goTask(func() { peer.SendPeeringRequest(n.ctx, n.PeeringRequest()) })
 }
 
 //Addr returns an Addr representing the node
@@ -96,32 +358,152 @@ func (n *Node) Addr() Addr {
 	}
 }
 
-//DeletePeer deletes a peer matching the given address
+/*DeletePeer deletes a peer matching the given address
+
+As peers send peer deletion requests when they stop, this also announces that
+the peer left the cluster.
+*/
 func (n *Node) DeletePeer(addr Addr) {
 	log.WithFields(log.Fields{"node": n, "addr": addr, "func": "DeletePeer"}).Info("Received peer deletion request")
 
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
 	//Find the peer's position
-	pos, found := n.FindPeer(addr)
+	pos, found := n.findPeer(addr)
 	if !found {
 		log.WithFields(log.Fields{"node": n, "addr": addr, "func": "AddPeer"}).Info("Skip unknown peer")
 		return
 	}
 
 	//Delete the peer from the slice of peers
-	n.Peers[pos] = n.Peers[0]
-	n.Peers = n.Peers[1:]
+	peer := n.Peers[pos]
+	_, incarnation := peer.Membership()
+	n.Peers = append(n.Peers[:pos], n.Peers[pos+1:]...)
+	n.members.Apply(MemberEvent{MemberLeave, peer.ID(), addr, incarnation})
+}
+
+/*Drain prepares the node to leave the cluster.
+
+The node stops accepting writes and waits for the ones in progress, pushes
+the latest state of each key to all its peers, then asks its controllers to
+re-home its peers before leaving them. The node keeps serving reads until it
+stops, but does not peer with other nodes anymore.
+
+This returns an error if the node is already draining, or ctx.Err() if ctx is
+cancelled before the node is drained.
+*/
+func (n *Node) Drain(ctx context.Context) error {
+	n.drainingMu.Lock()
+	if n.draining {
+		n.drainingMu.Unlock()
+		return errors.New("Node is already draining")
+	}
+	n.draining = true
+	n.drainingMu.Unlock()
+
+	log.WithFields(log.Fields{"node": n, "func": "Drain"}).Info("Draining node")
+	//Writes in progress can wait for acknowledgements from peers
+	done := make(chan struct{})
+	go func() {
+		n.writes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	n.flush(ctx)
+	n.pushStates(ctx)
+
+	for _, addr := range n.controllers {
+		log.WithFields(log.Fields{"node": n, "func": "Drain", "addr": addr}).Info("Asking controller to re-home peers")
+		if err := n.config.transport().SendPeerDeletionRequest(ctx, addr, n.Addr()); err != nil {
+			log.WithFields(log.Fields{"node": n, "func": "Drain", "addr": addr}).Warnf("Failed to reach controller: %s", err.Error())
+		}
+	}
+
+	n.leave(ctx)
+	return ctx.Err()
+}
+
+//Draining returns true once the node started draining
+func (n *Node) Draining() bool {
+	n.drainingMu.RLock()
+	defer n.drainingMu.RUnlock()
+
+	return n.draining
 }
 
 /*FindPeer looks up known peers and returns if there is a peer matching the
 Addr provided.
 */
 func (n *Node) FindPeer(addr Addr) (int, bool) {
-	for pos, peer := range n.Peers {
-		if peer.Addr == addr {
-			return pos, true
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	return n.findPeer(addr)
+}
+
+//Incarnation returns the incarnation number of the node
+func (n *Node) Incarnation() uint64 {
+	n.incarnationMu.Lock()
+	defer n.incarnationMu.Unlock()
+
+	return n.incarnation
+}
+
+/*Members returns the view of the node on the membership of the cluster,
+including the node itself, sorted by address.
+*/
+func (n *Node) Members() []Member {
+	peers := make(map[Addr]*Peer)
+	for _, peer := range n.PeerList() {
+		peers[peer.Addr] = peer
+	}
+
+	members := n.members.Members()
+	for i, member := range members {
+		if peer, ok := peers[member.Addr]; ok && (member.ID == "" || member.ID == peer.ID()) {
+			members[i].ID = peer.ID()
+			members[i].Phi = peer.Phi()
 		}
 	}
-	return -1, false
+	return members
+}
+
+//PeeringRequest returns a request for peering with this node
+func (n *Node) PeeringRequest() PeeringRequest {
+	return PeeringRequest{n.Addr(), n.ID}
+}
+
+//PeerList returns a copy of the slice of peers known to the node
+func (n *Node) PeerList() []*Peer {
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	return append([]*Peer{}, n.Peers...)
+}
+
+/*GetState returns the current state for a key and whether the key is known to
+the node.
+
+Deleted keys are known to the node: their state is a tombstone.
+*/
+func (n *Node) GetState(key string) (State, bool) {
+	iState, ok := n.States.Load(key)
+	if !ok {
+		return State{}, false
+	}
+
+	state, ok := iState.(State)
+	if !ok {
+		log.WithFields(log.Fields{"node": n, "func": "GetState", "key": key}).Warn("Failed to assert state")
+		return State{}, false
+	}
+
+	return state, true
 }
 
 /*PeerSendState sends a state to peers.
@@ -131,30 +513,20 @@ this function takes PeerMaxRecipients peers at random and sends the state to
 only those peers.
 */
 func (n *Node) PeerSendState(state State) int {
-	var peers []*Peer
-	//If there are too many peers, need to limit to PeerMaxRecipients peers
-	//chosen randomly.
-	if len(n.Peers) > n.config.Node.MaxRecipients {
-		for _, i := range rand.Perm(len(n.Peers)) {
-			peers = append(peers, n.Peers[i])
-			if len(peers) >= n.config.Node.MaxRecipients {
-				break
-			}
-		}
-	} else {
-		peers = n.Peers
-	}
-	log.WithFields(log.Fields{"node": n, "state": state, "func": "peerSendStateWorker"}).Infof("Sending state update to %d/%d peers", len(peers), len(n.Peers))
+	return n.peerSendState(state, n.recipients(n.config.Node.MaxRecipients), nil)
+}
 
-	for _, peer := range peers {
-		go peer.Send(state)
-	}
+/*PingPeers ping all peers known to the node
 
-	return len(peers)
-}
+Membership events are exchanged with every ping. If the root of the Merkle tree
+of a peer differs from the root of the tree of the node, the node runs an
+anti-entropy session with that peer.
+*/
+func (n *Node) PingPeers(ctx context.Context) {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
 
-//PingPeers ping all peers known to the node
-func (n *Node) PingPeers() {
+	peers := append([]*Peer{}, n.Peers...)
 	var peersToRemove []int
 	for i, peer := range n.Peers {
 		/*If the peer is irrecoverable, mark it for removal from the list
@@ -173,12 +545,29 @@ func (n *Node) PingPeers() {
 		already ready to be processed, without having to wait for the
 		goroutines to finish their execution.
 		*/
-		go func(n *Node, peer *Peer) {
-			peer.Ping()
-			if peer.LastState > n.State.Timestamp {
-				n.fetchStateChan <- peer
+		peer := peer
+		n.config.goTask(func() {
+			status, ok := n.probePeer(ctx, peer, peers)
+			if !ok {
+				return
+			}
+			if _, err := n.clock.Update(status.Clock); err != nil {
+				log.WithFields(log.Fields{"node": n, "peer": peer, "func": "PingPeers"}).Warnf("Failed to update clock: %s", err.Error())
 			}
-		}(n, peer)
+			n.members.Apply(status.Members...)
+
+			//Draining peers are leaving the cluster, but can still serve reads
+			if status.Draining {
+				n.DeletePeer(peer.Addr)
+				return
+			}
+
+			//Only the keys that differ are compared, by walking down the Merkle trees
+			if status.Root != "" && status.Root != n.tree.Root() && !n.Draining() {
+				pushed, pulled := n.syncPeer(ctx, peer)
+				log.WithFields(log.Fields{"node": n, "peer": peer, "func": "PingPeers"}).Infof("Pushed %d states and pulled %d states", pushed, pulled)
+			}
+		})
 	}
 
 	/* Every time we remove a peer 'i' from n.Peers, the new index of peers
@@ -194,62 +583,193 @@ func (n *Node) PingPeers() {
 
 	//Process irrecoverable peers.
 	for c, i := range peersToRemove {
-		log.WithFields(log.Fields{"node": n, "func": "PingPeers", "peer": n.Peers[i]}).Info("Removing irrecoverable peer")
+		peer := n.Peers[i-c]
+		log.WithFields(log.Fields{"node": n, "func": "PingPeers", "peer": peer}).Info("Removing irrecoverable peer")
+		_, incarnation := peer.Membership()
+		n.members.Apply(MemberEvent{MemberLeave, peer.ID(), peer.Addr, incarnation})
 		n.Peers = append(n.Peers[:i-c], n.Peers[i-c+1:]...)
 	}
 }
 
-//Run start the workers and run an HTTP server
+//Handler returns an http.Handler serving the API of the node
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", n.announceHandler)
+	mux.HandleFunc("/keys/", n.keysHandler)
+	mux.HandleFunc("/status", n.statusHandler)
+	mux.HandleFunc("/peers", n.peersHandler)
+	mux.HandleFunc("/members", n.membersHandler)
+	mux.HandleFunc("/probe", n.probeHandler)
+	mux.HandleFunc("/sync", n.syncHandler)
+	mux.HandleFunc("/tree", n.treeHandler)
+	mux.HandleFunc("/admin/drain", n.adminDrainHandler)
+	if n.config.Node.Debug {
+		mux.HandleFunc("/debug/faults", n.debugFaultsHandler)
+	}
+	return mux
+}
+
+/*Start starts the workers of the node and an HTTP server listening on the
+address of the node.
+
+The workers and the server run until ctx is cancelled or Stop is called. This
+returns an error if the server cannot listen on the address of the node.
+*/
+func (n *Node) Start(ctx context.Context) error {
+	server, ln, err := newServer(n.String(), n.Handler(), n.config)
+	if err != nil {
+		return err
+	}
+	n.server = server
+
+	log.WithFields(log.Fields{"node": n, "func": "Start"}).Info("Starting node")
+	n.StartWorkers(ctx)
+	n.startWorker(func() {
+		if err := serve(server, ln); err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{"node": n, "func": "Start"}).Errorf("Fatal error with HTTP server: %s", err.Error())
+		}
+	})
+	n.startWorker(func() {
+		//Close remaining connections if the node stops without calling Stop
+		n.config.track(-1)
+		<-n.ctx.Done()
+		n.config.track(1)
+		server.Close()
+	})
+
+	return nil
+}
+
+/*StartWorkers starts the workers of the node without running an HTTP server.
+
+The workers run until ctx is cancelled or Stop is called. This also starts
+peering with the seeds and registering with the controllers of the node,
+discovering other nodes through DNS, and running anti-entropy sessions.
+*/
+func (n *Node) StartWorkers(ctx context.Context) {
+	n.startWorker(func() {
+		n.config.track(-1)
+		select {
+		case <-ctx.Done():
+			n.cancel()
+		case <-n.ctx.Done():
+		}
+		n.config.track(1)
+	})
+	n.startWorker(n.addPeerWorker)
+	n.startWorker(n.deletePeerWorker)
+	n.startWorker(n.fetchStateWorker)
+	n.startWorker(n.peerSendStateWorker)
+	n.startWorker(n.pingWorker)
+	n.startWorker(n.snapshotWorker)
+	n.startWorker(n.stateWorker)
+
+	if n.config.Node.AntiEntropyInterval > 0 {
+		n.startWorker(n.antiEntropyWorker)
+	}
+	if n.discovery != nil {
+		n.startWorker(n.discoveryWorker)
+	}
+	for _, addr := range n.seeds {
+		addr := addr
+		n.startWorker(func() { n.joinWorker(addr, "seed") })
+	}
+	for _, addr := range n.controllers {
+		addr := addr
+		n.startWorker(func() { n.joinWorker(addr, "controller") })
+	}
+}
+
+/*Run starts the node and runs until it receives an interrupt signal, then
+drains the node before stopping it.
+*/
 func (n *Node) Run() {
-	//Start workers
-	go n.addPeerWorker()
-	go n.deletePeerWorker()
-	go n.fetchStateWorker()
-	go n.peerSendStateWorker()
-	go n.pingWorker()
-	go n.stateWorker()
-
-	//Register handlers
-	http.HandleFunc("/", n.rootHandler)
-	http.HandleFunc("/status", n.statusHandler)
-	http.HandleFunc("/peers", n.peersHandler)
-
-	//Run HTTP server
-	server := &http.Server{
-		Addr: n.String(),
-	}
-
-	done := make(chan bool)
-	quit := make(chan os.Signal)
+	if err := n.Start(context.Background()); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "Run"}).Fatalf("Failed to start node: %s", err.Error())
+	}
+
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
+	<-quit
 
-	go func() {
-		<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if !n.Draining() {
+		if err := n.Drain(ctx); err != nil {
+			log.WithFields(log.Fields{"node": n, "func": "Run"}).Warnf("Failed to drain node: %s", err.Error())
+		}
+	}
+	if err := n.Stop(ctx); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "Run"}).Fatalf("Error shutting down node: %s", err.Error())
+	}
+}
+
+/*Stop stops the node
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+This shuts down the HTTP server, cancels all in-flight requests to peers and
+waits for the workers to exit, before sending peer deletion requests to peers
+and persisting the states of the node.
 
-		if err := server.Shutdown(ctx); err != nil {
-			log.WithFields(log.Fields{"node": n, "func": "Run"}).Fatalf("Error shutting down node: %s", err.Error())
+If ctx is cancelled before the workers exit, this returns ctx.Err() without
+closing the storage. Stop can be called again: only the first call that sees
+the workers exit leaves and closes the storage, and the later ones return its
+result.
+*/
+func (n *Node) Stop(ctx context.Context) error {
+	log.WithFields(log.Fields{"node": n, "func": "Stop"}).Info("Stopping node")
+	if n.server != nil {
+		if err := n.server.Shutdown(ctx); err != nil {
+			log.WithFields(log.Fields{"node": n, "func": "Stop"}).Warnf("Failed to shut down HTTP server: %s", err.Error())
 		}
-		n.Shutdown()
+	}
+	n.cancel()
+
+	//Wait for the workers to exit
+	done := make(chan struct{})
+	go func() {
+		n.workers.Wait()
 		close(done)
 	}()
-
-	log.WithFields(log.Fields{"node": n, "func": "Run"}).Info("Starting node")
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.WithFields(log.Fields{"node": n, "func": "Run"}).Errorf("Fatal error with HTTP server: %s", err.Error())
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	<-done
+
+	n.stopOnce.Do(func() {
+		n.leave(ctx)
+
+		if err := n.Snapshot(); err != nil {
+			log.WithFields(log.Fields{"node": n, "func": "Stop"}).Errorf("Failed to snapshot states: %s", err.Error())
+			n.stopErr = err
+			return
+		}
+		n.stopErr = n.storage.Close()
+	})
+	return n.stopErr
 }
 
-//Shutdown shuts down the node
-func (n *Node) Shutdown() {
-	log.WithFields(log.Fields{"node": n, "func": "Shutdown"}).Info("Shutting down node")
-	for _, peer := range n.Peers {
-		log.WithFields(log.Fields{"node": n, "func": "Shutdown"}).Infof("Removing peer %v", peer)
-		peer.SendPeerDeletionRequest(n.Addr())
-	}
+/*Snapshot persists all the current states in a snapshot of the storage,
+which allows the storage to discard older data.
+*/
+func (n *Node) Snapshot() error {
+	n.storageMu.Lock()
+	defer n.storageMu.Unlock()
+
+	var states []State
+	n.States.Range(func(key, value interface{}) bool {
+		state, ok := value.(State)
+		if !ok {
+			log.WithFields(log.Fields{"node": n, "func": "Snapshot", "key": key}).Warn("Failed to assert state")
+			return true
+		}
+
+		states = append(states, state)
+		return true
+	})
+
+	log.WithFields(log.Fields{"node": n, "func": "Snapshot"}).Infof("Taking snapshot of %d states", len(states))
+	return n.storage.Snapshot(states)
 }
 
 //String returns a string representation of the node
@@ -262,33 +782,76 @@ func (n *Node) URL() string {
 	return fmt.Sprintf("%s://%s:%d", n.config.Protocol, n.IP, n.Port)
 }
 
-/*UpdateState updates the internal state if it is older than the proposed
-state.
+/*UpdateState updates the internal state of a key if it is older than the
+proposed state.
+
+New states from end-users do not have a timestamp: the node generates one from
+its clock. Otherwise, the node advances its clock with the state's timestamp,
+so that states created later by this node are ordered after it. States with a
+timestamp more than n.config.Node.MaxClockDrift ahead of the clock are
+rejected.
+
+The new state is persisted in the storage before updating the internal state
+and the Merkle tree of the node. If it cannot be persisted, the state is
+rejected.
 
 This returns true if the internal state has been updated.
 */
 func (n *Node) UpdateState(state State) (State, bool) {
+	n.storageMu.Lock()
+	defer n.storageMu.Unlock()
+
 	//New state received from the end-user
-	if state.Timestamp == 0 {
-		state.Timestamp = time.Now().UnixNano()
+	if state.Timestamp.IsZero() {
+		state.Timestamp = n.clock.Now()
+	} else if _, err := n.clock.Update(state.Timestamp); err != nil {
+		log.WithFields(log.Fields{"node": n, "state": state, "func": "stateWorker"}).Warnf("Rejected state: %s", err.Error())
+		return state, false
+	}
+
+	//Tombstones do not carry any data
+	if state.Deleted {
+		state.Data = ""
+	}
+	state.Digest = state.ComputeDigest()
+
+	current, found := n.GetState(state.Key)
+
+	//Different states sharing the same timestamp are resolved deterministically
+	conflict := state.Timestamp == current.Timestamp && state.Digest != current.Digest
+	if conflict {
+		state = n.Resolver.Resolve(current, state)
 	}
 
 	switch {
-	case state.Timestamp < n.State.Timestamp:
+	case state.Timestamp.Before(current.Timestamp):
 		log.WithFields(log.Fields{"node": n, "state": state, "func": "stateWorker"}).Info("Received obsolete state")
-	case state.Timestamp == n.State.Timestamp:
-		log.WithFields(log.Fields{"node": n, "state": state, "func": "stateWorker"}).Info("Received known state")
-	case state.Timestamp > n.State.Timestamp:
-		log.WithFields(log.Fields{"node": n, "state": state, "func": "stateWorker"}).Info("Received new state")
-		n.State = state
+	case state.Timestamp == current.Timestamp && state.Digest == current.Digest:
+		if conflict {
+			log.WithFields(log.Fields{"node": n, "state": state, "func": "stateWorker"}).Warn("Resolved conflict in favor of the current state")
+		} else {
+			log.WithFields(log.Fields{"node": n, "state": state, "func": "stateWorker"}).Info("Received known state")
+		}
+	default:
+		if conflict {
+			log.WithFields(log.Fields{"node": n, "state": state, "func": "stateWorker"}).Warn("Resolved conflict in favor of the received state")
+		} else {
+			log.WithFields(log.Fields{"node": n, "state": state, "func": "stateWorker"}).Info("Received new state")
+		}
+		if err := n.storage.Save(state); err != nil {
+			log.WithFields(log.Fields{"node": n, "state": state, "func": "stateWorker"}).Errorf("Failed to persist state: %s", err.Error())
+			return state, false
+		}
+		n.tree.Update(current, found, state)
+		n.States.Store(state.Key, state)
 		return state, true
 	}
 
 	return state, false
 }
 
-/*addPeerWorker waits for new Addrs on the n.addPeerChan channel and processes
-them.
+/*addPeerWorker waits for peering requests on the n.addPeerChan channel and
+processes them.
 
 If the node is known, there is no need to do anything, so the message can
 safely be ignored.
@@ -303,8 +866,15 @@ network.
 */
 func (n *Node) addPeerWorker() {
 	for {
-		addr := <-n.addPeerChan
-		n.AddPeer(addr)
+		n.addPeerInbox.wait(func() int { return len(n.addPeerChan) })
+		select {
+		case <-n.ctx.Done():
+			n.addPeerInbox.received(nil)
+			return
+		case req := <-n.addPeerChan:
+			n.addPeerInbox.received(n.addPeerChan)
+			n.addPeer(req)
+		}
 	}
 }
 
@@ -314,33 +884,473 @@ processes them.
 */
 func (n *Node) deletePeerWorker() {
 	for {
-		addr := <-n.deletePeerChan
-		n.DeletePeer(addr)
+		n.deletePeerInbox.wait(func() int { return len(n.deletePeerChan) })
+		select {
+		case <-n.ctx.Done():
+			n.deletePeerInbox.received(nil)
+			return
+		case addr := <-n.deletePeerChan:
+			n.deletePeerInbox.received(n.deletePeerChan)
+			n.DeletePeer(addr)
+		}
+	}
+}
+
+/*discoveryWorker resolves the DNS names of n.discovery when the node starts,
+then at regular interval.
+
+Discovered nodes join the view of the node on the membership of the cluster,
+which lets the node pick its peers among them.
+*/
+func (n *Node) discoveryWorker() {
+	for {
+		n.discover()
+
+		if !n.config.sleep(n.ctx, n.config.Node.DiscoveryInterval) {
+			return
+		}
+	}
+}
+
+//discover resolves the DNS names of n.discovery once
+func (n *Node) discover() {
+	addrs, err := n.discovery.Resolve(n.ctx)
+	if err != nil {
+		return
 	}
+
+	var events []MemberEvent
+	for _, addr := range addrs {
+		if !n.discovery.IsSelf(n.ctx, addr, n.Addr()) {
+			events = append(events, MemberEvent{MemberJoin, "", addr, 0})
+		}
+	}
+	if applied := n.members.Apply(events...); applied > 0 {
+		log.WithFields(log.Fields{"node": n, "func": "discover"}).Infof("Discovered %d new nodes", applied)
+	}
+	n.replacePeers()
 }
 
-/*fetchStateWorker waits for peers on the n.fetchStateChan channel and
-retrieves the last state from those peers, then sends the state to the
+/*fetchStateWorker waits for fetch requests on the n.fetchStateChan channel and
+retrieves the last state of a key from peers, then sends the state to the
 n.stateChan channel.
+
+If the state is split in chunks, only the chunks the node misses are
+downloaded.
 */
 func (n *Node) fetchStateWorker() {
 	for {
-		peer := <-n.fetchStateChan
-		log.WithFields(log.Fields{"node": n, "peer": peer, "func": "fetchStateWorker"}).Info("Fetching latest state")
+		var req fetchRequest
+		n.fetchStateInbox.wait(func() int { return len(n.fetchStateChan) })
+		select {
+		case <-n.ctx.Done():
+			n.fetchStateInbox.received(nil)
+			return
+		case req = <-n.fetchStateChan:
+			n.fetchStateInbox.received(n.fetchStateChan)
+		}
+		log.WithFields(log.Fields{"node": n, "peer": req.peer, "key": req.key, "func": "fetchStateWorker"}).Info("Fetching latest state")
 
 		/*It's possible that we have already fetched the latest state from the
 		peer. If that's the case, ignore, as this would generate a useless
 		GET request to the peer.
 		*/
-		if peer.LastState <= n.State.Timestamp {
-			log.WithFields(log.Fields{"node": n, "peer": peer, "func": "fetchStateWorker"}).Info("Skip fetching state")
+		if !n.needsFetch(req.key, req.status) {
+			log.WithFields(log.Fields{"node": n, "peer": req.peer, "key": req.key, "func": "fetchStateWorker"}).Info("Skip fetching state")
+			continue
+		}
+
+		if state, err := n.fetchState(n.ctx, req.peer, req.key, req.status); err == nil {
+			state.Hops++
+			if !n.stateInbox.sendState(n.ctx, n.stateChan, state) {
+				return
+			}
+		}
+	}
+}
+
+/*conflicts returns true if a peering request claims the address of a reachable
+peer with a different ID.
+
+This must be called while holding n.peersMu.
+*/
+func (n *Node) conflicts(req PeeringRequest) bool {
+	pos, found := n.findPeer(req.Addr)
+	return found && differentIDs(n.Peers[pos].ID(), req.ID) && n.Peers[pos].Reachable()
+}
+
+/*findPeer looks up known peers and returns the position of the peer matching
+the Addr provided.
+
+This must be called while holding n.peersMu.
+*/
+func (n *Node) findPeer(addr Addr) (int, bool) {
+	for pos, peer := range n.Peers {
+		if peer.Addr == addr {
+			return pos, true
+		}
+	}
+	return -1, false
+}
+
+/*identifyPeer records the ID a peer responded with, and returns the peer to
+use for that node.
+
+The address of the peer is authoritative: if the peer responds with a
+different ID than the one it is known with, another node now uses that address
+and the peer is replaced, so that the new node starts with a clean state in
+the failure detectors. Peers with the same ID at other addresses are removed,
+as the node changed address.
+*/
+func (n *Node) identifyPeer(peer *Peer, id string) *Peer {
+	if id == "" || peer.ID() == id {
+		return peer
+	}
+
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+
+	pos, found := n.findPeer(peer.Addr)
+	if !found || n.Peers[pos] != peer {
+		//The peer was removed or replaced in the meantime
+		return peer
+	}
+	if peer.ID() != "" {
+		log.WithFields(log.Fields{"node": n, "func": "identifyPeer", "peer": peer, "id": id}).Warnf("Peer responded with a different ID than %s", peer.ID())
+		peer = NewPeer(peer.Addr, n.config)
+		n.Peers[pos] = peer
+	}
+	peer.SetID(id)
+	n.removeMovedPeers(peer)
+	return peer
+}
+
+/*joinWorker sends the address of the node to a seed or a controller until it
+succeeds, waiting for an exponential backoff between attempts.
+
+Seeds send a peering request back to the node, while controllers connect it to
+other nodes during their next scan.
+*/
+func (n *Node) joinWorker(addr Addr, kind string) {
+	if addr == n.Addr() {
+		return
+	}
+
+	backoff := n.config.Peer.BackoffDuration
+	for {
+		//Draining nodes are leaving the cluster
+		if n.Draining() {
+			return
+		}
+
+		err := n.config.transport().SendPeeringRequest(n.ctx, addr, n.PeeringRequest())
+		if err == nil {
+			log.WithFields(log.Fields{"node": n, "func": "joinWorker", "addr": addr}).Infof("Joined %s", kind)
+			return
+		}
+		log.WithFields(log.Fields{"node": n, "func": "joinWorker", "addr": addr}).Warnf("Failed to join %s, retrying in %v: %s", kind, backoff, err.Error())
+
+		if !n.config.sleep(n.ctx, backoff) {
+			return
+		}
+		if backoff *= 2; backoff > n.config.Node.MaxJoinBackoff {
+			backoff = n.config.Node.MaxJoinBackoff
+		}
+	}
+}
+
+/*flush waits until the stateWorker applied the states received before the
+call, or until ctx is cancelled.
+*/
+func (n *Node) flush(ctx context.Context) {
+	done := make(chan struct{})
+	if !n.stateInbox.sendFlush(ctx, n.flushChan, done) {
+		return
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+/*leave sends peer deletion requests to all peers, then forgets them.
+
+Peers announce that the node left the cluster when they receive the request.
+*/
+func (n *Node) leave(ctx context.Context) {
+	reqCtx, cancel := context.WithTimeout(ctx, n.config.Peer.RequestTimeout)
+	defer cancel()
+	for _, peer := range n.PeerList() {
+		log.WithFields(log.Fields{"node": n, "func": "leave"}).Infof("Removing peer %v", peer)
+		peer.SendPeerDeletionRequest(reqCtx, n.Addr())
+	}
+
+	n.peersMu.Lock()
+	n.Peers = nil
+	n.peersMu.Unlock()
+}
+
+/*loadStates loads the states persisted in the storage.
+
+States are replayed in order and only applied if they are newer than the
+current state of their key.
+*/
+func (n *Node) loadStates() {
+	states, err := n.storage.Load()
+	if err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "loadStates"}).Errorf("Failed to load states: %s", err.Error())
+		return
+	}
+
+	for _, state := range states {
+		//States persisted by older versions do not carry a digest
+		if state.Digest == "" {
+			state.Digest = state.ComputeDigest()
+		}
+		if current, ok := n.GetState(state.Key); !ok || state.Timestamp.After(current.Timestamp) {
+			//States accepted before a restart are kept even if the clock is behind
+			n.clock.Update(state.Timestamp)
+			n.tree.Update(current, ok, state)
+			n.States.Store(state.Key, state)
+		}
+	}
+
+	log.WithFields(log.Fields{"node": n, "func": "loadStates"}).Infof("Loaded %d states", len(states))
+}
+
+/*needsFetch returns true if the state of a key advertised by a peer is newer
+than the current state, or if it has the same timestamp but different data.
+
+In the latter case, fetching the state lets the Resolver repair the
+divergence.
+*/
+func (n *Node) needsFetch(key string, status KeyStatus) bool {
+	state, _ := n.GetState(key)
+	switch {
+	case status.Timestamp.After(state.Timestamp):
+		return true
+	case status.Timestamp == state.Timestamp && status.Digest != state.Digest:
+		return true
+	}
+	return false
+}
+
+//recipients returns up to maxRecipients peers chosen randomly
+func (n *Node) recipients(maxRecipients int) []*Peer {
+	var peers []*Peer
+	allPeers := n.PeerList()
+	//If there are too many peers, need to limit to maxRecipients peers chosen
+	//randomly.
+	if len(allPeers) > maxRecipients {
+		for _, i := range n.config.perm(len(allPeers)) {
+			peers = append(peers, allPeers[i])
+			if len(peers) >= maxRecipients {
+				break
+			}
+		}
+	} else {
+		peers = allPeers
+	}
+	return peers
+}
+
+/*peerSendState sends a state to peers.
+
+If acks is not nil, the result of sending the state to each peer is sent to
+that channel. The channel must be able to buffer one result per peer.
+
+This returns the number of peers the state is sent to.
+*/
+func (n *Node) peerSendState(state State, peers []*Peer, acks chan<- peerAck) int {
+	log.WithFields(log.Fields{"node": n, "state": state, "func": "peerSendStateWorker"}).Infof("Sending state update to %d peers", len(peers))
+
+	//Peers receive the state one hop further from its writer
+	state.Hops++
+
+	for _, peer := range peers {
+		peer := peer
+		n.config.goTask(func() {
+			//Writes waiting for acknowledgements need peers to hold the data
+			if acks != nil {
+				ok := peer.Send(n.ctx, state, n.members.Piggyback()...)
+				acks <- peerAck{peer.Addr, ok}
+				return
+			}
+			n.sendState(n.ctx, peer, state)
+		})
+	}
+
+	return len(peers)
+}
+
+/*probePeer pings a peer and updates its liveness, following the SWIM failure
+detector. This returns the status of the peer if the ping succeeded.
+
+If the ping fails, up to n.config.Node.IndirectProbes other peers are asked to
+probe the peer. The peer becomes suspect if none of them could reach it.
+
+If the peer responds while being suspect, it is asked to refute the suspicion.
+
+Changes in the liveness of the peer are announced to the membership of the
+cluster.
+*/
+func (n *Node) probePeer(ctx context.Context, peer *Peer, peers []*Peer) (StatusResponse, bool) {
+	liveness, incarnation := peer.Membership()
+	req := ProbeRequest{
+		Target:      peer.Addr,
+		Incarnation: incarnation,
+		Suspect:     liveness == PeerSuspect,
+	}
+
+	status, err := peer.Ping(ctx, n.members.Piggyback()...)
+	if err == nil {
+		peer = n.identifyPeer(peer, status.ID)
+		alive := peer.MarkAlive(status.Incarnation)
+		if !alive {
+			if res, ok := peer.Probe(ctx, req); ok {
+				alive = peer.MarkAlive(res.Incarnation)
+			}
+		}
+		if alive {
+			_, incarnation := peer.Membership()
+			n.members.Apply(MemberEvent{MemberJoin, peer.ID(), peer.Addr, incarnation})
+		}
+		return status, true
+	}
+
+	//Ask other alive peers to probe the peer
+	var helpers []*Peer
+	for _, helper := range peers {
+		if helper.Addr == peer.Addr {
 			continue
 		}
+		if liveness, _ := helper.Membership(); liveness == PeerAlive {
+			helpers = append(helpers, helper)
+		}
+	}
+	n.config.shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	if len(helpers) > n.config.Node.IndirectProbes {
+		helpers = helpers[:n.config.Node.IndirectProbes]
+	}
+
+	acks := make(chan ProbeResponse, len(helpers))
+	tasks := n.config.newTaskGroup()
+	for _, helper := range helpers {
+		helper := helper
+		tasks.Go(func() {
+			if res, ok := helper.Probe(ctx, req); ok {
+				acks <- res
+			}
+		})
+	}
+	tasks.Wait()
+	close(acks)
 
-		if state, err := peer.Get(); err == nil {
-			n.stateChan <- state
+	acked := false
+	for res := range acks {
+		acked = true
+		peer.MarkAlive(res.Incarnation)
+	}
+	if acked {
+		peer.Heartbeat()
+	}
+	if !acked {
+		log.WithFields(log.Fields{"node": n, "func": "probePeer", "peer": peer}).Infof("Peer failed direct and %d indirect probes", len(helpers))
+		peer.MarkSuspect()
+	}
+
+	switch liveness, incarnation := peer.Membership(); liveness {
+	case PeerAlive:
+		n.members.Apply(MemberEvent{MemberJoin, peer.ID(), peer.Addr, incarnation})
+	case PeerSuspect:
+		n.members.Apply(MemberEvent{MemberSuspect, peer.ID(), peer.Addr, incarnation})
+	}
+	return StatusResponse{}, false
+}
+
+/*removeMovedPeers removes the peers that have the same ID as peer at another
+address, as the node moved to the address of peer.
+
+The former address is announced as suspect to the membership of the cluster,
+so that the node refutes it with a greater incarnation number at its new
+address.
+
+This must be called while holding n.peersMu.
+*/
+func (n *Node) removeMovedPeers(peer *Peer) {
+	id := peer.ID()
+	if id == "" {
+		return
+	}
+
+	peers := make([]*Peer, 0, len(n.Peers))
+	for _, other := range n.Peers {
+		if other != peer && other.ID() == id {
+			log.WithFields(log.Fields{"node": n, "func": "removeMovedPeers", "peer": other, "id": id}).Infof("Peer moved to %v", peer.Addr)
+			_, incarnation := other.Membership()
+			n.members.Apply(MemberEvent{MemberSuspect, id, other.Addr, incarnation})
+			continue
+		}
+		peers = append(peers, other)
+	}
+	n.Peers = peers
+}
+
+/*refute increases the incarnation number of the node if a peer suspects it
+with its current incarnation number, and returns the incarnation number.
+
+The new incarnation number is announced to the membership of the cluster. A
+draining node does not refute suspicions, as it is leaving the cluster.
+*/
+func (n *Node) refute(incarnation uint64) uint64 {
+	n.incarnationMu.Lock()
+	defer n.incarnationMu.Unlock()
+
+	if incarnation >= n.incarnation && !n.Draining() {
+		n.incarnation = incarnation + 1
+		log.WithFields(log.Fields{"node": n, "func": "refute"}).Infof("Refuting suspicion with incarnation %d", n.incarnation)
+		n.members.Refuted(n.incarnation)
+	}
+	return n.incarnation
+}
+
+/*pushStates sends the latest state of each key to all peers, and returns once
+all peers received them or ctx is cancelled.
+*/
+func (n *Node) pushStates(ctx context.Context) {
+	var states []State
+	n.States.Range(func(key, value interface{}) bool {
+		state, ok := value.(State)
+		if !ok {
+			log.WithFields(log.Fields{"node": n, "func": "pushStates", "key": key}).Warn("Failed to assert state")
+			return true
 		}
+
+		//Peers receive the state one hop further from its writer
+		state.Hops++
+		states = append(states, state)
+		return true
+	})
+
+	peers := n.PeerList()
+	log.WithFields(log.Fields{"node": n, "func": "pushStates"}).Infof("Pushing %d states to %d peers", len(states), len(peers))
+
+	tasks := n.config.newTaskGroup()
+	for _, peer := range peers {
+		peer := peer
+		tasks.Go(func() {
+			for _, state := range states {
+				if ctx.Err() != nil {
+					return
+				}
+				peer.Send(ctx, state, n.members.Piggyback()...)
+			}
+		})
 	}
+	tasks.Wait()
 }
 
 /*peerSendStateWorker waits for new states on the n.peerStateChan channel and
@@ -348,28 +1358,169 @@ sends the state to all known peers.
 */
 func (n *Node) peerSendStateWorker() {
 	for {
-		state := <-n.peerStateChan
-		n.PeerSendState(state)
+		n.peerStateInbox.wait(func() int { return len(n.peerStateChan) })
+		select {
+		case <-n.ctx.Done():
+			n.peerStateInbox.received(nil)
+			return
+		case state := <-n.peerStateChan:
+			n.peerStateInbox.received(n.peerStateChan)
+			n.PeerSendState(state)
+		}
 	}
 }
 
-//pingWorker checks the status of all peers at regular interval.
+/*pingWorker checks the status of all peers at regular interval, then replaces
+peers that were removed.
+*/
 func (n *Node) pingWorker() {
-	for {
-		time.Sleep(n.config.Node.PingInterval)
-		n.PingPeers()
+	for n.config.sleep(n.ctx, n.config.Node.PingInterval) {
+		n.PingPeers(n.ctx)
+		n.members.Expire()
+		n.replacePeers()
 	}
 }
 
-/*stateWorker waits for new states on the n.stateChan channel and process
-them.
+/*replacePeers picks new peers at random among alive members of the cluster if
+the node has less than n.config.Node.MinPeers peers.
+
+This lets nodes recover from failures of their peers while the controller is
+unavailable.
+*/
+func (n *Node) replacePeers() {
+	missing := n.config.Node.MinPeers - len(n.PeerList())
+	if missing <= 0 {
+		return
+	}
+
+	candidates := n.members.Alive()
+	n.config.shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for _, addr := range candidates {
+		if missing <= 0 {
+			break
+		}
+		if _, found := n.FindPeer(addr); found {
+			continue
+		}
+
+		log.WithFields(log.Fields{"node": n, "func": "replacePeers", "addr": addr}).Info("Picking replacement peer from the membership")
+		n.AddPeer(addr)
+		missing--
+	}
+}
+
+/*sendPeerState sends a state to the n.peerStateChan channel, unless the node
+stops first.
+*/
+func (n *Node) sendPeerState(state State) {
+	n.peerStateInbox.sendState(n.ctx, n.peerStateChan, state)
+}
+
+//snapshotWorker takes snapshots of the states at regular interval.
+func (n *Node) snapshotWorker() {
+	for n.config.sleep(n.ctx, n.config.Node.SnapshotInterval) {
+		if err := n.Snapshot(); err != nil {
+			log.WithFields(log.Fields{"node": n, "func": "snapshotWorker"}).Errorf("Failed to snapshot states: %s", err.Error())
+		}
+	}
+}
+
+/*startWorker runs a worker in a new goroutine and tracks it until it
+returns. The worker is counted as a task while it runs.
+*/
+func (n *Node) startWorker(worker func()) {
+	n.workers.Add(1)
+	n.config.goTask(func() {
+		defer n.workers.Done()
+		worker()
+	})
+}
+
+/*stateWorker waits for new states on the n.stateChan and n.writeChan channels
+and process them.
+
+On a flush request, the states already waiting in these channels are applied
+before closing the channel of the request.
 */
 func (n *Node) stateWorker() {
 	for {
-		state := <-n.stateChan
+		n.stateInbox.wait(func() int { return len(n.stateChan) + len(n.writeChan) })
+		select {
+		case <-n.ctx.Done():
+			n.stateInbox.received(nil)
+			return
+		case state := <-n.stateChan:
+			n.stateInbox.received(n.stateChan)
+			n.applyState(state)
+		case req := <-n.writeChan:
+			n.stateInbox.received(n.writeChan)
+			req.result <- n.write(req)
+		case done := <-n.flushChan:
+			n.stateInbox.received(n.flushChan)
+			//Apply the states waiting in the channels before the flush
+			for flushed := false; !flushed; {
+				select {
+				case state := <-n.stateChan:
+					n.stateInbox.received(n.stateChan)
+					n.applyState(state)
+				case req := <-n.writeChan:
+					n.stateInbox.received(n.writeChan)
+					req.result <- n.write(req)
+				default:
+					flushed = true
+				}
+			}
+			close(done)
+		}
+	}
+}
+
+//applyState updates the state of a key, then propagates it to peers if it is new
+func (n *Node) applyState(state State) {
+	if err := n.trustedKeys.Check(state); err != nil {
+		log.WithFields(log.Fields{"node": n, "state": state, "func": "applyState"}).Warnf("Rejected state: %s", err.Error())
+		return
+	}
+	if state, ok := n.UpdateState(state); ok {
+		n.sendPeerState(state)
+	}
+}
+
+/*write applies a client write and propagates it to peers.
 
-		if state, ok := n.UpdateState(state); ok {
-			n.peerStateChan <- state
+If the write requires acknowledgements from peers, the state is sent to at
+least that number of peers directly, instead of going through the
+n.peerStateChan channel, so that acknowledgements can be reported back.
+*/
+func (n *Node) write(req writeRequest) writeResult {
+	state, ok := n.UpdateState(req.state)
+	if !ok {
+		current, _ := n.GetState(state.Key)
+		return writeResult{
+			state:    state,
+			obsolete: !state.Timestamp.After(current.Timestamp),
 		}
 	}
+
+	res := writeResult{
+		state:   state,
+		applied: true,
+	}
+
+	if req.consistency.Peers == 0 {
+		n.sendPeerState(state)
+		return res
+	}
+
+	maxRecipients := n.config.Node.MaxRecipients
+	if req.consistency.Peers > maxRecipients {
+		maxRecipients = req.consistency.Peers
+	}
+	//The recipients are chosen once, so that the channel can buffer all their acknowledgements
+	peers := n.recipients(maxRecipients)
+	res.acks = make(chan peerAck, len(peers))
+	res.recipients = n.peerSendState(state, peers, res.acks)
+	return res
 }
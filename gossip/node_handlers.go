@@ -1,8 +1,11 @@
 package gossip
 
 import (
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -27,7 +30,7 @@ func (n *Node) peersHandler(w http.ResponseWriter, r *http.Request) {
 
 //peersDeleteHandler handles 'DELETE /peers' requests
 func (n *Node) peersDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	log.WithFields(log.Fields{"node": n, "func": "peersDeleteHandler"}).Info("Received GET /peers")
+	log.WithFields(log.Fields{"node": n, "func": "peersDeleteHandler"}).Info("Received DELETE /peers")
 	addr := &Addr{}
 
 	if err := json.NewDecoder(r.Body).Decode(addr); err != nil {
@@ -50,16 +53,27 @@ func (n *Node) peersDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		(*addr).IP = strings.SplitN(r.RemoteAddr, ":", 2)[0]
 	}
 
-	n.deletePeerChan <- *addr
+	if !n.deletePeerInbox.sendAddr(n.ctx, n.deletePeerChan, *addr) {
+		response(w, r, http.StatusServiceUnavailable, "Node is stopping")
+		return
+	}
 	response(w, r, http.StatusOK, "Peer deletion request received")
 }
 
 //peersGetHandler handles 'GET /peers' requests
 func (n *Node) peersGetHandler(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(log.Fields{"node": n, "func": "peersGetHandler"}).Info("Received GET /peers")
-	msg := PeersResponse{}
-	for _, peer := range n.Peers {
+	msg := PeersResponse{ID: n.ID, Draining: n.Draining()}
+	for _, peer := range n.PeerList() {
+		liveness, incarnation := peer.Membership()
 		msg.Peers = append(msg.Peers, peer.Addr)
+		msg.Members = append(msg.Members, Member{
+			ID:          peer.ID(),
+			Addr:        peer.Addr,
+			Liveness:    liveness,
+			Incarnation: incarnation,
+			Phi:         peer.Phi(),
+		})
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -69,16 +83,16 @@ func (n *Node) peersGetHandler(w http.ResponseWriter, r *http.Request) {
 //peersPostHandler handles 'POST /peers' requests
 func (n *Node) peersPostHandler(w http.ResponseWriter, r *http.Request) {
 	log.WithFields(log.Fields{"node": n, "func": "peersPostHandler"}).Info("Received POST /peers")
-	addr := &Addr{}
+	req := &PeeringRequest{}
 
-	if err := json.NewDecoder(r.Body).Decode(addr); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
 		log.WithFields(log.Fields{"node": n, "func": "peersPostHandler"}).Warnf("Failed to decode request body: %s", err.Error())
 		response(w, r, http.StatusInternalServerError, "Failed to decode request body")
 		return
 	}
 
 	//Invalid port number
-	if (*addr).Port == 0 {
+	if req.Port == 0 {
 		response(w, r, http.StatusBadRequest, "Required property 'port' is 0 or not present")
 		return
 	}
@@ -86,59 +100,250 @@ func (n *Node) peersPostHandler(w http.ResponseWriter, r *http.Request) {
 	/*Infer that the client node does not know its IP address and use the one
 	from the HTTP request instead.
 	*/
-	if (*addr).IP == "" {
+	if req.IP == "" {
 		log.WithFields(log.Fields{"node": n, "func": "peersPostHandler"}).Infof("Auto-detecting IP address for peer: %s", strings.SplitN(r.RemoteAddr, ":", 2)[0])
-		(*addr).IP = strings.SplitN(r.RemoteAddr, ":", 2)[0]
+		req.IP = strings.SplitN(r.RemoteAddr, ":", 2)[0]
 	}
 
-	n.addPeerChan <- *addr
+	if n.Draining() {
+		response(w, r, http.StatusServiceUnavailable, "Node is draining")
+		return
+	}
+
+	if err := n.CheckPeeringRequest(*req); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "peersPostHandler", "addr": req.Addr, "id": req.ID}).Warnf("Rejected peering request: %s", err.Error())
+		response(w, r, http.StatusConflict, err.Error())
+		return
+	}
+
+	if !n.addPeerInbox.sendPeeringRequest(n.ctx, n.addPeerChan, *req) {
+		response(w, r, http.StatusServiceUnavailable, "Node is stopping")
+		return
+	}
 	response(w, r, http.StatusOK, "Peering request received")
 }
 
-//rootHandler handles requests to the '/' path
-func (n *Node) rootHandler(w http.ResponseWriter, r *http.Request) {
-	corsHeadersResponse(&w, r, n.config, "GET, POST")
+//keysHandler handles requests to the '/keys/{key}' path
+func (n *Node) keysHandler(w http.ResponseWriter, r *http.Request) {
+	corsHeadersResponse(&w, r, n.config, "GET, POST, DELETE")
+	if r.Method == http.MethodOptions {
+		corsOptionsResponse(w, r, n.config, "GET, POST, DELETE")
+		return
+	}
+
+	//Missing key
+	key := strings.TrimPrefix(r.URL.Path, "/keys/")
+	if key == "" {
+		response(w, r, http.StatusBadRequest, "Required key is empty or not present")
+		return
+	}
+
 	switch r.Method {
+	case http.MethodDelete:
+		n.keysDeleteHandler(w, r, key)
 	case http.MethodGet:
-		n.rootGetHandler(w, r)
+		n.keysGetHandler(w, r, key)
 	case http.MethodPost:
-		n.rootPostHandler(w, r)
-	case http.MethodOptions:
-		corsOptionsResponse(w, r, n.config, "GET, POST")
+		n.keysPostHandler(w, r, key)
 	default:
 		methodNotAllowedHandler(w, r)
 	}
 }
 
-//rootGetHandler handles 'GET /' requests
-func (n *Node) rootGetHandler(w http.ResponseWriter, r *http.Request) {
-	log.WithFields(log.Fields{"node": n, "func": "rootGetHandler"}).Info("Received GET /")
+/*keysDeleteHandler handles 'DELETE /keys/{key}' requests
+
+The body of the request is optional. If the node has trusted keys, it must
+contain a tombstone state signed by one of them, with its timestamp.
+*/
+func (n *Node) keysDeleteHandler(w http.ResponseWriter, r *http.Request, key string) {
+	log.WithFields(log.Fields{"node": n, "func": "keysDeleteHandler", "key": key}).Info("Received DELETE /keys/{key}")
+	state := &State{}
+
+	if err := json.NewDecoder(r.Body).Decode(state); err != nil && err != io.EOF {
+		log.WithFields(log.Fields{"node": n, "func": "keysDeleteHandler"}).Warnf("Failed to decode request body: %s", err.Error())
+		response(w, r, http.StatusBadRequest, "Failed to decode request body")
+		return
+	}
+
+	//The key from the path takes precedence over the one in the body
+	state.Key = key
+	state.Deleted = true
+
+	n.writeState(w, r, *state, "Deletion received")
+}
+
+/*keysGetHandler handles 'GET /keys/{key}' requests
+
+For deleted keys, this sends the tombstone state with a 410 status code, so
+that peers can still retrieve it.
+
+If the 'metadata' query parameter is 'true', the state is sent without its
+data. If the 'chunk' query parameter is set, this sends a chunk of the data
+instead of the state.
+*/
+func (n *Node) keysGetHandler(w http.ResponseWriter, r *http.Request, key string) {
+	log.WithFields(log.Fields{"node": n, "func": "keysGetHandler", "key": key}).Info("Received GET /keys/{key}")
+
+	state, ok := n.GetState(key)
+	if !ok {
+		response(w, r, http.StatusNotFound, "Key not found")
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("chunk") != "" {
+		n.keysGetChunkHandler(w, r, state)
+		return
+	}
+	if query.Get("metadata") == "true" {
+		state.Data = ""
+	}
+
+	if state.Deleted {
+		w.WriteHeader(http.StatusGone)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(state)
+}
+
+/*keysGetChunkHandler sends the chunk of the data of a state at the index in the
+'chunk' query parameter, as raw bytes.
+
+If the 'digest' query parameter does not match the digest of the state, this
+responds with a 409 status code, as the chunk would be part of another state.
+*/
+func (n *Node) keysGetChunkHandler(w http.ResponseWriter, r *http.Request, state State) {
+	query := r.URL.Query()
+	if digest := query.Get("digest"); digest != "" && digest != state.Digest {
+		response(w, r, http.StatusConflict, "State changed")
+		return
+	}
+
+	//Only the requested chunk is sliced from the data, as in splitChunks
+	size := n.config.Node.ChunkSize
+	if size <= 0 || len(state.Data) <= size {
+		size = len(state.Data)
+	}
+	count := 1
+	if size > 0 {
+		count = (len(state.Data) + size - 1) / size
+	}
+	index, err := strconv.Atoi(query.Get("chunk"))
+	if err != nil || index < 0 || index >= count {
+		response(w, r, http.StatusBadRequest, "Invalid chunk index")
+		return
+	}
+	start, end := index*size, (index+1)*size
+	if end > len(state.Data) {
+		end = len(state.Data)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(n.State)
+	w.Write([]byte(state.Data[start:end]))
 }
 
-//rootPostHandler handles 'POST /' requests
-func (n *Node) rootPostHandler(w http.ResponseWriter, r *http.Request) {
-	log.WithFields(log.Fields{"node": n, "func": "rootPostHandler"}).Info("Received POST /")
+//keysPostHandler handles 'POST /keys/{key}' requests
+func (n *Node) keysPostHandler(w http.ResponseWriter, r *http.Request, key string) {
+	log.WithFields(log.Fields{"node": n, "func": "keysPostHandler", "key": key}).Info("Received POST /keys/{key}")
 	state := &State{}
 
 	if err := json.NewDecoder(r.Body).Decode(state); err != nil {
-		log.WithFields(log.Fields{"node": n, "func": "rootPostHandler"}).Warnf("Failed to decode request body: %s", err.Error())
+		log.WithFields(log.Fields{"node": n, "func": "keysPostHandler"}).Warnf("Failed to decode request body: %s", err.Error())
 		response(w, r, http.StatusInternalServerError, "Failed to decode request body")
 		return
 	}
 
-	//Invalid data
-	if state.Data == "" {
+	//The key from the path takes precedence over the one in the body
+	state.Key = key
+
+	//Invalid data, tombstones sent by peers do not carry any data
+	if state.Data == "" && !state.Deleted {
 		response(w, r, http.StatusBadRequest, "Required property 'data' is empty or not present")
 		return
 	}
 
-	n.stateChan <- *state
-	response(w, r, http.StatusOK, "State received")
+	//Clients may omit the digest, but it must match the data if present
+	if state.Digest != "" && !state.VerifyDigest() {
+		log.WithFields(log.Fields{"node": n, "func": "keysPostHandler", "state": state}).Warn("Received state with invalid digest")
+		response(w, r, http.StatusBadRequest, "Property 'digest' does not match the data")
+		return
+	}
+
+	//Peers piggyback membership events on states
+	n.members.Apply(decodeMembersHeader(r)...)
+
+	n.writeState(w, r, *state, "State received")
 }
 
-//statusHandler handles requests to '/status'
+//membersHandler handles requests to '/members'
+func (n *Node) membersHandler(w http.ResponseWriter, r *http.Request) {
+	corsHeadersResponse(&w, r, n.config, "GET")
+	if r.Method == http.MethodOptions {
+		corsOptionsResponse(w, r, n.config, "GET")
+		return
+	} else if r.Method != http.MethodGet {
+		methodNotAllowedHandler(w, r)
+		return
+	}
+
+	log.WithFields(log.Fields{"node": n, "func": "membersHandler"}).Info("Received GET /members")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(MembersResponse{Members: n.Members()})
+}
+
+/*probeHandler handles 'POST /probe' requests
+
+If the node is the target of the probe, it acknowledges it directly, refuting
+the suspicion if needed. Otherwise, it forwards the probe to the target and
+reports whether the target acknowledged it.
+*/
+func (n *Node) probeHandler(w http.ResponseWriter, r *http.Request) {
+	corsHeadersResponse(&w, r, n.config, "POST")
+	if r.Method == http.MethodOptions {
+		corsOptionsResponse(w, r, n.config, "POST")
+		return
+	} else if r.Method != http.MethodPost {
+		methodNotAllowedHandler(w, r)
+		return
+	}
+
+	log.WithFields(log.Fields{"node": n, "func": "probeHandler"}).Debug("Received POST /probe")
+	req := ProbeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "probeHandler"}).Warnf("Failed to decode request body: %s", err.Error())
+		response(w, r, http.StatusInternalServerError, "Failed to decode request body")
+		return
+	}
+
+	res := ProbeResponse{Ack: true}
+	if req.Target == n.Addr() {
+		res.Incarnation = n.Incarnation()
+		if req.Suspect {
+			res.Incarnation = n.refute(req.Incarnation)
+		}
+	} else {
+		targetRes, err := n.config.transport().Probe(r.Context(), req.Target, req)
+		if err != nil {
+			log.WithFields(log.Fields{"node": n, "func": "probeHandler", "target": req.Target}).Infof("Indirect probe failed with error: %s", err.Error())
+		}
+		res = targetRes
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+/*statusHandler handles requests to '/status'
+
+The response only contains the status of each key if the 'keys' query
+parameter is 'true'. Peers compare the roots of their Merkle trees instead.
+
+Nodes piggyback membership events on pings in the X-Gossip-Members header.
+Events are only piggybacked on the response if the request has that header,
+so that other clients do not use up retransmissions of events.
+*/
 func (n *Node) statusHandler(w http.ResponseWriter, r *http.Request) {
 	corsHeadersResponse(&w, r, n.config, "GET")
 	if r.Method == http.MethodOptions {
@@ -151,8 +356,371 @@ func (n *Node) statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	status := StatusResponse{
-		LastState: n.State.Timestamp,
+		ID:          n.ID,
+		Clock:       n.clock.Last(),
+		Incarnation: n.Incarnation(),
+		Root:        n.tree.Root(),
+		Draining:    n.Draining(),
 	}
+	if _, ok := r.Header[membersHeader]; ok {
+		n.members.Apply(decodeMembersHeader(r)...)
+		status.Members = n.members.Piggyback()
+	}
+
+	//Listing all keys is linear in their number, so only do it if asked
+	if r.URL.Query().Get("keys") != "true" {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	status.Keys = make(map[string]KeyStatus)
+	n.States.Range(func(key, value interface{}) bool {
+		state, ok := value.(State)
+		if !ok {
+			log.WithFields(log.Fields{"node": n, "func": "statusHandler", "key": key}).Warn("Failed to assert state")
+			return true
+		}
+
+		status.Keys[state.Key] = n.keyStatus(state)
+		return true
+	})
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(status)
 }
+
+/*syncHandler handles 'POST /sync' requests
+
+The request contains leaves of the Merkle tree of the node that differ from the
+tree of a peer, found through '/tree' requests. The node responds with the
+status of its keys in those leaves. While the node is draining, this responds
+with a 503 status code, as its states are already pushed to its peers.
+*/
+func (n *Node) syncHandler(w http.ResponseWriter, r *http.Request) {
+	corsHeadersResponse(&w, r, n.config, "POST")
+	if r.Method == http.MethodOptions {
+		corsOptionsResponse(w, r, n.config, "POST")
+		return
+	} else if r.Method != http.MethodPost {
+		methodNotAllowedHandler(w, r)
+		return
+	}
+
+	log.WithFields(log.Fields{"node": n, "func": "syncHandler"}).Info("Received POST /sync")
+	if n.Draining() {
+		response(w, r, http.StatusServiceUnavailable, "Node is draining")
+		return
+	}
+
+	req := SyncRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "syncHandler"}).Warnf("Failed to decode request body: %s", err.Error())
+		response(w, r, http.StatusInternalServerError, "Failed to decode request body")
+		return
+	}
+
+	keys, err := n.leafStatus(req.Leaves)
+	if err != nil {
+		response(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(SyncResponse{Keys: keys})
+}
+
+/*treeHandler handles 'POST /tree' requests
+
+The request contains a level of the Merkle tree of the node and the indexes of
+nodes at that level. The node responds with the hashes of those nodes, or of
+all nodes at that level if there are no indexes. While the node is draining,
+this responds with a 503 status code.
+*/
+func (n *Node) treeHandler(w http.ResponseWriter, r *http.Request) {
+	corsHeadersResponse(&w, r, n.config, "POST")
+	if r.Method == http.MethodOptions {
+		corsOptionsResponse(w, r, n.config, "POST")
+		return
+	} else if r.Method != http.MethodPost {
+		methodNotAllowedHandler(w, r)
+		return
+	}
+
+	log.WithFields(log.Fields{"node": n, "func": "treeHandler"}).Debug("Received POST /tree")
+	if n.Draining() {
+		response(w, r, http.StatusServiceUnavailable, "Node is draining")
+		return
+	}
+
+	req := TreeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "treeHandler"}).Warnf("Failed to decode request body: %s", err.Error())
+		response(w, r, http.StatusInternalServerError, "Failed to decode request body")
+		return
+	}
+
+	hashes, err := n.tree.Hashes(req.Level, req.Nodes)
+	if err != nil {
+		response(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TreeResponse{Level: req.Level, Hashes: hashes})
+}
+
+/*writeState sends a client write or a state pushed by a peer to the node and
+responds once the consistency level requested by the client is met.
+
+The consistency level is read from the 'consistency' query parameter or from
+the 'X-Gossip-Consistency' header. If the level is not met within
+n.config.Node.WriteTimeout, this responds with a 504 status code.
+
+If the node has trusted keys, states that are not signed by one of them are
+rejected with a 403 status code. States with a timestamp too far ahead of the
+clock of the node are rejected with a 400 status code.
+
+Peers always send states with the X-Gossip-Members header. While the node is
+draining, client writes are rejected with a 503 status code, but states pushed
+by peers are still accepted, so that peers do not count them as failures.
+*/
+func (n *Node) writeState(w http.ResponseWriter, r *http.Request, state State, msg string) {
+	_, fromPeer := r.Header[membersHeader]
+
+	//A draining node waits for the client writes it accepted before it starts draining
+	n.drainingMu.RLock()
+	if !n.draining {
+		n.writes.Add(1)
+		n.drainingMu.RUnlock()
+		defer n.writes.Done()
+	} else if fromPeer {
+		n.drainingMu.RUnlock()
+	} else {
+		n.drainingMu.RUnlock()
+		response(w, r, http.StatusServiceUnavailable, "Node is draining")
+		return
+	}
+
+	if err := n.trustedKeys.Check(state); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "writeState", "state": state}).Warnf("Rejected state: %s", err.Error())
+		response(w, r, http.StatusForbidden, err.Error())
+		return
+	}
+	if err := n.clock.Check(state.Timestamp); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "writeState", "state": state}).Warnf("Rejected state: %s", err.Error())
+		response(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	level := r.URL.Query().Get("consistency")
+	if level == "" {
+		level = r.Header.Get("X-Gossip-Consistency")
+	}
+	consistency, err := ParseConsistency(level)
+	if err != nil {
+		response(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	//Local writes are acknowledged as soon as they are received
+	if consistency == (Consistency{}) {
+		if !n.stateInbox.sendState(n.ctx, n.stateChan, state) {
+			response(w, r, http.StatusServiceUnavailable, "Node is stopping")
+			return
+		}
+		response(w, r, http.StatusOK, msg)
+		return
+	}
+
+	log.WithFields(log.Fields{"node": n, "func": "writeState", "state": state, "consistency": consistency}).Info("Waiting for consistency level")
+	ctx, cancel := context.WithTimeout(n.ctx, n.config.Node.WriteTimeout)
+	defer cancel()
+
+	//Wait for the state to be applied
+	req := writeRequest{state, consistency, make(chan writeResult, 1)}
+	var res writeResult
+	if !n.stateInbox.sendWrite(ctx, n.writeChan, req) {
+		response(w, r, http.StatusGatewayTimeout, "Timed out waiting for the state to be applied")
+		return
+	}
+	select {
+	case res = <-req.result:
+	case <-ctx.Done():
+		response(w, r, http.StatusGatewayTimeout, "Timed out waiting for the state to be applied")
+		return
+	}
+
+	if res.obsolete {
+		response(w, r, http.StatusConflict, "State is obsolete")
+		return
+	} else if !res.applied {
+		response(w, r, http.StatusInternalServerError, "Failed to persist state")
+		return
+	}
+
+	//Wait for acknowledgements from peers
+	wr := WriteResponse{
+		Message:   msg,
+		Timestamp: res.state.Timestamp,
+		Peers:     []Addr{},
+	}
+	for received := 0; len(wr.Peers) < consistency.Peers && received < res.recipients; {
+		select {
+		case ack := <-res.acks:
+			received++
+			if ack.ok {
+				wr.Peers = append(wr.Peers, ack.addr)
+			}
+		case <-ctx.Done():
+			wr.Message = "Timed out waiting for peers to acknowledge the state"
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(wr)
+			return
+		}
+	}
+
+	if len(wr.Peers) < consistency.Peers {
+		wr.Message = "Not enough peers acknowledged the state"
+		w.WriteHeader(http.StatusGatewayTimeout)
+		json.NewEncoder(w).Encode(wr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(wr)
+}
+
+/*debugFaultsHandler handles requests to the '/debug/faults' path
+
+This is only available when the node runs in debug mode.
+*/
+func (n *Node) debugFaultsHandler(w http.ResponseWriter, r *http.Request) {
+	corsHeadersResponse(&w, r, n.config, "GET, PUT, DELETE")
+	switch r.Method {
+	case http.MethodDelete:
+		log.WithFields(log.Fields{"node": n, "func": "debugFaultsHandler"}).Info("Received DELETE /debug/faults")
+		n.Faults.Reset()
+		response(w, r, http.StatusOK, "Faults removed")
+	case http.MethodGet:
+		log.WithFields(log.Fields{"node": n, "func": "debugFaultsHandler"}).Info("Received GET /debug/faults")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(n.Faults.Spec())
+	case http.MethodPut:
+		log.WithFields(log.Fields{"node": n, "func": "debugFaultsHandler"}).Info("Received PUT /debug/faults")
+		spec := FaultSpec{}
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			log.WithFields(log.Fields{"node": n, "func": "debugFaultsHandler"}).Warnf("Failed to decode request body: %s", err.Error())
+			response(w, r, http.StatusInternalServerError, "Failed to decode request body")
+			return
+		}
+		if err := n.Faults.Set(spec); err != nil {
+			response(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.WithFields(log.Fields{"node": n, "func": "debugFaultsHandler"}).Warnf("Injecting %d rules and %d partitions", len(spec.Rules), len(spec.Partitions))
+		response(w, r, http.StatusOK, "Faults updated")
+	case http.MethodOptions:
+		corsOptionsResponse(w, r, n.config, "GET, PUT, DELETE")
+	default:
+		methodNotAllowedHandler(w, r)
+	}
+}
+
+/*announceHandler handles 'POST /announce' requests
+
+Peers send this request instead of the state when its data is split in chunks.
+If the announced state is newer, the node downloads the chunks it misses from
+the sender. Announcements from nodes that are not peers of the node are
+rejected with a 403 status code.
+*/
+func (n *Node) announceHandler(w http.ResponseWriter, r *http.Request) {
+	corsHeadersResponse(&w, r, n.config, "POST")
+	if r.Method == http.MethodOptions {
+		corsOptionsResponse(w, r, n.config, "POST")
+		return
+	} else if r.Method != http.MethodPost {
+		methodNotAllowedHandler(w, r)
+		return
+	}
+
+	log.WithFields(log.Fields{"node": n, "func": "announceHandler"}).Info("Received POST /announce")
+	announcement := Announcement{}
+	if err := json.NewDecoder(r.Body).Decode(&announcement); err != nil {
+		log.WithFields(log.Fields{"node": n, "func": "announceHandler"}).Warnf("Failed to decode request body: %s", err.Error())
+		response(w, r, http.StatusInternalServerError, "Failed to decode request body")
+		return
+	}
+
+	//Invalid port number or key
+	if announcement.Addr.Port == 0 {
+		response(w, r, http.StatusBadRequest, "Required property 'port' is 0 or not present")
+		return
+	}
+	if announcement.Key == "" {
+		response(w, r, http.StatusBadRequest, "Required property 'key' is empty or not present")
+		return
+	}
+
+	/*Infer that the client node does not know its IP address and use the one
+	from the HTTP request instead.
+	*/
+	if announcement.Addr.IP == "" {
+		announcement.Addr.IP = strings.SplitN(r.RemoteAddr, ":", 2)[0]
+	}
+
+	if n.Draining() {
+		response(w, r, http.StatusServiceUnavailable, "Node is draining")
+		return
+	}
+
+	//Only peers can make the node download data from them
+	var peer *Peer
+	for _, p := range n.PeerList() {
+		if p.Addr == announcement.Addr {
+			peer = p
+			break
+		}
+	}
+	if peer == nil {
+		log.WithFields(log.Fields{"node": n, "func": "announceHandler", "addr": announcement.Addr}).Warn("Rejected announcement from unknown peer")
+		response(w, r, http.StatusForbidden, "Announcements are only accepted from peers")
+		return
+	}
+
+	if n.needsFetch(announcement.Key, announcement.Status) {
+		if !n.fetchStateInbox.sendFetch(n.ctx, n.fetchStateChan, fetchRequest{peer, announcement.Key, announcement.Status}) {
+			response(w, r, http.StatusServiceUnavailable, "Node is stopping")
+			return
+		}
+	}
+	response(w, r, http.StatusOK, "Announcement received")
+}
+
+/*adminDrainHandler handles requests to '/admin/drain'
+
+The node responds once it is drained. The drain is not aborted if the client
+disconnects, as the node would be left halfway through leaving the cluster.
+
+Controllers drain nodes through this endpoint, so it is always served and has
+no access control of its own: with mutual TLS, only clients presenting a
+trusted certificate can reach it.
+*/
+func (n *Node) adminDrainHandler(w http.ResponseWriter, r *http.Request) {
+	corsHeadersResponse(&w, r, n.config, "POST")
+	switch r.Method {
+	case http.MethodPost:
+		log.WithFields(log.Fields{"node": n, "func": "adminDrainHandler"}).Info("Received POST /admin/drain")
+		if err := n.Drain(n.ctx); err != nil {
+			if n.ctx.Err() != nil {
+				response(w, r, http.StatusServiceUnavailable, "Node is stopping")
+				return
+			}
+			response(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		response(w, r, http.StatusOK, "Node drained")
+	case http.MethodOptions:
+		corsOptionsResponse(w, r, n.config, "POST")
+	default:
+		methodNotAllowedHandler(w, r)
+	}
+}
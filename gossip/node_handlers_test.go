@@ -2,6 +2,9 @@ package gossip
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -30,11 +33,21 @@ func TestNodePeersHandlerGet(t *testing.T) {
 	var pr PeersResponse
 	json.NewDecoder(res.Body).Decode(&pr)
 
+	if pr.ID != n.ID {
+		t.Errorf("pr.ID == %q; want %q", pr.ID, n.ID)
+	}
+
 	if len(pr.Peers) != 1 {
 		t.Errorf("len(pr.Peers) == %d; want %d", len(pr.Peers), 1)
 	} else if pr.Peers[0] != peer.Addr {
 		t.Errorf("pr.Peers[1] == %v; want %v", pr.Peers[0], peer.Addr)
 	}
+
+	if len(pr.Members) != 1 {
+		t.Errorf("len(pr.Members) == %d; want %d", len(pr.Members), 1)
+	} else if pr.Members[0].Addr != peer.Addr || pr.Members[0].Liveness != PeerAlive {
+		t.Errorf("pr.Members[0] == %v; want %v with liveness %v", pr.Members[0], peer.Addr, PeerAlive)
+	}
 }
 
 func TestNodePeersHandlerDelete(t *testing.T) {
@@ -121,7 +134,7 @@ func TestNodePeersHandlerPost(t *testing.T) {
 	if res.StatusCode != http.StatusOK {
 		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusOK)
 	} else {
-		rAddr := <-n.addPeerChan
+		rAddr := (<-n.addPeerChan).Addr
 
 		if rAddr != addr {
 			t.Errorf("rAddr == %v; want %v", rAddr, addr)
@@ -129,6 +142,29 @@ func TestNodePeersHandlerPost(t *testing.T) {
 	}
 }
 
+func TestNodePeersHandlerPostConflict(t *testing.T) {
+	//Prepare peer and node
+	peer := NewPeer(Addr{"127.0.0.1", 8081}, nil)
+	peer.SetID("a")
+	n := NewNode(nil)
+	n.Peers = append(n.Peers, peer)
+	reqBody, _ := json.Marshal(PeeringRequest{Addr: peer.Addr, ID: "b"})
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/peers", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	n.peersHandler(w, req)
+	res := w.Result()
+
+	//Parse response
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusConflict)
+	}
+	if len(n.addPeerChan) != 0 {
+		t.Errorf("len(n.addPeerChan) == %d; want %d", len(n.addPeerChan), 0)
+	}
+}
+
 func TestNodePeersHandlerPostNoIP(t *testing.T) {
 	//Prepare address and node
 	addr := Addr{"", 8081}
@@ -145,7 +181,7 @@ func TestNodePeersHandlerPostNoIP(t *testing.T) {
 	if res.StatusCode != http.StatusOK {
 		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusOK)
 	} else {
-		rAddr := <-n.addPeerChan
+		rAddr := (<-n.addPeerChan).Addr
 
 		if rAddr.IP != strings.SplitN(req.RemoteAddr, ":", 2)[0] {
 			t.Errorf("rAddr.IP == %s; want %s", rAddr.IP, strings.SplitN(req.RemoteAddr, ":", 2)[0])
@@ -188,16 +224,16 @@ func TestNodePeersHandlerOptions(t *testing.T) {
 	}
 }
 
-func TestNodeRootHandlerGet(t *testing.T) {
+func TestNodeKeysHandlerGet(t *testing.T) {
 	//Prepare state and node
-	state := State{time.Now().UnixNano(), "TestNodeRootHandlerGet"}
+	state := State{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Data: "TestNodeKeysHandlerGet"}
 	n := NewNode(nil)
-	n.State = state
+	n.States.Store(state.Key, state)
 
 	//Send request
-	req := httptest.NewRequest("GET", n.URL()+"", nil)
+	req := httptest.NewRequest("GET", n.URL()+"/keys/key", nil)
 	w := httptest.NewRecorder()
-	n.rootHandler(w, req)
+	n.keysHandler(w, req)
 	res := w.Result()
 
 	//Parse response
@@ -213,16 +249,73 @@ func TestNodeRootHandlerGet(t *testing.T) {
 	}
 }
 
-func TestNodeRootHandlerPost(t *testing.T) {
+func TestNodeKeysHandlerGetDeleted(t *testing.T) {
 	//Prepare state and node
-	state := State{time.Now().UnixNano(), "TestNodeRootHandlerPost"}
+	state := State{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Deleted: true}
 	n := NewNode(nil)
-	reqBody, _ := json.Marshal(state)
+	n.States.Store(state.Key, state)
 
 	//Send request
-	req := httptest.NewRequest("POST", n.URL()+"", bytes.NewBuffer(reqBody))
+	req := httptest.NewRequest("GET", n.URL()+"/keys/key", nil)
 	w := httptest.NewRecorder()
-	n.rootHandler(w, req)
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	//Parse response
+	if res.StatusCode != http.StatusGone {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusGone)
+	}
+
+	var rState State
+	json.NewDecoder(res.Body).Decode(&rState)
+
+	if rState != state {
+		t.Errorf("rState == %v; want %v", rState, state)
+	}
+}
+
+func TestNodeKeysHandlerGetNotFound(t *testing.T) {
+	//Prepare node
+	n := NewNode(nil)
+
+	//Send request
+	req := httptest.NewRequest("GET", n.URL()+"/keys/key", nil)
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestNodeKeysHandlerNoKey(t *testing.T) {
+	//Prepare node
+	n := NewNode(nil)
+
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		//Send request
+		req := httptest.NewRequest(method, n.URL()+"/keys/", bytes.NewBuffer([]byte("{}")))
+		w := httptest.NewRecorder()
+		n.keysHandler(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("res.StatusCode == %d for %s; want %d", res.StatusCode, method, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestNodeKeysHandlerPost(t *testing.T) {
+	//Prepare state and node
+	state := State{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Data: "TestNodeKeysHandlerPost"}
+	n := NewNode(nil)
+	reqBody, _ := json.Marshal(State{Timestamp: state.Timestamp, Data: state.Data})
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
 	res := w.Result()
 
 	//Parse response
@@ -237,14 +330,14 @@ func TestNodeRootHandlerPost(t *testing.T) {
 	}
 }
 
-func TestNodeRootHandlerPostEmpty(t *testing.T) {
+func TestNodeKeysHandlerPostEmpty(t *testing.T) {
 	//Prepare node
 	n := NewNode(nil)
 
 	//Send request
-	req := httptest.NewRequest("POST", n.URL()+"", bytes.NewBuffer([]byte("{}")))
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key", bytes.NewBuffer([]byte("{}")))
 	w := httptest.NewRecorder()
-	n.rootHandler(w, req)
+	n.keysHandler(w, req)
 	res := w.Result()
 
 	//Parse response
@@ -253,14 +346,56 @@ func TestNodeRootHandlerPostEmpty(t *testing.T) {
 	}
 }
 
-func TestNodeRootHandlerOptions(t *testing.T) {
+func TestNodeKeysHandlerPostClockDrift(t *testing.T) {
+	//Prepare node
+	n := NewNode(nil)
+	reqBody, _ := json.Marshal(State{Timestamp: Timestamp{Physical: time.Now().Add(time.Hour).UnixNano()}, Data: "TestNodeKeysHandlerPostClockDrift"})
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	//Parse response
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	if len(n.stateChan) != 0 {
+		t.Errorf("len(n.stateChan) == %d; want %d", len(n.stateChan), 0)
+	}
+}
+
+func TestNodeKeysHandlerDelete(t *testing.T) {
+	//Prepare node
+	n := NewNode(nil)
+
+	//Send request
+	req := httptest.NewRequest("DELETE", n.URL()+"/keys/key", nil)
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	//Parse response
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusOK)
+	} else {
+		rState := <-n.stateChan
+
+		if rState.Key != "key" || !rState.Deleted {
+			t.Errorf("rState == %v; want tombstone for %s", rState, "key")
+		}
+	}
+}
+
+func TestNodeKeysHandlerOptions(t *testing.T) {
 	//Prepare peer and node
 	n := NewNode(nil)
 
 	//Send request
-	req := httptest.NewRequest("OPTIONS", n.URL()+"", nil)
+	req := httptest.NewRequest("OPTIONS", n.URL()+"/keys/key", nil)
 	w := httptest.NewRecorder()
-	n.rootHandler(w, req)
+	n.keysHandler(w, req)
 	res := w.Result()
 
 	if res.StatusCode != http.StatusOK {
@@ -268,24 +403,171 @@ func TestNodeRootHandlerOptions(t *testing.T) {
 	}
 }
 
+func TestNodeProbeHandlerSelf(t *testing.T) {
+	n := NewNode(nil)
+	testCases := []struct {
+		Request     ProbeRequest
+		Incarnation uint64
+	}{
+		{ProbeRequest{Target: n.Addr()}, 0},
+		//Refute a suspicion
+		{ProbeRequest{Target: n.Addr(), Suspect: true}, 1},
+		//Ignore suspicions for older incarnations
+		{ProbeRequest{Target: n.Addr(), Suspect: true}, 1},
+		{ProbeRequest{Target: n.Addr(), Incarnation: 1, Suspect: true}, 2},
+	}
+
+	for _, testCase := range testCases {
+		reqBody, _ := json.Marshal(testCase.Request)
+		req := httptest.NewRequest("POST", n.URL()+"/probe", bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		n.probeHandler(w, req)
+		res := w.Result()
+
+		var pr ProbeResponse
+		json.NewDecoder(res.Body).Decode(&pr)
+		if res.StatusCode != http.StatusOK || !pr.Ack || pr.Incarnation != testCase.Incarnation {
+			t.Errorf("Response to %v == %d, %v; want %d, %v", testCase.Request, res.StatusCode, pr, http.StatusOK, ProbeResponse{true, testCase.Incarnation})
+		}
+	}
+	if n.Incarnation() != 2 {
+		t.Errorf("n.Incarnation() == %d; want %d", n.Incarnation(), 2)
+	}
+}
+
+func TestNodeProbeHandlerForward(t *testing.T) {
+	target := Addr{"127.0.0.1", 9000}
+	testCases := []struct {
+		Transport *stubTransport
+		Expected  ProbeResponse
+	}{
+		{&stubTransport{probe: ProbeResponse{Ack: true, Incarnation: 4}}, ProbeResponse{Ack: true, Incarnation: 4}},
+		{&stubTransport{err: ErrMessageDropped}, ProbeResponse{}},
+	}
+
+	for _, testCase := range testCases {
+		config := *DefaultConfig
+		config.Transport = testCase.Transport
+		n := NewNode(&config)
+
+		reqBody, _ := json.Marshal(ProbeRequest{Target: target})
+		req := httptest.NewRequest("POST", n.URL()+"/probe", bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		n.probeHandler(w, req)
+		res := w.Result()
+
+		var pr ProbeResponse
+		json.NewDecoder(res.Body).Decode(&pr)
+		if res.StatusCode != http.StatusOK || pr != testCase.Expected {
+			t.Errorf("Response == %d, %v; want %d, %v", res.StatusCode, pr, http.StatusOK, testCase.Expected)
+		}
+		if len(testCase.Transport.calls) != 1 || testCase.Transport.calls[0] != "Probe" {
+			t.Errorf("transport.calls == %v; want [Probe]", testCase.Transport.calls)
+		}
+	}
+}
+
 func TestNodeStatusHandlerGet(t *testing.T) {
 	//Prepare state and node
-	state := State{time.Now().UnixNano(), "TestNodeStatusHandlerGet"}
+	state := State{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Data: "TestNodeStatusHandlerGet"}
+	state.Digest = state.ComputeDigest()
 	n := NewNode(nil)
-	n.State = state
+	n.UpdateState(state)
 
-	//Send request
+	testCases := []struct {
+		Query string
+		Keys  int
+	}{
+		//Pings only carry the root of the Merkle tree
+		{"", 0},
+		{"?keys=true", 1},
+	}
+
+	for i, testCase := range testCases {
+		//Send request
+		req := httptest.NewRequest("GET", n.URL()+"/status"+testCase.Query, nil)
+		w := httptest.NewRecorder()
+		n.statusHandler(w, req)
+		res := w.Result()
+
+		//Parse response
+		var sr StatusResponse
+		json.NewDecoder(res.Body).Decode(&sr)
+
+		if sr.ID != n.ID {
+			t.Errorf("sr.ID == %q for test case %d; want %q", sr.ID, i, n.ID)
+		}
+		if sr.Root != n.tree.Root() || sr.Root == NewMerkleTree().Root() {
+			t.Errorf("sr.Root == %q for test case %d; want %q", sr.Root, i, n.tree.Root())
+		}
+		if len(sr.Keys) != testCase.Keys {
+			t.Errorf("len(sr.Keys) == %d for test case %d; want %d", len(sr.Keys), i, testCase.Keys)
+		}
+		if testCase.Keys == 0 {
+			continue
+		}
+		if sr.Keys[state.Key].Timestamp != state.Timestamp {
+			t.Errorf("sr.Keys[%q].Timestamp == %v; want %v", state.Key, sr.Keys[state.Key].Timestamp, state.Timestamp)
+		}
+		if sr.Keys[state.Key].Digest != state.Digest {
+			t.Errorf("sr.Keys[%q].Digest == %q; want %q", state.Key, sr.Keys[state.Key].Digest, state.Digest)
+		}
+	}
+}
+
+func TestNodeStatusHandlerMembers(t *testing.T) {
+	n := NewNode(nil)
+	addr := Addr{"127.0.0.1", 8081}
+
+	//Clients that are not nodes do not receive membership events
 	req := httptest.NewRequest("GET", n.URL()+"/status", nil)
 	w := httptest.NewRecorder()
 	n.statusHandler(w, req)
-	res := w.Result()
 
-	//Parse response
 	var sr StatusResponse
-	json.NewDecoder(res.Body).Decode(&sr)
+	json.NewDecoder(w.Result().Body).Decode(&sr)
+	if len(sr.Members) != 0 {
+		t.Errorf("len(sr.Members) == %d without %s header; want 0", len(sr.Members), membersHeader)
+	}
 
-	if sr.LastState != state.Timestamp {
-		t.Errorf("sr.LastState == %d; want %d", sr.LastState, state.Timestamp)
+	//Nodes exchange membership events
+	events, _ := json.Marshal([]MemberEvent{{MemberJoin, "b", addr, 1}})
+	req = httptest.NewRequest("GET", n.URL()+"/status", nil)
+	req.Header.Set(membersHeader, string(events))
+	w = httptest.NewRecorder()
+	n.statusHandler(w, req)
+
+	json.NewDecoder(w.Result().Body).Decode(&sr)
+	if len(sr.Members) != 2 {
+		t.Errorf("len(sr.Members) == %d; want 2", len(sr.Members))
+	}
+	found := false
+	for _, member := range n.Members() {
+		if member.Addr == addr && member.Liveness == PeerAlive && member.Incarnation == 1 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("n.Members() == %v; want %v alive with incarnation 1", n.Members(), addr)
+	}
+}
+
+func TestNodeMembersHandlerGet(t *testing.T) {
+	n := NewNode(nil)
+
+	req := httptest.NewRequest("GET", n.URL()+"/members", nil)
+	w := httptest.NewRecorder()
+	n.membersHandler(w, req)
+	res := w.Result()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusOK)
+	}
+
+	var mr MembersResponse
+	json.NewDecoder(res.Body).Decode(&mr)
+	if len(mr.Members) != 1 || mr.Members[0].Addr != n.Addr() {
+		t.Errorf("mr.Members == %v; want only %v", mr.Members, n.Addr())
 	}
 }
 
@@ -303,3 +585,477 @@ func TestNodeStatusHandlerOptions(t *testing.T) {
 		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusOK)
 	}
 }
+
+func TestNodeKeysHandlerPostDurable(t *testing.T) {
+	//Prepare node
+	n := NewNode(nil)
+	go n.stateWorker()
+	reqBody, _ := json.Marshal(State{Data: "TestNodeKeysHandlerPostDurable"})
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key?consistency=durable", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	//Parse response
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusOK)
+	}
+
+	var wr WriteResponse
+	json.NewDecoder(res.Body).Decode(&wr)
+
+	//The state must be applied before the response is sent
+	state, ok := n.GetState("key")
+	if !ok {
+		t.Errorf("n.GetState(\"key\") not found")
+	}
+	if wr.Timestamp != state.Timestamp {
+		t.Errorf("wr.Timestamp == %v; want %v", wr.Timestamp, state.Timestamp)
+	}
+}
+
+func TestNodeKeysHandlerPostDrainingInProgress(t *testing.T) {
+	//Prepare node without a stateWorker, so that durable writes stay in progress
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	reqBody, _ := json.Marshal(State{Data: "TestNodeKeysHandlerPostDrainingInProgress"})
+
+	//Send a write that waits to be applied
+	results := make(chan int)
+	go func() {
+		req := httptest.NewRequest("POST", n.URL()+"/keys/key?consistency=durable", bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		n.keysHandler(w, req)
+		results <- w.Result().StatusCode
+	}()
+	timeout := time.Now().Add(5 * time.Second)
+	for len(n.writeChan) == 0 {
+		if time.Now().After(timeout) {
+			t.Fatalf("The write did not reach n.writeChan")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//The node waits for the write in progress before draining
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := n.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("n.Drain() == %v with a write in progress; want %v", err, context.DeadlineExceeded)
+	}
+
+	//New writes are rejected without waiting for the write in progress
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	if res := w.Result(); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("res.StatusCode == %d while draining; want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	go n.stateWorker()
+	if code := <-results; code != http.StatusOK {
+		t.Errorf("res.StatusCode == %d for the write in progress; want %d", code, http.StatusOK)
+	}
+}
+
+func TestNodeKeysHandlerPostObsolete(t *testing.T) {
+	//Prepare node
+	n := NewNode(nil)
+	n.UpdateState(State{Key: "key", Timestamp: Timestamp{Physical: 2}, Data: "TestNodeKeysHandlerPostObsolete"})
+	go n.stateWorker()
+	reqBody, _ := json.Marshal(State{Timestamp: Timestamp{Physical: 1}, Data: "TestNodeKeysHandlerPostObsolete"})
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key", bytes.NewBuffer(reqBody))
+	req.Header.Set("X-Gossip-Consistency", "durable")
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestNodeKeysHandlerPostInvalidConsistency(t *testing.T) {
+	//Prepare node
+	n := NewNode(nil)
+	reqBody, _ := json.Marshal(State{Data: "TestNodeKeysHandlerPostInvalidConsistency"})
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key?consistency=strong", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestNodeKeysHandlerPostInvalidDigest(t *testing.T) {
+	//Prepare node
+	n := NewNode(nil)
+	reqBody, _ := json.Marshal(State{Data: "TestNodeKeysHandlerPostInvalidDigest", Digest: "digest"})
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	if _, ok := n.GetState("key"); ok {
+		t.Errorf("n.GetState(\"key\") found after invalid digest")
+	}
+}
+
+func TestNodeKeysHandlerPostSigned(t *testing.T) {
+	//Prepare node
+	publicKey, key, _ := ed25519.GenerateKey(nil)
+	config := *DefaultConfig
+	config.Node.TrustedKeys = []string{base64.StdEncoding.EncodeToString(publicKey)}
+	n := NewNode(&config)
+
+	signed := State{Key: "key", Data: "TestNodeKeysHandlerPostSigned"}
+	signed.Sign(key)
+	tombstone := State{Key: "key", Deleted: true}
+	tombstone.Sign(key)
+	//Signatures cover the timestamp, so the node cannot stamp signed states
+	unstamped := State{Key: "key", Data: "TestNodeKeysHandlerPostSigned", Signer: signed.Signer}
+	unstamped.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, unstamped.signedPayload()))
+
+	testCases := []struct {
+		Method     string
+		State      *State
+		StatusCode int
+	}{
+		{"POST", &signed, http.StatusOK},
+		{"POST", &State{Data: "TestNodeKeysHandlerPostSigned"}, http.StatusForbidden},
+		{"POST", &unstamped, http.StatusForbidden},
+		{"DELETE", &State{}, http.StatusForbidden},
+		{"DELETE", nil, http.StatusForbidden},
+		{"DELETE", &tombstone, http.StatusOK},
+	}
+
+	for i, testCase := range testCases {
+		//Send request
+		var reqBody []byte
+		if testCase.State != nil {
+			reqBody, _ = json.Marshal(testCase.State)
+		}
+		req := httptest.NewRequest(testCase.Method, n.URL()+"/keys/key", bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		n.keysHandler(w, req)
+		res := w.Result()
+
+		if res.StatusCode != testCase.StatusCode {
+			t.Errorf("res.StatusCode == %d for test case %d; want %d", res.StatusCode, i, testCase.StatusCode)
+		}
+	}
+}
+
+func TestNodeKeysHandlerPostPeers(t *testing.T) {
+	//Prepare peers
+	okServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response(w, r, http.StatusOK, "State received")
+	}))
+	defer func() { okServer.Close() }()
+	failServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response(w, r, http.StatusInternalServerError, "Internal Server Error")
+	}))
+	defer func() { failServer.Close() }()
+
+	testCases := []struct {
+		Consistency string
+		StatusCode  int
+		Peers       int
+	}{
+		{"peers=1", http.StatusOK, 1},
+		{"peers=2", http.StatusGatewayTimeout, 1},
+	}
+
+	for i, testCase := range testCases {
+		//Prepare node
+		n := NewNode(nil)
+		n.Peers = []*Peer{
+			NewPeer(parseURL(okServer.URL), nil),
+			NewPeer(parseURL(failServer.URL), nil),
+		}
+		go n.stateWorker()
+		reqBody, _ := json.Marshal(State{Data: "TestNodeKeysHandlerPostPeers"})
+
+		//Send request
+		req := httptest.NewRequest("POST", n.URL()+"/keys/key?consistency="+testCase.Consistency, bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		n.keysHandler(w, req)
+		res := w.Result()
+
+		//Parse response
+		if res.StatusCode != testCase.StatusCode {
+			t.Errorf("res.StatusCode == %d in test case %d; want %d", res.StatusCode, i, testCase.StatusCode)
+		}
+
+		var wr WriteResponse
+		json.NewDecoder(res.Body).Decode(&wr)
+
+		if len(wr.Peers) != testCase.Peers {
+			t.Errorf("len(wr.Peers) == %d in test case %d; want %d", len(wr.Peers), i, testCase.Peers)
+		} else if wr.Peers[0] != n.Peers[0].Addr {
+			t.Errorf("wr.Peers[0] == %v in test case %d; want %v", wr.Peers[0], i, n.Peers[0].Addr)
+		}
+	}
+}
+
+func TestNodeKeysHandlerPostTimeout(t *testing.T) {
+	//Prepare peer that never responds in time
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		response(w, r, http.StatusOK, "State received")
+	}))
+	defer func() { testServer.Close() }()
+
+	//Prepare node
+	config := *DefaultConfig
+	config.Node.WriteTimeout = 50 * time.Millisecond
+	n := NewNode(&config)
+	n.Peers = []*Peer{NewPeer(parseURL(testServer.URL), &config)}
+	go n.stateWorker()
+	reqBody, _ := json.Marshal(State{Data: "TestNodeKeysHandlerPostTimeout"})
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key?consistency=peers=1", bytes.NewBuffer(reqBody))
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+func TestNodeDebugFaultsHandler(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.Debug = true
+	n := NewNode(&config)
+	handler := n.Handler()
+
+	//Set faults
+	req := httptest.NewRequest("PUT", n.URL()+"/debug/faults", strings.NewReader(`{"rules": [{"drop": 0.5, "latency": {"distribution": "normal", "mean": 100000000, "jitter": 10000000}}]}`))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code == %d; want %d", w.Code, http.StatusOK)
+	}
+
+	//Retrieve faults
+	req = httptest.NewRequest("GET", n.URL()+"/debug/faults", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	spec := FaultSpec{}
+	json.NewDecoder(w.Body).Decode(&spec)
+	if len(spec.Rules) != 1 || spec.Rules[0].Drop != 0.5 || spec.Rules[0].Latency.Mean != 100*time.Millisecond {
+		t.Errorf("spec == %+v; want 1 rule", spec)
+	}
+
+	//Invalid faults
+	req = httptest.NewRequest("PUT", n.URL()+"/debug/faults", strings.NewReader(`{"rules": [{"drop": 2}]}`))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w.Code == %d; want %d", w.Code, http.StatusBadRequest)
+	}
+
+	//Remove faults
+	req = httptest.NewRequest("DELETE", n.URL()+"/debug/faults", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if spec := n.Faults.Spec(); len(spec.Rules) != 0 {
+		t.Errorf("len(spec.Rules) == %d; want 0", len(spec.Rules))
+	}
+}
+
+func TestNodeDebugFaultsHandlerDisabled(t *testing.T) {
+	n := NewNode(nil)
+
+	req := httptest.NewRequest("GET", n.URL()+"/debug/faults", nil)
+	w := httptest.NewRecorder()
+	n.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("w.Code == %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestNodeAdminDrainHandler(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.StartWorkers(ctx)
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/admin/drain", nil)
+	w := httptest.NewRecorder()
+	n.Handler().ServeHTTP(w, req)
+	res := w.Result()
+
+	//Parse response
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusOK)
+	}
+	if !n.Draining() {
+		t.Errorf("n.Draining() == false; want true")
+	}
+
+	//Nodes can only be drained once
+	req = httptest.NewRequest("POST", n.URL()+"/admin/drain", nil)
+	w = httptest.NewRecorder()
+	n.Handler().ServeHTTP(w, req)
+	res = w.Result()
+
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("res.StatusCode == %d for a second drain; want %d", res.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestNodeKeysHandlerPostDraining(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.StartWorkers(ctx)
+	n.Drain(ctx)
+
+	//Send request
+	req := httptest.NewRequest("POST", n.URL()+"/keys/key", bytes.NewBuffer([]byte(`{"data": "TestNodeKeysHandlerPostDraining"}`)))
+	w := httptest.NewRecorder()
+	n.keysHandler(w, req)
+	res := w.Result()
+
+	//Parse response
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("res.StatusCode == %d; want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	if _, ok := n.GetState("key"); ok {
+		t.Errorf("State for key %q found after a write while draining", "key")
+	}
+}
+
+func TestNodeKeysHandlerPostDrainingPeer(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.StartWorkers(ctx)
+	n.Drain(ctx)
+	testServer := httptest.NewServer(n.Handler())
+	defer func() { testServer.Close() }()
+
+	//States pushed by peers are still accepted while draining
+	state := State{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano(), Node: "other"}, Data: "TestNodeKeysHandlerPostDrainingPeer"}
+	state.Digest = state.ComputeDigest()
+	if err := NewHTTPTransport(nil).Send(ctx, parseURL(testServer.URL), state, nil); err != nil {
+		t.Errorf("Send() == %v while draining; want nil", err)
+	}
+
+	timeout := time.Now().Add(5 * time.Second)
+	for {
+		if current, ok := n.GetState("key"); ok && current.Timestamp == state.Timestamp {
+			break
+		}
+		if time.Now().After(timeout) {
+			t.Fatalf("State for key %q not applied after a push from a peer while draining", "key")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNodeSyncHandler(t *testing.T) {
+	n := NewNode(nil)
+	n.UpdateState(State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeSyncHandler"})
+	testCases := []struct {
+		Leaves     []int
+		StatusCode int
+		Keys       int
+	}{
+		{[]int{merkleLeaf("key")}, http.StatusOK, 1},
+		{[]int{merkleLeaf("key") ^ 1}, http.StatusOK, 0},
+		{[]int{merkleLeaves}, http.StatusBadRequest, 0},
+	}
+
+	for _, testCase := range testCases {
+		reqBody, _ := json.Marshal(SyncRequest{Leaves: testCase.Leaves})
+		req := httptest.NewRequest("POST", n.URL()+"/sync", bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		n.syncHandler(w, req)
+		res := w.Result()
+
+		sr := SyncResponse{}
+		json.NewDecoder(res.Body).Decode(&sr)
+		if res.StatusCode != testCase.StatusCode || len(sr.Keys) != testCase.Keys {
+			t.Errorf("Response to %v == %d, %v; want %d with %d keys", testCase.Leaves, res.StatusCode, sr.Keys, testCase.StatusCode, testCase.Keys)
+		}
+	}
+}
+
+func TestNodeTreeHandler(t *testing.T) {
+	n := NewNode(nil)
+	empty, _ := n.tree.Hashes(0, nil)
+	n.UpdateState(State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeTreeHandler"})
+	testCases := []struct {
+		Request    TreeRequest
+		StatusCode int
+		Hashes     int
+	}{
+		{TreeRequest{Level: 0, Nodes: []int{0}}, http.StatusOK, 1},
+		{TreeRequest{Level: 1}, http.StatusOK, merkleFanout},
+		{TreeRequest{Level: merkleDepth + 1}, http.StatusBadRequest, 0},
+		{TreeRequest{Level: 1, Nodes: []int{merkleFanout}}, http.StatusBadRequest, 0},
+	}
+
+	for _, testCase := range testCases {
+		reqBody, _ := json.Marshal(testCase.Request)
+		req := httptest.NewRequest("POST", n.URL()+"/tree", bytes.NewBuffer(reqBody))
+		w := httptest.NewRecorder()
+		n.treeHandler(w, req)
+		res := w.Result()
+
+		tr := TreeResponse{}
+		json.NewDecoder(res.Body).Decode(&tr)
+		if res.StatusCode != testCase.StatusCode || len(tr.Hashes) != testCase.Hashes {
+			t.Errorf("Response to %v == %d, %v; want %d with %d hashes", testCase.Request, res.StatusCode, tr.Hashes, testCase.StatusCode, testCase.Hashes)
+		}
+		//UpdateState maintains the tree
+		if testCase.Request.Level == 0 && len(tr.Hashes) == 1 && tr.Hashes[0] == empty[0] {
+			t.Errorf("Root hash == %s after an update; want a different hash", tr.Hashes[0])
+		}
+	}
+}
+
+func TestNodeSyncHandlerDraining(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.StartWorkers(ctx)
+	n.Drain(ctx)
+
+	for _, path := range []string{"/sync", "/tree"} {
+		req := httptest.NewRequest("POST", n.URL()+path, bytes.NewBuffer([]byte(`{}`)))
+		w := httptest.NewRecorder()
+		n.Handler().ServeHTTP(w, req)
+		res := w.Result()
+
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("res.StatusCode == %d for %s; want %d", res.StatusCode, path, http.StatusServiceUnavailable)
+		}
+	}
+}
@@ -1,9 +1,20 @@
 package gossip
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -66,6 +77,29 @@ func TestNodeDeletePeer(t *testing.T) {
 	}
 }
 
+func TestNodeDeletePeerMiddle(t *testing.T) {
+	//Setup the node and peers
+	n := NewNode(nil)
+	peer1 := NewPeer(Addr{"127.0.0.1", 8081}, nil)
+	peer2 := NewPeer(Addr{"127.0.0.1", 8082}, nil)
+	peer3 := NewPeer(Addr{"127.0.0.1", 8083}, nil)
+	peer4 := NewPeer(Addr{"127.0.0.1", 8084}, nil)
+	n.Peers = []*Peer{peer1, peer2, peer3, peer4}
+
+	n.DeletePeer(peer3.Addr)
+
+	//The other peers keep their order
+	expected := []*Peer{peer1, peer2, peer4}
+	if len(n.Peers) != len(expected) {
+		t.Fatalf("len(n.Peers) == %d; want %d", len(n.Peers), len(expected))
+	}
+	for i, peer := range expected {
+		if n.Peers[i] != peer {
+			t.Errorf("n.Peers[%d] == %v; want %v", i, n.Peers[i], peer)
+		}
+	}
+}
+
 func TestNodeFindPeer(t *testing.T) {
 	n := NewNode(nil)
 
@@ -103,13 +137,14 @@ func TestNodeFindPeer(t *testing.T) {
 
 func TestNodeFetchStateWorker(t *testing.T) {
 	var received bool
-	state := State{time.Now().UnixNano(), "TestNodeFetchStateWorker"}
+	state := State{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Data: "TestNodeFetchStateWorker"}
+	state.Digest = state.ComputeDigest()
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			t.Errorf("r.Method == %s; want %s", r.Method, "GET")
 		}
-		if r.URL.Path != "/" {
-			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/")
+		if r.URL.Path != "/keys/key" {
+			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/keys/key")
 		}
 		received = true
 		w.WriteHeader(http.StatusOK)
@@ -118,15 +153,16 @@ func TestNodeFetchStateWorker(t *testing.T) {
 	defer func() { testServer.Close() }()
 
 	peer := NewPeer(parseURL(testServer.URL), nil)
-	peer.LastState = state.Timestamp
 
 	n := NewNode(nil)
 	n.Peers = append(n.Peers, peer)
 
 	go n.fetchStateWorker()
-	n.fetchStateChan <- peer
+	n.fetchStateChan <- fetchRequest{peer, state.Key, KeyStatus{Timestamp: state.Timestamp, Digest: state.Digest}}
 	newState := <-n.stateChan
 
+	//The state is one hop further from its writer
+	state.Hops++
 	if newState != state {
 		t.Errorf("newState == %v; want %v", newState, state)
 	}
@@ -136,6 +172,29 @@ func TestNodeFetchStateWorker(t *testing.T) {
 	}
 }
 
+func TestNodeWriteAcks(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	config.Node.MaxRecipients = 2
+	n := NewNode(&config)
+	for i := 0; i < 5; i++ {
+		n.Peers = append(n.Peers, NewPeer(Addr{"127.0.0.1", 8080 + i}, &config))
+	}
+
+	state := State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeWriteAcks"}
+	res := n.write(writeRequest{state, Consistency{Peers: 1}, nil})
+
+	//Each recipient has room for its acknowledgement
+	if res.recipients != 2 || cap(res.acks) != res.recipients {
+		t.Fatalf("res.recipients == %d, cap(res.acks) == %d; want 2, 2", res.recipients, cap(res.acks))
+	}
+	for i := 0; i < res.recipients; i++ {
+		if ack := <-res.acks; !ack.ok {
+			t.Errorf("ack.ok == false for %v; want true", ack.addr)
+		}
+	}
+}
+
 func TestNodePeerSendState(t *testing.T) {
 	testCases := []struct {
 		Recipients int
@@ -147,15 +206,15 @@ func TestNodePeerSendState(t *testing.T) {
 		{DefaultConfig.Node.MaxRecipients + 1, DefaultConfig.Node.MaxRecipients},
 	}
 
-	var receivedCount int
+	var receivedCount int32
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			t.Errorf("r.Method == %s; want %s", r.Method, "GET")
 		}
-		if r.URL.Path != "/" {
-			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/")
+		if r.URL.Path != "/keys/key" {
+			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/keys/key")
 		}
-		receivedCount++
+		atomic.AddInt32(&receivedCount, 1)
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(Response{
 			Message: "State received",
@@ -164,7 +223,7 @@ func TestNodePeerSendState(t *testing.T) {
 	defer func() { testServer.Close() }()
 	peer := NewPeer(parseURL(testServer.URL), nil)
 
-	state := State{time.Now().UnixNano(), "TestNodePeerSendState"}
+	state := State{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Data: "TestNodePeerSendState"}
 	n := NewNode(nil)
 
 	for i, testCase := range testCases {
@@ -182,10 +241,10 @@ func TestNodePeerSendState(t *testing.T) {
 		if count != testCase.Expected {
 			t.Errorf("count == %d in test case %d; want %d", count, i, testCase.Expected)
 		}
-		if receivedCount != testCase.Expected {
-			t.Errorf("receivedCount == %d in test case %d; want %d", receivedCount, i, testCase.Expected)
+		if received := atomic.LoadInt32(&receivedCount); int(received) != testCase.Expected {
+			t.Errorf("receivedCount == %d in test case %d; want %d", received, i, testCase.Expected)
 		}
-		receivedCount = 0
+		atomic.StoreInt32(&receivedCount, 0)
 	}
 
 	//TODO: Test that testCase.Expected requests are sent to the peers
@@ -198,7 +257,7 @@ func TestNodePeerSendState(t *testing.T) {
 // 	peer := &Peer{config: DefaultConfig}
 // 	peer.UpdateStatus(true)
 // 	peer.UpdateStatus(false)
-// 	peer.LastState = time.Now().UnixNano()
+// 	peer.LastStates = map[string]KeyStatus{"key": {Timestamp: Timestamp{Physical: time.Now().UnixNano()}}}
 // 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 // 		if r.Method != "GET" {
 // 			t.Errorf("r.Method == %s; want %s", r.Method, "GET")
@@ -209,7 +268,7 @@ func TestNodePeerSendState(t *testing.T) {
 // 		received = true
 // 		w.WriteHeader(http.StatusOK)
 // 		json.NewEncoder(w).Encode(StatusResponse{
-// 			LastState: peer.LastState,
+// 			Keys: peer.LastStates,
 // 		})
 // 	}))
 // 	defer func() { testServer.Close() }()
@@ -220,14 +279,14 @@ func TestNodePeerSendState(t *testing.T) {
 // 	n.Peers = append(n.Peers, peer)
 
 // 	//Ping all peers
-// 	go n.PingPeers()
+// 	go n.PingPeers(context.Background())
 
 // 	//Wait for a peer from n.PingPeers()
-// 	rPeer := <-n.fetchStateChan
+// 	req := <-n.fetchStateChan
 
 // 	//Check results
-// 	if rPeer != peer {
-// 		t.Errorf("rPeer == %v; want %v", rPeer, peer)
+// 	if req.peer != peer {
+// 		t.Errorf("req.peer == %v; want %v", req.peer, peer)
 // 	}
 
 // 	if peer.Attempts != 0 {
@@ -254,7 +313,7 @@ func TestNodePingPeersUnreachable(t *testing.T) {
 		received = true
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(StatusResponse{
-			LastState: peer.LastState,
+			Root: peer.LastRoot,
 		})
 	}))
 	defer func() { testServer.Close() }()
@@ -265,7 +324,7 @@ func TestNodePingPeersUnreachable(t *testing.T) {
 	n.Peers = append(n.Peers, peer)
 
 	//Ping all peers
-	go n.PingPeers()
+	go n.PingPeers(context.Background())
 
 	/*Need to wait for asynchronous processing. This should be enough but could
 	cause issues.
@@ -273,8 +332,8 @@ func TestNodePingPeersUnreachable(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	//Check results
-	if len(n.Peers) != 0 {
-		t.Errorf("len(n.Peers) == %d; want %d", len(n.Peers), 0)
+	if peers := n.PeerList(); len(peers) != 0 {
+		t.Errorf("len(n.Peers) == %d; want %d", len(peers), 0)
 	}
 
 	if peer.Attempts != 10 {
@@ -286,7 +345,41 @@ func TestNodePingPeersUnreachable(t *testing.T) {
 	}
 }
 
-func TestNodeShutdown(t *testing.T) {
+func TestNodePingPeersRoot(t *testing.T) {
+	empty := NewMerkleTree().Root()
+
+	testCases := []struct {
+		Root     string
+		Expected []string
+	}{
+		//Same trees: nothing to compare
+		{empty, []string{"Ping"}},
+		//Different trees: walk down the trees of both nodes
+		{"0123456789abcdef", []string{"Ping", "GetTree"}},
+	}
+
+	for i, testCase := range testCases {
+		tracker := &countTracker{count: 1}
+		transport := &stubTransport{
+			status: StatusResponse{Root: testCase.Root},
+			tree:   TreeResponse{Hashes: []string{empty}},
+		}
+		config := *DefaultConfig
+		config.Transport = transport
+		config.Tracker = tracker
+		n := NewNode(&config)
+		n.Peers = []*Peer{NewPeer(Addr{"127.0.0.1", 8081}, n.config)}
+
+		n.PingPeers(context.Background())
+		waitCount(t, tracker, 1)
+
+		if !reflect.DeepEqual(transport.calls, testCase.Expected) {
+			t.Errorf("transport.calls == %v for test case %d; want %v", transport.calls, i, testCase.Expected)
+		}
+	}
+}
+
+func TestNodeStop(t *testing.T) {
 	//Setup node
 	n := NewNode(nil)
 
@@ -307,7 +400,9 @@ func TestNodeShutdown(t *testing.T) {
 
 	n.Peers = []*Peer{peer}
 
-	n.Shutdown()
+	if err := n.Stop(context.Background()); err != nil {
+		t.Errorf("n.Stop() == %v; want nil", err)
+	}
 
 	//Check results
 	if !received {
@@ -315,8 +410,53 @@ func TestNodeShutdown(t *testing.T) {
 	}
 }
 
+func TestNodeStopTwice(t *testing.T) {
+	//Setup node with a storage that fails if closed twice
+	dir, err := ioutil.TempDir("", "gossip")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage() returned error %s", err.Error())
+	}
+	n := NewNodeWithStorage(nil, storage)
+
+	//Setup peer server
+	var received int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+		response(w, r, http.StatusOK, "Peering request received")
+	}))
+	defer func() { testServer.Close() }()
+	n.Peers = []*Peer{NewPeer(parseURL(testServer.URL), nil)}
+
+	//Stop the node concurrently, then once more
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.Stop(context.Background()); err != nil {
+				t.Errorf("n.Stop() == %v; want nil", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := n.Stop(context.Background()); err != nil {
+		t.Errorf("n.Stop() == %v; want nil", err)
+	}
+
+	//The node leaves its peers only once
+	if r := atomic.LoadInt32(&received); r != 1 {
+		t.Errorf("HTTP Server received %d requests; want %d", r, 1)
+	}
+}
+
 func TestNodeStateWorker(t *testing.T) {
-	state := State{time.Now().UnixNano(), "TestNodeStateWorker"}
+	state := State{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Data: "TestNodeStateWorker"}
+	state.Digest = state.ComputeDigest()
 	n := NewNode(nil)
 
 	go n.stateWorker()
@@ -324,14 +464,38 @@ func TestNodeStateWorker(t *testing.T) {
 
 	_ = <-n.peerStateChan
 
-	if n.State != state {
-		t.Errorf("n.State == %v; want %v", n.State, state)
+	if nState, _ := n.GetState(state.Key); nState != state {
+		t.Errorf("n.GetState() == %v; want %v", nState, state)
+	}
+}
+
+func TestNodeStateWorkerUnsigned(t *testing.T) {
+	publicKey, key, _ := ed25519.GenerateKey(nil)
+	config := *DefaultConfig
+	config.Node.TrustedKeys = []string{base64.StdEncoding.EncodeToString(publicKey)}
+	n := NewNode(&config)
+
+	unsigned := State{Key: "unsigned", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Data: "TestNodeStateWorkerUnsigned"}
+	signed := State{Key: "signed", Data: "TestNodeStateWorkerUnsigned"}
+	signed.Sign(key)
+
+	go n.stateWorker()
+	n.stateChan <- unsigned
+	n.stateChan <- signed
+
+	//Only the signed state should be propagated
+	if state := <-n.peerStateChan; state.Key != signed.Key {
+		t.Errorf("state.Key == %q; want %q", state.Key, signed.Key)
+	}
+	if _, ok := n.GetState(unsigned.Key); ok {
+		t.Errorf("n.GetState(%q) found", unsigned.Key)
 	}
 }
 
 func TestNodeUpdateState(t *testing.T) {
 	origState := State{
-		Timestamp: time.Now().UnixNano(),
+		Key:       "key",
+		Timestamp: Timestamp{Physical: time.Now().UnixNano()},
 		Data:      "TestNodeUpdateState",
 	}
 
@@ -339,12 +503,14 @@ func TestNodeUpdateState(t *testing.T) {
 		State    State
 		Expected bool
 	}{
-		{State{1, "TestNodeUpdateState"}, false},
+		{State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeUpdateState"}, false},
 		{origState, false},
-		{State{origState.Timestamp + 1, "TestNodeUpdateState"}, true},
+		{State{Key: "key", Timestamp: Timestamp{Physical: origState.Timestamp.Physical + 1}, Data: "TestNodeUpdateState"}, true},
+		{State{Key: "key", Timestamp: Timestamp{Physical: origState.Timestamp.Physical + 1}, Deleted: true}, true},
+		{State{Key: "other", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeUpdateState"}, true},
 		//This test case may fail due to time.Now() resolution being too low on
 		//some systems.
-		//{State{0, "Data"}, true},
+		//{State{Key: "key", Data: "Data"}, true},
 	}
 
 	for i, testCase := range testCases {
@@ -357,3 +523,611 @@ func TestNodeUpdateState(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeUpdateStateConflict(t *testing.T) {
+	states := []State{
+		{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeUpdateStateConflict"},
+		{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "Conflicting data"},
+	}
+	for i := range states {
+		states[i].Digest = states[i].ComputeDigest()
+	}
+	expected := DigestResolver{}.Resolve(states[0], states[1])
+
+	//Nodes must converge regardless of the order in which they receive states
+	for _, order := range [][]State{{states[0], states[1]}, {states[1], states[0]}} {
+		n := NewNode(nil)
+		n.UpdateState(order[0])
+		_, updated := n.UpdateState(order[1])
+
+		if updated != (expected == order[1]) {
+			t.Errorf("n.UpdateState(%v) == %t; want %t", order[1], updated, expected == order[1])
+		}
+		if nState, _ := n.GetState("key"); nState != expected {
+			t.Errorf("n.GetState() == %v; want %v", nState, expected)
+		}
+	}
+}
+
+func TestNodeNeedsFetch(t *testing.T) {
+	state := State{Key: "key", Timestamp: Timestamp{Physical: 2}, Data: "TestNodeNeedsFetch"}
+	n := NewNode(nil)
+	n.UpdateState(state)
+
+	testCases := []struct {
+		Key      string
+		Status   KeyStatus
+		Expected bool
+	}{
+		{"key", KeyStatus{Timestamp: Timestamp{Physical: 1}, Digest: "digest"}, false},
+		{"key", KeyStatus{Timestamp: state.Timestamp, Digest: state.ComputeDigest()}, false},
+		{"key", KeyStatus{Timestamp: state.Timestamp, Digest: "digest"}, true},
+		{"key", KeyStatus{Timestamp: Timestamp{Physical: 3}, Digest: state.ComputeDigest()}, true},
+		{"other", KeyStatus{Timestamp: Timestamp{Physical: 1}, Digest: "digest"}, true},
+	}
+
+	for i, testCase := range testCases {
+		if fetch := n.needsFetch(testCase.Key, testCase.Status); fetch != testCase.Expected {
+			t.Errorf("n.needsFetch() == %t for test case %d; want %t", fetch, i, testCase.Expected)
+		}
+	}
+}
+
+func TestNodeUpdateStateKeys(t *testing.T) {
+	n := NewNode(nil)
+	states := []State{
+		{Key: "key1", Timestamp: Timestamp{Physical: 2}, Data: "TestNodeUpdateStateKeys"},
+		{Key: "key2", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeUpdateStateKeys"},
+		{Key: "key1", Timestamp: Timestamp{Physical: 3}, Data: "Deleted data", Deleted: true},
+	}
+	for i := range states {
+		states[i].Digest = states[i].ComputeDigest()
+	}
+
+	for _, state := range states {
+		n.UpdateState(state)
+	}
+
+	//key1 should be a tombstone without data
+	state, ok := n.GetState("key1")
+	if !ok {
+		t.Errorf("n.GetState(\"key1\") not found")
+	}
+	if !state.Deleted || state.Data != "" {
+		t.Errorf("n.GetState(\"key1\") == %v; want tombstone", state)
+	}
+
+	//key2 should not be affected by key1
+	state, ok = n.GetState("key2")
+	if !ok || state != states[1] {
+		t.Errorf("n.GetState(\"key2\") == %v; want %v", state, states[1])
+	}
+
+	//key3 does not exist
+	if _, ok := n.GetState("key3"); ok {
+		t.Errorf("n.GetState(\"key3\") found")
+	}
+}
+
+func TestNodeStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	config := *DefaultConfig
+	config.Node.DataDir = dir
+	states := []State{
+		{Key: "key1", Timestamp: Timestamp{Physical: 2}, Data: "TestNodeStorage"},
+		{Key: "key2", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeStorage"},
+		{Key: "key1", Timestamp: Timestamp{Physical: 1}, Data: "Obsolete data"},
+	}
+	for i := range states {
+		states[i].Digest = states[i].ComputeDigest()
+	}
+
+	//Update states on a first node
+	n := NewNode(&config)
+	for _, state := range states {
+		n.UpdateState(state)
+	}
+	n.storage.Close()
+
+	//Start a second node with the same data directory
+	n = NewNode(&config)
+	defer n.storage.Close()
+
+	for _, state := range states[:2] {
+		if nState, _ := n.GetState(state.Key); nState != state {
+			t.Errorf("n.GetState(%q) == %v; want %v", state.Key, nState, state)
+		}
+	}
+
+	//Snapshot and load again
+	if err := n.Snapshot(); err != nil {
+		t.Errorf("n.Snapshot() returned error %s", err.Error())
+	}
+	loaded, _ := n.storage.Load()
+	if len(loaded) != 2 {
+		t.Errorf("len(n.storage.Load()) == %d after snapshot; want %d", len(loaded), 2)
+	}
+}
+
+func TestNodeUpdateStateClock(t *testing.T) {
+	n := NewNode(nil)
+
+	//Receive a state from a node with a clock in the future, within the maximum drift
+	remote := State{Key: "key1", Timestamp: Timestamp{Physical: time.Now().Add(time.Minute).UnixNano(), Node: "other"}, Data: "TestNodeUpdateStateClock"}
+	if _, ok := n.UpdateState(remote); !ok {
+		t.Errorf("n.UpdateState() == %t; want %t", ok, true)
+	}
+
+	//A later write on this node must be ordered after the remote state
+	state, ok := n.UpdateState(State{Key: "key1", Data: "TestNodeUpdateStateClock"})
+	if !ok {
+		t.Errorf("n.UpdateState() == %t; want %t", ok, true)
+	}
+	if !state.Timestamp.After(remote.Timestamp) {
+		t.Errorf("state.Timestamp == %v; want after %v", state.Timestamp, remote.Timestamp)
+	}
+	if state.Timestamp.Node != n.ID {
+		t.Errorf("state.Timestamp.Node == %s; want %s", state.Timestamp.Node, n.ID)
+	}
+}
+
+func TestNodeUpdateStateClockDrift(t *testing.T) {
+	n := NewNode(nil)
+
+	//States too far in the future are rejected and do not move the clock
+	remote := State{Key: "key1", Timestamp: Timestamp{Physical: time.Now().Add(time.Hour).UnixNano(), Node: "other"}, Data: "TestNodeUpdateStateClockDrift"}
+	if _, ok := n.UpdateState(remote); ok {
+		t.Errorf("n.UpdateState() == %t; want %t", ok, false)
+	}
+	if _, ok := n.GetState("key1"); ok {
+		t.Errorf("n.GetState() returned the rejected state")
+	}
+	if last := n.clock.Last(); !last.Before(remote.Timestamp) {
+		t.Errorf("n.clock.Last() == %v; want before %v", last, remote.Timestamp)
+	}
+}
+
+func TestNodeConcurrentPeers(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	n.StartWorkers(context.Background())
+	defer n.Stop(context.Background())
+	handler := n.Handler()
+
+	//Hammer the HTTP handlers while peers churn
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				addr := fmt.Sprintf(`{"ip": "127.0.0.1", "port": %d}`, 9000+(i+j)%5)
+				requests := []*http.Request{
+					httptest.NewRequest("POST", "/peers", strings.NewReader(addr)),
+					httptest.NewRequest("GET", "/peers", nil),
+					httptest.NewRequest("POST", "/keys/key", strings.NewReader(`{"data": "TestNodeConcurrentPeers"}`)),
+					httptest.NewRequest("GET", "/status", nil),
+					httptest.NewRequest("DELETE", "/peers", strings.NewReader(addr)),
+				}
+				for _, req := range requests {
+					handler.ServeHTTP(httptest.NewRecorder(), req)
+				}
+				n.PingPeers(context.Background())
+				n.PeerSendState(State{Key: "key", Data: "TestNodeConcurrentPeers"})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	//Peers are never duplicated
+	seen := make(map[Addr]bool)
+	for _, peer := range n.PeerList() {
+		if seen[peer.Addr] {
+			t.Errorf("Peer %v is duplicated", peer.Addr)
+		}
+		seen[peer.Addr] = true
+	}
+}
+
+func TestNodeStartStop(t *testing.T) {
+	//Run two nodes in the same process
+	nodes := make([]*Node, 2)
+	for i := range nodes {
+		config := *DefaultConfig
+		config.Node.IP = "127.0.0.1"
+		config.Node.Port = 0
+		nodes[i] = NewNode(&config)
+		if err := nodes[i].Start(context.Background()); err != nil {
+			t.Fatalf("nodes[%d].Start() == %v; want nil", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i, n := range nodes {
+		if err := n.Stop(ctx); err != nil {
+			t.Errorf("nodes[%d].Stop() == %v; want nil", i, err)
+		}
+	}
+}
+
+func TestNodeStartCancel(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.IP = "127.0.0.1"
+	config.Node.Port = 0
+	n := NewNode(&config)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := n.Start(ctx); err != nil {
+		t.Fatalf("n.Start() == %v; want nil", err)
+	}
+
+	//Cancelling the context stops the workers
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		n.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Workers did not exit after cancelling the context")
+	}
+}
+
+func TestNodeStartListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	config := *DefaultConfig
+	config.Node.IP = "127.0.0.1"
+	config.Node.Port = ln.Addr().(*net.TCPAddr).Port
+	n := NewNode(&config)
+	if err := n.Start(context.Background()); err == nil {
+		t.Errorf("n.Start() == nil; want error")
+		n.Stop(context.Background())
+	}
+}
+
+//probeTransport is a Transport where pings fail for unreachable addresses and probes only succeed through helpers
+type probeTransport struct {
+	stubTransport
+	unreachable map[Addr]bool
+	helpers     map[Addr]ProbeResponse
+}
+
+func (t *probeTransport) Ping(ctx context.Context, addr Addr, events []MemberEvent) (StatusResponse, error) {
+	if t.unreachable[addr] {
+		return StatusResponse{}, ErrMessageDropped
+	}
+	return StatusResponse{}, nil
+}
+
+func (t *probeTransport) Probe(ctx context.Context, addr Addr, req ProbeRequest) (ProbeResponse, error) {
+	res, ok := t.helpers[addr]
+	if !ok {
+		return ProbeResponse{}, ErrMessageDropped
+	}
+	return res, nil
+}
+
+func TestNodeProbePeer(t *testing.T) {
+	target, helper := Addr{"127.0.0.1", 9000}, Addr{"127.0.0.1", 9001}
+	testCases := []struct {
+		Name        string
+		Unreachable bool
+		Liveness    Liveness
+		Helpers     map[Addr]ProbeResponse
+		Expected    Liveness
+		Incarnation uint64
+	}{
+		{"direct", false, PeerAlive, nil, PeerAlive, 0},
+		{"indirect", true, PeerAlive, map[Addr]ProbeResponse{helper: {Ack: true}}, PeerAlive, 0},
+		{"indirect-nack", true, PeerAlive, map[Addr]ProbeResponse{helper: {Ack: false}}, PeerSuspect, 0},
+		{"suspect", true, PeerAlive, nil, PeerSuspect, 0},
+		{"refute", false, PeerSuspect, map[Addr]ProbeResponse{target: {Ack: true, Incarnation: 1}}, PeerAlive, 1},
+		{"refute-indirect", true, PeerSuspect, map[Addr]ProbeResponse{helper: {Ack: true, Incarnation: 1}}, PeerAlive, 1},
+		{"no-refute", false, PeerSuspect, map[Addr]ProbeResponse{target: {Ack: true}}, PeerSuspect, 0},
+	}
+
+	for _, testCase := range testCases {
+		config := *DefaultConfig
+		config.Transport = &probeTransport{
+			unreachable: map[Addr]bool{target: testCase.Unreachable},
+			helpers:     testCase.Helpers,
+		}
+		n := NewNode(&config)
+		peer := NewPeer(target, &config)
+		peer.Liveness = testCase.Liveness
+		peers := []*Peer{peer, NewPeer(helper, &config)}
+
+		_, ok := n.probePeer(context.Background(), peer, peers)
+		if ok == testCase.Unreachable {
+			t.Errorf("[%s] n.probePeer() == %t; want %t", testCase.Name, ok, !testCase.Unreachable)
+		}
+		if liveness, incarnation := peer.Membership(); liveness != testCase.Expected || incarnation != testCase.Incarnation {
+			t.Errorf("[%s] peer.Membership() == %v, %d; want %v, %d", testCase.Name, liveness, incarnation, testCase.Expected, testCase.Incarnation)
+		}
+		for _, member := range n.Members() {
+			if member.Addr == target && member.Liveness != testCase.Expected {
+				t.Errorf("[%s] Member %v is %v; want %v", testCase.Name, target, member.Liveness, testCase.Expected)
+			}
+		}
+	}
+}
+
+func TestNodeReplacePeers(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.MinPeers = 2
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	peer, suspect := Addr{"127.0.0.1", 8081}, Addr{"127.0.0.1", 8082}
+	n.AddPeer(peer)
+	n.members.Apply(
+		MemberEvent{MemberSuspect, "", suspect, 0},
+		MemberEvent{MemberJoin, "", Addr{"127.0.0.1", 8083}, 0},
+		MemberEvent{MemberJoin, "", Addr{"127.0.0.1", 8084}, 0},
+	)
+
+	n.replacePeers()
+
+	peers := n.PeerList()
+	if len(peers) != 2 {
+		t.Fatalf("len(n.Peers) == %d; want 2", len(peers))
+	}
+	if peers[0].Addr != peer {
+		t.Errorf("n.Peers[0].Addr == %v; want %v", peers[0].Addr, peer)
+	}
+	if peers[1].Addr == suspect {
+		t.Errorf("Picked suspect member %v as replacement peer", suspect)
+	}
+
+	//The node has enough peers
+	n.replacePeers()
+	if peers := n.PeerList(); len(peers) != 2 {
+		t.Errorf("len(n.Peers) == %d; want 2", len(peers))
+	}
+}
+
+func TestNodeMembers(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	addr := Addr{"127.0.0.1", 8081}
+
+	//Peers join the membership and leave it when deleted
+	n.AddPeer(addr)
+	n.DeletePeer(addr)
+
+	members := n.Members()
+	if len(members) != 2 {
+		t.Fatalf("len(n.Members()) == %d; want 2", len(members))
+	}
+	if members[0].Addr != n.Addr() || members[0].Liveness != PeerAlive {
+		t.Errorf("members[0] == %v; want %v alive", members[0], n.Addr())
+	}
+	if members[1].Addr != addr || members[1].Liveness != PeerDead {
+		t.Errorf("members[1] == %v; want %v dead", members[1], addr)
+	}
+}
+
+//joinTransport is a Transport where peering requests fail a number of times before succeeding
+type joinTransport struct {
+	stubTransport
+	failures int
+}
+
+func (t *joinTransport) SendPeeringRequest(ctx context.Context, addr Addr, req PeeringRequest) error {
+	t.call("SendPeeringRequest")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failures > 0 {
+		t.failures--
+		return ErrMessageDropped
+	}
+	return nil
+}
+
+func TestNodeJoinWorker(t *testing.T) {
+	transport := &joinTransport{failures: 3}
+	config := *DefaultConfig
+	config.Transport = transport
+	config.Peer.BackoffDuration = time.Millisecond
+	config.Node.MaxJoinBackoff = 2 * time.Millisecond
+	n := NewNode(&config)
+
+	//Seeds pointing to the node itself are skipped
+	n.joinWorker(n.Addr(), "seed")
+	if len(transport.calls) != 0 {
+		t.Errorf("len(transport.calls) == %d after joining self; want 0", len(transport.calls))
+	}
+
+	//The node retries until the request succeeds
+	n.joinWorker(Addr{"127.0.0.1", 8081}, "seed")
+	if len(transport.calls) != 4 {
+		t.Errorf("len(transport.calls) == %d; want 4", len(transport.calls))
+	}
+}
+
+func TestNodeJoinWorkerStop(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &joinTransport{failures: 1 << 30}
+	config.Node.Controllers = []string{"127.0.0.1:7080"}
+	n := NewNode(&config)
+	n.StartWorkers(context.Background())
+
+	//Stopping the node stops retrying
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := n.Stop(ctx); err != nil {
+		t.Errorf("n.Stop() == %v; want nil", err)
+	}
+}
+
+func TestNodeDiscover(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.IP = "10.0.0.1"
+	config.Node.Port = 8080
+	config.DNS = newStubResolver()
+	config.Transport = &stubTransport{}
+	config.Node.MinPeers = 1
+	config.Node.Discovery = []string{"_gossip._tcp.gossip.local"}
+	n := NewNode(&config)
+
+	n.discover()
+
+	//node-1.local resolves to the node itself
+	members := n.members.Members()
+	if len(members) != 2 {
+		t.Fatalf("len(n.members.Members()) == %d; want 2", len(members))
+	}
+	addr := Addr{"node-3.local", 8080}
+	if members[1].Addr != addr || members[1].Liveness != PeerAlive {
+		t.Errorf("n.members.Members()[1] == %v; want %v alive", members[1], addr)
+	}
+	if peers := n.PeerList(); len(peers) != 1 || peers[0].Addr != addr {
+		t.Errorf("n.PeerList() == %v; want peer %v", peers, addr)
+	}
+}
+
+func TestNodeAddPeerID(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	addr, moved := Addr{"127.0.0.1", 8081}, Addr{"127.0.0.1", 8082}
+
+	//Peers learn their ID from peering requests
+	n.AddPeer(addr)
+	n.addPeer(PeeringRequest{addr, "a"})
+	if peers := n.PeerList(); len(peers) != 1 || peers[0].ID() != "a" {
+		t.Fatalf("n.PeerList() == %v; want 1 peer with ID %q", peers, "a")
+	}
+
+	//Another node cannot claim the address of a reachable peer
+	if err := n.CheckPeeringRequest(PeeringRequest{addr, "b"}); err == nil {
+		t.Errorf("n.CheckPeeringRequest() == nil for a used address; want an error")
+	}
+	n.addPeer(PeeringRequest{addr, "b"})
+	if peers := n.PeerList(); len(peers) != 1 || peers[0].ID() != "a" {
+		t.Errorf("n.PeerList() == %v after a conflicting request; want 1 peer with ID %q", peers, "a")
+	}
+
+	//The node moves to another address
+	n.addPeer(PeeringRequest{moved, "a"})
+	peers := n.PeerList()
+	if len(peers) != 1 || peers[0].Addr != moved {
+		t.Fatalf("n.PeerList() == %v after the node moved; want [%v]", peers, moved)
+	}
+	//The former address is suspect until the node refutes it
+	members := n.members.Members()
+	if len(members) != 2 || members[1].ID != "a" || members[1].Addr != addr || members[1].Liveness != PeerSuspect {
+		t.Errorf("n.members.Members() == %v after the node moved; want %q suspect at %v", members, "a", addr)
+	}
+	n.members.Apply(MemberEvent{MemberJoin, "a", moved, 1})
+	members = n.members.Members()
+	if len(members) != 2 || members[1].ID != "a" || members[1].Addr != moved || members[1].Liveness != PeerAlive {
+		t.Errorf("n.members.Members() == %v after the refutation; want %q alive at %v", members, "a", moved)
+	}
+
+	//Another node replaces an unreachable peer
+	peers[0].UpdateStatus(false)
+	if err := n.CheckPeeringRequest(PeeringRequest{moved, "b"}); err != nil {
+		t.Errorf("n.CheckPeeringRequest() == %v for an unreachable peer; want nil", err)
+	}
+	n.addPeer(PeeringRequest{moved, "b"})
+	if peers := n.PeerList(); len(peers) != 1 || peers[0].ID() != "b" {
+		t.Errorf("n.PeerList() == %v after replacing an unreachable peer; want 1 peer with ID %q", peers, "b")
+	}
+
+	//Requests with the ID of the node itself are skipped
+	n.addPeer(PeeringRequest{Addr{"127.0.0.1", 8083}, n.ID})
+	if peers := n.PeerList(); len(peers) != 1 {
+		t.Errorf("len(n.Peers) == %d after a request with the ID of the node; want 1", len(peers))
+	}
+}
+
+func TestNodeIdentifyPeer(t *testing.T) {
+	config := *DefaultConfig
+	config.Transport = &stubTransport{}
+	n := NewNode(&config)
+	addr, moved := Addr{"127.0.0.1", 8081}, Addr{"127.0.0.1", 8082}
+	n.AddPeer(addr)
+	n.AddPeer(moved)
+	peers := n.PeerList()
+
+	//Peers learn their ID from pings
+	if peer := n.identifyPeer(peers[0], "a"); peer != peers[0] || peer.ID() != "a" {
+		t.Errorf("n.identifyPeer() returned peer with ID %q; want the same peer with ID %q", peer.ID(), "a")
+	}
+
+	//The node now responds on another address
+	n.identifyPeer(peers[1], "a")
+	if peers := n.PeerList(); len(peers) != 1 || peers[0].Addr != moved {
+		t.Errorf("n.PeerList() == %v; want [%v]", peers, moved)
+	}
+
+	//Another node now uses the address
+	peer := n.identifyPeer(peers[1], "b")
+	if peer == peers[1] || peer.ID() != "b" {
+		t.Errorf("n.identifyPeer() returned peer with ID %q; want a new peer with ID %q", peer.ID(), "b")
+	}
+	if peers := n.PeerList(); len(peers) != 1 || peers[0] != peer {
+		t.Errorf("n.PeerList() == %v; want [%v]", peers, peer)
+	}
+}
+
+func TestNodeDrain(t *testing.T) {
+	transport := &stubTransport{}
+	config := *DefaultConfig
+	config.Transport = transport
+	n := NewNode(&config)
+	n.Peers = append(n.Peers, NewPeer(Addr{"127.0.0.1", 8081}, &config))
+	state := State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestNodeDrain"}
+	n.States.Store(state.Key, state)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.StartWorkers(ctx)
+	//Set the controller after starting the workers, so that the node does not join it
+	n.controllers = []Addr{{"127.0.0.1", 7080}}
+
+	if err := n.Drain(context.Background()); err != nil {
+		t.Fatalf("n.Drain() == %v; want nil", err)
+	}
+	if !n.Draining() {
+		t.Errorf("n.Draining() == false; want true")
+	}
+	if peers := n.PeerList(); len(peers) != 0 {
+		t.Errorf("n.PeerList() == %v after draining; want no peers", peers)
+	}
+
+	//The state is pushed before asking the controller to re-home peers
+	expected := []string{"Send", "SendPeerDeletionRequest", "SendPeerDeletionRequest"}
+	if len(transport.calls) != len(expected) {
+		t.Fatalf("transport.calls == %v; want %v", transport.calls, expected)
+	}
+	for i := range expected {
+		if transport.calls[i] != expected[i] {
+			t.Errorf("transport.calls[%d] == %s; want %s", i, transport.calls[i], expected[i])
+		}
+	}
+
+	//Draining nodes do not peer with other nodes
+	n.AddPeer(Addr{"127.0.0.1", 8082})
+	if peers := n.PeerList(); len(peers) != 0 {
+		t.Errorf("n.PeerList() == %v after a peering request; want no peers", peers)
+	}
+
+	if err := n.Drain(context.Background()); err == nil {
+		t.Errorf("n.Drain() == nil while draining; want an error")
+	}
+}
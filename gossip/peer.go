@@ -1,28 +1,88 @@
 package gossip
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-//Peer represents a peer to this node
+//Liveness is the state of a peer in the SWIM failure detector
+type Liveness int
+
+const (
+	//PeerAlive is the state of peers that responded to the last probe
+	PeerAlive Liveness = iota
+	/*PeerSuspect is the state of peers that failed direct and indirect
+	probes. Suspect peers can still refute the suspicion.*/
+	PeerSuspect
+	/*PeerDead is the state of peers that did not refute a suspicion before
+	the suspicion timeout*/
+	PeerDead
+)
+
+//String returns a string representation of the liveness of a peer
+func (l Liveness) String() string {
+	switch l {
+	case PeerAlive:
+		return "alive"
+	case PeerSuspect:
+		return "suspect"
+	case PeerDead:
+		return "dead"
+	}
+	return fmt.Sprintf("Liveness(%d)", int(l))
+}
+
+//MarshalText encodes the liveness of a peer as a string
+func (l Liveness) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+//UnmarshalText decodes the liveness of a peer from a string
+func (l *Liveness) UnmarshalText(text []byte) error {
+	for _, liveness := range []Liveness{PeerAlive, PeerSuspect, PeerDead} {
+		if string(text) == liveness.String() {
+			*l = liveness
+			return nil
+		}
+	}
+	return errors.New("Unknown liveness " + string(text))
+}
+
+/*Peer represents a peer to this node
+
+Peers are shared between goroutines: the fields below Addr must only be
+accessed through methods, or before the peer is shared.
+*/
 type Peer struct {
 	//Attempts is the number of unsuccessful attempts to reach the peer
 	Attempts int
 	//Addr is the peer address, such as IP address and port number
 	Addr Addr
-	//LastState is the identifier for the last known data state for that peer
-	LastState int64
+	//Incarnation is the last known incarnation number of the peer
+	Incarnation uint64
+	//LastRoot is the root hash of the Merkle tree of the peer at the last ping
+	LastRoot string
 	//LastSuccess is the timestamp in seconds when the last successful contact with the peer was made
 	LastSuccess time.Time
+	//Liveness is the state of the peer in the SWIM failure detector
+	Liveness Liveness
 	//Peers is the list of peers of this peer
 	Peers []*Peer
+	//SuspectSince is the time when the peer became suspect
+	SuspectSince time.Time
+
+	//detector is the phi-accrual failure detector fed by heartbeats
+	detector *PhiDetector
+	//id is the ID of the node, or empty if it is not known yet
+	id string
+	//mu protects access to all fields except Addr
+	mu sync.RWMutex
 
 	//config store the configuration for the peer
 	config *Config
@@ -34,12 +94,22 @@ func NewPeer(addr Addr, config *Config) *Peer {
 		config = DefaultConfig
 	}
 
+	/*Requests reuse the same HTTP client. Nodes and controllers create it once
+	for all their peers, so this only creates one for peers used on their own.
+	If it fails, each request logs the error.*/
+	if transportConfig, err := config.withTransport(); err == nil {
+		config = transportConfig
+	}
+
 	p := &Peer{
 		Addr:        addr,
-		LastSuccess: time.Now(),
+		LastSuccess: config.clock().Now(),
 
 		config: config,
 	}
+	//Suspect peers that never respond, starting from now
+	p.detector = p.newDetector()
+	p.detector.Heartbeat(p.LastSuccess)
 
 	return p
 }
@@ -55,7 +125,7 @@ func (p *Peer) CanPeer(tgt *Peer) bool {
 		return false
 	}
 
-	for _, subPeer := range p.Peers {
+	for _, subPeer := range p.PeerList() {
 		if subPeer.Addr == tgt.Addr {
 			log.WithFields(log.Fields{"peer": p, "func": "CanPeer"}).Infof("Cannot peer with already peered node %v", tgt.Addr)
 			return false
@@ -65,135 +135,374 @@ func (p *Peer) CanPeer(tgt *Peer) bool {
 	return true
 }
 
-//Get retrieves the latest state from the peer
-func (p *Peer) Get() (State, error) {
-	res, err := http.Get(p.URL())
+/*AddPeer adds a peer to the list of peers of this peer.
+
+This is used by controllers to track the graph of peers.
+*/
+func (p *Peer) AddPeer(peer *Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Peers = append(p.Peers, peer)
+}
+
+/*Announce tells the peer that this node holds a state whose data is split in
+chunks, so that the peer downloads the chunks it misses.
+
+This returns true if the peer acknowledged the announcement.
+*/
+func (p *Peer) Announce(ctx context.Context, announcement Announcement) bool {
+	//Skip unreachable peers
+	if p.IsUnreachable() {
+		log.WithFields(log.Fields{"peer": p, "func": "Announce", "key": announcement.Key}).Info("Skip announcing state to unreachable peer")
+		return false
+	}
+
+	log.WithFields(log.Fields{"peer": p, "func": "Announce", "key": announcement.Key}).Info("Announcing state to peer")
+
+	//Try to send the announcement to the peer
+	if p.retry(ctx, func(ctx context.Context) error {
+		return p.config.transport().Announce(ctx, p.Addr, announcement)
+	}) {
+		p.UpdateStatus(true)
+		return true
+	}
+
+	log.WithFields(log.Fields{"peer": p, "func": "Announce", "key": announcement.Key}).Warn("Failed to announce state")
+	p.UpdateStatus(false)
+	return false
+}
+
+/*Drain asks the peer to drain before it leaves the cluster.
+
+This waits until the peer is drained and is not retried, as the peer rejects
+drain requests once it started draining.
+*/
+func (p *Peer) Drain(ctx context.Context) error {
+	log.WithFields(log.Fields{"peer": p, "func": "Drain"}).Info("Asking peer to drain")
+	if err := p.config.transport().Drain(ctx, p.Addr); err != nil {
+		log.WithFields(log.Fields{"peer": p, "func": "Drain"}).Warnf("Failed to drain peer with error: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+/*Get retrieves the latest state for a key from the peer
+
+If the key was deleted, this returns the tombstone state for that key.
+*/
+func (p *Peer) Get(ctx context.Context, key string) (State, error) {
+	state, err := p.config.transport().Get(ctx, p.Addr, key)
 	if err != nil {
-		log.WithFields(log.Fields{"peer": p, "func": "Get"}).Warnf("Failed to retrieve the latest state with error: %s", err.Error())
+		log.WithFields(log.Fields{"peer": p, "func": "Get", "key": key}).Warnf("Failed to retrieve the latest state with error: %s", err.Error())
 		p.UpdateStatus(false)
 		return State{}, err
 	}
-	if res.StatusCode != http.StatusOK {
-		log.WithFields(log.Fields{"peer": p, "func": "Get"}).Warnf("Failed to retrieve the latest state with status code %d", res.StatusCode)
+	if state.Key != key {
+		log.WithFields(log.Fields{"peer": p, "func": "Get", "key": key}).Warnf("Received state for key %q", state.Key)
 		p.UpdateStatus(false)
-		return State{}, errors.New("Failed to retrieve the latest state")
+		return State{}, errors.New("Received state for a different key")
 	}
-
-	state := &State{}
-	if err = json.NewDecoder(res.Body).Decode(state); err != nil {
-		log.WithFields(log.Fields{"peer": p, "func": "Get"}).Warn("Failed to decode state")
+	if !state.VerifyDigest() {
+		log.WithFields(log.Fields{"peer": p, "func": "Get", "state": state}).Warnf("Received state with invalid digest %q", state.Digest)
 		p.UpdateStatus(false)
-		return State{}, errors.New("Failed to decode state")
+		return State{}, errors.New("Received state with an invalid digest")
 	}
 
 	log.WithFields(log.Fields{"peer": p, "func": "Get", "state": state}).Info("Retrieved state")
-	p.LastState = state.Timestamp
 	p.UpdateStatus(true)
-	return *state, nil
+	return state, nil
 }
 
-/*GetPeers retrieves the peers of this peer.
- */
-func (p *Peer) GetPeers() ([]Addr, error) {
-	res, err := http.Get(p.URL() + "/peers")
+/*GetChunk retrieves a chunk of the data of the latest state for a key from the
+peer, and checks that its SHA-256 digest matches hash.
+
+This fails if the digest of the latest state on the peer is not digest.
+*/
+func (p *Peer) GetChunk(ctx context.Context, key, digest string, index int, hash string) ([]byte, error) {
+	chunk, err := p.config.transport().GetChunk(ctx, p.Addr, key, digest, index)
 	if err != nil {
-		log.WithFields(log.Fields{"peer": p, "func": "GetPeers"}).Warnf("Failed to retrieve peers with error: %s", err.Error())
+		log.WithFields(log.Fields{"peer": p, "func": "GetChunk", "key": key, "chunk": index}).Warnf("Failed to retrieve chunk with error: %s", err.Error())
 		p.UpdateStatus(false)
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		log.WithFields(log.Fields{"peer": p, "func": "GetPeers"}).Warnf("Failed to retrieve peers with status code %d", res.StatusCode)
+	if chunkHash(chunk) != hash {
+		log.WithFields(log.Fields{"peer": p, "func": "GetChunk", "key": key, "chunk": index}).Warn("Received chunk with invalid digest")
 		p.UpdateStatus(false)
-		return nil, errors.New("Failed to retrieve peers")
+		return nil, errors.New("Received chunk with an invalid digest")
 	}
 
-	peersResponse := &PeersResponse{}
-	if err = json.NewDecoder(res.Body).Decode(peersResponse); err != nil {
-		log.WithFields(log.Fields{"peer": p, "func": "GetPeers"}).Warn("Failed to decode peers")
+	p.UpdateStatus(true)
+	return chunk, nil
+}
+
+/*GetMetadata retrieves the latest state for a key from the peer, without its
+data.
+
+The digest of the state still covers its data: the data must be set before
+calling VerifyDigest.
+*/
+func (p *Peer) GetMetadata(ctx context.Context, key string) (State, error) {
+	state, err := p.config.transport().GetMetadata(ctx, p.Addr, key)
+	if err != nil {
+		log.WithFields(log.Fields{"peer": p, "func": "GetMetadata", "key": key}).Warnf("Failed to retrieve the latest state with error: %s", err.Error())
+		p.UpdateStatus(false)
+		return State{}, err
+	}
+	if state.Key != key {
+		log.WithFields(log.Fields{"peer": p, "func": "GetMetadata", "key": key}).Warnf("Received state for key %q", state.Key)
+		p.UpdateStatus(false)
+		return State{}, errors.New("Received state for a different key")
+	}
+
+	p.UpdateStatus(true)
+	return state, nil
+}
+
+/*GetPeers retrieves the ID and the peers of this peer.
+ */
+func (p *Peer) GetPeers(ctx context.Context) (PeersResponse, error) {
+	res, err := p.config.transport().GetPeers(ctx, p.Addr)
+	if err != nil {
+		log.WithFields(log.Fields{"peer": p, "func": "GetPeers"}).Warnf("Failed to retrieve peers with error: %s", err.Error())
 		p.UpdateStatus(false)
-		return nil, errors.New("Failed to decode peers")
+		return PeersResponse{}, err
 	}
 
 	log.WithFields(log.Fields{"peer": p, "func": "GetPeers"}).Info("Retrieved peers")
 	p.UpdateStatus(true)
-	return peersResponse.Peers, nil
+	return res, nil
+}
+
+/*GetTree retrieves the hashes of nodes at a level of the Merkle tree of this
+peer.
+*/
+func (p *Peer) GetTree(ctx context.Context, req TreeRequest) (TreeResponse, error) {
+	res, err := p.config.transport().GetTree(ctx, p.Addr, req)
+	if err != nil {
+		log.WithFields(log.Fields{"peer": p, "func": "GetTree", "level": req.Level}).Warnf("Failed to retrieve tree with error: %s", err.Error())
+		p.UpdateStatus(false)
+		return TreeResponse{}, err
+	}
+	if len(req.Nodes) > 0 && len(res.Hashes) != len(req.Nodes) {
+		log.WithFields(log.Fields{"peer": p, "func": "GetTree", "level": req.Level}).Warnf("Received %d hashes for %d nodes", len(res.Hashes), len(req.Nodes))
+		p.UpdateStatus(false)
+		return TreeResponse{}, errors.New("Received an invalid number of hashes")
+	}
+
+	p.UpdateStatus(true)
+	return res, nil
+}
+
+/*Heartbeat records a heartbeat from the peer in its failure detector, after
+the peer responded to a ping directly or through an indirect probe.
+*/
+func (p *Peer) Heartbeat() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.detector == nil {
+		p.detector = p.newDetector()
+	}
+	p.detector.Heartbeat(p.config.clock().Now())
 }
 
-//IsIrrecoverable returns if a peer is considered as permanently unreachable
+//ID returns the ID of the peer, or an empty string if it is not known yet
+func (p *Peer) ID() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.id
+}
+
+/*IsIrrecoverable returns if a peer is considered as permanently unreachable
+
+This is the case if the peer is dead, or if the peer stayed suspect for longer
+than p.config.Node.SuspicionTimeout, in which case the peer is marked as dead.
+Peers with a suspicion level above p.config.Node.PhiIrrecoverable, or that were
+not reached for p.config.Node.MaxPingDelay, are also considered as
+irrecoverable.
+*/
 func (p *Peer) IsIrrecoverable() bool {
-	return p.LastSuccess.Add(p.config.Node.MaxPingDelay).Before(time.Now())
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.config.clock().Now()
+	if p.Liveness == PeerSuspect && p.SuspectSince.Add(p.config.Node.SuspicionTimeout).Before(now) {
+		log.WithFields(log.Fields{"peer": p, "func": "IsIrrecoverable", "incarnation": p.Incarnation}).Warn("Suspect peer is dead")
+		p.Liveness = PeerDead
+	}
+
+	return p.Liveness == PeerDead ||
+		phiExceeds(p.detector.Phi(now), p.config.Node.PhiIrrecoverable) ||
+		p.LastSuccess.Add(p.config.Node.MaxPingDelay).Before(now)
 }
 
 /*IsCtrlIrrecoverable returns if a peer is considered as permanently
 unreachable for a controller node.
 */
 func (p *Peer) IsCtrlIrrecoverable() bool {
-	return p.LastSuccess.Add(p.config.Controller.MaxScanDelay).Before(time.Now())
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.LastSuccess.Add(p.config.Controller.MaxScanDelay).Before(p.config.clock().Now())
 }
 
 /*IsUnreachable returns if the peer is considered unreachable
 
-If the number of attempts to contact the peer exceeds the PeerMaxAttempts
+If the suspicion level of the peer exceeds the PhiUnreachable threshold, or if
+the number of attempts to contact the peer exceeds the PeerMaxAttempts
 threshold, the peer is considered unreachable.
 */
 func (p *Peer) IsUnreachable() bool {
-	return p.Attempts >= p.config.Peer.MaxAttempts
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return phiExceeds(p.detector.Phi(p.config.clock().Now()), p.config.Peer.PhiUnreachable) ||
+		p.Attempts >= p.config.Peer.MaxAttempts
 }
 
-//Ping checks if the peer is reachable and retrieves its status
-func (p *Peer) Ping() {
+/*MarkAlive records that the peer acknowledged a probe with its incarnation
+number, and returns true if the peer is alive.
+
+A suspect peer only becomes alive again if the incarnation number is greater
+than the one it was suspected with, which means that the peer refuted the
+suspicion. Dead peers cannot become alive again.
+*/
+func (p *Peer) MarkAlive(incarnation uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.LastSuccess = p.config.clock().Now()
+	switch p.Liveness {
+	case PeerDead:
+		return false
+	case PeerSuspect:
+		if incarnation <= p.Incarnation {
+			return false
+		}
+		log.WithFields(log.Fields{"peer": p, "func": "MarkAlive", "incarnation": incarnation}).Info("Suspect peer refuted the suspicion")
+	}
+
+	if incarnation > p.Incarnation {
+		p.Incarnation = incarnation
+	}
+	p.Liveness = PeerAlive
+	p.SuspectSince = time.Time{}
+	return true
+}
+
+/*MarkSuspect marks an alive peer as suspect, after it failed both direct and
+indirect probes.
+*/
+func (p *Peer) MarkSuspect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Liveness != PeerAlive {
+		return
+	}
+	log.WithFields(log.Fields{"peer": p, "func": "MarkSuspect", "incarnation": p.Incarnation}).Warn("Peer is suspect")
+	p.Liveness = PeerSuspect
+	p.SuspectSince = p.config.clock().Now()
+}
+
+//Membership returns the liveness and the last known incarnation number of the peer
+func (p *Peer) Membership() (Liveness, uint64) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.Liveness, p.Incarnation
+}
+
+//Phi returns the suspicion level of the peer from its failure detector
+func (p *Peer) Phi() float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.detector.Phi(p.config.clock().Now())
+}
+
+//PeeringRequest returns a request for peering with this peer
+func (p *Peer) PeeringRequest() PeeringRequest {
+	return PeeringRequest{p.Addr, p.ID()}
+}
+
+//PeerCount returns the number of peers of this peer
+func (p *Peer) PeerCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.Peers)
+}
+
+//PeerList returns a copy of the list of peers of this peer
+func (p *Peer) PeerList() []*Peer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return append([]*Peer{}, p.Peers...)
+}
+
+/*Ping checks if the peer is reachable and retrieves its status, piggybacking
+membership events on the request.
+*/
+func (p *Peer) Ping(ctx context.Context, events ...MemberEvent) (StatusResponse, error) {
 	log.WithFields(log.Fields{"peer": p, "func": "Ping"}).Debug("Ping")
 
-	res, err := http.Get(p.URL() + "/status")
+	status, err := p.config.transport().Ping(ctx, p.Addr, events)
 	if err != nil {
 		log.WithFields(log.Fields{"peer": p, "func": "Ping"}).Warnf("Ping failed with error: %s", err)
 		p.UpdateStatus(false)
-		return
-	}
-	if res.StatusCode != http.StatusOK {
-		log.WithFields(log.Fields{"peer": p, "func": "Ping"}).Warnf("Ping failed with status code %d", res.StatusCode)
-		p.UpdateStatus(false)
-		return
+		return StatusResponse{}, err
 	}
 
-	statusResponse := &StatusResponse{}
-	if err := json.NewDecoder(res.Body).Decode(statusResponse); err != nil {
-		log.WithFields(log.Fields{"peer": p, "func": "Ping"}).Warn("Failed to decode response")
+	p.UpdateStatus(true)
+	p.Heartbeat()
+	p.mu.Lock()
+	p.LastRoot = status.Root
+	p.mu.Unlock()
+	return status, nil
+}
+
+/*Probe asks the peer to probe the target on behalf of this node, and returns
+true if the target acknowledged the probe.
+
+If the target is the peer itself, this lets the peer know about a suspicion so
+that it can refute it.
+*/
+func (p *Peer) Probe(ctx context.Context, req ProbeRequest) (ProbeResponse, bool) {
+	res, err := p.config.transport().Probe(ctx, p.Addr, req)
+	if err != nil {
+		log.WithFields(log.Fields{"peer": p, "func": "Probe", "target": req.Target}).Infof("Probe failed with error: %s", err)
 		p.UpdateStatus(false)
-		return
+		return ProbeResponse{}, false
 	}
 
 	p.UpdateStatus(true)
-	p.LastState = statusResponse.LastState
+	return res, res.Ack
 }
 
-//Send sends a message to a peer
-func (p *Peer) Send(state State) {
+/*Send sends a message to a peer, piggybacking membership events on the
+request.
+
+This returns true if the peer acknowledged the message.
+*/
+func (p *Peer) Send(ctx context.Context, state State, events ...MemberEvent) bool {
 	//Skip unreachable peers
 	if p.IsUnreachable() {
 		log.WithFields(log.Fields{"peer": p, "func": "Send", "state": state}).Info("Skip sending state to unreachable peer")
-		return
+		return false
 	}
 
 	log.WithFields(log.Fields{"peer": p, "func": "Send", "state": state}).Info("Sending state to peer")
 
-	//Create a JSON document from the state
-	jsonVal, err := json.Marshal(state)
-	if err != nil {
-		log.WithFields(log.Fields{"peer": p, "func": "Send", "state": state}).Error("Failed to marshal state")
-		return
-	}
-
 	//Try to send the state to the peer
-	for i := 0; i <= p.config.Peer.MaxRetries; i++ {
-		res, err := http.Post(p.URL(), "application/json", bytes.NewBuffer(jsonVal))
-		if err == nil && res.StatusCode == http.StatusOK {
-			p.UpdateStatus(true)
-			return
-		}
-
-		//TODO: add jitter
-		time.Sleep(p.config.Peer.BackoffDuration * (1 << i))
+	if p.retry(ctx, func(ctx context.Context) error {
+		return p.config.transport().Send(ctx, p.Addr, state, events)
+	}) {
+		p.UpdateStatus(true)
+		return true
 	}
 
 	/*Set the status as failed for this message.
@@ -204,28 +513,19 @@ func (p *Peer) Send(state State) {
 	*/
 	log.WithFields(log.Fields{"peer": p, "func": "Send", "state": state}).Warn("Failed to send state")
 	p.UpdateStatus(false)
+	return false
 }
 
 //SendPeeringRequest sends a request for peering to a peer
-func (p *Peer) SendPeeringRequest(addr Addr) {
-	log.WithFields(log.Fields{"peer": p, "func": "SendPeeringRequest"}).Infof("Sending peering request with %v", addr)
-
-	jsonVal, err := json.Marshal(addr)
-	if err != nil {
-		log.WithFields(log.Fields{"peer": p, "func": "SendPeeringRequest", "addr": addr}).Warn("Failed to marshal addr")
-		return
-	}
+func (p *Peer) SendPeeringRequest(ctx context.Context, req PeeringRequest) {
+	log.WithFields(log.Fields{"peer": p, "func": "SendPeeringRequest"}).Infof("Sending peering request with %v", req.Addr)
 
 	//Try to send a peering request to the peer
-	for i := 0; i <= p.config.Peer.MaxRetries; i++ {
-		res, err := http.Post(p.URL()+"/peers", "application/json", bytes.NewBuffer(jsonVal))
-		if err == nil && res.StatusCode == http.StatusOK {
-			p.UpdateStatus(true)
-			return
-		}
-
-		//TODO: add jitter
-		time.Sleep(p.config.Peer.BackoffDuration * (1 >> i))
+	if p.retry(ctx, func(ctx context.Context) error {
+		return p.config.transport().SendPeeringRequest(ctx, p.Addr, req)
+	}) {
+		p.UpdateStatus(true)
+		return
 	}
 
 	log.WithFields(log.Fields{"peer": p, "func": "SendPeeringRequest"}).Warn("Failed to send peering request")
@@ -234,40 +534,108 @@ func (p *Peer) SendPeeringRequest(addr Addr) {
 
 /*SendPeerDeletionRequest sends a request to delete the addr from the list of
 known peers.*/
-func (p *Peer) SendPeerDeletionRequest(addr Addr) {
+func (p *Peer) SendPeerDeletionRequest(ctx context.Context, addr Addr) {
 	log.WithFields(log.Fields{"peer": p, "func": "SendPeerDeletionRequest"}).Infof("Sending peer deletion request to %v", addr)
 
-	jsonVal, err := json.Marshal(addr)
+	//Try to send a peer deletion request to the peer
+	if p.retry(ctx, func(ctx context.Context) error {
+		return p.config.transport().SendPeerDeletionRequest(ctx, p.Addr, addr)
+	}) {
+		p.UpdateStatus(true)
+		return
+	}
+
+	log.WithFields(log.Fields{"peer": p, "func": "SendPeerDeletionRequest"}).Warn("Failed to send peer deletion request")
+	p.UpdateStatus(false)
+}
+
+/*Sync retrieves the status of the keys of the peer in the given leaves of its
+Merkle tree.
+*/
+func (p *Peer) Sync(ctx context.Context, leaves []int) (SyncResponse, error) {
+	res, err := p.config.transport().Sync(ctx, p.Addr, SyncRequest{Leaves: leaves})
 	if err != nil {
-		log.WithFields(log.Fields{"peer": p, "func": "SendPeerDeletionRequest", "addr": addr}).Warnf("Failed to marshal addr: %s", err.Error())
+		log.WithFields(log.Fields{"peer": p, "func": "Sync"}).Warnf("Failed to synchronize with error: %s", err.Error())
+		p.UpdateStatus(false)
+		return SyncResponse{}, err
+	}
+
+	log.WithFields(log.Fields{"peer": p, "func": "Sync"}).Infof("Retrieved the status of %d keys", len(res.Keys))
+	p.UpdateStatus(true)
+	return res, nil
+}
+
+/*Reachable returns true if the last attempt to reach the peer succeeded, or if
+there was no attempt yet.
+*/
+func (p *Peer) Reachable() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.Attempts == 0
+}
+
+//SetID sets the ID of the peer, unless id is empty
+func (p *Peer) SetID(id string) {
+	if id == "" {
 		return
 	}
 
-	//Try to send a peering request to the peer
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.id = id
+}
+
+//SetPeers replaces the list of peers of this peer
+func (p *Peer) SetPeers(peers []*Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.Peers = peers
+}
+
+/*newDetector creates a failure detector expecting heartbeats at every ping
+interval of the node.
+*/
+func (p *Peer) newDetector() *PhiDetector {
+	return NewPhiDetector(p.config.Peer.PhiWindowSize, p.config.Peer.PhiMinStdDev, p.config.Node.PingInterval)
+}
+
+/*retry calls a function until it succeeds, up to p.config.Peer.MaxRetries
+times.
+
+Between two attempts, this waits for an exponential backoff duration. This
+returns false if all attempts failed or if the context was cancelled.
+*/
+func (p *Peer) retry(ctx context.Context, f func(ctx context.Context) error) bool {
 	for i := 0; i <= p.config.Peer.MaxRetries; i++ {
-		req, err := http.NewRequest("DELETE", p.URL()+"/peers", bytes.NewBuffer(jsonVal))
-		req.Header.Add("Content-Type", "application/json")
-		if err != nil {
-			log.WithFields(log.Fields{"peer": p, "func": "SendPeerDeletionRequest", "addr": addr}).Warnf("Failed to create request: %s", err.Error())
-			return
+		err := f(ctx)
+		if err == nil {
+			return true
 		}
+		log.WithFields(log.Fields{"peer": p, "func": "retry"}).Debugf("Attempt %d failed with error: %s", i+1, err.Error())
 
-		res, err := http.DefaultClient.Do(req)
-		if err == nil && res.StatusCode == http.StatusOK {
-			p.UpdateStatus(true)
-			return
+		if i == p.config.Peer.MaxRetries {
+			break
 		}
 
 		//TODO: add jitter
-		time.Sleep(p.config.Peer.BackoffDuration * (1 >> i))
+		if !p.config.sleep(ctx, p.config.Peer.BackoffDuration*(1<<i)) {
+			return false
+		}
 	}
 
-	log.WithFields(log.Fields{"peer": p, "func": "SendPeerDeletionRequest"}).Warn("Failed to send peer deletion request")
-	p.UpdateStatus(false)
+	return false
+}
+
+//KeyURL returns the complete URL for a key on that peer
+func (p *Peer) KeyURL(key string) string {
+	return p.URL() + "/keys/" + url.PathEscape(key)
 }
 
 //String returns a string representation of the peer
-func (p Peer) String() string {
+func (p *Peer) String() string {
 	return p.Addr.String()
 }
 
@@ -283,15 +651,23 @@ If the attempts counter exceeds the PeerMaxAttempts constant, consider the peer
 as failed (see Peer.IsUnreachable).
 */
 func (p *Peer) UpdateStatus(ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if ok {
 		p.Attempts = 0
-		p.LastSuccess = time.Now()
+		p.LastSuccess = p.config.clock().Now()
 	} else {
 		p.Attempts++
 		log.WithFields(log.Fields{"peer": p, "func": "UpdateStatus"}).Infof("%d unsuccessful attempts", p.Attempts)
 	}
 }
 
+//phiExceeds returns true if a suspicion level reaches a threshold, or false if the threshold is 0
+func phiExceeds(level, threshold float64) bool {
+	return threshold > 0 && level >= threshold
+}
+
 //URL returns the complete URL for that peer
 func (p *Peer) URL() string {
 	return fmt.Sprintf("%s://%s:%d", p.config.Protocol, p.Addr.IP, p.Addr.Port)
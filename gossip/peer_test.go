@@ -1,18 +1,21 @@
 package gossip
 
 import (
+	"context"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 //parseURL takes a url generated by httptest.Server and returns an Addr
 func parseURL(url string) Addr {
-	urlParts := strings.Split(url[7:], ":")
+	urlParts := strings.Split(url[strings.Index(url, "://")+3:], ":")
 	ip := urlParts[0]
 	port, _ := strconv.Atoi(urlParts[1])
 
@@ -66,7 +69,7 @@ func TestPeerDelete(t *testing.T) {
 	defer func() { testServer.Close() }()
 	peer := NewPeer(parseURL(testServer.URL), nil)
 
-	peer.SendPeerDeletionRequest(Addr{"127.0.0.1", 8080})
+	peer.SendPeerDeletionRequest(context.Background(), Addr{"127.0.0.1", 8080})
 
 	if !received {
 		t.Errorf("HTTP Server did not receive a request")
@@ -75,27 +78,33 @@ func TestPeerDelete(t *testing.T) {
 
 func TestPeerGet(t *testing.T) {
 	testCases := []State{
-		{0, "Test Data"},
-		{time.Now().UnixNano(), "Other test data"},
+		{Key: "key", Timestamp: Timestamp{Physical: 0}, Data: "Test Data"},
+		{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Data: "Other test data"},
+		{Key: "key", Timestamp: Timestamp{Physical: time.Now().UnixNano()}, Deleted: true},
 	}
 
 	for _, testCase := range testCases {
+		testCase.Digest = testCase.ComputeDigest()
 		func() {
 			p := &Peer{config: DefaultConfig}
 			testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if r.Method != "GET" {
 					t.Errorf("r.Method == %s; want %s", r.Method, "GET")
 				}
-				if r.URL.Path != "/" {
-					t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/")
+				if r.URL.Path != "/keys/key" {
+					t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/keys/key")
+				}
+				if testCase.Deleted {
+					w.WriteHeader(http.StatusGone)
+				} else {
+					w.WriteHeader(http.StatusOK)
 				}
-				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(testCase)
 			}))
 			defer func() { testServer.Close() }()
 			p.Addr = parseURL(testServer.URL)
 
-			state, err := p.Get()
+			state, err := p.Get(context.Background(), "key")
 
 			if err != nil {
 				t.Errorf("err == %v; want %v", err, nil)
@@ -106,9 +115,6 @@ func TestPeerGet(t *testing.T) {
 			if p.Attempts != 0 {
 				t.Errorf("p.Attempts == %d after p.Get(); want 0", p.Attempts)
 			}
-			if p.LastState != testCase.Timestamp {
-				t.Errorf("p.LastState == %d after p.Get(); want %d", p.LastState, testCase.Timestamp)
-			}
 			if state != testCase {
 				t.Errorf("p.Get() == %v; want %v", state, testCase)
 			}
@@ -119,15 +125,16 @@ func TestPeerGet(t *testing.T) {
 func TestPeerGetFail(t *testing.T) {
 	p := &Peer{config: DefaultConfig}
 	pState := State{
-		Timestamp: time.Now().UnixNano(),
+		Key:       "key",
+		Timestamp: Timestamp{Physical: time.Now().UnixNano()},
 		Data:      "Test Data",
 	}
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			t.Errorf("r.Method == %s; want %s", r.Method, "GET")
 		}
-		if r.URL.Path != "/" {
-			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/")
+		if r.URL.Path != "/keys/key" {
+			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/keys/key")
 		}
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(pState)
@@ -135,7 +142,7 @@ func TestPeerGetFail(t *testing.T) {
 	defer func() { testServer.Close() }()
 	p.Addr = parseURL(testServer.URL)
 
-	state, err := p.Get()
+	state, err := p.Get(context.Background(), "key")
 
 	if err == nil {
 		t.Errorf("err == %v", err)
@@ -146,9 +153,6 @@ func TestPeerGetFail(t *testing.T) {
 	if p.Attempts != 1 {
 		t.Errorf("p.Attempts == %d after failed p.Get(); want %d", p.Attempts, 1)
 	}
-	if p.LastState != 0 {
-		t.Errorf("p.LastState == %d after failed p.Get(); want %d", p.LastState, 0)
-	}
 	if state != (State{}) {
 		t.Errorf("p.Get() == %v; want %v", state, State{})
 	}
@@ -159,8 +163,8 @@ func TestPeerGetFail2(t *testing.T) {
 		if r.Method != "GET" {
 			t.Errorf("r.Method == %s; want %s", r.Method, "GET")
 		}
-		if r.URL.Path != "/" {
-			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/")
+		if r.URL.Path != "/keys/key" {
+			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/keys/key")
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("This should not work"))
@@ -168,7 +172,7 @@ func TestPeerGetFail2(t *testing.T) {
 	defer func() { testServer.Close() }()
 	p.Addr = parseURL(testServer.URL)
 
-	state, err := p.Get()
+	state, err := p.Get(context.Background(), "key")
 
 	if err == nil {
 		t.Errorf("err == %v", err)
@@ -179,9 +183,6 @@ func TestPeerGetFail2(t *testing.T) {
 	if p.Attempts != 1 {
 		t.Errorf("p.Attempts == %d after failed p.Get(); want %d", p.Attempts, 1)
 	}
-	if p.LastState != 0 {
-		t.Errorf("p.LastState == %d after failed p.Get(); want %d", p.LastState, 0)
-	}
 	if state != (State{}) {
 		t.Errorf("p.Get() == %v; want %v", state, State{})
 	}
@@ -210,7 +211,7 @@ func TestPeerGetPeers(t *testing.T) {
 			defer func() { testServer.Close() }()
 			p.Addr = parseURL(testServer.URL)
 
-			addrs, err := p.GetPeers()
+			res, err := p.GetPeers(context.Background())
 
 			if err != nil {
 				t.Errorf("err == %v; want %v", err, nil)
@@ -221,8 +222,8 @@ func TestPeerGetPeers(t *testing.T) {
 			if p.Attempts != 0 {
 				t.Errorf("p.Attempts == %d after p.GetPeers(); want 0", p.Attempts)
 			}
-			if len(addrs) != len(testCase.Peers) {
-				t.Errorf("p.GetPeers() == %v; want %v", addrs, testCase.Peers)
+			if len(res.Peers) != len(testCase.Peers) {
+				t.Errorf("p.GetPeers() == %v; want %v", res.Peers, testCase.Peers)
 			}
 		}()
 	}
@@ -245,7 +246,7 @@ func TestPeerGetPeersFail(t *testing.T) {
 	defer func() { testServer.Close() }()
 	p.Addr = parseURL(testServer.URL)
 
-	addrs, err := p.GetPeers()
+	res, err := p.GetPeers(context.Background())
 
 	if err == nil {
 		t.Errorf("err == %v", err)
@@ -256,11 +257,8 @@ func TestPeerGetPeersFail(t *testing.T) {
 	if p.Attempts != 1 {
 		t.Errorf("p.Attempts == %d after failed p.GetPeers(); want %d", p.Attempts, 1)
 	}
-	if p.LastState != 0 {
-		t.Errorf("p.LastState == %d after failed p.GetPeers(); want %d", p.LastState, 0)
-	}
-	if addrs != nil {
-		t.Errorf("p.GetPeers() == %v; want %v", addrs, nil)
+	if res.Peers != nil {
+		t.Errorf("p.GetPeers() == %v; want %v", res.Peers, nil)
 	}
 }
 
@@ -279,7 +277,7 @@ func TestPeerGetPeersFail2(t *testing.T) {
 	defer func() { testServer.Close() }()
 	p.Addr = parseURL(testServer.URL)
 
-	addrs, err := p.GetPeers()
+	res, err := p.GetPeers(context.Background())
 
 	if err == nil {
 		t.Errorf("err == %v", err)
@@ -290,11 +288,8 @@ func TestPeerGetPeersFail2(t *testing.T) {
 	if p.Attempts != 1 {
 		t.Errorf("p.Attempts == %d after failed p.GetPeers(); want %d", p.Attempts, 1)
 	}
-	if p.LastState != 0 {
-		t.Errorf("p.LastState == %d after failed p.GetPeers(); want %d", p.LastState, 0)
-	}
-	if addrs != nil {
-		t.Errorf("p.GetPeers() == %v; want %v", addrs, nil)
+	if res.Peers != nil {
+		t.Errorf("p.GetPeers() == %v; want %v", res.Peers, nil)
 	}
 }
 
@@ -318,6 +313,103 @@ func TestPeerIsIrrecoverable(t *testing.T) {
 	}
 }
 
+func TestPeerIsIrrecoverableSuspect(t *testing.T) {
+	p := &Peer{config: DefaultConfig, LastSuccess: time.Now()}
+	testCases := []struct {
+		Expected     bool
+		Liveness     Liveness
+		SuspectSince time.Time
+	}{
+		{false, PeerAlive, time.Time{}},
+		{false, PeerSuspect, time.Now()},
+		{true, PeerSuspect, time.Now().Add(-p.config.Node.SuspicionTimeout - 5*time.Second)},
+		{true, PeerDead, time.Time{}},
+	}
+
+	for _, testCase := range testCases {
+		p.Liveness = testCase.Liveness
+		p.SuspectSince = testCase.SuspectSince
+		if p.IsIrrecoverable() != testCase.Expected {
+			t.Errorf("p.IsIrrecoverable() == %t with p.Liveness == %v; want %t", !testCase.Expected, testCase.Liveness, testCase.Expected)
+		}
+	}
+
+	//Suspect peers are marked as dead after the suspicion timeout
+	if p.Liveness != PeerDead {
+		t.Errorf("p.Liveness == %v; want %v", p.Liveness, PeerDead)
+	}
+}
+
+func TestPeerMarkAlive(t *testing.T) {
+	p := &Peer{config: DefaultConfig, Incarnation: 2}
+
+	//Alive peers stay alive and track the latest incarnation
+	if !p.MarkAlive(1) {
+		t.Errorf("p.MarkAlive(1) == false; want true")
+	}
+	if p.Incarnation != 2 {
+		t.Errorf("p.Incarnation == %d; want %d", p.Incarnation, 2)
+	}
+
+	//Suspect peers need a greater incarnation to refute the suspicion
+	p.MarkSuspect()
+	if p.Liveness != PeerSuspect || p.SuspectSince.IsZero() {
+		t.Fatalf("p.Liveness == %v, p.SuspectSince == %v after p.MarkSuspect(); want %v", p.Liveness, p.SuspectSince, PeerSuspect)
+	}
+	if p.MarkAlive(2) {
+		t.Errorf("p.MarkAlive(2) == true; want false")
+	}
+	if !p.MarkAlive(3) {
+		t.Errorf("p.MarkAlive(3) == false; want true")
+	}
+	if p.Liveness != PeerAlive || p.Incarnation != 3 || !p.SuspectSince.IsZero() {
+		t.Errorf("p.Liveness == %v, p.Incarnation == %d, p.SuspectSince == %v; want %v, %d, zero", p.Liveness, p.Incarnation, p.SuspectSince, PeerAlive, 3)
+	}
+
+	//Dead peers cannot become alive again
+	p.Liveness = PeerDead
+	if p.MarkAlive(4) {
+		t.Errorf("p.MarkAlive(4) == true for a dead peer; want false")
+	}
+}
+
+func TestPeerPhi(t *testing.T) {
+	testCases := []struct {
+		Name             string
+		PhiUnreachable   float64
+		PhiIrrecoverable float64
+		Silence          time.Duration
+		Unreachable      bool
+		Irrecoverable    bool
+	}{
+		{"recent", 8, 32, 0, false, false},
+		{"silent", 8, 32, 4 * time.Minute, true, true},
+		{"unreachable", 8, 1e6, 4 * time.Minute, true, false},
+		{"disabled", 0, 0, 4 * time.Minute, false, false},
+	}
+
+	for _, testCase := range testCases {
+		config := *DefaultConfig
+		config.Peer.PhiUnreachable = testCase.PhiUnreachable
+		config.Node.PhiIrrecoverable = testCase.PhiIrrecoverable
+		p := NewPeer(Addr{"127.0.0.1", 8080}, &config)
+
+		//Heartbeats every ping interval, then silence
+		now := time.Now()
+		p.detector = p.newDetector()
+		for i := 10; i >= 0; i-- {
+			p.detector.Heartbeat(now.Add(-testCase.Silence - time.Duration(i)*config.Node.PingInterval))
+		}
+
+		if p.IsUnreachable() != testCase.Unreachable {
+			t.Errorf("[%s] p.IsUnreachable() == %t with phi %f; want %t", testCase.Name, !testCase.Unreachable, p.Phi(), testCase.Unreachable)
+		}
+		if p.IsIrrecoverable() != testCase.Irrecoverable {
+			t.Errorf("[%s] p.IsIrrecoverable() == %t with phi %f; want %t", testCase.Name, !testCase.Irrecoverable, p.Phi(), testCase.Irrecoverable)
+		}
+	}
+}
+
 func TestPeerIsCtrlIrrecoverable(t *testing.T) {
 	p := &Peer{config: DefaultConfig}
 	testCases := []struct {
@@ -359,10 +451,11 @@ func TestPeerIsUnreachable(t *testing.T) {
 
 func TestPeerPing(t *testing.T) {
 	testCases := []struct {
-		LastState int64
+		LastRoot string
 	}{
-		{0},
-		{time.Now().UnixNano()},
+		{""},
+		{"0000000000000000"},
+		{"0123456789abcdef"},
 	}
 
 	for _, testCase := range testCases {
@@ -377,13 +470,13 @@ func TestPeerPing(t *testing.T) {
 				}
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(StatusResponse{
-					LastState: testCase.LastState,
+					Root: testCase.LastRoot,
 				})
 			}))
 			defer func() { testServer.Close() }()
 			p.Addr = parseURL(testServer.URL)
 
-			p.Ping()
+			p.Ping(context.Background())
 
 			if p.LastSuccess == (time.Time{}) {
 				t.Errorf("p.LastSuccess == %v after p.Ping()", p.LastSuccess)
@@ -391,8 +484,8 @@ func TestPeerPing(t *testing.T) {
 			if p.Attempts != 0 {
 				t.Errorf("p.Attempts == %d after p.Ping(); want 0", p.Attempts)
 			}
-			if p.LastState != testCase.LastState {
-				t.Errorf("p.LastState == %d after p.Ping(); want %d", p.LastState, testCase.LastState)
+			if p.LastRoot != testCase.LastRoot {
+				t.Errorf("p.LastRoot == %q after p.Ping(); want %q", p.LastRoot, testCase.LastRoot)
 			}
 		}()
 	}
@@ -409,16 +502,16 @@ func TestPeerPingFail(t *testing.T) {
 		}
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(StatusResponse{
-			LastState: 5000,
+			Root: "0123456789abcdef",
 		})
 	}))
 	defer func() { testServer.Close() }()
 	p.Addr = parseURL(testServer.URL)
 
-	p.Ping()
+	p.Ping(context.Background())
 
-	if p.LastState != 0 {
-		t.Errorf("p.LastState == %d after failed p.Ping(); want %d", p.LastState, 0)
+	if p.LastRoot != "" {
+		t.Errorf("p.LastRoot == %q after failed p.Ping(); want %q", p.LastRoot, "")
 	}
 	if p.LastSuccess != (time.Time{}) {
 		t.Errorf("p.LastSuccess == %v after failed p.Ping(); want %v", p.LastSuccess, time.Time{})
@@ -443,10 +536,10 @@ func TestPeerPingFail2(t *testing.T) {
 	defer func() { testServer.Close() }()
 	p.Addr = parseURL(testServer.URL)
 
-	p.Ping()
+	p.Ping(context.Background())
 
-	if p.LastState != 0 {
-		t.Errorf("p.LastState == %d after failed p.Ping(); want %d", p.LastState, 0)
+	if p.LastRoot != "" {
+		t.Errorf("p.LastRoot == %q after failed p.Ping(); want %q", p.LastRoot, "")
 	}
 	if p.LastSuccess != (time.Time{}) {
 		t.Errorf("p.LastSuccess == %v after failed p.Ping(); want %d", p.LastSuccess, 0)
@@ -462,8 +555,8 @@ func TestPeerSend(t *testing.T) {
 		if r.Method != "POST" {
 			t.Errorf("r.Method == %s; want %s", r.Method, "POST")
 		}
-		if r.URL.Path != "/" {
-			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/")
+		if r.URL.Path != "/keys/key" {
+			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/keys/key")
 		}
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(Response{
@@ -473,11 +566,12 @@ func TestPeerSend(t *testing.T) {
 	defer func() { testServer.Close() }()
 	p.Addr = parseURL(testServer.URL)
 	state := State{
-		Timestamp: time.Now().UnixNano(),
+		Key:       "key",
+		Timestamp: Timestamp{Physical: time.Now().UnixNano()},
 		Data:      "Test Data",
 	}
 
-	p.Send(state)
+	p.Send(context.Background(), state)
 	if p.LastSuccess == (time.Time{}) {
 		t.Errorf("p.LastSuccess == %v after p.Send()", p.LastSuccess)
 	}
@@ -492,8 +586,8 @@ func TestPeerSendFail(t *testing.T) {
 		if r.Method != "POST" {
 			t.Errorf("r.Method == %s; want %s", r.Method, "POST")
 		}
-		if r.URL.Path != "/" {
-			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/")
+		if r.URL.Path != "/keys/key" {
+			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/keys/key")
 		}
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(Response{
@@ -503,11 +597,12 @@ func TestPeerSendFail(t *testing.T) {
 	defer func() { testServer.Close() }()
 	p.Addr = parseURL(testServer.URL)
 	state := State{
-		Timestamp: time.Now().UnixNano(),
+		Key:       "key",
+		Timestamp: Timestamp{Physical: time.Now().UnixNano()},
 		Data:      "Test Data",
 	}
 
-	p.Send(state)
+	p.Send(context.Background(), state)
 
 	if p.LastSuccess != (time.Time{}) {
 		t.Errorf("p.LastSuccess == %v after failed p.Send(); want %d", p.LastSuccess, 0)
@@ -523,8 +618,8 @@ func TestPeerSendUnreachable(t *testing.T) {
 		if r.Method != "POST" {
 			t.Errorf("r.Method == %s; want %s", r.Method, "POST")
 		}
-		if r.URL.Path != "/" {
-			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/")
+		if r.URL.Path != "/keys/key" {
+			t.Errorf("r.URL.PATH == %s; want %s", r.URL.Path, "/keys/key")
 		}
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(Response{
@@ -535,11 +630,12 @@ func TestPeerSendUnreachable(t *testing.T) {
 	p.Addr = parseURL(testServer.URL)
 	p.Attempts = DefaultConfig.Peer.MaxAttempts
 	state := State{
-		Timestamp: time.Now().UnixNano(),
+		Key:       "key",
+		Timestamp: Timestamp{Physical: time.Now().UnixNano()},
 		Data:      "Test Data",
 	}
 
-	p.Send(state)
+	p.Send(context.Background(), state)
 
 	if p.LastSuccess != (time.Time{}) {
 		t.Errorf("p.LastSuccess == %v after unreachable p.Send(); want %d", p.LastSuccess, 0)
@@ -567,7 +663,7 @@ func TestPeerSendPeeringRequest(t *testing.T) {
 	p.Addr = parseURL(testServer.URL)
 	addr := Addr{"127.0.0.1", 8080}
 
-	p.SendPeeringRequest(addr)
+	p.SendPeeringRequest(context.Background(), PeeringRequest{Addr: addr})
 
 	if p.LastSuccess == (time.Time{}) {
 		t.Errorf("p.LastSuccess == %v after p.SendPeeringRequest()", p.LastSuccess)
@@ -595,7 +691,7 @@ func TestPeerSendPeeringRequestFail(t *testing.T) {
 	p.Addr = parseURL(testServer.URL)
 	addr := Addr{"127.0.0.1", 8080}
 
-	p.SendPeeringRequest(addr)
+	p.SendPeeringRequest(context.Background(), PeeringRequest{Addr: addr})
 
 	if p.LastSuccess != (time.Time{}) {
 		t.Errorf("p.LastSuccess == %v after failed p.SendPeeringRequest(); want %d", p.LastSuccess, 0)
@@ -625,3 +721,158 @@ func TestPeerUpdateStatus(t *testing.T) {
 		t.Errorf("p.Attempts == %d after p.UpdateStatus(); want %d", p.Attempts, 0)
 	}
 }
+
+func TestPeerKeyURL(t *testing.T) {
+	p := NewPeer(Addr{"127.0.0.1", 8080}, nil)
+	testCases := []struct {
+		Key      string
+		Expected string
+	}{
+		{"key", "http://127.0.0.1:8080/keys/key"},
+		{"some key", "http://127.0.0.1:8080/keys/some%20key"},
+		{"a/b", "http://127.0.0.1:8080/keys/a%2Fb"},
+	}
+
+	for _, testCase := range testCases {
+		if p.KeyURL(testCase.Key) != testCase.Expected {
+			t.Errorf("p.KeyURL(%q) == %s; want %s", testCase.Key, p.KeyURL(testCase.Key), testCase.Expected)
+		}
+	}
+}
+
+func TestPeerGetWrongKey(t *testing.T) {
+	p := &Peer{config: DefaultConfig}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(State{Key: "other", Timestamp: Timestamp{Physical: 1}, Data: "Test Data"})
+	}))
+	defer func() { testServer.Close() }()
+	p.Addr = parseURL(testServer.URL)
+
+	_, err := p.Get(context.Background(), "key")
+
+	if err == nil {
+		t.Errorf("err == %v", err)
+	}
+	if p.Attempts != 1 {
+		t.Errorf("p.Attempts == %d after failed p.Get(); want %d", p.Attempts, 1)
+	}
+}
+
+func TestPeerGetInvalidDigest(t *testing.T) {
+	p := &Peer{config: DefaultConfig}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "Test Data", Digest: "digest"})
+	}))
+	defer func() { testServer.Close() }()
+	p.Addr = parseURL(testServer.URL)
+
+	_, err := p.Get(context.Background(), "key")
+
+	if err == nil {
+		t.Errorf("err == %v", err)
+	}
+	if p.Attempts != 1 {
+		t.Errorf("p.Attempts == %d after failed p.Get(); want %d", p.Attempts, 1)
+	}
+}
+
+func TestPeerPingTimeout(t *testing.T) {
+	config := *DefaultConfig
+	config.Peer.RequestTimeout = 50 * time.Millisecond
+	done := make(chan bool)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer func() { testServer.Close() }()
+	defer close(done)
+
+	p := NewPeer(parseURL(testServer.URL), &config)
+	start := time.Now()
+	_, err := p.Ping(context.Background())
+
+	if err == nil {
+		t.Errorf("err == %v after p.Ping() on a hung peer", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("p.Ping() took %v; want less than %v", elapsed, time.Second)
+	}
+	if p.Attempts != 1 {
+		t.Errorf("p.Attempts == %d after failed p.Ping(); want %d", p.Attempts, 1)
+	}
+}
+
+func TestPeerSendCancel(t *testing.T) {
+	config := *DefaultConfig
+	config.Peer.MaxRetries = 3
+	config.Peer.BackoffDuration = time.Hour
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer func() { testServer.Close() }()
+
+	p := NewPeer(parseURL(testServer.URL), &config)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if p.Send(ctx, State{Key: "key", Data: "TestPeerSendCancel"}) {
+		t.Errorf("p.Send() == true; want false")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("p.Send() took %v after cancellation; want less than %v", elapsed, time.Second)
+	}
+}
+
+func TestPeerKeepAlive(t *testing.T) {
+	var conns int32
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(StatusResponse{})
+	}))
+	testServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	testServer.Start()
+	defer func() { testServer.Close() }()
+
+	//Requests must reuse the same connection
+	config := *DefaultConfig
+	p := NewPeer(parseURL(testServer.URL), &config)
+	for i := 0; i < 5; i++ {
+		p.Ping(context.Background())
+	}
+
+	if c := atomic.LoadInt32(&conns); c != 1 {
+		t.Errorf("Server received %d connections; want %d", c, 1)
+	}
+}
+
+func TestPeerClient(t *testing.T) {
+	var received bool
+	config := *DefaultConfig
+	config.Client = &http.Client{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			received = true
+			return httptest.NewRecorder().Result(), nil
+		}),
+	}
+
+	p := NewPeer(Addr{"127.0.0.1", 8080}, &config)
+	p.Send(context.Background(), State{Key: "key", Data: "TestPeerClient"})
+
+	if !received {
+		t.Errorf("Injected client did not receive a request")
+	}
+}
+
+//roundTripFunc is an http.RoundTripper implemented by a function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+//RoundTrip calls the function
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -0,0 +1,130 @@
+package gossip
+
+import (
+	"math"
+	"time"
+)
+
+/*PhiDetector is a phi-accrual failure detector.
+
+Instead of a fixed timeout, the detector learns the distribution of the
+intervals between heartbeats of a peer, and returns a suspicion level phi that
+grows with the time elapsed since the last heartbeat. A phi of 1 means that
+there is a 10% chance that the peer is still alive, 2 means 1%, 3 means 0.1%,
+and so on.
+
+Heartbeat intervals are assumed to follow a normal distribution, with a
+standard deviation of at least minStdDev. As intervals between pings barely
+vary on stable networks, this prevents a single late heartbeat from raising the
+suspicion level.
+
+A PhiDetector is not safe for concurrent use.
+*/
+type PhiDetector struct {
+	//intervals is a ring buffer of the last intervals between heartbeats, in seconds
+	intervals []float64
+	//next is the position of the next interval in the ring buffer
+	next int
+	//sum is the sum of all intervals
+	sum float64
+	//sumSquares is the sum of the squares of all intervals
+	sumSquares float64
+	//last is the time of the last heartbeat
+	last time.Time
+
+	//windowSize is the maximum number of intervals
+	windowSize int
+	//minStdDev is the minimum standard deviation of intervals, in seconds
+	minStdDev float64
+}
+
+/*NewPhiDetector creates a new PhiDetector keeping up to windowSize intervals
+between heartbeats.
+
+If firstInterval is not zero, the detector starts with two intervals around
+firstInterval, so that it can compute a suspicion level before receiving
+heartbeats.
+*/
+func NewPhiDetector(windowSize int, minStdDev, firstInterval time.Duration) *PhiDetector {
+	if windowSize < 2 {
+		windowSize = 2
+	}
+
+	d := &PhiDetector{
+		intervals:  make([]float64, 0, windowSize),
+		windowSize: windowSize,
+		minStdDev:  minStdDev.Seconds(),
+	}
+	if firstInterval > 0 {
+		d.add(firstInterval.Seconds() * 0.75)
+		d.add(firstInterval.Seconds() * 1.25)
+	}
+	return d
+}
+
+/*Heartbeat records a heartbeat at the given time.
+
+The first heartbeat only sets the starting point for the next interval.
+*/
+func (d *PhiDetector) Heartbeat(now time.Time) {
+	if !d.last.IsZero() && now.After(d.last) {
+		d.add(now.Sub(d.last).Seconds())
+	}
+	if now.After(d.last) {
+		d.last = now
+	}
+}
+
+/*Phi returns the suspicion level at the given time.
+
+This returns 0 if the detector has not received any heartbeat or does not know
+any interval yet.
+*/
+func (d *PhiDetector) Phi(now time.Time) float64 {
+	if d == nil || d.last.IsZero() || len(d.intervals) == 0 {
+		return 0
+	}
+
+	n := float64(len(d.intervals))
+	mean := d.sum / n
+	stdDev := math.Sqrt(math.Max(d.sumSquares/n-mean*mean, 0))
+	if stdDev < d.minStdDev {
+		stdDev = d.minStdDev
+	}
+	if stdDev <= 0 {
+		stdDev = 1e-3
+	}
+
+	return phi(now.Sub(d.last).Seconds(), mean, stdDev)
+}
+
+//add adds an interval to the ring buffer, replacing the oldest one if it is full
+func (d *PhiDetector) add(interval float64) {
+	if len(d.intervals) < d.windowSize {
+		d.intervals = append(d.intervals, interval)
+	} else {
+		old := d.intervals[d.next]
+		d.sum -= old
+		d.sumSquares -= old * old
+		d.intervals[d.next] = interval
+		d.next = (d.next + 1) % d.windowSize
+	}
+	d.sum += interval
+	d.sumSquares += interval * interval
+}
+
+/*phi returns -log10 of the probability that a heartbeat arrives after
+elapsed, for normally distributed intervals.
+
+This uses a logistic approximation of the cumulative distribution function,
+computed in the log domain so that the result stays finite when the
+probability is too small to be represented.
+*/
+func phi(elapsed, mean, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	a := y * (1.5976 + 0.070566*y*y)
+	if a > 0 {
+		return a/math.Ln10 + math.Log10(1+math.Exp(-a))
+	}
+	return -math.Log10(1 - 1/(1+math.Exp(-a)))
+}
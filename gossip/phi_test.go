@@ -0,0 +1,83 @@
+package gossip
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPhiDetector(t *testing.T) {
+	d := NewPhiDetector(10, 100*time.Millisecond, 0)
+	start := time.Now()
+
+	//No heartbeat yet
+	if phi := d.Phi(start); phi != 0 {
+		t.Errorf("d.Phi() == %f before any heartbeat; want 0", phi)
+	}
+
+	//Heartbeats every second
+	for i := 0; i <= 20; i++ {
+		d.Heartbeat(start.Add(time.Duration(i) * time.Second))
+	}
+	last := start.Add(20 * time.Second)
+	if len(d.intervals) != 10 {
+		t.Errorf("len(d.intervals) == %d; want %d", len(d.intervals), 10)
+	}
+
+	testCases := []struct {
+		Elapsed time.Duration
+		Min     float64
+		Max     float64
+	}{
+		{0, 0, 0.1},
+		{time.Second, 0, 1},
+		{2 * time.Second, 8, math.Inf(1)},
+		{time.Hour, 1000, math.Inf(1)},
+	}
+	for _, testCase := range testCases {
+		phi := d.Phi(last.Add(testCase.Elapsed))
+		if phi < testCase.Min || phi > testCase.Max || math.IsInf(phi, 0) || math.IsNaN(phi) {
+			t.Errorf("d.Phi() == %f after %v; want between %f and %f", phi, testCase.Elapsed, testCase.Min, testCase.Max)
+		}
+	}
+
+	//Phi grows with the time since the last heartbeat
+	prev := 0.0
+	for elapsed := time.Duration(0); elapsed < 5*time.Second; elapsed += 100 * time.Millisecond {
+		phi := d.Phi(last.Add(elapsed))
+		if phi < prev {
+			t.Errorf("d.Phi() == %f after %v; want >= %f", phi, elapsed, prev)
+		}
+		prev = phi
+	}
+}
+
+func TestPhiDetectorFirstInterval(t *testing.T) {
+	d := NewPhiDetector(10, time.Second, 30*time.Second)
+	start := time.Now()
+	d.Heartbeat(start)
+
+	if phi := d.Phi(start.Add(30 * time.Second)); phi > 1 {
+		t.Errorf("d.Phi() == %f after one interval; want <= 1", phi)
+	}
+	if phi := d.Phi(start.Add(5 * time.Minute)); phi < 8 {
+		t.Errorf("d.Phi() == %f after ten intervals; want >= 8", phi)
+	}
+}
+
+func TestPhiDetectorAdaptive(t *testing.T) {
+	stable := NewPhiDetector(100, 10*time.Millisecond, 0)
+	jittery := NewPhiDetector(100, 10*time.Millisecond, 0)
+	start := time.Now()
+	for i := 0; i <= 50; i++ {
+		stable.Heartbeat(start.Add(time.Duration(i) * time.Second))
+		jitter := time.Duration(i%2) * 500 * time.Millisecond
+		jittery.Heartbeat(start.Add(time.Duration(i)*time.Second + jitter))
+	}
+
+	//The same delay is more suspicious on a stable network
+	elapsed := 2 * time.Second
+	if s, j := stable.Phi(start.Add(50*time.Second+elapsed)), jittery.Phi(start.Add(50*time.Second+elapsed)); s <= j {
+		t.Errorf("stable.Phi() == %f, jittery.Phi() == %f; want stable > jittery", s, j)
+	}
+}
@@ -0,0 +1,26 @@
+package gossip
+
+/*ConflictResolver decides which state to keep when two states for the same key
+share the same timestamp but hold different data.
+
+Implementations must be deterministic: every node must pick the same state
+regardless of the order in which it received them, otherwise nodes could end
+up permanently divergent.
+*/
+type ConflictResolver interface {
+	//Resolve returns the state to keep between the current and proposed states
+	Resolve(current, proposed State) State
+}
+
+/*DigestResolver is a ConflictResolver that keeps the state with the greatest
+content digest.
+*/
+type DigestResolver struct{}
+
+//Resolve returns the state with the greatest content digest
+func (r DigestResolver) Resolve(current, proposed State) State {
+	if proposed.ComputeDigest() > current.ComputeDigest() {
+		return proposed
+	}
+	return current
+}
@@ -0,0 +1,30 @@
+package gossip
+
+import (
+	"testing"
+)
+
+func TestDigestResolver(t *testing.T) {
+	testCases := []struct {
+		A State
+		B State
+	}{
+		{State{Key: "key", Data: "a"}, State{Key: "key", Data: "b"}},
+		{State{Key: "key", Data: "a"}, State{Key: "key", Deleted: true}},
+		{State{Key: "key", Data: "a"}, State{Key: "key", Data: "a"}},
+	}
+
+	r := DigestResolver{}
+	for i, testCase := range testCases {
+		ab := r.Resolve(testCase.A, testCase.B)
+		ba := r.Resolve(testCase.B, testCase.A)
+
+		//The result must not depend on the order of the states
+		if ab != ba {
+			t.Errorf("r.Resolve() == %v and %v for test case %d; want the same state", ab, ba, i)
+		}
+		if ab != testCase.A && ab != testCase.B {
+			t.Errorf("r.Resolve() == %v for test case %d; want one of the states", ab, i)
+		}
+	}
+}
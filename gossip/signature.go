@@ -0,0 +1,107 @@
+package gossip
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+/*signedPayload returns the bytes covered by the signature of a state.
+
+This is the JSON array [key, physical, logical, node, deleted, digest], so that
+writers in any language can reproduce it. The digest is always computed from
+the data, and is the digest of an empty string for tombstones.
+*/
+func (s State) signedPayload() []byte {
+	if s.Deleted {
+		s.Data = ""
+	}
+	payload, _ := json.Marshal([]interface{}{
+		s.Key,
+		s.Timestamp.Physical,
+		s.Timestamp.Logical,
+		s.Timestamp.Node,
+		s.Deleted,
+		s.ComputeDigest(),
+	})
+	return payload
+}
+
+/*Sign signs the state with the private key of a writer.
+
+As nodes only stamp states that do not carry a timestamp, and a signature must
+cover the timestamp, this sets the timestamp to the current time if it is
+missing.
+*/
+func (s *State) Sign(key ed25519.PrivateKey) {
+	if s.Timestamp.IsZero() {
+		s.Timestamp = Timestamp{Physical: time.Now().UnixNano()}
+	}
+	s.Digest = s.ComputeDigest()
+	s.Signer = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	s.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, s.signedPayload()))
+}
+
+//VerifySignature returns true if the state carries a valid signature from its signer
+func (s State) VerifySignature() bool {
+	publicKey, err := base64.StdEncoding.DecodeString(s.Signer)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(publicKey, s.signedPayload(), signature)
+}
+
+/*TrustedKeys is a set of base64-encoded Ed25519 public keys that are allowed to
+sign states.
+
+An empty set disables signature checks.
+*/
+type TrustedKeys map[string]bool
+
+//NewTrustedKeys creates a set of trusted keys from base64-encoded public keys
+func NewTrustedKeys(keys []string) (TrustedKeys, error) {
+	t := make(TrustedKeys)
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		publicKey, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 public key " + key)
+		}
+		t[key] = true
+	}
+	return t, nil
+}
+
+/*Check returns an error if the state is not signed by a trusted key, or if it
+does not carry the timestamp covered by its signature.
+
+This always succeeds if the set is empty.
+*/
+func (t TrustedKeys) Check(state State) error {
+	if len(t) == 0 {
+		return nil
+	}
+	if state.Signer == "" || state.Signature == "" {
+		return errors.New("State is not signed")
+	}
+	//Nodes stamp states without a timestamp, which would invalidate the signature
+	if state.Timestamp.IsZero() {
+		return errors.New("Signed state has no timestamp")
+	}
+	if !t[state.Signer] {
+		return errors.New("State is signed by an untrusted key")
+	}
+	if !state.VerifySignature() {
+		return errors.New("State has an invalid signature")
+	}
+	return nil
+}
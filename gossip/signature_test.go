@@ -0,0 +1,121 @@
+package gossip
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+)
+
+func TestStateSign(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	testCases := []State{
+		{Key: "key", Data: "TestStateSign"},
+		{Key: "key", Timestamp: Timestamp{Physical: 1, Logical: 2, Node: "node"}, Data: "TestStateSign"},
+		{Key: "key", Timestamp: Timestamp{Physical: 1}, Deleted: true},
+	}
+
+	for i, testCase := range testCases {
+		testCase.Sign(key)
+
+		if testCase.Timestamp.IsZero() {
+			t.Errorf("testCase.Timestamp is zero after Sign() for test case %d", i)
+		}
+		if !testCase.VerifySignature() {
+			t.Errorf("testCase.VerifySignature() == false for test case %d; want true", i)
+		}
+	}
+}
+
+func TestStateVerifySignature(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	state := State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestStateVerifySignature"}
+	state.Sign(key)
+
+	//Tombstones are signed without data
+	tombstone := State{Key: "key", Timestamp: Timestamp{Physical: 1}, Deleted: true}
+	tombstone.Sign(key)
+	tombstone.Data = "Ignored data"
+
+	otherSigner := state
+	otherSigner.Signer = base64.StdEncoding.EncodeToString(otherKey.Public().(ed25519.PublicKey))
+
+	testCases := []struct {
+		State    State
+		Expected bool
+	}{
+		{state, true},
+		{tombstone, true},
+		{State{Key: "other", Timestamp: state.Timestamp, Data: state.Data, Signer: state.Signer, Signature: state.Signature}, false},
+		{State{Key: state.Key, Timestamp: Timestamp{Physical: 2}, Data: state.Data, Signer: state.Signer, Signature: state.Signature}, false},
+		{State{Key: state.Key, Timestamp: state.Timestamp, Data: "Other data", Signer: state.Signer, Signature: state.Signature}, false},
+		{State{Key: state.Key, Timestamp: state.Timestamp, Deleted: true, Signer: state.Signer, Signature: state.Signature}, false},
+		{otherSigner, false},
+		{State{Key: state.Key, Timestamp: state.Timestamp, Data: state.Data, Signer: "invalid", Signature: state.Signature}, false},
+		{State{Key: state.Key, Timestamp: state.Timestamp, Data: state.Data}, false},
+	}
+
+	for i, testCase := range testCases {
+		if valid := testCase.State.VerifySignature(); valid != testCase.Expected {
+			t.Errorf("VerifySignature() == %t for test case %d; want %t", valid, i, testCase.Expected)
+		}
+	}
+}
+
+func TestNewTrustedKeys(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(nil)
+	encoded := base64.StdEncoding.EncodeToString(publicKey)
+
+	testCases := []struct {
+		Keys  []string
+		Error bool
+	}{
+		{nil, false},
+		{[]string{""}, false},
+		{[]string{encoded}, false},
+		{[]string{"invalid"}, true},
+		{[]string{base64.StdEncoding.EncodeToString([]byte("short"))}, true},
+	}
+
+	for i, testCase := range testCases {
+		if _, err := NewTrustedKeys(testCase.Keys); (err != nil) != testCase.Error {
+			t.Errorf("NewTrustedKeys() returned error %v for test case %d", err, i)
+		}
+	}
+}
+
+func TestTrustedKeysCheck(t *testing.T) {
+	publicKey, key, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	trustedKeys, _ := NewTrustedKeys([]string{base64.StdEncoding.EncodeToString(publicKey)})
+
+	signed := State{Key: "key", Data: "TestTrustedKeysCheck"}
+	signed.Sign(key)
+	untrusted := State{Key: "key", Data: "TestTrustedKeysCheck"}
+	untrusted.Sign(otherKey)
+	tampered := signed
+	tampered.Data = "Tampered data"
+	//A valid signature of a state without a timestamp
+	unstamped := State{Key: "key", Data: "TestTrustedKeysCheck", Signer: base64.StdEncoding.EncodeToString(publicKey)}
+	unstamped.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, unstamped.signedPayload()))
+
+	testCases := []struct {
+		TrustedKeys TrustedKeys
+		State       State
+		Error       bool
+	}{
+		{TrustedKeys{}, State{Key: "key", Data: "TestTrustedKeysCheck"}, false},
+		{trustedKeys, signed, false},
+		{trustedKeys, State{Key: "key", Data: "TestTrustedKeysCheck"}, true},
+		{trustedKeys, untrusted, true},
+		{trustedKeys, tampered, true},
+		{trustedKeys, unstamped, true},
+	}
+
+	for i, testCase := range testCases {
+		if err := testCase.TrustedKeys.Check(testCase.State); (err != nil) != testCase.Error {
+			t.Errorf("Check() returned error %v for test case %d", err, i)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package sim
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nmoutschen/gossip/gossip"
+)
+
+/*Clock is a virtual gossip.Clock that only moves forward when the simulation
+advances it.
+
+Timers created with After fire in order of their deadline. Timers sharing the
+same deadline fire together, so that workers of nodes started at the same time
+run in the same step.
+
+Nodes use the view returned by Tracked, which counts fired timers as tasks.
+*/
+type Clock struct {
+	//now is the current virtual time
+	now time.Time
+	//timers is the list of pending timers, sorted by deadline
+	timers []*timer
+	//mu protects access to now and timers
+	mu sync.Mutex
+}
+
+//timer is a pending call to After
+type timer struct {
+	//deadline is the virtual time at which the timer fires
+	deadline time.Time
+	//ch is the channel returned by After
+	ch chan time.Time
+	//tracker counts the timer as a task once it fires, if not nil
+	tracker gossip.Tracker
+}
+
+//NewClock creates a new virtual clock starting at the given time
+func NewClock(start time.Time) *Clock {
+	return &Clock{
+		now: start,
+	}
+}
+
+//Now returns the current virtual time
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+//After returns a channel that receives the virtual time once d has elapsed
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	return c.after(d, nil)
+}
+
+/*Tracked returns a view of the clock adding a task to tracker every time one
+of its timers fires, as required by gossip.Tracker.
+*/
+func (c *Clock) Tracked(tracker gossip.Tracker) gossip.Clock {
+	return trackedClock{c, tracker}
+}
+
+//after creates a timer firing once d has elapsed, tracked by tracker if not nil
+func (c *Clock) after(d time.Duration, tracker gossip.Tracker) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		if tracker != nil {
+			tracker.Add(1)
+		}
+		ch <- c.now
+		return ch
+	}
+
+	t := &timer{deadline: c.now.Add(d), ch: ch, tracker: tracker}
+	i := sort.Search(len(c.timers), func(i int) bool {
+		return c.timers[i].deadline.After(t.deadline)
+	})
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+
+	return ch
+}
+
+/*Step moves the clock to the deadline of the earliest pending timer and fires
+all timers with that deadline.
+
+This returns false without moving the clock if there are no pending timers
+with a deadline before or at until.
+*/
+func (c *Clock) Step(until time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.timers) == 0 || c.timers[0].deadline.After(until) {
+		return false
+	}
+
+	c.now = c.timers[0].deadline
+	for len(c.timers) > 0 && c.timers[0].deadline.Equal(c.now) {
+		if c.timers[0].tracker != nil {
+			c.timers[0].tracker.Add(1)
+		}
+		c.timers[0].ch <- c.now
+		c.timers = c.timers[1:]
+	}
+	return true
+}
+
+/*Advance moves the clock forward by d, firing all timers that expire in the
+meantime in order.
+
+This does not wait for the goroutines woken up by the timers. See
+Cluster.Advance for that.
+*/
+func (c *Clock) Advance(d time.Duration) {
+	until := c.Now().Add(d)
+	for c.Step(until) {
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until.After(c.now) {
+		c.now = until
+	}
+}
+
+//Pending returns the number of pending timers
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
+
+//trackedClock is a view of a Clock whose timers are counted as tasks
+type trackedClock struct {
+	//clock is the underlying clock
+	clock *Clock
+	//tracker counts fired timers as tasks
+	tracker gossip.Tracker
+}
+
+//Now returns the current virtual time
+func (c trackedClock) Now() time.Time {
+	return c.clock.Now()
+}
+
+//After returns a channel that receives the virtual time once d has elapsed
+func (c trackedClock) After(d time.Duration) <-chan time.Time {
+	return c.clock.after(d, c.tracker)
+}
@@ -0,0 +1,76 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockAfter(t *testing.T) {
+	c := NewClock(Start)
+
+	ch1 := c.After(2 * time.Second)
+	ch2 := c.After(time.Second)
+	ch3 := c.After(time.Second)
+
+	if c.Pending() != 3 {
+		t.Errorf("c.Pending() == %d; want 3", c.Pending())
+	}
+
+	if !c.Step(Start.Add(time.Minute)) {
+		t.Fatalf("c.Step() == false; want true")
+	}
+	if !c.Now().Equal(Start.Add(time.Second)) {
+		t.Errorf("c.Now() == %v; want %v", c.Now(), Start.Add(time.Second))
+	}
+	for i, ch := range []<-chan time.Time{ch2, ch3} {
+		select {
+		case <-ch:
+		default:
+			t.Errorf("Timer %d did not fire", i+2)
+		}
+	}
+	select {
+	case <-ch1:
+		t.Errorf("Timer 1 fired before its deadline")
+	default:
+	}
+
+	if c.Step(Start.Add(time.Second)) {
+		t.Errorf("c.Step() == true; want false")
+	}
+}
+
+func TestClockAfterZero(t *testing.T) {
+	c := NewClock(Start)
+
+	select {
+	case now := <-c.After(0):
+		if !now.Equal(Start) {
+			t.Errorf("now == %v; want %v", now, Start)
+		}
+	default:
+		t.Errorf("Timer did not fire")
+	}
+	if c.Pending() != 0 {
+		t.Errorf("c.Pending() == %d; want 0", c.Pending())
+	}
+}
+
+func TestClockAdvance(t *testing.T) {
+	c := NewClock(Start)
+	ch := c.After(time.Second)
+
+	c.Advance(time.Minute)
+
+	if !c.Now().Equal(Start.Add(time.Minute)) {
+		t.Errorf("c.Now() == %v; want %v", c.Now(), Start.Add(time.Minute))
+	}
+	select {
+	case now := <-ch:
+		if !now.Equal(Start.Add(time.Second)) {
+			t.Errorf("now == %v; want %v", now, Start.Add(time.Second))
+		}
+	default:
+		t.Errorf("Timer did not fire")
+	}
+}
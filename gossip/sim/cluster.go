@@ -0,0 +1,423 @@
+/*Package sim runs simulated clusters of nodes and a controller in a single
+process.
+
+Nodes and the controller communicate through an in-memory Network instead of
+real sockets, and their workers are scheduled by a virtual Clock. This allows
+tests to simulate hours of gossip in a few seconds.
+
+Time is fully controlled by the simulation: the clock only moves once every
+goroutine, message and fired timer of the nodes and the controller is done,
+regardless of the load of the machine. Random choices, fault injection and node
+IDs are seeded, so that a simulation takes the same decisions across runs.
+
+The goroutines of nodes still run concurrently within a single step of the
+clock, so messages sent during the same step can be delivered in any order.
+Tests should check properties that eventually hold, such as convergence, rather
+than exact sequences of messages.
+*/
+package sim
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/nmoutschen/gossip/gossip"
+)
+
+/*Start is the virtual time at which clusters start. Using a fixed time makes
+timestamps reproducible across runs.
+*/
+var Start = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+/*Seed is the seed of the random choices of clusters created with a
+configuration without Rand.
+*/
+var Seed int64 = 1
+
+//Cluster is a set of simulated nodes and a controller
+type Cluster struct {
+	//Clock is the virtual clock shared by all nodes and the controller
+	Clock *Clock
+	//Network is the in-memory network connecting nodes and the controller
+	Network *Network
+	//Nodes is the list of nodes in the cluster
+	Nodes []*gossip.Node
+	//Controller is the controller of the cluster
+	Controller *gossip.Controller
+	/*Faults are injected in all messages between nodes and the controller.
+	Rules and partitions expire based on the virtual clock.*/
+	Faults *gossip.Faults
+
+	//config is the base configuration for nodes and the controller
+	config *gossip.Config
+	//started is the number of nodes started, used to give each node a new address
+	started int
+	//rand seeds the random choices of nodes and faults, and generates node IDs
+	rand *rand.Rand
+	//tasks counts the tasks in progress in the cluster
+	tasks *tasks
+	//trackers is the tracker of each node and of the controller, by address
+	trackers map[gossip.Addr]*tracker
+}
+
+/*NewCluster creates a cluster with a controller and the given number of nodes,
+and starts their workers.
+
+Nodes are not peered with each other. Use Register to let the controller
+connect them, or Connect to peer them manually.
+*/
+func NewCluster(size int, config *gossip.Config) *Cluster {
+	if config == nil {
+		config = gossip.DefaultConfig
+	}
+
+	seed := Seed
+	if config.Rand != nil {
+		seed = config.Rand.Int63()
+	}
+	c := &Cluster{
+		Clock:    NewClock(Start),
+		Network:  NewNetwork(),
+		rand:     rand.New(rand.NewSource(seed)),
+		tasks:    newTasks(),
+		trackers: make(map[gossip.Addr]*tracker),
+	}
+	c.Faults = gossip.NewFaults(c.Clock)
+	c.Faults.Seed(c.rand.Int63())
+	base := *config
+	base.Faults = c.Faults
+	c.config = &base
+
+	//Start the controller
+	ctrlAddr := gossip.Addr{IP: "10.255.0.1", Port: c.config.Controller.Port}
+	ctrlConfig := c.newConfig(ctrlAddr)
+	ctrlConfig.Controller.IP = ctrlAddr.IP
+	c.Controller = gossip.NewController(ctrlConfig)
+	c.Network.Register(ctrlAddr, c.Controller.Handler())
+	c.Controller.StartWorkers(context.Background())
+
+	for i := 0; i < size; i++ {
+		c.AddNode()
+	}
+
+	return c
+}
+
+/*AddNode creates a new node, registers it on the network and starts its
+workers.
+*/
+func (c *Cluster) AddNode() *gossip.Node {
+	n := c.startNode("")
+	c.Nodes = append(c.Nodes, n)
+	return n
+}
+
+/*Move crashes node i and restarts it with the same ID on a new address, as if
+its process was rescheduled on another host.
+
+The node does not know any peer after moving. Use Register or Connect to let
+other nodes know about its new address.
+*/
+func (c *Cluster) Move(i int) *gossip.Node {
+	old := c.Nodes[i]
+	c.Network.Unregister(old.Addr())
+
+	//Stop the node without notifying its peers
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	old.Stop(ctx)
+	c.trackers[old.Addr()].Close()
+
+	c.Nodes[i] = c.startNode(old.ID)
+	return c.Nodes[i]
+}
+
+/*startNode creates a new node with the given ID on a new address, registers it
+on the network and starts its workers. If id is empty, the node gets a new ID.
+*/
+func (c *Cluster) startNode(id string) *gossip.Node {
+	i := c.started
+	c.started++
+	addr := gossip.Addr{IP: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), Port: c.config.Node.Port}
+	if id == "" {
+		b := make([]byte, 16)
+		c.rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+
+	config := c.newConfig(addr)
+	config.Node.ID = id
+	config.Node.IP = addr.IP
+	config.Node.DataDir = ""
+	n := gossip.NewNode(config)
+	c.Network.Register(addr, n.Handler())
+	n.StartWorkers(context.Background())
+	return n
+}
+
+/*newConfig creates the configuration of a node or controller, with its own
+tracker and source of random numbers.
+*/
+func (c *Cluster) newConfig(addr gossip.Addr) *gossip.Config {
+	tracker := c.tasks.tracker()
+	c.trackers[addr] = tracker
+
+	config := *c.config
+	config.Protocol = "http"
+	config.Clock = c.Clock.Tracked(tracker)
+	config.Tracker = tracker
+	config.Rand = rand.New(rand.NewSource(c.rand.Int63()))
+	config.Transport = c.Network.Transport(addr, &config)
+	return &config
+}
+
+/*Advance moves the virtual clock forward by d.
+
+Every time timers fire, this waits until the cluster settles before moving the
+clock further, so that workers woken up by the timers can run.
+*/
+func (c *Cluster) Advance(d time.Duration) {
+	until := c.Clock.Now().Add(d)
+	for c.Clock.Step(until) {
+		c.Settle()
+	}
+	c.Clock.Advance(until.Sub(c.Clock.Now()))
+	c.Settle()
+}
+
+/*Eventually advances the virtual clock by steps of step until cond returns
+true, or until timeout has elapsed on the virtual clock.
+
+This returns the result of the last call to cond.
+*/
+func (c *Cluster) Eventually(cond func() bool, step, timeout time.Duration) bool {
+	deadline := c.Clock.Now().Add(timeout)
+	for {
+		if cond() {
+			return true
+		}
+		if !c.Clock.Now().Before(deadline) {
+			return false
+		}
+		c.Advance(step)
+	}
+}
+
+/*Settle waits until no task is in progress in the nodes and the controller.
+
+Workers waiting for a timer, such as requests delayed by an injected latency,
+are not in progress: they only run once the clock moves forward.
+*/
+func (c *Cluster) Settle() {
+	c.tasks.Wait()
+}
+
+/*Register sends the address of node i to the controller, so that the
+controller connects it to other nodes during its next scan.
+*/
+func (c *Cluster) Register(i int) error {
+	return c.post(c.ControllerAddr(), "/peers", c.Nodes[i].PeeringRequest())
+}
+
+//RegisterAll sends the address of every node to the controller
+func (c *Cluster) RegisterAll() error {
+	for i := range c.Nodes {
+		if err := c.Register(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*Connect sends a peering request to node i with node j. Node i then sends a
+peering request back to node j.
+*/
+func (c *Cluster) Connect(i, j int) error {
+	return c.post(c.Nodes[i].Addr(), "/peers", c.Nodes[j].PeeringRequest())
+}
+
+/*Drain asks the controller to drain node i. The node keeps running, but leaves
+its peers once drained.
+*/
+func (c *Cluster) Drain(i int) error {
+	return c.post(c.ControllerAddr(), "/nodes/"+c.Nodes[i].Addr().String()+"/drain", nil)
+}
+
+//Write sends a new state for a key to node i, as a client would
+func (c *Cluster) Write(i int, key, data string) error {
+	return c.post(c.Nodes[i].Addr(), "/keys/"+key, gossip.State{Data: data})
+}
+
+//Crash makes node i unreachable, as if its process had crashed
+func (c *Cluster) Crash(i int) {
+	c.Network.Unregister(c.Nodes[i].Addr())
+}
+
+//Recover makes node i reachable again after a crash
+func (c *Cluster) Recover(i int) {
+	c.Network.Register(c.Nodes[i].Addr(), c.Nodes[i].Handler())
+}
+
+/*Stop stops all nodes and the controller, and waits for their workers to
+exit.
+
+Faults are removed first, so that requests sent by nodes while they stop do not
+wait on the virtual clock.
+*/
+func (c *Cluster) Stop() error {
+	c.Faults.Reset()
+
+	var err error
+	for _, n := range c.Nodes {
+		if nErr := n.Stop(context.Background()); nErr != nil && err == nil {
+			err = nErr
+		}
+	}
+	if cErr := c.Controller.Stop(context.Background()); cErr != nil && err == nil {
+		err = cErr
+	}
+	for _, tracker := range c.trackers {
+		tracker.Close()
+	}
+	return err
+}
+
+/*Converged returns true if all nodes in the list, or all nodes in the cluster
+if the list is empty, hold the same state for a key.
+*/
+func (c *Cluster) Converged(key string, nodes ...int) bool {
+	if len(nodes) == 0 {
+		for i := range c.Nodes {
+			nodes = append(nodes, i)
+		}
+	}
+
+	first, ok := c.Nodes[nodes[0]].GetState(key)
+	if !ok {
+		return false
+	}
+	for _, i := range nodes[1:] {
+		state, ok := c.Nodes[i].GetState(key)
+		if !ok || state.Timestamp != first.Timestamp || state.Digest != first.Digest {
+			return false
+		}
+	}
+	return true
+}
+
+/*MembershipConverged returns true if all nodes in the list know that all other
+nodes in the list are alive, and do not consider any node outside of the list
+as alive.
+*/
+func (c *Cluster) MembershipConverged(nodes ...int) bool {
+	expected := make(map[gossip.Addr]bool)
+	for _, addr := range c.Addrs(nodes...) {
+		expected[addr] = true
+	}
+
+	for _, i := range nodes {
+		alive := 0
+		for _, member := range c.Nodes[i].Members() {
+			if member.Liveness != gossip.PeerAlive {
+				continue
+			}
+			if !expected[member.Addr] {
+				return false
+			}
+			alive++
+		}
+		if alive != len(expected) {
+			return false
+		}
+	}
+	return true
+}
+
+/*Checker creates a convergence checker polling the nodes known to the
+controller.
+
+The checker is not affected by faults, and its polls are not scheduled: call
+Poll or Run on the checker from the test.
+*/
+func (c *Cluster) Checker() *gossip.Checker {
+	addr := gossip.Addr{IP: "10.255.0.2", Port: c.config.Controller.Port}
+	c.Network.Register(addr, http.NotFoundHandler())
+
+	config := *c.config
+	config.Protocol = "http"
+	config.Clock = c.Clock
+	config.Tracker = nil
+	config.Faults = nil
+	config.Client = c.Network.Client(addr)
+	config.Transport = c.Network.Transport(addr, &config)
+	return gossip.NewChecker(gossip.ControllerNodes(c.ControllerAddr(), &config), &config)
+}
+
+/*Partition splits nodes in groups that cannot communicate with each other,
+until heal has elapsed on the virtual clock. If heal is zero, the partition
+never heals.
+
+Nodes that are not part of any group, as well as the controller, can still
+communicate with all nodes.
+*/
+func (c *Cluster) Partition(heal time.Duration, groups ...[]int) {
+	partition := gossip.Partition{}
+	for _, group := range groups {
+		partition.Groups = append(partition.Groups, c.Addrs(group...))
+	}
+	if heal > 0 {
+		partition.Until = c.Clock.Now().Add(heal)
+	}
+	c.Faults.AddPartition(partition)
+}
+
+/*Range returns the indexes of nodes from start (inclusive) to end
+(exclusive), to build groups of nodes.
+*/
+func Range(start, end int) []int {
+	nodes := make([]int, 0, end-start)
+	for i := start; i < end; i++ {
+		nodes = append(nodes, i)
+	}
+	return nodes
+}
+
+//Addrs returns the addresses of nodes
+func (c *Cluster) Addrs(nodes ...int) []gossip.Addr {
+	addrs := make([]gossip.Addr, 0, len(nodes))
+	for _, i := range nodes {
+		addrs = append(addrs, c.Nodes[i].Addr())
+	}
+	return addrs
+}
+
+//ControllerAddr returns the address of the controller
+func (c *Cluster) ControllerAddr() gossip.Addr {
+	return gossip.Addr{IP: c.Controller.IP, Port: c.Controller.Port}
+}
+
+//post sends a JSON document to an address on behalf of a client
+func (c *Cluster) post(addr gossip.Addr, path string, value interface{}) error {
+	jsonVal, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	client := c.Network.Client(addr)
+	res, err := client.Post(fmt.Sprintf("http://%s%s", addr, path), "application/json", bytes.NewBuffer(jsonVal))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("Request to " + addr.String() + path + " failed with status " + res.Status)
+	}
+	return nil
+}
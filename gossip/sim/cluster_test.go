@@ -0,0 +1,581 @@
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nmoutschen/gossip/gossip"
+)
+
+//newConfig returns a configuration for clusters used in tests
+func newConfig() *gossip.Config {
+	config := *gossip.DefaultConfig
+	config.Controller.ScanInterval = 10 * time.Second
+	config.Node.PingInterval = 5 * time.Second
+	config.Node.MaxPingDelay = time.Minute
+	return &config
+}
+
+func TestClusterConvergence(t *testing.T) {
+	c := NewCluster(100, newConfig())
+	defer c.Stop()
+
+	if err := c.RegisterAll(); err != nil {
+		t.Fatalf("c.RegisterAll() returned an error: %s", err.Error())
+	}
+	//Let the controller connect all nodes
+	c.Advance(time.Minute)
+
+	if err := c.Write(0, "key", "value"); err != nil {
+		t.Fatalf("c.Write() returned an error: %s", err.Error())
+	}
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Cluster did not converge after %v", c.Clock.Now().Sub(Start))
+	}
+}
+
+func TestClusterSeeds(t *testing.T) {
+	config := newConfig()
+	config.Node.Seeds = []string{"10.0.0.1:8080"}
+	config.Node.Controllers = []string{fmt.Sprintf("10.255.0.1:%d", config.Controller.Port)}
+	c := NewCluster(5, config)
+	defer c.Stop()
+
+	//Nodes join the seed and register with the controller on their own
+	c.Advance(time.Minute)
+
+	registered := 0
+	c.Controller.Peers.Range(func(key, value interface{}) bool {
+		registered++
+		return true
+	})
+	if registered != 5 {
+		t.Errorf("Controller knows %d nodes; want 5", registered)
+	}
+	for i, n := range c.Nodes {
+		if peers := n.PeerList(); len(peers) == 0 {
+			t.Errorf("len(c.Nodes[%d].Peers) == 0; want > 0", i)
+		}
+	}
+
+	if err := c.Write(0, "key", "value"); err != nil {
+		t.Fatalf("c.Write() returned an error: %s", err.Error())
+	}
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Cluster did not converge after %v", c.Clock.Now().Sub(Start))
+	}
+}
+
+func TestClusterConnect(t *testing.T) {
+	c := NewCluster(2, newConfig())
+	defer c.Stop()
+
+	if err := c.Connect(0, 1); err != nil {
+		t.Fatalf("c.Connect() returned an error: %s", err.Error())
+	}
+	c.Settle()
+
+	for i, n := range c.Nodes {
+		if peers := n.PeerList(); len(peers) != 1 {
+			t.Errorf("len(c.Nodes[%d].Peers) == %d; want 1", i, len(peers))
+		}
+	}
+}
+
+func TestClusterCrashRecover(t *testing.T) {
+	c := NewCluster(3, newConfig())
+	defer c.Stop()
+	c.Connect(0, 1)
+	c.Connect(1, 2)
+	c.Settle()
+
+	c.Crash(2)
+	if err := c.Write(0, "key", "value"); err != nil {
+		t.Fatalf("c.Write() returned an error: %s", err.Error())
+	}
+	c.Advance(10 * time.Second)
+
+	if !c.Converged("key", 0, 1) {
+		t.Errorf("Nodes 0 and 1 did not converge")
+	}
+	if _, ok := c.Nodes[2].GetState("key"); ok {
+		t.Errorf("Crashed node received the state")
+	}
+
+	//The node recovers before its peers consider it irrecoverable
+	c.Recover(2)
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, 30*time.Second) {
+		t.Errorf("Recovered node did not converge")
+	}
+}
+
+func TestClusterCrashIrrecoverable(t *testing.T) {
+	c := NewCluster(2, newConfig())
+	defer c.Stop()
+	c.Connect(0, 1)
+	c.Settle()
+
+	c.Crash(1)
+	c.Advance(2 * time.Minute)
+
+	if peers := c.Nodes[0].PeerList(); len(peers) != 0 {
+		t.Errorf("len(c.Nodes[0].Peers) == %d; want 0", len(peers))
+	}
+}
+
+func TestClusterFlakyLink(t *testing.T) {
+	c := NewCluster(3, newConfig())
+	defer c.Stop()
+	c.Connect(0, 1)
+	c.Connect(0, 2)
+	c.Connect(1, 2)
+	c.Settle()
+
+	//Drop all messages between nodes 0 and 1, which can still reach each other through node 2
+	c.Faults.AddRule(gossip.FaultRule{From: c.Addrs(0), To: c.Addrs(1), Drop: 1})
+	c.Faults.AddRule(gossip.FaultRule{From: c.Addrs(1), To: c.Addrs(0), Drop: 1})
+	c.Advance(3 * time.Minute)
+
+	for _, i := range []int{0, 1} {
+		peers := c.Nodes[i].PeerList()
+		if len(peers) != 2 {
+			t.Errorf("len(c.Nodes[%d].Peers) == %d; want 2", i, len(peers))
+		}
+		for _, peer := range peers {
+			if liveness, _ := peer.Membership(); liveness != gossip.PeerAlive {
+				t.Errorf("Peer %v of node %d is %v; want %v", peer, i, liveness, gossip.PeerAlive)
+			}
+		}
+	}
+}
+
+func TestClusterRefuteSuspicion(t *testing.T) {
+	c := NewCluster(3, newConfig())
+	defer c.Stop()
+	c.Connect(0, 1)
+	c.Connect(0, 2)
+	c.Connect(1, 2)
+	c.Settle()
+
+	//Node 2 becomes suspect while it is unreachable
+	c.Crash(2)
+	c.Advance(10 * time.Second)
+	for _, peer := range c.Nodes[0].PeerList() {
+		if liveness, _ := peer.Membership(); peer.Addr == c.Nodes[2].Addr() && liveness != gossip.PeerSuspect {
+			t.Errorf("Node 2 is %v; want %v", liveness, gossip.PeerSuspect)
+		}
+	}
+
+	//Node 2 refutes the suspicion once it recovers
+	c.Recover(2)
+	c.Advance(10 * time.Second)
+	if incarnation := c.Nodes[2].Incarnation(); incarnation == 0 {
+		t.Errorf("c.Nodes[2].Incarnation() == 0; want > 0")
+	}
+	for _, i := range []int{0, 1} {
+		for _, peer := range c.Nodes[i].PeerList() {
+			if liveness, _ := peer.Membership(); liveness != gossip.PeerAlive {
+				t.Errorf("Peer %v of node %d is %v; want %v", peer, i, liveness, gossip.PeerAlive)
+			}
+		}
+	}
+}
+
+func TestClusterMembership(t *testing.T) {
+	c := NewCluster(20, newConfig())
+	defer c.Stop()
+	c.RegisterAll()
+
+	//Every node learns about all nodes, not only its peers
+	if !c.Eventually(func() bool { return c.MembershipConverged(Range(0, 20)...) }, 5*time.Second, 5*time.Minute) {
+		for i, n := range c.Nodes {
+			t.Logf("Node %d knows %d members", i, len(n.Members()))
+		}
+		t.Errorf("Membership did not converge after %v", c.Clock.Now().Sub(Start))
+	}
+}
+
+func TestClusterControllerDown(t *testing.T) {
+	c := NewCluster(10, newConfig())
+	defer c.Stop()
+	c.RegisterAll()
+	if !c.Eventually(func() bool { return c.MembershipConverged(Range(0, 10)...) }, 5*time.Second, 5*time.Minute) {
+		t.Fatalf("Membership did not converge after %v", c.Clock.Now().Sub(Start))
+	}
+
+	//Nodes replace crashed peers on their own while the controller is down
+	c.Network.Unregister(c.ControllerAddr())
+	for i := 7; i < 10; i++ {
+		c.Crash(i)
+	}
+	alive := Range(0, 7)
+	crashed := make(map[gossip.Addr]bool)
+	for _, addr := range c.Addrs(Range(7, 10)...) {
+		crashed[addr] = true
+	}
+
+	replaced := func() bool {
+		for _, i := range alive {
+			peers := c.Nodes[i].PeerList()
+			if len(peers) < c.config.Node.MinPeers {
+				return false
+			}
+			for _, peer := range peers {
+				if crashed[peer.Addr] {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if !c.Eventually(replaced, 5*time.Second, 10*time.Minute) {
+		for _, i := range alive {
+			t.Logf("Node %d has peers %v", i, c.Nodes[i].PeerList())
+		}
+		t.Errorf("Nodes did not replace crashed peers after %v", c.Clock.Now().Sub(Start))
+	}
+
+	if err := c.Write(0, "key", "value"); err != nil {
+		t.Fatalf("c.Write() returned an error: %s", err.Error())
+	}
+	if !c.Eventually(func() bool { return c.Converged("key", alive...) }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Alive nodes did not converge without the controller")
+	}
+}
+
+func TestClusterShortPartition(t *testing.T) {
+	c := NewCluster(10, newConfig())
+	defer c.Stop()
+	c.RegisterAll()
+	c.Advance(time.Minute)
+
+	//The partition heals before nodes consider peers on the other side irrecoverable
+	c.Partition(20*time.Second, Range(0, 5), Range(5, 10))
+	c.Write(0, "key", "value")
+	c.Advance(10 * time.Second)
+
+	if _, ok := c.Nodes[0].GetState("key"); !ok {
+		t.Errorf("Node 0 did not apply the state")
+	}
+	for i := 5; i < 10; i++ {
+		if _, ok := c.Nodes[i].GetState("key"); ok {
+			t.Errorf("Node %d received the state across the partition", i)
+		}
+	}
+
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, time.Minute) {
+		t.Errorf("Cluster did not converge after the partition healed")
+	}
+}
+
+func TestClusterLongPartition(t *testing.T) {
+	c := NewCluster(10, newConfig())
+	defer c.Stop()
+	c.RegisterAll()
+	c.Advance(time.Minute)
+
+	//Nodes consider peers on the other side irrecoverable, but not the controller
+	c.Partition(3*time.Minute, Range(0, 5), Range(5, 10))
+	c.Write(0, "key", "value")
+	c.Advance(3 * time.Minute)
+
+	for _, i := range Range(0, 5) {
+		for _, peer := range c.Nodes[i].PeerList() {
+			for _, addr := range c.Addrs(Range(5, 10)...) {
+				if peer.Addr == addr && peer.IsIrrecoverable() {
+					t.Errorf("Node %d did not remove irrecoverable peer %v", i, addr)
+				}
+			}
+		}
+	}
+
+	//The controller reconnects both sides after the partition heals
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Cluster did not converge after the partition healed")
+	}
+}
+
+func TestClusterMessageLoss(t *testing.T) {
+	c := NewCluster(20, newConfig())
+	defer c.Stop()
+	c.RegisterAll()
+	c.Advance(time.Minute)
+
+	c.Faults.Seed(1)
+	c.Faults.AddRule(gossip.FaultRule{
+		Drop:    0.2,
+		Latency: gossip.Latency{Mean: 100 * time.Millisecond},
+	})
+	c.Write(0, "key", "value")
+
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Cluster did not converge with message loss")
+	}
+}
+
+func TestClusterChecker(t *testing.T) {
+	c := NewCluster(20, newConfig())
+	defer c.Stop()
+	c.RegisterAll()
+	c.Advance(time.Minute)
+	checker := c.Checker()
+	ctx := context.Background()
+
+	c.Partition(20*time.Second, Range(0, 10), Range(10, 20))
+	c.Write(0, "key", "value")
+	converged := func() bool {
+		checker.Poll(ctx)
+		return checker.Report().Converged == 1
+	}
+	if !c.Eventually(converged, time.Second, 2*time.Minute) {
+		t.Fatalf("Cluster did not converge")
+	}
+
+	report := checker.Report()
+	if len(report.Writes) != 1 {
+		t.Fatalf("len(report.Writes) == %d; want 1", len(report.Writes))
+	}
+	if wr := report.Writes[0]; wr.Reached != 20 || wr.MaxHops < 1 || len(wr.Unreached) != 0 {
+		t.Errorf("report.Writes[0] == %+v; want reached by 20 nodes in at least 1 hop", wr)
+	}
+	//The write cannot reach the other side before the partition heals
+	if report.P50 < 20*time.Second {
+		t.Errorf("report.P50 == %v; want at least 20s", report.P50)
+	}
+	if len(report.Regressions) != 0 {
+		t.Errorf("report.Regressions == %v; want none", report.Regressions)
+	}
+}
+
+func TestClusterSeed(t *testing.T) {
+	a := NewCluster(3, newConfig())
+	defer a.Stop()
+	b := NewCluster(3, newConfig())
+	defer b.Stop()
+	config := newConfig()
+	config.Rand = rand.New(rand.NewSource(Seed + 1))
+	other := NewCluster(3, config)
+	defer other.Stop()
+
+	//Clusters with the same seed give the same IDs to their nodes
+	for i := range a.Nodes {
+		if a.Nodes[i].ID != b.Nodes[i].ID {
+			t.Errorf("b.Nodes[%d].ID == %s; want %s", i, b.Nodes[i].ID, a.Nodes[i].ID)
+		}
+		if a.Nodes[i].ID == other.Nodes[i].ID {
+			t.Errorf("other.Nodes[%d].ID == %s with another seed; want a different ID", i, other.Nodes[i].ID)
+		}
+	}
+}
+
+func TestClusterStop(t *testing.T) {
+	c := NewCluster(5, newConfig())
+	c.RegisterAll()
+	c.Advance(time.Minute)
+
+	if err := c.Stop(); err != nil {
+		t.Fatalf("c.Stop() == %v; want nil", err)
+	}
+
+	//Stopped nodes reject requests instead of blocking once their queues are full
+	client := c.Network.Client(c.ControllerAddr())
+	rejected := 0
+	for i := 0; i < 20; i++ {
+		res, err := client.Post(fmt.Sprintf("http://%v/peers", c.Nodes[0].Addr()), "application/json", strings.NewReader(`{"ip": "10.0.0.2", "port": 8080}`))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusServiceUnavailable {
+			rejected++
+		}
+	}
+	if rejected == 0 {
+		t.Errorf("rejected == 0; want > 0")
+	}
+}
+
+//simResolver resolves every name to the addresses of the first nodes of a cluster
+type simResolver struct {
+	nodes int
+}
+
+func (r *simResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	ips := make([]string, r.nodes)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.0.%d", i+1)
+	}
+	return ips, nil
+}
+
+func (r *simResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return "", nil, errors.New("No SRV records")
+}
+
+func TestClusterDiscovery(t *testing.T) {
+	config := newConfig()
+	config.DNS = &simResolver{nodes: 5}
+	config.Node.Discovery = []string{"gossip.sim:8080"}
+	config.Controller.Discovery = []string{"gossip.sim:8080"}
+	c := NewCluster(5, config)
+	defer c.Stop()
+
+	//Nodes and the controller find each other through DNS
+	c.Advance(time.Minute)
+
+	registered := 0
+	c.Controller.Peers.Range(func(key, value interface{}) bool {
+		registered++
+		return true
+	})
+	if registered != 5 {
+		t.Errorf("Controller knows %d nodes; want 5", registered)
+	}
+	for i, n := range c.Nodes {
+		if peers := n.PeerList(); len(peers) < config.Node.MinPeers {
+			t.Errorf("len(c.Nodes[%d].Peers) == %d; want >= %d", i, len(peers), config.Node.MinPeers)
+		}
+	}
+
+	if err := c.Write(0, "key", "value"); err != nil {
+		t.Fatalf("c.Write() returned an error: %s", err.Error())
+	}
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Cluster did not converge after %v", c.Clock.Now().Sub(Start))
+	}
+}
+
+func TestClusterNodeMoved(t *testing.T) {
+	c := NewCluster(5, newConfig())
+	defer c.Stop()
+
+	if err := c.RegisterAll(); err != nil {
+		t.Fatalf("c.RegisterAll() returned an error: %s", err.Error())
+	}
+	c.Advance(time.Minute)
+
+	//Node 0 restarts on a new address with the same ID
+	oldAddr := c.Nodes[0].Addr()
+	n := c.Move(0)
+	if err := c.Register(0); err != nil {
+		t.Fatalf("c.Register() returned an error: %s", err.Error())
+	}
+	c.Advance(time.Minute)
+
+	//The controller tracks the new address instead of adding a node
+	registered := 0
+	c.Controller.Peers.Range(func(key, value interface{}) bool {
+		registered++
+		peer := value.(*gossip.Peer)
+		if peer.Addr == oldAddr {
+			t.Errorf("Controller still knows node 0 at its former address %v", oldAddr)
+		}
+		if peer.ID() == n.ID && peer.Addr != n.Addr() {
+			t.Errorf("Controller knows node 0 at %v; want %v", peer.Addr, n.Addr())
+		}
+		return true
+	})
+	if registered != 5 {
+		t.Errorf("Controller knows %d nodes; want 5", registered)
+	}
+
+	//Other nodes eventually drop the former address
+	dropped := func() bool {
+		for _, node := range c.Nodes {
+			if _, found := node.FindPeer(oldAddr); found {
+				return false
+			}
+		}
+		return true
+	}
+	if !c.Eventually(dropped, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Nodes still peer with the former address of node 0 after %v", c.Clock.Now().Sub(Start))
+	}
+
+	if err := c.Write(1, "key", "value"); err != nil {
+		t.Fatalf("c.Write() returned an error: %s", err.Error())
+	}
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Cluster did not converge after %v", c.Clock.Now().Sub(Start))
+	}
+}
+
+func TestClusterDrain(t *testing.T) {
+	c := NewCluster(6, newConfig())
+	defer c.Stop()
+
+	if err := c.RegisterAll(); err != nil {
+		t.Fatalf("c.RegisterAll() returned an error: %s", err.Error())
+	}
+	if err := c.Write(1, "key", "value"); err != nil {
+		t.Fatalf("c.Write() returned an error: %s", err.Error())
+	}
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, 5*time.Minute) {
+		t.Fatalf("Cluster did not converge after %v", c.Clock.Now().Sub(Start))
+	}
+
+	//A state written right before draining reaches the other nodes
+	if err := c.Write(0, "drained", "value"); err != nil {
+		t.Fatalf("c.Write() returned an error: %s", err.Error())
+	}
+	if err := c.Drain(0); err != nil {
+		t.Fatalf("c.Drain() returned an error: %s", err.Error())
+	}
+	if !c.Eventually(func() bool { return c.Converged("drained", Range(1, 6)...) }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Cluster did not converge after %v", c.Clock.Now().Sub(Start))
+	}
+
+	//Node 0 rejects writes and does not peer with other nodes anymore
+	if err := c.Write(0, "other", "value"); err == nil {
+		t.Errorf("c.Write() to a drained node returned no error")
+	}
+	c.Advance(5 * time.Minute)
+	addr := c.Nodes[0].Addr()
+	for i, n := range c.Nodes {
+		if _, found := n.FindPeer(addr); found {
+			t.Errorf("Node %d still peers with drained node %v", i, addr)
+		}
+	}
+	if peers := c.Nodes[0].PeerList(); len(peers) != 0 {
+		t.Errorf("Drained node has %d peers; want 0", len(peers))
+	}
+
+	//The remaining nodes stay connected
+	if err := c.Write(1, "other", "value"); err != nil {
+		t.Fatalf("c.Write() returned an error: %s", err.Error())
+	}
+	if !c.Eventually(func() bool { return c.Converged("other", Range(1, 6)...) }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Cluster did not converge after draining node 0 after %v", c.Clock.Now().Sub(Start))
+	}
+}
+
+func TestClusterAntiEntropy(t *testing.T) {
+	config := newConfig()
+	//Nodes only repair missed states through anti-entropy
+	config.Node.PingInterval = time.Hour
+	config.Node.AntiEntropyInterval = 10 * time.Second
+	c := NewCluster(10, config)
+	defer c.Stop()
+	c.RegisterAll()
+	c.Advance(time.Minute)
+
+	c.Partition(20*time.Second, Range(0, 5), Range(5, 10))
+	c.Write(0, "key", "value")
+	c.Advance(10 * time.Second)
+	for i := 5; i < 10; i++ {
+		if _, ok := c.Nodes[i].GetState("key"); ok {
+			t.Errorf("Node %d received the state across the partition", i)
+		}
+	}
+
+	if !c.Eventually(func() bool { return c.Converged("key") }, 5*time.Second, 5*time.Minute) {
+		t.Errorf("Cluster did not converge through anti-entropy after the partition healed")
+	}
+}
@@ -0,0 +1,123 @@
+package sim
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"github.com/nmoutschen/gossip/gossip"
+)
+
+/*Network delivers HTTP requests between simulated nodes and controllers in
+memory, by calling their handlers directly.
+
+An address that is not registered behaves like a crashed process: requests
+to and from that address fail.
+*/
+type Network struct {
+	//handlers is the handler for each registered address
+	handlers map[gossip.Addr]http.Handler
+	//mu protects access to handlers
+	mu sync.RWMutex
+}
+
+//NewNetwork creates a new empty network
+func NewNetwork() *Network {
+	return &Network{
+		handlers: make(map[gossip.Addr]http.Handler),
+	}
+}
+
+//Register makes a handler reachable at the given address
+func (n *Network) Register(addr gossip.Addr, handler http.Handler) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.handlers[addr] = handler
+}
+
+//Unregister makes an address unreachable
+func (n *Network) Unregister(addr gossip.Addr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.handlers, addr)
+}
+
+//Handler returns the handler registered for an address
+func (n *Network) Handler(addr gossip.Addr) (http.Handler, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	handler, ok := n.handlers[addr]
+	return handler, ok
+}
+
+/*Client returns an HTTP client that sends requests from the given address
+through the network.
+*/
+func (n *Network) Client(from gossip.Addr) *http.Client {
+	return &http.Client{
+		Transport: &roundTripper{network: n, from: from},
+	}
+}
+
+/*Transport returns a gossip.Transport that sends messages from the given
+address through the network.
+*/
+func (n *Network) Transport(from gossip.Addr, config *gossip.Config) gossip.Transport {
+	transportConfig := *config
+	transportConfig.Protocol = "http"
+	transportConfig.Client = n.Client(from)
+	transportConfig.Transport = nil
+	return gossip.NewHTTPTransport(&transportConfig)
+}
+
+//roundTripper is an http.RoundTripper delivering requests through a Network
+type roundTripper struct {
+	//network is the network delivering requests
+	network *Network
+	//from is the address sending requests
+	from gossip.Addr
+}
+
+//RoundTrip delivers a request to the handler registered for its host
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	to, err := parseHost(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := rt.network.Handler(rt.from); !ok {
+		return nil, errors.New("Sender " + rt.from.String() + " is not registered on the network")
+	}
+	handler, ok := rt.network.Handler(to)
+	if !ok {
+		return nil, errors.New("Connection refused by " + to.String())
+	}
+
+	req.RemoteAddr = rt.from.String()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec.Result(), nil
+}
+
+//parseHost parses a 'host:port' string into an Addr
+func parseHost(host string) (gossip.Addr, error) {
+	ip, portStr, err := net.SplitHostPort(host)
+	if err != nil {
+		return gossip.Addr{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return gossip.Addr{}, err
+	}
+	return gossip.Addr{IP: ip, Port: port}, nil
+}
@@ -0,0 +1,16 @@
+package sim
+
+import (
+	"os"
+	"testing"
+
+	"github.com/nmoutschen/gossip/gossip"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	gossip.DefaultConfig.Peer.MaxRetries = 0
+	log.SetLevel(log.WarnLevel)
+
+	os.Exit(m.Run())
+}
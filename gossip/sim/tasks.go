@@ -0,0 +1,89 @@
+package sim
+
+import (
+	"sync"
+)
+
+/*tasks counts the tasks in progress in all nodes and the controller of a
+cluster, so that the cluster can wait until they are all idle.
+
+Each node and the controller reports its tasks through its own tracker. See
+gossip.Tracker for what counts as a task.
+*/
+type tasks struct {
+	//count is the number of tasks in progress
+	count int
+	//mu protects access to count and the trackers
+	mu sync.Mutex
+	//idle is signaled when count drops to zero
+	idle *sync.Cond
+}
+
+//newTasks creates a new task counter
+func newTasks() *tasks {
+	t := &tasks{}
+	t.idle = sync.NewCond(&t.mu)
+	return t
+}
+
+//tracker creates a new gossip.Tracker adding its tasks to t
+func (t *tasks) tracker() *tracker {
+	return &tracker{tasks: t}
+}
+
+//Wait blocks until no task is in progress
+func (t *tasks) Wait() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for t.count > 0 {
+		t.idle.Wait()
+	}
+}
+
+//add adds delta to the number of tasks in progress. t.mu must be held.
+func (t *tasks) add(delta int) {
+	t.count += delta
+	if t.count <= 0 {
+		t.idle.Broadcast()
+	}
+}
+
+/*tracker is the gossip.Tracker of a single node or controller.
+
+Closing the tracker removes its tasks from the count, as a crashed process
+leaves messages in its channels that nobody will ever receive.
+*/
+type tracker struct {
+	//tasks is the counter of the cluster
+	tasks *tasks
+	//count is the number of tasks in progress for this tracker
+	count int
+	//closed is true once the tracker is closed
+	closed bool
+}
+
+//Add adds delta to the number of tasks in progress, unless the tracker is closed
+func (t *tracker) Add(delta int) {
+	t.tasks.mu.Lock()
+	defer t.tasks.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+	t.count += delta
+	t.tasks.add(delta)
+}
+
+//Close removes the tasks of the tracker from the count and ignores further changes
+func (t *tracker) Close() {
+	t.tasks.mu.Lock()
+	defer t.tasks.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.tasks.add(-t.count)
+	t.count = 0
+}
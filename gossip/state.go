@@ -1,16 +1,50 @@
 package gossip
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 )
 
-//State represents a piece of information at a given point in time
+//State represents a piece of information for a key at a given point in time
 type State struct {
-	Timestamp int64  `json:"time"`
-	Data      string `json:"data"`
+	//Key is the key in the keyspace that this state belongs to
+	Key       string    `json:"key"`
+	Timestamp Timestamp `json:"time"`
+	Data      string    `json:"data"`
+	/*Deleted marks the state as a tombstone. Tombstones are propagated like
+	any other state so that deletions reach all nodes.*/
+	Deleted bool `json:"deleted,omitempty"`
+	/*Digest is the hex-encoded SHA-256 digest of Data. This is computed by
+	the node when it receives the state.*/
+	Digest string `json:"digest,omitempty"`
+	//Signer is the base64-encoded Ed25519 public key of the writer
+	Signer string `json:"signer,omitempty"`
+	//Signature is the base64-encoded Ed25519 signature of the state
+	Signature string `json:"signature,omitempty"`
+	/*Hops is the number of nodes the state went through since it was
+	written. This is not covered by the digest or the signature.*/
+	Hops int `json:"hops,omitempty"`
+}
+
+/*ComputeDigest returns the hex-encoded SHA-256 digest of the data of the
+state.
+
+Two states with the same digest hold the same data. As tombstones do not hold
+any data and other states cannot be empty, the digest also tells tombstones
+apart.
+*/
+func (s State) ComputeDigest() string {
+	sum := sha256.Sum256([]byte(s.Data))
+	return hex.EncodeToString(sum[:])
+}
+
+//VerifyDigest returns true if the digest of the state matches its data
+func (s State) VerifyDigest() bool {
+	return s.Digest == s.ComputeDigest()
 }
 
 //String returns a string representation of the state
 func (s *State) String() string {
-	return fmt.Sprintf("%x", s.Timestamp)
+	return fmt.Sprintf("%s@%v", s.Key, s.Timestamp)
 }
@@ -0,0 +1,214 @@
+package gossip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	//storageLogName is the name of the append-only log file in the data directory
+	storageLogName = "states.log"
+	//storageSnapshotName is the name of the snapshot file in the data directory
+	storageSnapshotName = "snapshot.json"
+)
+
+/*Storage persists the states of a node so that they survive restarts.
+
+Implementations must be safe to call from multiple goroutines.
+*/
+type Storage interface {
+	//Load returns all persisted states, in the order they were saved
+	Load() ([]State, error)
+	//Save durably persists a single state before returning
+	Save(state State) error
+	//Snapshot replaces all persisted content with the given states
+	Snapshot(states []State) error
+	//Close releases the resources held by the storage
+	Close() error
+}
+
+//nullStorage is a Storage that does not persist anything
+type nullStorage struct{}
+
+//Load returns no states
+func (s nullStorage) Load() ([]State, error) {
+	return nil, nil
+}
+
+//Save discards the state
+func (s nullStorage) Save(state State) error {
+	return nil
+}
+
+//Snapshot discards the states
+func (s nullStorage) Snapshot(states []State) error {
+	return nil
+}
+
+//Close does nothing
+func (s nullStorage) Close() error {
+	return nil
+}
+
+/*FileStorage is a Storage backed by files in a directory.
+
+Each state is appended to a log file as a JSON document on its own line, and
+the log file is fsynced before Save returns. Snapshots write all states to a
+separate file, then truncate the log.
+*/
+type FileStorage struct {
+	//Dir is the directory containing the storage files
+	Dir string
+
+	//file is the append-only log file
+	file *os.File
+	//mu protects access to the log file
+	mu sync.Mutex
+}
+
+//NewFileStorage opens or creates a FileStorage in the given directory
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, storageLogName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{
+		Dir:  dir,
+		file: file,
+	}, nil
+}
+
+//Close closes the log file
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+/*Load returns the states from the latest snapshot, followed by the states from
+the log file.
+
+A crash while appending to the log can leave a partial line at the end of the
+file. As the state in that line was never acknowledged, it is skipped.
+*/
+func (s *FileStorage) Load() ([]State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var states []State
+
+	//Read the snapshot
+	snapshot, err := os.Open(filepath.Join(s.Dir, storageSnapshotName))
+	if err == nil {
+		err = json.NewDecoder(snapshot).Decode(&states)
+		snapshot.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	//Replay the log
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(s.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.WithFields(log.Fields{"storage": s.Dir, "func": "Load"}).Warn("Skip partial state at the end of the log")
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		state := State{}
+		if err := json.Unmarshal(line, &state); err != nil {
+			log.WithFields(log.Fields{"storage": s.Dir, "func": "Load"}).Warnf("Skip invalid state in the log: %s", err.Error())
+			continue
+		}
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+//Save appends a state to the log file and syncs it to disk
+func (s *FileStorage) Save(state State) error {
+	line, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+/*Snapshot writes all states to the snapshot file, then truncates the log.
+
+The snapshot is written to a temporary file first, then renamed, so that a
+crash never leaves a partial snapshot behind. If a crash happens before the log
+is truncated, the log is replayed on top of the snapshot, which is harmless
+as states are only applied if they are newer.
+*/
+func (s *FileStorage) Snapshot(states []State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := filepath.Join(s.Dir, storageSnapshotName)
+	tmpPath := path + ".tmp"
+
+	//Write the temporary snapshot
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(tmp).Encode(states); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	//Replace the snapshot
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(s.Dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	//Truncate the log
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
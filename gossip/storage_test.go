@@ -0,0 +1,120 @@
+package gossip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	states := []State{
+		{Key: "key1", Timestamp: Timestamp{Physical: 1}, Data: "TestFileStorage"},
+		{Key: "key2", Timestamp: Timestamp{Physical: 2}, Data: "TestFileStorage"},
+		{Key: "key1", Timestamp: Timestamp{Physical: 3}, Deleted: true},
+	}
+
+	//Save states
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage() returned error %s", err.Error())
+	}
+	for _, state := range states {
+		if err := s.Save(state); err != nil {
+			t.Errorf("s.Save(%v) returned error %s", state, err.Error())
+		}
+	}
+	s.Close()
+
+	//Reopen the storage and load states
+	s, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage() returned error %s", err.Error())
+	}
+	defer s.Close()
+
+	loaded, err := s.Load()
+	if err != nil {
+		t.Errorf("s.Load() returned error %s", err.Error())
+	}
+	if len(loaded) != len(states) {
+		t.Fatalf("len(s.Load()) == %d; want %d", len(loaded), len(states))
+	}
+	for i, state := range states {
+		if loaded[i] != state {
+			t.Errorf("s.Load()[%d] == %v; want %v", i, loaded[i], state)
+		}
+	}
+}
+
+func TestFileStorageSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage() returned error %s", err.Error())
+	}
+	defer s.Close()
+
+	//Save a state, snapshot, then save another state
+	s.Save(State{Key: "key1", Timestamp: Timestamp{Physical: 1}, Data: "Old data"})
+	snapshot := []State{{Key: "key1", Timestamp: Timestamp{Physical: 2}, Data: "TestFileStorageSnapshot"}}
+	if err := s.Snapshot(snapshot); err != nil {
+		t.Errorf("s.Snapshot() returned error %s", err.Error())
+	}
+	state := State{Key: "key2", Timestamp: Timestamp{Physical: 3}, Data: "TestFileStorageSnapshot"}
+	s.Save(state)
+
+	loaded, err := s.Load()
+	if err != nil {
+		t.Errorf("s.Load() returned error %s", err.Error())
+	}
+	if len(loaded) != 2 {
+		t.Fatalf("len(s.Load()) == %d; want %d", len(loaded), 2)
+	}
+	if loaded[0] != snapshot[0] {
+		t.Errorf("s.Load()[0] == %v; want %v", loaded[0], snapshot[0])
+	}
+	if loaded[1] != state {
+		t.Errorf("s.Load()[1] == %v; want %v", loaded[1], state)
+	}
+}
+
+func TestFileStoragePartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage() returned error %s", err.Error())
+	}
+	defer s.Close()
+
+	//Simulate a crash while writing the second state
+	state := State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestFileStoragePartialLine"}
+	s.Save(state)
+	f, _ := os.OpenFile(filepath.Join(dir, storageLogName), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte(`{"key":"key","time":2,"da`))
+	f.Close()
+
+	loaded, err := s.Load()
+	if err != nil {
+		t.Errorf("s.Load() returned error %s", err.Error())
+	}
+	if len(loaded) != 1 || loaded[0] != state {
+		t.Errorf("s.Load() == %v; want %v", loaded, []State{state})
+	}
+}
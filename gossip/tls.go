@@ -0,0 +1,152 @@
+package gossip
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*HTTPClient returns an HTTP client to send requests to peers using this
+configuration.
+
+If c.Client is set, this returns it as is. Otherwise, this creates a new
+client using the timeouts and connection pooling settings from c.Peer. If the
+protocol is https, the client also presents the certificate from c.TLS and
+verifies servers against the certificate authorities from c.TLS.CAFile.
+
+Each new client has its own pool of connections: callers should create it
+once and reuse it for all peers.
+*/
+func (c *Config) HTTPClient() (*http.Client, error) {
+	if c.Client != nil {
+		return c.Client, nil
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   c.Peer.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost: c.Peer.MaxIdleConns,
+		IdleConnTimeout:     c.Peer.IdleConnTimeout,
+		TLSHandshakeTimeout: c.Peer.ConnectTimeout,
+	}
+	if c.Protocol == "https" {
+		tlsConfig, err := c.ClientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   c.Peer.RequestTimeout,
+	}, nil
+}
+
+//ClientTLSConfig returns the TLS configuration used to send requests to peers
+func (c *Config) ClientTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.TLS.CAFile != "" {
+		pool, err := c.certPool()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+/*ServerTLSConfig returns the TLS configuration used by the HTTP servers of
+nodes and controllers.
+
+If c.TLS.CAFile is set, clients must present a certificate signed by one of
+the certificate authorities in that file.
+*/
+func (c *Config) ServerTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.TLS.CAFile != "" {
+		pool, err := c.certPool()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+//certPool loads the certificate authorities from c.TLS.CAFile
+func (c *Config) certPool() (*x509.CertPool, error) {
+	caCerts, err := ioutil.ReadFile(c.TLS.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCerts) {
+		return nil, errors.New("No valid certificate found in " + c.TLS.CAFile)
+	}
+	return pool, nil
+}
+
+/*newServer creates an HTTP server for a handler and a listener on addr.
+
+If the protocol from the configuration is https, the server uses the TLS
+configuration from config.ServerTLSConfig().
+*/
+func newServer(addr string, handler http.Handler, config *Config) (*http.Server, net.Listener, error) {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+	if config.Protocol == "https" {
+		tlsConfig, err := config.ServerTLSConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server, ln, nil
+}
+
+//serve accepts connections on the listener until the server is shut down
+func serve(server *http.Server, ln net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
@@ -0,0 +1,168 @@
+package gossip
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*generateCertificate writes a self-signed certificate for 127.0.0.1 and its
+private key in a directory, and returns a TLSConfig using that certificate as
+its own certificate authority.
+*/
+func generateCertificate(t *testing.T, dir string) TLSConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err.Error())
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gossip"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err.Error())
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %s", err.Error())
+	}
+
+	config := TLSConfig{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		CAFile:   filepath.Join(dir, "cert.pem"),
+	}
+	ioutil.WriteFile(config.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600)
+	ioutil.WriteFile(config.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+
+	return config
+}
+
+func TestConfigHTTPClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	tlsConfig := &Config{Protocol: "https", TLS: generateCertificate(t, dir)}
+	missingConfig := &Config{Protocol: "https", TLS: TLSConfig{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "missing.pem")}}
+
+	testCases := []struct {
+		Config *Config
+		Error  bool
+	}{
+		{&Config{Protocol: "http"}, false},
+		{tlsConfig, false},
+		{missingConfig, true},
+	}
+
+	for i, testCase := range testCases {
+		_, err := testCase.Config.HTTPClient()
+		if (err != nil) != testCase.Error {
+			t.Errorf("HTTPClient() returned error %v for test case %d", err, i)
+		}
+	}
+}
+
+func TestConfigWithTransport(t *testing.T) {
+	config, err := (&Config{Protocol: "http"}).withTransport()
+	if err != nil {
+		t.Fatalf("withTransport() returned error %s", err.Error())
+	}
+
+	transport, ok := config.transport().(*HTTPTransport)
+	if !ok {
+		t.Fatalf("config.transport() returned %T; expected *HTTPTransport", config.transport())
+	}
+	if other := config.transport(); other != transport {
+		t.Errorf("config.transport() returned a different transport")
+	}
+
+	//Copies of the configuration keep the same client
+	copied := *config
+	if other := copied.transport().(*HTTPTransport); other.client != transport.client {
+		t.Errorf("Copy of the configuration returned a different client")
+	}
+
+	//A transport set in the configuration is kept as is
+	faults := &FaultTransport{}
+	other, err := (&Config{Transport: faults}).withTransport()
+	if err != nil {
+		t.Fatalf("withTransport() returned error %s", err.Error())
+	}
+	if other.Transport != faults {
+		t.Errorf("withTransport() replaced the transport")
+	}
+}
+
+func TestPeerPingTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gossip")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	config := *DefaultConfig
+	config.Protocol = "https"
+	config.TLS = generateCertificate(t, dir)
+
+	//Clients without a certificate are rejected by the server
+	anonConfig := config
+	anonConfig.TLS = TLSConfig{CAFile: config.TLS.CAFile}
+
+	serverTLS, err := config.ServerTLSConfig()
+	if err != nil {
+		t.Fatalf("config.ServerTLSConfig() returned error %s", err.Error())
+	}
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			t.Errorf("Received request without client certificate")
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(StatusResponse{})
+	}))
+	testServer.TLS = serverTLS
+	testServer.StartTLS()
+	defer func() { testServer.Close() }()
+
+	testCases := []struct {
+		Config   *Config
+		Attempts int
+	}{
+		{&config, 0},
+		{&anonConfig, 1},
+	}
+
+	for i, testCase := range testCases {
+		p := NewPeer(parseURL(testServer.URL), testCase.Config)
+		p.Ping(context.Background())
+
+		if p.Attempts != testCase.Attempts {
+			t.Errorf("p.Attempts == %d after p.Ping() for test case %d; want %d", p.Attempts, i, testCase.Attempts)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package gossip
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*Tracker counts the tasks in progress in a node or a controller, so that
+simulations can wait until all nodes are idle before moving their clock
+forward.
+
+A task is a goroutine that can run, or a timer that fired. Goroutines waiting
+for a timer, for a message or for other tasks are not counted: the task is
+added back by whoever wakes them up. A Clock used along with a Tracker must
+therefore add a task every time a timer fires, before sending on the channel
+returned by After.
+
+Implementations must be safe to call from multiple goroutines.
+*/
+type Tracker interface {
+	//Add adds delta, which can be negative, to the number of tasks in progress
+	Add(delta int)
+}
+
+//track adds delta to the number of tasks in progress, if tasks are tracked
+func (c *Config) track(delta int) {
+	if c.Tracker != nil {
+		c.Tracker.Add(delta)
+	}
+}
+
+//goTask runs f in a new goroutine, counted as a task until f returns
+func (c *Config) goTask(f func()) {
+	c.track(1)
+	go func() {
+		defer c.track(-1)
+		f()
+	}()
+}
+
+/*sleep waits for d to elapse on the clock, and returns false if ctx is done
+first.
+
+The calling goroutine is not counted as a task while it waits, and is counted
+again once this returns.
+*/
+func (c *Config) sleep(ctx context.Context, d time.Duration) bool {
+	return sleep(ctx, c.clock(), c.Tracker, d)
+}
+
+//sleep waits for d to elapse on a clock, see Config.sleep
+func sleep(ctx context.Context, clock Clock, tracker Tracker, d time.Duration) bool {
+	timer := clock.After(d)
+	if tracker == nil {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer:
+			return true
+		}
+	}
+
+	tracker.Add(-1)
+	select {
+	case <-ctx.Done():
+		tracker.Add(1)
+		//The timer is counted as a task once it fires, even if nobody waits for it
+		go func() {
+			<-timer
+			tracker.Add(-1)
+		}()
+		return false
+	case <-timer:
+		//The task added when the timer fired is now the calling goroutine
+		return true
+	}
+}
+
+/*taskGroup waits for a set of tasks to finish, like a sync.WaitGroup.
+
+The waiting goroutine is not counted as a task while it waits. The last task
+of the group hands its place over to the waiting goroutine before returning.
+*/
+type taskGroup struct {
+	//config tracks the tasks of the group
+	config *Config
+	//pending is the number of tasks still running
+	pending int
+	//done is closed when the last task finishes while a goroutine waits
+	done chan struct{}
+	//mu protects access to pending and done
+	mu sync.Mutex
+}
+
+//newTaskGroup creates a new empty taskGroup
+func (c *Config) newTaskGroup() *taskGroup {
+	return &taskGroup{config: c}
+}
+
+//Go runs f in a new goroutine as part of the group
+func (g *taskGroup) Go(f func()) {
+	g.mu.Lock()
+	g.pending++
+	g.mu.Unlock()
+
+	g.config.goTask(func() {
+		defer g.finish()
+		f()
+	})
+}
+
+//finish marks a task as finished, and wakes up the waiting goroutine if it was the last one
+func (g *taskGroup) finish() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.pending--
+	if g.pending == 0 && g.done != nil {
+		g.config.track(1)
+		close(g.done)
+		g.done = nil
+	}
+}
+
+//Wait waits until all tasks of the group are finished
+func (g *taskGroup) Wait() {
+	g.mu.Lock()
+	if g.pending == 0 {
+		g.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	g.done = done
+	g.config.track(-1)
+	g.mu.Unlock()
+
+	<-done
+}
+
+/*inbox tracks the messages sent to a worker through its channels.
+
+Messages waiting in a channel are not counted as tasks, as the worker may be
+waiting for a timer. Instead, a sender hands a task over to the worker if the
+worker waits for a message, and a worker hands a task over to a sender blocked
+on a full channel when it receives a message from that channel.
+
+Senders use the typed send methods, such as sendState, which return false if
+their context is done before the message could be sent. If tasks are not
+tracked, these only run a plain select and the other methods return
+immediately.
+*/
+type inbox struct {
+	//config tracks the tasks of the worker and of its senders
+	config *Config
+	//idle is true while the worker waits for a message and is not counted
+	idle bool
+	//blocked is the number of senders blocked on each channel
+	blocked map[interface{}]int
+	//mu protects access to idle and blocked
+	mu sync.Mutex
+}
+
+//newInbox creates a new inbox for a worker
+func (c *Config) newInbox() *inbox {
+	return &inbox{
+		config:  c,
+		blocked: make(map[interface{}]int),
+	}
+}
+
+/*sendTracked sends a message on the channel ch while tasks are tracked, and
+returns false if the message could not be sent.
+
+send sends the message and returns whether it was sent. If block is false, it
+must not block. Otherwise, it blocks until the message is sent or until the
+context of the sender is done.
+*/
+func (b *inbox) sendTracked(ch interface{}, send func(block bool) bool) bool {
+	b.mu.Lock()
+	if send(false) {
+		b.wake()
+		b.mu.Unlock()
+		return true
+	}
+	//The channel is full: wait without being counted until the worker receives a message
+	b.blocked[ch]++
+	b.config.track(-1)
+	b.mu.Unlock()
+
+	if send(true) {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.blocked[ch] > 0 {
+		b.blocked[ch]--
+		b.config.track(1)
+	}
+	return false
+}
+
+/*wait marks the worker as waiting for a message, unless pending returns that
+messages are already waiting in its channels. The worker must call received
+once it wakes up.
+*/
+func (b *inbox) wait(pending func() int) {
+	if b.config.Tracker == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if pending() > 0 {
+		return
+	}
+	b.idle = true
+	b.config.track(-1)
+}
+
+/*received counts the worker again after it received a message from ch, or
+woke up for another reason if ch is nil.
+*/
+func (b *inbox) received(ch interface{}) {
+	if b.config.Tracker == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.wake()
+	if ch == nil {
+		return
+	}
+	if b.blocked[ch] > 0 {
+		b.blocked[ch]--
+		b.config.track(1)
+	}
+}
+
+//wake counts the worker again if it waits for a message. b.mu must be held.
+func (b *inbox) wake() {
+	if b.idle {
+		b.idle = false
+		b.config.track(1)
+	}
+}
+
+//sendState sends a state on ch
+func (b *inbox) sendState(ctx context.Context, ch chan State, state State) bool {
+	if b.config.Tracker != nil {
+		return b.sendTracked(ch, func(block bool) bool {
+			if !block {
+				select {
+				case ch <- state:
+					return true
+				default:
+					return false
+				}
+			}
+			select {
+			case ch <- state:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}
+
+	select {
+	case ch <- state:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//sendFetch sends a fetch request on ch
+func (b *inbox) sendFetch(ctx context.Context, ch chan fetchRequest, req fetchRequest) bool {
+	if b.config.Tracker != nil {
+		return b.sendTracked(ch, func(block bool) bool {
+			if !block {
+				select {
+				case ch <- req:
+					return true
+				default:
+					return false
+				}
+			}
+			select {
+			case ch <- req:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}
+
+	select {
+	case ch <- req:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//sendWrite sends a write request on ch
+func (b *inbox) sendWrite(ctx context.Context, ch chan writeRequest, req writeRequest) bool {
+	if b.config.Tracker != nil {
+		return b.sendTracked(ch, func(block bool) bool {
+			if !block {
+				select {
+				case ch <- req:
+					return true
+				default:
+					return false
+				}
+			}
+			select {
+			case ch <- req:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}
+
+	select {
+	case ch <- req:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//sendFlush sends a flush request on ch
+func (b *inbox) sendFlush(ctx context.Context, ch chan chan struct{}, done chan struct{}) bool {
+	if b.config.Tracker != nil {
+		return b.sendTracked(ch, func(block bool) bool {
+			if !block {
+				select {
+				case ch <- done:
+					return true
+				default:
+					return false
+				}
+			}
+			select {
+			case ch <- done:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}
+
+	select {
+	case ch <- done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//sendAddr sends an address on ch
+func (b *inbox) sendAddr(ctx context.Context, ch chan Addr, addr Addr) bool {
+	if b.config.Tracker != nil {
+		return b.sendTracked(ch, func(block bool) bool {
+			if !block {
+				select {
+				case ch <- addr:
+					return true
+				default:
+					return false
+				}
+			}
+			select {
+			case ch <- addr:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}
+
+	select {
+	case ch <- addr:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//sendPeeringRequest sends a peering request on ch
+func (b *inbox) sendPeeringRequest(ctx context.Context, ch chan PeeringRequest, req PeeringRequest) bool {
+	if b.config.Tracker != nil {
+		return b.sendTracked(ch, func(block bool) bool {
+			if !block {
+				select {
+				case ch <- req:
+					return true
+				default:
+					return false
+				}
+			}
+			select {
+			case ch <- req:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}
+
+	select {
+	case ch <- req:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//sendPeer sends a peer on ch
+func (b *inbox) sendPeer(ctx context.Context, ch chan *Peer, peer *Peer) bool {
+	if b.config.Tracker != nil {
+		return b.sendTracked(ch, func(block bool) bool {
+			if !block {
+				select {
+				case ch <- peer:
+					return true
+				default:
+					return false
+				}
+			}
+			select {
+			case ch <- peer:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}
+
+	select {
+	case ch <- peer:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//closePeers closes ch, waking up the worker if it waits for a peer
+func (b *inbox) closePeers(ch chan *Peer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.wake()
+	close(ch)
+}
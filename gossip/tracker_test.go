@@ -0,0 +1,161 @@
+package gossip
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+//countTracker is a Tracker keeping the number of tasks in progress
+type countTracker struct {
+	count int
+	mu    sync.Mutex
+}
+
+//Add adds delta to the number of tasks in progress
+func (t *countTracker) Add(delta int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count += delta
+}
+
+//Count returns the number of tasks in progress
+func (t *countTracker) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count
+}
+
+//waitCount waits until the tracker counts the given number of tasks
+func waitCount(t *testing.T, tracker *countTracker, count int) {
+	timeout := time.Now().Add(5 * time.Second)
+	for tracker.Count() != count {
+		if time.Now().After(timeout) {
+			t.Fatalf("tracker.Count() == %d; want %d", tracker.Count(), count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInboxHandOver(t *testing.T) {
+	tracker := &countTracker{count: 1}
+	config := *DefaultConfig
+	config.Tracker = tracker
+	b := config.newInbox()
+	ch := make(chan State, 1)
+	ctx := context.Background()
+
+	//A message waiting in the channel is not counted
+	b.sendState(ctx, ch, State{Key: "1"})
+	if tracker.Count() != 1 {
+		t.Errorf("tracker.Count() == %d with a waiting message; want 1", tracker.Count())
+	}
+	b.wait(func() int { return len(ch) })
+	if tracker.Count() != 1 {
+		t.Errorf("tracker.Count() == %d after b.wait() with a waiting message; want 1", tracker.Count())
+	}
+	<-ch
+	b.received(ch)
+
+	//The worker is not counted while it waits, until a sender wakes it up
+	b.wait(func() int { return len(ch) })
+	if tracker.Count() != 0 {
+		t.Errorf("tracker.Count() == %d while waiting; want 0", tracker.Count())
+	}
+	b.sendState(ctx, ch, State{Key: "2"})
+	if tracker.Count() != 1 {
+		t.Errorf("tracker.Count() == %d after sending; want 1", tracker.Count())
+	}
+	<-ch
+	b.received(ch)
+	if tracker.Count() != 1 {
+		t.Errorf("tracker.Count() == %d after receiving; want 1", tracker.Count())
+	}
+}
+
+func TestInboxBlockedSender(t *testing.T) {
+	tracker := &countTracker{count: 1}
+	config := *DefaultConfig
+	config.Tracker = tracker
+	b := config.newInbox()
+	ch := make(chan State, 1)
+	ctx := context.Background()
+	b.sendState(ctx, ch, State{Key: "1"})
+
+	//The sender is not counted while the channel is full
+	done := make(chan bool)
+	config.goTask(func() {
+		done <- b.sendState(ctx, ch, State{Key: "2"})
+	})
+	waitCount(t, tracker, 1)
+
+	<-ch
+	b.received(ch)
+	if !<-done {
+		t.Errorf("b.sendState() == false; want true")
+	}
+	if v := <-ch; v.Key != "2" {
+		t.Errorf("<-ch == %v; want state for key 2", v)
+	}
+	b.received(ch)
+	waitCount(t, tracker, 1)
+
+	//A sender that gives up is counted again
+	ctx, cancel := context.WithCancel(ctx)
+	b.sendState(ctx, ch, State{Key: "3"})
+	cancel()
+	if b.sendState(ctx, ch, State{Key: "4"}) {
+		t.Errorf("b.sendState() == true with a full channel and a cancelled context; want false")
+	}
+	if tracker.Count() != 1 {
+		t.Errorf("tracker.Count() == %d after cancelling; want 1", tracker.Count())
+	}
+}
+
+func TestInboxUntracked(t *testing.T) {
+	config := *DefaultConfig
+	b := config.newInbox()
+	ch := make(chan State, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if !b.sendState(ctx, ch, State{Key: "1"}) {
+		t.Errorf("b.sendState() == false; want true")
+	}
+	b.wait(func() int {
+		t.Errorf("b.wait() called pending without a tracker")
+		return 0
+	})
+	b.received(ch)
+
+	//A sender blocked on a full channel gives up once ctx is done
+	cancel()
+	if b.sendState(ctx, ch, State{Key: "2"}) {
+		t.Errorf("b.sendState() == true with a full channel and a cancelled context; want false")
+	}
+	if v := <-ch; v.Key != "1" {
+		t.Errorf("<-ch == %v; want state for key 1", v)
+	}
+}
+
+func TestTaskGroup(t *testing.T) {
+	tracker := &countTracker{count: 1}
+	config := *DefaultConfig
+	config.Tracker = tracker
+	g := config.newTaskGroup()
+
+	start := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		g.Go(func() {
+			<-start
+		})
+	}
+	if tracker.Count() != 4 {
+		t.Errorf("tracker.Count() == %d with 3 tasks; want 4", tracker.Count())
+	}
+
+	close(start)
+	g.Wait()
+	//The tasks may still be returning
+	waitCount(t, tracker, 1)
+}
@@ -0,0 +1,399 @@
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*Transport sends messages to peers.
+
+Each method makes a single attempt: retries, backoff and tracking the status of
+peers are handled by Peer. Implementations must be safe to call from multiple
+goroutines.
+*/
+type Transport interface {
+	/*Announce tells a peer that the sender holds a state whose data is split
+	in chunks*/
+	Announce(ctx context.Context, addr Addr, announcement Announcement) error
+	//Drain asks a node to drain before it leaves the cluster
+	Drain(ctx context.Context, addr Addr) error
+	//Get retrieves the latest state for a key, including tombstones
+	Get(ctx context.Context, addr Addr, key string) (State, error)
+	/*GetChunk retrieves a chunk of the data of the latest state for a key, if
+	its digest matches*/
+	GetChunk(ctx context.Context, addr Addr, key, digest string, index int) ([]byte, error)
+	//GetMetadata retrieves the latest state for a key without its data
+	GetMetadata(ctx context.Context, addr Addr, key string) (State, error)
+	//GetPeers retrieves the ID and the peers of a peer
+	GetPeers(ctx context.Context, addr Addr) (PeersResponse, error)
+	//GetTree retrieves the hashes of nodes at a level of the Merkle tree of a peer
+	GetTree(ctx context.Context, addr Addr, req TreeRequest) (TreeResponse, error)
+	/*GetStatus retrieves the status of a peer, including the status of each
+	of its keys*/
+	GetStatus(ctx context.Context, addr Addr) (StatusResponse, error)
+	/*Ping retrieves the status of a peer without the status of its keys,
+	piggybacking membership events*/
+	Ping(ctx context.Context, addr Addr, events []MemberEvent) (StatusResponse, error)
+	//Probe asks a peer to probe req.Target on behalf of the sender
+	Probe(ctx context.Context, addr Addr, req ProbeRequest) (ProbeResponse, error)
+	/*Send sends a state, piggybacking membership events, and returns an error
+	if the peer did not acknowledge it*/
+	Send(ctx context.Context, addr Addr, state State, events []MemberEvent) error
+	//SendPeeringRequest asks a peer to peer with the node in req
+	SendPeeringRequest(ctx context.Context, addr Addr, req PeeringRequest) error
+	//SendPeerDeletionRequest asks a peer to remove peerAddr from its peers
+	SendPeerDeletionRequest(ctx context.Context, addr Addr, peerAddr Addr) error
+	/*Sync retrieves the status of the keys in leaves of the Merkle tree of a
+	peer*/
+	Sync(ctx context.Context, addr Addr, req SyncRequest) (SyncResponse, error)
+}
+
+/*maxDrainSize is the maximum number of bytes read from the body of a response
+before closing it. Larger bodies are discarded with their connection.
+*/
+const maxDrainSize = 64 << 10
+
+//HTTPTransport is a Transport sending JSON documents over HTTP or HTTPS
+type HTTPTransport struct {
+	//client sends the requests to all peers
+	client *http.Client
+	//config stores the configuration parameters
+	config *Config
+}
+
+/*NewHTTPTransport creates a new HTTPTransport
+
+If the HTTP client cannot be created from the configuration, this logs the
+error and sends requests with http.DefaultClient.
+*/
+func NewHTTPTransport(config *Config) *HTTPTransport {
+	if config == nil {
+		config = DefaultConfig
+	}
+
+	client, err := config.HTTPClient()
+	if err != nil {
+		log.WithFields(log.Fields{"func": "NewHTTPTransport"}).Errorf("Failed to create HTTP client: %s", err.Error())
+		client = http.DefaultClient
+	}
+
+	return &HTTPTransport{
+		client: client,
+		config: config,
+	}
+}
+
+//Announce tells a peer that the sender holds a state whose data is split in chunks
+func (t *HTTPTransport) Announce(ctx context.Context, addr Addr, announcement Announcement) error {
+	return t.send(ctx, http.MethodPost, t.URL(addr)+"/announce", announcement, nil)
+}
+
+/*Drain asks a node to drain before it leaves the cluster
+
+The node responds once it is drained, or with a 409 status code if it is
+already draining.
+*/
+func (t *HTTPTransport) Drain(ctx context.Context, addr Addr) error {
+	res, err := t.do(ctx, http.MethodPost, t.URL(addr)+"/admin/drain", nil, nil)
+	if err != nil {
+		return err
+	}
+	closeBody(res)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Drain failed with status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+/*Get retrieves the latest state for a key from a peer
+
+If the key was deleted, the peer responds with a 410 status code and the
+tombstone state for that key.
+*/
+func (t *HTTPTransport) Get(ctx context.Context, addr Addr, key string) (State, error) {
+	return t.get(ctx, t.URL(addr)+"/keys/"+url.PathEscape(key))
+}
+
+/*GetChunk retrieves a chunk of the data of the latest state for a key from a
+peer
+
+If the digest of the latest state does not match, the peer responds with a
+409 status code. Responses larger than t.config.Node.ChunkSize are rejected.
+*/
+func (t *HTTPTransport) GetChunk(ctx context.Context, addr Addr, key, digest string, index int) ([]byte, error) {
+	query := url.Values{}
+	query.Set("digest", digest)
+	query.Set("chunk", strconv.Itoa(index))
+	res, err := t.do(ctx, http.MethodGet, t.URL(addr)+"/keys/"+url.PathEscape(key)+"?"+query.Encode(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(res)
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to retrieve chunk with status code %d", res.StatusCode)
+	}
+
+	//Read one more byte than a chunk can hold to detect larger responses
+	chunkSize := t.config.Node.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultConfig.Node.ChunkSize
+	}
+	chunk, err := ioutil.ReadAll(io.LimitReader(res.Body, int64(chunkSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) > chunkSize {
+		return nil, fmt.Errorf("Chunk is larger than %d bytes", chunkSize)
+	}
+	return chunk, nil
+}
+
+/*GetMetadata retrieves the latest state for a key from a peer, without its
+data
+
+If the key was deleted, the peer responds with a 410 status code and the
+tombstone state for that key.
+*/
+func (t *HTTPTransport) GetMetadata(ctx context.Context, addr Addr, key string) (State, error) {
+	return t.get(ctx, t.URL(addr)+"/keys/"+url.PathEscape(key)+"?metadata=true")
+}
+
+//GetPeers retrieves the ID and the peers of a peer
+func (t *HTTPTransport) GetPeers(ctx context.Context, addr Addr) (PeersResponse, error) {
+	res, err := t.do(ctx, http.MethodGet, t.URL(addr)+"/peers", nil, nil)
+	if err != nil {
+		return PeersResponse{}, err
+	}
+	defer closeBody(res)
+	if res.StatusCode != http.StatusOK {
+		return PeersResponse{}, fmt.Errorf("Failed to retrieve peers with status code %d", res.StatusCode)
+	}
+
+	peersResponse := PeersResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&peersResponse); err != nil {
+		return PeersResponse{}, errors.New("Failed to decode peers")
+	}
+	return peersResponse, nil
+}
+
+/*GetTree retrieves the hashes of nodes at a level of the Merkle tree of a peer
+
+The peer responds with a 503 status code if it is draining.
+*/
+func (t *HTTPTransport) GetTree(ctx context.Context, addr Addr, req TreeRequest) (TreeResponse, error) {
+	jsonVal, err := json.Marshal(req)
+	if err != nil {
+		return TreeResponse{}, err
+	}
+
+	res, err := t.do(ctx, http.MethodPost, t.URL(addr)+"/tree", jsonVal, nil)
+	if err != nil {
+		return TreeResponse{}, err
+	}
+	defer closeBody(res)
+	if res.StatusCode != http.StatusOK {
+		return TreeResponse{}, fmt.Errorf("Failed to retrieve tree with status code %d", res.StatusCode)
+	}
+
+	treeResponse := TreeResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&treeResponse); err != nil {
+		return TreeResponse{}, errors.New("Failed to decode response")
+	}
+	return treeResponse, nil
+}
+
+//GetStatus retrieves the status of a peer, including the status of each of its keys
+func (t *HTTPTransport) GetStatus(ctx context.Context, addr Addr) (StatusResponse, error) {
+	return t.status(ctx, t.URL(addr)+"/status?keys=true", nil)
+}
+
+/*Ping retrieves the status of a peer without the status of its keys
+
+Membership events are sent in the X-Gossip-Members header.
+*/
+func (t *HTTPTransport) Ping(ctx context.Context, addr Addr, events []MemberEvent) (StatusResponse, error) {
+	return t.status(ctx, t.URL(addr)+"/status", events)
+}
+
+//status retrieves the status of a peer
+func (t *HTTPTransport) status(ctx context.Context, url string, events []MemberEvent) (StatusResponse, error) {
+	res, err := t.do(ctx, http.MethodGet, url, nil, events)
+	if err != nil {
+		return StatusResponse{}, err
+	}
+	defer closeBody(res)
+	if res.StatusCode != http.StatusOK {
+		return StatusResponse{}, fmt.Errorf("Status failed with status code %d", res.StatusCode)
+	}
+
+	statusResponse := StatusResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&statusResponse); err != nil {
+		return StatusResponse{}, errors.New("Failed to decode response")
+	}
+	return statusResponse, nil
+}
+
+//Probe asks a peer to probe req.Target on behalf of the sender
+func (t *HTTPTransport) Probe(ctx context.Context, addr Addr, req ProbeRequest) (ProbeResponse, error) {
+	jsonVal, err := json.Marshal(req)
+	if err != nil {
+		return ProbeResponse{}, err
+	}
+
+	res, err := t.do(ctx, http.MethodPost, t.URL(addr)+"/probe", jsonVal, nil)
+	if err != nil {
+		return ProbeResponse{}, err
+	}
+	defer closeBody(res)
+	if res.StatusCode != http.StatusOK {
+		return ProbeResponse{}, fmt.Errorf("Probe failed with status code %d", res.StatusCode)
+	}
+
+	probeResponse := ProbeResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&probeResponse); err != nil {
+		return ProbeResponse{}, errors.New("Failed to decode response")
+	}
+	return probeResponse, nil
+}
+
+/*Send sends a state to a peer
+
+Membership events are sent in the X-Gossip-Members header. The header is set
+even if there are no events, so that the peer tells states pushed by nodes
+apart from client writes.
+*/
+func (t *HTTPTransport) Send(ctx context.Context, addr Addr, state State, events []MemberEvent) error {
+	if events == nil {
+		events = []MemberEvent{}
+	}
+	return t.send(ctx, http.MethodPost, t.URL(addr)+"/keys/"+url.PathEscape(state.Key), state, events)
+}
+
+/*SendPeeringRequest asks a peer to peer with the node in req
+
+If the address of the node is used by another node, the peer responds with a
+409 status code.
+*/
+func (t *HTTPTransport) SendPeeringRequest(ctx context.Context, addr Addr, req PeeringRequest) error {
+	return t.send(ctx, http.MethodPost, t.URL(addr)+"/peers", req, nil)
+}
+
+//SendPeerDeletionRequest asks a peer to remove peerAddr from its peers
+func (t *HTTPTransport) SendPeerDeletionRequest(ctx context.Context, addr Addr, peerAddr Addr) error {
+	return t.send(ctx, http.MethodDelete, t.URL(addr)+"/peers", peerAddr, nil)
+}
+
+/*Sync retrieves the status of the keys in leaves of the Merkle tree of a peer
+
+The peer responds with a 503 status code if it is draining.
+*/
+func (t *HTTPTransport) Sync(ctx context.Context, addr Addr, req SyncRequest) (SyncResponse, error) {
+	jsonVal, err := json.Marshal(req)
+	if err != nil {
+		return SyncResponse{}, err
+	}
+
+	res, err := t.do(ctx, http.MethodPost, t.URL(addr)+"/sync", jsonVal, nil)
+	if err != nil {
+		return SyncResponse{}, err
+	}
+	defer closeBody(res)
+	if res.StatusCode != http.StatusOK {
+		return SyncResponse{}, fmt.Errorf("Sync failed with status code %d", res.StatusCode)
+	}
+
+	syncResponse := SyncResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&syncResponse); err != nil {
+		return SyncResponse{}, errors.New("Failed to decode response")
+	}
+	return syncResponse, nil
+}
+
+//URL returns the complete URL for a peer
+func (t *HTTPTransport) URL(addr Addr) string {
+	return fmt.Sprintf("%s://%s", t.config.Protocol, addr)
+}
+
+/*do sends a request to a peer with an optional JSON body and optional
+membership events. If events is not nil, the X-Gossip-Members header is set
+even if there are no events.
+
+The caller must close the body of the response with closeBody.
+*/
+func (t *HTTPTransport) do(ctx context.Context, method, url string, body []byte, events []MemberEvent) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if events != nil {
+		jsonEvents, err := json.Marshal(events)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(membersHeader, string(jsonEvents))
+	}
+
+	return t.client.Do(req)
+}
+
+//get retrieves a state from a peer
+func (t *HTTPTransport) get(ctx context.Context, url string) (State, error) {
+	res, err := t.do(ctx, http.MethodGet, url, nil, nil)
+	if err != nil {
+		return State{}, err
+	}
+	defer closeBody(res)
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusGone {
+		return State{}, fmt.Errorf("Failed to retrieve the latest state with status code %d", res.StatusCode)
+	}
+
+	state := State{}
+	if err := json.NewDecoder(res.Body).Decode(&state); err != nil {
+		return State{}, errors.New("Failed to decode state")
+	}
+	return state, nil
+}
+
+//send sends a value as a JSON document and expects a 200 status code
+func (t *HTTPTransport) send(ctx context.Context, method, url string, value interface{}, events []MemberEvent) error {
+	jsonVal, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	res, err := t.do(ctx, method, url, jsonVal, events)
+	if err != nil {
+		return err
+	}
+	closeBody(res)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Request failed with status code %d", res.StatusCode)
+	}
+	return nil
+}
+
+/*closeBody drains and closes the body of a response, so that the connection
+can be reused for other requests.
+*/
+func closeBody(res *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxDrainSize))
+	res.Body.Close()
+}
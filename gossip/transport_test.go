@@ -0,0 +1,238 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+//stubTransport is a Transport returning canned responses and recording calls
+type stubTransport struct {
+	state  State
+	peers  []Addr
+	status StatusResponse
+	probe  ProbeResponse
+	sync   SyncResponse
+	tree   TreeResponse
+	err    error
+	calls  []string
+	mu     sync.Mutex
+}
+
+func (t *stubTransport) call(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.calls = append(t.calls, name)
+}
+
+func (t *stubTransport) Announce(ctx context.Context, addr Addr, announcement Announcement) error {
+	t.call("Announce")
+	return t.err
+}
+
+func (t *stubTransport) Drain(ctx context.Context, addr Addr) error {
+	t.call("Drain")
+	return t.err
+}
+
+func (t *stubTransport) Get(ctx context.Context, addr Addr, key string) (State, error) {
+	t.call("Get")
+	return t.state, t.err
+}
+
+func (t *stubTransport) GetChunk(ctx context.Context, addr Addr, key, digest string, index int) ([]byte, error) {
+	t.call("GetChunk")
+	return []byte(t.state.Data), t.err
+}
+
+func (t *stubTransport) GetMetadata(ctx context.Context, addr Addr, key string) (State, error) {
+	t.call("GetMetadata")
+	state := t.state
+	state.Data = ""
+	return state, t.err
+}
+
+func (t *stubTransport) GetPeers(ctx context.Context, addr Addr) (PeersResponse, error) {
+	t.call("GetPeers")
+	return PeersResponse{Peers: t.peers}, t.err
+}
+
+func (t *stubTransport) GetTree(ctx context.Context, addr Addr, req TreeRequest) (TreeResponse, error) {
+	t.call("GetTree")
+	return t.tree, t.err
+}
+
+func (t *stubTransport) GetStatus(ctx context.Context, addr Addr) (StatusResponse, error) {
+	t.call("GetStatus")
+	return t.status, t.err
+}
+
+func (t *stubTransport) Ping(ctx context.Context, addr Addr, events []MemberEvent) (StatusResponse, error) {
+	t.call("Ping")
+	return t.status, t.err
+}
+
+func (t *stubTransport) Probe(ctx context.Context, addr Addr, req ProbeRequest) (ProbeResponse, error) {
+	t.call("Probe")
+	return t.probe, t.err
+}
+
+func (t *stubTransport) Send(ctx context.Context, addr Addr, state State, events []MemberEvent) error {
+	t.call("Send")
+	return t.err
+}
+
+func (t *stubTransport) SendPeeringRequest(ctx context.Context, addr Addr, req PeeringRequest) error {
+	t.call("SendPeeringRequest")
+	return t.err
+}
+
+func (t *stubTransport) SendPeerDeletionRequest(ctx context.Context, addr Addr, peerAddr Addr) error {
+	t.call("SendPeerDeletionRequest")
+	return t.err
+}
+
+func (t *stubTransport) Sync(ctx context.Context, addr Addr, req SyncRequest) (SyncResponse, error) {
+	t.call("Sync")
+	return t.sync, t.err
+}
+
+func TestPeerTransport(t *testing.T) {
+	state := State{Key: "key", Timestamp: Timestamp{Physical: 1}, Data: "TestPeerTransport"}
+	state.Digest = state.ComputeDigest()
+	transport := &stubTransport{
+		state:  state,
+		peers:  []Addr{{"127.0.0.1", 8081}},
+		status: StatusResponse{Root: "0123456789abcdef"},
+		tree:   TreeResponse{Hashes: []string{"0000000000000000"}},
+	}
+	config := *DefaultConfig
+	config.Transport = transport
+	p := NewPeer(Addr{"127.0.0.1", 8080}, &config)
+	ctx := context.Background()
+
+	if s, err := p.Get(ctx, "key"); err != nil || s != state {
+		t.Errorf("p.Get() == %v, %v; want %v, nil", s, err, state)
+	}
+	if res, err := p.GetPeers(ctx); err != nil || len(res.Peers) != 1 {
+		t.Errorf("p.GetPeers() == %v, %v; want %v, nil", res.Peers, err, transport.peers)
+	}
+	if _, err := p.Ping(ctx); err != nil || p.LastRoot != transport.status.Root {
+		t.Errorf("p.LastRoot == %q after p.Ping(); want %q", p.LastRoot, transport.status.Root)
+	}
+	if !p.Send(ctx, state) {
+		t.Errorf("p.Send() == false; want true")
+	}
+	p.SendPeeringRequest(ctx, PeeringRequest{Addr: Addr{"127.0.0.1", 8081}})
+	p.SendPeerDeletionRequest(ctx, Addr{"127.0.0.1", 8081})
+	if err := p.Drain(ctx); err != nil {
+		t.Errorf("p.Drain() == %v; want nil", err)
+	}
+	if _, err := p.GetTree(ctx, TreeRequest{Nodes: []int{0}}); err != nil {
+		t.Errorf("p.GetTree() == %v; want nil", err)
+	}
+	if _, err := p.Sync(ctx, []int{0}); err != nil {
+		t.Errorf("p.Sync() == %v; want nil", err)
+	}
+	if !p.Announce(ctx, Announcement{Key: "key"}) {
+		t.Errorf("p.Announce() == false; want true")
+	}
+	if s, err := p.GetMetadata(ctx, "key"); err != nil || s.Digest != state.Digest || s.Data != "" {
+		t.Errorf("p.GetMetadata() == %v, %v; want %v without data, nil", s, err, state)
+	}
+	if chunk, err := p.GetChunk(ctx, "key", state.Digest, 0, chunkHash([]byte(state.Data))); err != nil || string(chunk) != state.Data {
+		t.Errorf("p.GetChunk() == %q, %v; want %q, nil", chunk, err, state.Data)
+	}
+
+	expected := []string{"Get", "GetPeers", "Ping", "Send", "SendPeeringRequest", "SendPeerDeletionRequest", "Drain", "GetTree", "Sync", "Announce", "GetMetadata", "GetChunk"}
+	if len(transport.calls) != len(expected) {
+		t.Fatalf("transport.calls == %v; want %v", transport.calls, expected)
+	}
+	for i := range expected {
+		if transport.calls[i] != expected[i] {
+			t.Errorf("transport.calls[%d] == %s; want %s", i, transport.calls[i], expected[i])
+		}
+	}
+	if p.Attempts != 0 {
+		t.Errorf("p.Attempts == %d; want %d", p.Attempts, 0)
+	}
+
+	//Chunks that do not match the advertised hash are rejected
+	if _, err := p.GetChunk(ctx, "key", state.Digest, 0, chunkHash(nil)); err == nil {
+		t.Errorf("p.GetChunk() == nil with an invalid hash; want an error")
+	}
+}
+
+func TestPeerTransportRetry(t *testing.T) {
+	transport := &stubTransport{err: errors.New("Unreachable")}
+	config := *DefaultConfig
+	config.Transport = transport
+	config.Peer.MaxRetries = 2
+	config.Peer.BackoffDuration = 0
+	p := NewPeer(Addr{"127.0.0.1", 8080}, &config)
+
+	if p.Send(context.Background(), State{Key: "key", Data: "TestPeerTransportRetry"}) {
+		t.Errorf("p.Send() == true; want false")
+	}
+
+	if len(transport.calls) != config.Peer.MaxRetries+1 {
+		t.Errorf("len(transport.calls) == %d; want %d", len(transport.calls), config.Peer.MaxRetries+1)
+	}
+	if p.Attempts != 1 {
+		t.Errorf("p.Attempts == %d after failed p.Send(); want %d", p.Attempts, 1)
+	}
+}
+
+func TestHTTPTransportStatus(t *testing.T) {
+	n := NewNode(nil)
+	n.UpdateState(State{Key: "key", Data: "TestHTTPTransportStatus"})
+	testServer := httptest.NewServer(n.Handler())
+	defer func() { testServer.Close() }()
+	transport := NewHTTPTransport(nil)
+	ctx := context.Background()
+
+	//Pings only carry the root of the Merkle tree
+	status, err := transport.Ping(ctx, parseURL(testServer.URL), nil)
+	if err != nil || status.Root != n.tree.Root() || status.Keys != nil {
+		t.Errorf("transport.Ping() == %v, %v; want root %q without keys", status, err, n.tree.Root())
+	}
+
+	status, err = transport.GetStatus(ctx, parseURL(testServer.URL))
+	if err != nil || status.Root != n.tree.Root() || len(status.Keys) != 1 {
+		t.Errorf("transport.GetStatus() == %v, %v; want root %q with 1 key", status, err, n.tree.Root())
+	}
+}
+
+func TestHTTPTransportGetChunk(t *testing.T) {
+	config := *DefaultConfig
+	config.Node.ChunkSize = 4
+	testCases := []struct {
+		Body     string
+		Expected bool
+	}{
+		{"abc", true},
+		{"abcd", true},
+		{"abcde", false},
+	}
+
+	for i, testCase := range testCases {
+		body := testCase.Body
+		testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		transport := NewHTTPTransport(&config)
+
+		chunk, err := transport.GetChunk(context.Background(), parseURL(testServer.URL), "key", "digest", 0)
+		if testCase.Expected && (err != nil || string(chunk) != body) {
+			t.Errorf("transport.GetChunk() == %q, %v for test case %d; want %q", chunk, err, i, body)
+		}
+		if !testCase.Expected && err == nil {
+			t.Errorf("transport.GetChunk() == %q, nil for test case %d; want an error", chunk, i)
+		}
+		testServer.Close()
+	}
+}
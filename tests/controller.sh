@@ -11,6 +11,10 @@ function ctrl_c() {
 export GOSSIP_CONTROLLER_SCANINTERVAL="3s"
 export GOSSIP_CONTROLLER_MINPEERS="3"
 
+# Data nodes register with the controller once it is up
+export GOSSIP_NODE_CONTROLLERS="127.0.0.1:7080"
+export GOSSIP_NODE_MAXJOINBACKOFF="1s"
+
 # Start nodes
 export NODE_PIDS=""
 pushd ./node/
@@ -29,13 +33,10 @@ export CONTROL_PID=$!
 echo "\$CONTROL_PID=$CONTROL_PID"
 popd
 
-# Send peers to controller
+# Wait for the controller to come online
 while ! nc -vz localhost 7080; do
     sleep 1
 done
-for i in {8080..8089}; do
-    curl -s -X POST -d '{"ip": "127.0.0.1", "port": '$i'}' http://127.0.0.1:7080/peers
-done
 
 # Wait for the controllers to connect all the nodes
 sleep 7s
@@ -30,12 +30,14 @@ while ! nc -vz 127.0.0.1 7080; do
     sleep 1
 done
 
+# Data nodes register with the controller on startup
+export GOSSIP_NODE_CONTROLLERS="$(docker inspect -f '{{range .NetworkSettings.Networks}}{{.IPAddress}}{{end}}' gossip-control):7080"
+
 # Start nodes
 for i in {0..7}; do
-    # Start container
-    docker run -d --rm --name gossip-node$i gossip-node
-    # Notify controller of the new data node
-    curl -s -X POST -d '{"ip": "'$(docker inspect -f '{{range .NetworkSettings.Networks}}{{.IPAddress}}{{end}}' gossip-node$i)'", "port": 8080}' http://127.0.0.1:7080/peers
+    docker run -d --rm --name gossip-node$i \
+        --env GOSSIP_NODE_CONTROLLERS \
+        gossip-node
 done
 
 # Wait for the controllers to connect all the nodes
@@ -14,17 +14,15 @@ go build .
 GOSSIP_NODE_PORT=8080 ./node &
 NODE1_PID=$!
 
-GOSSIP_NODE_PORT=8081 ./node &
+# The second node peers with the first one on startup
+GOSSIP_NODE_PORT=8081 GOSSIP_NODE_SEEDS=127.0.0.1:8080 ./node &
 NODE2_PID=$!
 
 # Waiting for the peer to come online
 while ! nc -vz 127.0.0.1 8080; do
     sleep 1
 done
-
-# Send peering
-curl -s -X POST -d '{"ip": "127.0.0.1", "port": 8081}' http://127.0.0.1:8080/peers
-sleep 1s
+sleep 2s
 
 if (( $(curl -s http://127.0.0.1:8080/peers | jq '.peers | length') < 1 )); then
     echo "127.0.0.1:8080 does not have any peer"